@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
@@ -14,6 +15,8 @@ import (
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscodedeploy"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscodepipeline"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscodepipelineactions"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
@@ -27,6 +30,51 @@ import (
 
 type PipelineBuildV1Props struct {
 	awscdk.StackProps
+
+	// DeploymentTargets are the other accounts and regions the deploy
+	// Lambda may deploy to, through each target's trust role
+	DeploymentTargets []DeploymentTargetProps
+}
+
+// DeploymentTargetProps describes one account and region the pipeline
+// deploys to. Each gets a DeploymentTargetStack with a trust role and an
+// artifact bucket, deployed into that account.
+type DeploymentTargetProps struct {
+	Account    string
+	Region     string
+	ExternalID string
+}
+
+// RoleName is the trust role's name, fixed so the pipeline account can
+// grant sts:AssumeRole on it before the target stack exists
+func (t DeploymentTargetProps) RoleName() string {
+	return fmt.Sprintf("pipeline-deploy-target-%s", t.Region)
+}
+
+func (t DeploymentTargetProps) RoleArn() string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", t.Account, t.RoleName())
+}
+
+// deployLambdaRoleName is the deploy Lambda's role name, fixed so target
+// accounts can trust that one role rather than the whole pipeline account
+func deployLambdaRoleName(region string) string {
+	return fmt.Sprintf("pipeline-deploy-lambda-%s", region)
+}
+
+// ArtifactBucketName is where the deploy Lambda copies bundles for
+// targets in this region
+func (t DeploymentTargetProps) ArtifactBucketName() string {
+	return fmt.Sprintf("pipeline-deploy-artifacts-%s-%s", t.Account, t.Region)
+}
+
+type DeploymentTargetStackProps struct {
+	awscdk.StackProps
+	Target DeploymentTargetProps
+
+	// PipelineAccount and PipelineRegion are where the deploy Lambda that
+	// assumes the role runs
+	PipelineAccount string
+	PipelineRegion  string
 }
 
 // Validate env variables
@@ -65,12 +113,30 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 		RetentionPeriod: awscdk.Duration_Days(jsii.Number(7)),
 	})
 
+	// Audit log of every deploy job. Records are written once and kept;
+	// versioning keeps anything deleted by hand recoverable.
+	auditBucket := awss3.NewBucket(stack, jsii.String("DeploymentAuditLog"), &awss3.BucketProps{
+		Versioned:         jsii.Bool(true),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		EnforceSSL:        jsii.Bool(true),
+		RemovalPolicy:     awscdk.RemovalPolicy_RETAIN,
+	})
+
 	// Get the Lambda function directory path
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
 		panic("Could not get file name")
 	}
 	lambdaDir := filepath.Join(filepath.Dir(filename), "lambda")
+	hookDir := filepath.Join(filepath.Dir(filename), "hook")
+
+	// Lambda IAM role definition. The deploy Lambda runs as this role, which
+	// is the one deployment targets trust.
+	lambdaRoleV1 := awsiam.NewRole(stack, jsii.String("LambdaRoleV1"), &awsiam.RoleProps{
+		RoleName:  jsii.String(deployLambdaRoleName(*stack.Region())),
+		AssumedBy: awsiam.NewServicePrincipal(jsii.String("lambda.amazonaws.com"), &awsiam.ServicePrincipalOpts{}),
+	})
 
 	// Create the Lambda function with configuration
 	lambdaFunctionV1 := awslambda.NewFunction(stack, jsii.String("pipelineHandler"), &awslambda.FunctionProps{
@@ -81,6 +147,7 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 		Timeout:         awscdk.Duration_Minutes(jsii.Number(6)),
 		Architecture:    awslambda.Architecture_X86_64(),
 		DeadLetterQueue: deadLetterQueue,
+		Role:            lambdaRoleV1,
 		CurrentVersionOptions: &awslambda.VersionOptions{
 			RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
 			Description:   jsii.String("Automated Version"),
@@ -91,8 +158,18 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 			"APPLICATION_NAME":         jsii.String("LambdaDeployApp"),
 			"DEPLOYMENT_GROUP_NAME":    jsii.String("LambdaDeploymentGroup"),
 			"MAX_DEPLOYMENT_WAIT_TIME": jsii.String("600"), // 6 minutes in seconds
-			// "HEALTH_CHECK_URL":         TODO,
-			// "APP_HEALTH_CHECK_URL":     TODO,
+			"SKIP_UNCHANGED_REVISIONS": jsii.String("true"),
+			"RETRY_MAX_ATTEMPTS":       jsii.String("3"),
+			"RETRY_BASE_DELAY":         jsii.String("2s"),
+			"RETRY_MAX_DELAY":          jsii.String("30s"),
+			"SECRETS_CACHE_TTL":        jsii.String("5m"),
+			"AUDIT_LOG_LOCATION":       jsii.String(fmt.Sprintf("s3://%s/deployments", *auditBucket.BucketName())),
+			"DIAGNOSTICS_LOCATION":     jsii.String(fmt.Sprintf("s3://%s/diagnostics", *auditBucket.BucketName())),
+			"DEPLOYMENT_LOCK_LOCATION": jsii.String(fmt.Sprintf("s3://%s/locks", *auditBucket.BucketName())),
+			// The function has no URL to check, so health checks invoke it
+			// instead. It cannot name itself here without a circular
+			// reference, so set these once its name is known, e.g.
+			// "APP_HEALTH_CHECK_LAMBDA": `{"functionName":"<name>","qualifier":"Live","expectStatusCode":200}`
 		},
 		Tracing: awslambda.Tracing_ACTIVE,
 	})
@@ -123,6 +200,13 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 		TreatMissingData:   awscloudwatch.TreatMissingData_NOT_BREACHING,
 	})
 
+	// Traffic hooks gate the alias before and after CodeDeploy shifts it.
+	// The deployed function is this pipeline's own deploy handler, which
+	// has no test payload to answer, so the hooks do not invoke it and only
+	// check APP_HEALTH_CHECK_URL when it is set.
+	preTrafficHook := newTrafficHook(stack, "PreTrafficHook", hookDir, "BeforeAllowTraffic")
+	postTrafficHook := newTrafficHook(stack, "PostTrafficHook", hookDir, "AfterAllowTraffic")
+
 	// Set up the CodeDeploy application for Lambda
 	codeDeployV1 := awscodedeploy.NewLambdaApplication(stack, jsii.String("LambdaDeployV1"), &awscodedeploy.LambdaApplicationProps{
 		ApplicationName: jsii.String(checkEnv("CODE_DEPLOY_APP_NAME")),
@@ -138,30 +222,41 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 			StoppedDeployment: jsii.Bool(true),
 			DeploymentInAlarm: jsii.Bool(true),
 		},
-		Alarms: &[]awscloudwatch.IAlarm{lambdaErrorsAlarm},
+		Alarms:   &[]awscloudwatch.IAlarm{lambdaErrorsAlarm},
+		PreHook:  preTrafficHook,
+		PostHook: postTrafficHook,
 	})
 
-	// Lambda IAM role definition
-	lambdaRoleV1 := awsiam.NewRole(stack, jsii.String("LambdaRoleV1"), &awsiam.RoleProps{
-		AssumedBy: awsiam.NewServicePrincipal(jsii.String("lambda.amazonaws.com"), &awsiam.ServicePrincipalOpts{}),
+	// The role's statements name the function, its alarm and deployment
+	// group, so they live in a policy of their own. The function waits for
+	// the role's default policy, and that would make a cycle.
+	lambdaPolicyV1 := awsiam.NewPolicy(stack, jsii.String("LambdaPolicyV1"), &awsiam.PolicyProps{
+		Roles: &[]awsiam.IRole{lambdaRoleV1},
 	})
 
 	// Granting Lambda function permissions to access GitHub secret
-	lambdaRoleV1.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Effect:    awsiam.Effect_ALLOW,
 		Actions:   jsii.Strings("secretsmanager:GetSecretValue"),
 		Resources: jsii.Strings(*githubSecret.SecretArn()),
 	}))
 
 	// Granting Lambda function permissions for CodeDeploy operations
-	lambdaRoleV1.AddToPrincipalPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Effect: awsiam.Effect_ALLOW,
 		Actions: jsii.Strings(
 			"codedeploy:CreateDeployment",
 			"codedeploy:GetDeploymentConfig",
 			"codedeploy:ApplicationRevision",
 			"codedeploy:GetDeployment",
+			"codedeploy:GetDeploymentGroup",
 			"codedeploy:UpdateDeployment",
+			"codedeploy:ListDeployments",
+			"codedeploy:BatchGetDeployments",
+			"codedeploy:StopDeployment",
+			"codedeploy:ListDeploymentTargets",
+			"codedeploy:GetDeploymentTarget",
+			"codedeploy:BatchGetDeploymentTargets",
 		),
 		Resources: jsii.Strings(
 			*deploymentGroupV1.DeploymentGroupArn(),
@@ -172,17 +267,93 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 	}))
 
 	// Limit CodePipeline job result permissions to the specific pipeline
-	lambdaRoleV1.AddToPrincipalPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Effect: awsiam.Effect_ALLOW,
 		Actions: jsii.Strings(
+			"codepipeline:AcknowledgeJob",
+			"codepipeline:GetJobDetails",
 			"codepipeline:PutJobSuccessResult",
 			"codepipeline:PutJobFailureResult",
 		),
 		Resources: jsii.Strings(fmt.Sprintf("arn:aws:codepipeline:%s:%s:*", *stack.Region(), *stack.Account())),
 	}))
 
+	// ECS blue/green targets register a new task definition per deployment,
+	// and pass its roles on to ECS
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"ecs:RegisterTaskDefinition",
+			"ecs:DescribeServices",
+			"ecs:DescribeTaskDefinition",
+		),
+		Resources: jsii.Strings("*"),
+	}))
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect:    awsiam.Effect_ALLOW,
+		Actions:   jsii.Strings("iam:PassRole"),
+		Resources: jsii.Strings(fmt.Sprintf("arn:aws:iam::%s:role/*", *stack.Account())),
+		Conditions: &map[string]interface{}{
+			"StringLike": map[string]interface{}{
+				"iam:PassedToService": "ecs-tasks.amazonaws.com",
+			},
+		},
+	}))
+
+	// Allow reading pipeline-to-deployment mapping documents kept in SSM
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect:  awsiam.Effect_ALLOW,
+		Actions: jsii.Strings("ssm:GetParameter"),
+		Resources: jsii.Strings(fmt.Sprintf("arn:aws:ssm:%s:%s:parameter/pipeline/*",
+			*stack.Region(), *stack.Account())),
+	}))
+
+	// Allow writing and querying the audit log
+	auditBucket.GrantPut(lambdaRoleV1, jsii.String("deployments/*"))
+	auditBucket.GrantRead(lambdaRoleV1, jsii.String("deployments/*"))
+	auditBucket.GrantPut(lambdaRoleV1, jsii.String("diagnostics/*"))
+
+	// Allow taking, renewing and releasing deployment group leases
+	auditBucket.GrantReadWrite(lambdaRoleV1, jsii.String("locks/*"))
+
+	// The deploy Lambda also processes CodeDeploy's deployment state
+	// changes, recording them in the audit log and notifying about them
+	awsevents.NewRule(stack, jsii.String("DeploymentStateChangeRule"), &awsevents.RuleProps{
+		Description: jsii.String("Sends CodeDeploy deployment state changes to the deploy Lambda"),
+		EventPattern: &awsevents.EventPattern{
+			Source:     jsii.Strings("aws.codedeploy"),
+			DetailType: jsii.Strings("CodeDeploy Deployment State-change Notification"),
+		},
+		Targets: &[]awsevents.IRuleTarget{
+			awseventstargets.NewLambdaFunction(lambdaFunctionV1, &awseventstargets.LambdaFunctionProps{
+				RetryAttempts: jsii.Number(2),
+			}),
+		},
+	})
+
+	// Allow Lambda health checks to invoke functions and their aliases
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect:  awsiam.Effect_ALLOW,
+		Actions: jsii.Strings("lambda:InvokeFunction"),
+		Resources: jsii.Strings(fmt.Sprintf("arn:aws:lambda:%s:%s:function:*",
+			*stack.Region(), *stack.Account())),
+	}))
+
+	// Allow assuming the trust role of each cross-account or cross-region target
+	if props != nil && len(props.DeploymentTargets) > 0 {
+		var roleArns []string
+		for _, target := range props.DeploymentTargets {
+			roleArns = append(roleArns, target.RoleArn())
+		}
+		lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Effect:    awsiam.Effect_ALLOW,
+			Actions:   jsii.Strings("sts:AssumeRole"),
+			Resources: jsii.Strings(roleArns...),
+		}))
+	}
+
 	// Allow CloudWatch logs with specific resource pattern
-	lambdaRoleV1.AddToPrincipalPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+	lambdaPolicyV1.AddStatements(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Effect: awsiam.Effect_ALLOW,
 		Actions: jsii.Strings(
 			"logs:CreateLogGroup",
@@ -278,6 +449,7 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 	// Here, we define artifacts for the pipeline stages
 	sourceArtifact := awscodepipeline.NewArtifact(jsii.String("SourceArtifact"), nil)
 	buildArtifact := awscodepipeline.NewArtifact(jsii.String("BuildArtifact"), nil)
+	deployReportArtifact := awscodepipeline.NewArtifact(jsii.String("DeployReportArtifact"), nil)
 
 	// Create IAM role for CodePipeline
 	codePipelineRoleV1 := awsiam.NewRole(stack, jsii.String("CodePipelineRole"), &awsiam.RoleProps{
@@ -322,12 +494,16 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 				// function must be called to do this.
 				// The trigger lambda function is defined in the bin/lambda/pipeline.go, which is
 				// packaged with the provided.AL2 runtime.
+				// On success it writes a deployment report to DeployReportArtifact and exports
+				// deploymentId, targetVersion and bundleSha256 under the DeployVariables namespace.
 				StageName: jsii.String("Deploy"),
 				Actions: &[]awscodepipeline.IAction{
 					awscodepipelineactions.NewLambdaInvokeAction(&awscodepipelineactions.LambdaInvokeActionProps{
-						ActionName: jsii.String("DeployLambda"),
-						Inputs:     &[]awscodepipeline.Artifact{buildArtifact},
-						Lambda:     lambdaFunctionV1,
+						ActionName:         jsii.String("DeployLambda"),
+						Inputs:             &[]awscodepipeline.Artifact{buildArtifact},
+						Outputs:            &[]awscodepipeline.Artifact{deployReportArtifact},
+						Lambda:             lambdaFunctionV1,
+						VariablesNamespace: jsii.String("DeployVariables"),
 					}),
 				},
 			},
@@ -357,6 +533,7 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 
 	// Granting permissions to CodePipeline role
 	artifactBucketV1.GrantReadWrite(codePipelineRoleV1, nil)
+
 	codePipelineRoleV1.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 		Effect:    awsiam.Effect_ALLOW,
 		Actions:   jsii.Strings("iam:PassRole"),
@@ -447,20 +624,183 @@ func NewPipelineBuildV1(scope constructs.Construct, id string, props *PipelineBu
 	return stack
 }
 
+// NewDeploymentTargetStack creates, in a target account and region, the role
+// the deploy Lambda assumes and the bucket it copies bundles into
+func NewDeploymentTargetStack(scope constructs.Construct, id string, props *DeploymentTargetStackProps) awscdk.Stack {
+	stack := awscdk.NewStack(scope, &id, &props.StackProps)
+	target := props.Target
+
+	// Bundles are copied here for every deployment, so we only keep them for a while
+	artifactBucket := awss3.NewBucket(stack, jsii.String("TargetArtifactBucket"), &awss3.BucketProps{
+		BucketName:        jsii.String(target.ArtifactBucketName()),
+		Versioned:         jsii.Bool(true),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		EnforceSSL:        jsii.Bool(true),
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{
+				Expiration:                  awscdk.Duration_Days(jsii.Number(30)),
+				NoncurrentVersionExpiration: awscdk.Duration_Days(jsii.Number(7)),
+			},
+		},
+	})
+
+	// Only the deploy Lambda's role may assume the trust role, and only
+	// with the external ID, so nothing else in the pipeline account can
+	// deploy here
+	if target.ExternalID == "" {
+		log.Fatalf("WARNING: deployment target %s:%s needs an external ID", target.Account, target.Region)
+	}
+	deployRoleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", props.PipelineAccount, deployLambdaRoleName(props.PipelineRegion))
+	trustRole := awsiam.NewRole(stack, jsii.String("DeploymentTrustRole"), &awsiam.RoleProps{
+		RoleName:    jsii.String(target.RoleName()),
+		AssumedBy:   awsiam.NewArnPrincipal(jsii.String(deployRoleArn)),
+		ExternalIds: jsii.Strings(target.ExternalID),
+		Description: jsii.String(fmt.Sprintf("Assumed by the deploy Lambda role %s", deployRoleArn)),
+	})
+
+	trustRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"codedeploy:CreateDeployment",
+			"codedeploy:GetDeployment",
+			"codedeploy:GetDeploymentConfig",
+			"codedeploy:GetDeploymentGroup",
+			"codedeploy:GetDeploymentTarget",
+			"codedeploy:ListDeployments",
+			"codedeploy:ListDeploymentTargets",
+			"codedeploy:BatchGetDeployments",
+			"codedeploy:BatchGetDeploymentTargets",
+			"codedeploy:StopDeployment",
+			"codedeploy:RegisterApplicationRevision",
+		),
+		Resources: jsii.Strings(
+			fmt.Sprintf("arn:aws:codedeploy:%s:%s:*", target.Region, target.Account),
+		),
+	}))
+
+	trustRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"ecs:RegisterTaskDefinition",
+			"ecs:DescribeServices",
+			"ecs:DescribeTaskDefinition",
+		),
+		Resources: jsii.Strings("*"),
+	}))
+	trustRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect:    awsiam.Effect_ALLOW,
+		Actions:   jsii.Strings("iam:PassRole"),
+		Resources: jsii.Strings(fmt.Sprintf("arn:aws:iam::%s:role/*", target.Account)),
+		Conditions: &map[string]interface{}{
+			"StringLike": map[string]interface{}{
+				"iam:PassedToService": "ecs-tasks.amazonaws.com",
+			},
+		},
+	}))
+
+	trustRole.AddToPolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect:  awsiam.Effect_ALLOW,
+		Actions: jsii.Strings("lambda:InvokeFunction"),
+		Resources: jsii.Strings(
+			fmt.Sprintf("arn:aws:lambda:%s:%s:function:*", target.Region, target.Account),
+		),
+	}))
+
+	artifactBucket.GrantReadWrite(trustRole, nil)
+
+	awscdk.NewCfnOutput(stack, jsii.String("TrustRoleArnOutput"), &awscdk.CfnOutputProps{
+		Value: trustRole.RoleArn(),
+	})
+	awscdk.NewCfnOutput(stack, jsii.String("ArtifactBucketOutput"), &awscdk.CfnOutputProps{
+		Value: artifactBucket.BucketName(),
+	})
+
+	return stack
+}
+
 // Main() is the entry point of the CDK application
 func main() {
 	defer jsii.Close()
 
 	app := awscdk.NewApp(nil)
-	NewPipelineBuildV1(app, "CodePipelineCdkStack", &PipelineBuildV1Props{
-		awscdk.StackProps{
+	targets := deploymentTargets()
+	pipelineStack := NewPipelineBuildV1(app, "CodePipelineCdkStack", &PipelineBuildV1Props{
+		StackProps: awscdk.StackProps{
 			Env: env(),
 		},
+		DeploymentTargets: targets,
 	})
 
+	// One trust stack per target, deployed into the target's account. IAM
+	// only accepts the deploy Lambda's role as a principal once it exists.
+	for _, target := range targets {
+		targetStack := NewDeploymentTargetStack(app, fmt.Sprintf("DeploymentTarget-%s-%s", target.Account, target.Region), &DeploymentTargetStackProps{
+			StackProps: awscdk.StackProps{
+				Env: &awscdk.Environment{
+					Account: jsii.String(target.Account),
+					Region:  jsii.String(target.Region),
+				},
+			},
+			Target:          target,
+			PipelineAccount: *env().Account,
+			PipelineRegion:  *env().Region,
+		})
+		targetStack.AddDependency(pipelineStack, jsii.String("trusts the deploy Lambda's role"))
+	}
+
 	app.Synth(nil)
 }
 
+// deploymentTargets reads DEPLOYMENT_TARGETS, a comma-separated list of
+// account:region pairs such as "111111111111:eu-west-1". Every target
+// shares DEPLOYMENT_TARGET_EXTERNAL_ID, which is then required.
+func deploymentTargets() []DeploymentTargetProps {
+	value := os.Getenv("DEPLOYMENT_TARGETS")
+	if value == "" {
+		return nil
+	}
+
+	externalID := checkEnv("DEPLOYMENT_TARGET_EXTERNAL_ID")
+	var targets []DeploymentTargetProps
+	for _, entry := range strings.Split(value, ",") {
+		account, region, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || account == "" || region == "" {
+			log.Fatalf("WARNING: DEPLOYMENT_TARGETS entry %q must be account:region", entry)
+		}
+		targets = append(targets, DeploymentTargetProps{
+			Account:    account,
+			Region:     region,
+			ExternalID: externalID,
+		})
+	}
+	return targets
+}
+
+// newTrafficHook creates a CodeDeploy lifecycle hook function for the given
+// phase. CodeDeploy grants it permission to report the hook's status.
+func newTrafficHook(stack awscdk.Stack, id, hookDir, phase string) awslambda.Function {
+	environment := map[string]*string{
+		"HOOK_PHASE": jsii.String(phase),
+	}
+	if url := os.Getenv("APP_HEALTH_CHECK_URL"); url != "" {
+		environment["APP_HEALTH_CHECK_URL"] = jsii.String(url)
+	}
+
+	hook := awslambda.NewFunction(stack, jsii.String(id), &awslambda.FunctionProps{
+		Runtime:      awslambda.Runtime_PROVIDED_AL2(),
+		Handler:      jsii.String("bootstrap"),
+		MemorySize:   jsii.Number(256),
+		Timeout:      awscdk.Duration_Minutes(jsii.Number(1)),
+		Architecture: awslambda.Architecture_X86_64(),
+		Code:         awslambda.Code_FromAsset(jsii.String(hookDir), &awss3assets.AssetOptions{}),
+		Environment:  &environment,
+		Tracing:      awslambda.Tracing_ACTIVE,
+	})
+
+	return hook
+}
+
 func env() *awscdk.Environment {
 	return &awscdk.Environment{
 		Account: jsii.String(checkEnv("ACCOUNT_ID")),
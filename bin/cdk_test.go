@@ -24,3 +24,30 @@ func TestCdkStack(t *testing.T) {
 		"VisibilityTimeout": 300,
 	})
 }
+
+func TestDeploymentTargetStackTrustsDeployRole(t *testing.T) {
+	app := awscdk.NewApp(nil)
+	stack := NewDeploymentTargetStack(app, "DeploymentTarget", &DeploymentTargetStackProps{
+		Target:          DeploymentTargetProps{Account: "222222222222", Region: "eu-west-1", ExternalID: "ext-1"},
+		PipelineAccount: "111111111111",
+		PipelineRegion:  "us-east-1",
+	})
+
+	template := assertions.Template_FromStack(stack, nil)
+
+	// Only the deploy Lambda's role, with the external ID, and not the
+	// whole pipeline account
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"RoleName": "pipeline-deploy-target-eu-west-1",
+		"AssumeRolePolicyDocument": map[string]interface{}{
+			"Statement": []interface{}{
+				map[string]interface{}{
+					"Action":    "sts:AssumeRole",
+					"Effect":    "Allow",
+					"Principal": map[string]interface{}{"AWS": "arn:aws:iam::111111111111:role/pipeline-deploy-lambda-us-east-1"},
+					"Condition": map[string]interface{}{"StringEquals": map[string]interface{}{"sts:ExternalId": "ext-1"}},
+				},
+			},
+		},
+	})
+}
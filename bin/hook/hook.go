@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// HookEvent is what CodeDeploy sends to a Lambda lifecycle hook
+type HookEvent struct {
+	DeploymentId                  string `json:"DeploymentId"`
+	LifecycleEventHookExecutionId string `json:"LifecycleEventHookExecutionId"`
+}
+
+// codeDeployAPI is the subset of CodeDeploy the hook uses
+type codeDeployAPI interface {
+	GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error)
+	PutLifecycleEventHookExecutionStatus(ctx context.Context, params *codedeploy.PutLifecycleEventHookExecutionStatusInput, optFns ...func(*codedeploy.Options)) (*codedeploy.PutLifecycleEventHookExecutionStatusOutput, error)
+}
+
+type hook struct {
+	cfg        *config.HookConfig
+	codeDeploy codeDeployAPI
+	lambda     deploy.LambdaAPI
+
+	// bundles reads the AppSpec of S3 revisions
+	bundles deploy.BundleAPI
+
+	// healthCheck validates AppHealthCheckURL. It is a field so tests do
+	// not make HTTP requests.
+	healthCheck func(ctx context.Context, url string) error
+
+	// initErr is why the hook could not start. Every deployment then fails
+	// its checks, rather than the hook crashing and never reporting.
+	initErr error
+}
+
+// handle runs the checks and reports the outcome to CodeDeploy. A failed
+// check is reported as Failed, which makes CodeDeploy roll back; we only
+// return an error when the status itself could not be reported.
+func (h *hook) handle(ctx context.Context, event HookEvent) error {
+	if event.DeploymentId == "" || event.LifecycleEventHookExecutionId == "" {
+		return fmt.Errorf("deployment ID and lifecycle event hook execution ID are required")
+	}
+	if h.codeDeploy == nil {
+		// Without AWS config there is no status to report, and CodeDeploy
+		// fails the hook when it times out
+		return h.initErr
+	}
+
+	status := types.LifecycleEventStatusSucceeded
+	if err := h.run(ctx, event.DeploymentId); err != nil {
+		log.Printf("%s checks failed for deployment %s: %v", h.cfg.Phase, event.DeploymentId, err)
+		status = types.LifecycleEventStatusFailed
+	} else {
+		log.Printf("%s checks passed for deployment %s", h.cfg.Phase, event.DeploymentId)
+	}
+
+	_, err := h.codeDeploy.PutLifecycleEventHookExecutionStatus(ctx, &codedeploy.PutLifecycleEventHookExecutionStatusInput{
+		DeploymentId:                  aws.String(event.DeploymentId),
+		LifecycleEventHookExecutionId: aws.String(event.LifecycleEventHookExecutionId),
+		Status:                        status,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to report %s status for deployment %s: %v", status, event.DeploymentId, err)
+	}
+	return nil
+}
+
+// run invokes the target version with the test payload, checks the
+// response with the deploy Lambda's health check and then the application
+// health URL
+func (h *hook) run(ctx context.Context, deploymentID string) error {
+	if h.initErr != nil {
+		return h.initErr
+	}
+	if h.cfg.TargetFunctionName == "" {
+		log.Printf("No target function to invoke, checking application health only")
+		return h.healthCheck(ctx, h.cfg.AppHealthCheckURL)
+	}
+	qualifier, err := h.qualifier(ctx, deploymentID)
+	if err != nil {
+		return err
+	}
+
+	check := h.cfg.Check
+	check.Qualifier = qualifier
+	log.Printf("Invoking %s:%s with the test payload", check.FunctionName, qualifier)
+	if err := deploy.InvokeLambdaHealthCheck(ctx, h.lambda, check); err != nil {
+		return err
+	}
+
+	return h.healthCheck(ctx, h.cfg.AppHealthCheckURL)
+}
+
+// qualifier returns the version being deployed. Before traffic shifts,
+// the alias still points at the old version, so we take TargetVersion from
+// the deployment's AppSpec, reading the bundle of an S3 revision, and only
+// fall back to the alias when there is no AppSpec or it names no version.
+func (h *hook) qualifier(ctx context.Context, deploymentID string) (string, error) {
+	output, err := h.codeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(deploymentID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment %s: %v", deploymentID, err)
+	}
+
+	info := output.DeploymentInfo
+	if info == nil || info.Revision == nil {
+		return h.cfg.TargetFunctionAlias, nil
+	}
+
+	content, err := deploy.RevisionAppSpec(ctx, h.bundles, info.Revision)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the AppSpec of deployment %s: %v", deploymentID, err)
+	}
+	if versions := deploy.ParseAppSpecVersions(content); versions.TargetVersion != "" {
+		return versions.TargetVersion, nil
+	}
+
+	return h.cfg.TargetFunctionAlias, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const appSpec = `version: 0.0
+Resources:
+  - app:
+      Type: AWS::Lambda::Function
+      Properties:
+        Name: app
+        Alias: Live
+        CurrentVersion: "4"
+        TargetVersion: "5"
+`
+
+type fakeCodeDeploy struct {
+	codeDeployAPI
+	appSpec  string
+	revision *types.RevisionLocation
+	statuses []types.LifecycleEventStatus
+}
+
+func (f *fakeCodeDeploy) GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error) {
+	info := &types.DeploymentInfo{DeploymentId: params.DeploymentId, Revision: f.revision}
+	if f.appSpec != "" {
+		info.Revision = &types.RevisionLocation{
+			RevisionType:   types.RevisionLocationTypeAppSpecContent,
+			AppSpecContent: &types.AppSpecContent{Content: aws.String(f.appSpec)},
+		}
+	}
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: info}, nil
+}
+
+func (f *fakeCodeDeploy) PutLifecycleEventHookExecutionStatus(ctx context.Context, params *codedeploy.PutLifecycleEventHookExecutionStatusInput, optFns ...func(*codedeploy.Options)) (*codedeploy.PutLifecycleEventHookExecutionStatusOutput, error) {
+	f.statuses = append(f.statuses, params.Status)
+	return &codedeploy.PutLifecycleEventHookExecutionStatusOutput{}, nil
+}
+
+// fakeBundles serves revision bundles by key
+type fakeBundles map[string][]byte
+
+func (f fakeBundles) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", aws.ToString(params.Key))
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+type fakeLambda struct {
+	output    *lambda.InvokeOutput
+	qualifier string
+}
+
+func (f *fakeLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	f.qualifier = aws.ToString(params.Qualifier)
+	return f.output, nil
+}
+
+func TestHandleReportsAssertionOutcome(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    config.HookConfig
+		output *lambda.InvokeOutput
+		health error
+		want   types.LifecycleEventStatus
+	}{
+		{"success", config.HookConfig{}, &lambda.InvokeOutput{Payload: []byte(`{"ok":true}`)}, nil, types.LifecycleEventStatusSucceeded},
+		{"function error", config.HookConfig{}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"boom"}`)}, nil, types.LifecycleEventStatusFailed},
+		{"response contains", config.HookConfig{Check: config.LambdaHealthCheck{ExpectResponseContains: "ok"}}, &lambda.InvokeOutput{Payload: []byte(`"nope"`)}, nil, types.LifecycleEventStatusFailed},
+		{"json subset matches", config.HookConfig{Check: config.LambdaHealthCheck{ExpectFields: map[string]any{"status": "ok"}}}, &lambda.InvokeOutput{Payload: []byte(`{"status":"ok","extra":1}`)}, nil, types.LifecycleEventStatusSucceeded},
+		{"json subset differs", config.HookConfig{Check: config.LambdaHealthCheck{ExpectFields: map[string]any{"status": "ok"}}}, &lambda.InvokeOutput{Payload: []byte(`{"status":"degraded"}`)}, nil, types.LifecycleEventStatusFailed},
+		{"expected error", config.HookConfig{Check: config.LambdaHealthCheck{ExpectError: "job ID not found"}}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"job ID not found in event"}`)}, nil, types.LifecycleEventStatusSucceeded},
+		{"expected error missing", config.HookConfig{Check: config.LambdaHealthCheck{ExpectError: "job ID not found"}}, &lambda.InvokeOutput{Payload: []byte(`null`)}, nil, types.LifecycleEventStatusFailed},
+		{"health check fails", config.HookConfig{}, &lambda.InvokeOutput{Payload: []byte(`{}`)}, errors.New("unhealthy"), types.LifecycleEventStatusFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := &fakeCodeDeploy{appSpec: appSpec}
+			fn := &fakeLambda{output: tt.output}
+			cfg := tt.cfg
+			cfg.Phase = config.BeforeAllowTraffic
+			cfg.TargetFunctionName = "app"
+			cfg.Check.FunctionName = "app"
+			cfg.TargetFunctionAlias = "Live"
+			h := &hook{
+				cfg:         &cfg,
+				codeDeploy:  cd,
+				lambda:      fn,
+				healthCheck: func(context.Context, string) error { return tt.health },
+			}
+
+			if err := h.handle(context.Background(), HookEvent{DeploymentId: "d-1", LifecycleEventHookExecutionId: "h-1"}); err != nil {
+				t.Fatalf("handle() returned error: %v", err)
+			}
+			if len(cd.statuses) != 1 || cd.statuses[0] != tt.want {
+				t.Errorf("reported %v, want %v", cd.statuses, tt.want)
+			}
+			if fn.qualifier != "5" {
+				t.Errorf("invoked qualifier %q, want the AppSpec target version 5", fn.qualifier)
+			}
+		})
+	}
+}
+
+func TestQualifierFallsBackToAlias(t *testing.T) {
+	h := &hook{
+		cfg:        &config.HookConfig{TargetFunctionName: "app", TargetFunctionAlias: "Live"},
+		codeDeploy: &fakeCodeDeploy{},
+	}
+
+	qualifier, err := h.qualifier(context.Background(), "d-1")
+	if err != nil || qualifier != "Live" {
+		t.Errorf("qualifier() = %q, %v, want Live", qualifier, err)
+	}
+}
+
+func TestQualifierReadsS3Revisions(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("appspec.yml")
+	w.Write([]byte(appSpec))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bundles := fakeBundles{"bundle.zip": buf.Bytes(), "appspec.yml": []byte(appSpec)}
+
+	s3Revision := func(key string, bundleType types.BundleType) *types.RevisionLocation {
+		return &types.RevisionLocation{
+			RevisionType: types.RevisionLocationTypeS3,
+			S3Location:   &types.S3Location{Bucket: aws.String("artifacts"), Key: aws.String(key), BundleType: bundleType},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		revision *types.RevisionLocation
+		want     string
+		wantErr  bool
+	}{
+		{"zip bundle", s3Revision("bundle.zip", types.BundleTypeZip), "5", false},
+		{"YAML bundle", s3Revision("appspec.yml", types.BundleTypeYaml), "5", false},
+		{"missing bundle", s3Revision("gone.zip", types.BundleTypeZip), "", true},
+		{"bundle without an AppSpec", s3Revision("appspec.yml", types.BundleTypeZip), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &hook{
+				cfg:        &config.HookConfig{TargetFunctionName: "app", TargetFunctionAlias: "Live"},
+				codeDeploy: &fakeCodeDeploy{revision: tt.revision},
+				bundles:    bundles,
+			}
+			qualifier, err := h.qualifier(context.Background(), "d-1")
+			if (err != nil) != tt.wantErr || qualifier != tt.want {
+				t.Errorf("qualifier() = %q, %v, want %q (error: %v)", qualifier, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleReportsInitErrorAsFailed(t *testing.T) {
+	cd := &fakeCodeDeploy{appSpec: appSpec}
+	fn := &fakeLambda{output: &lambda.InvokeOutput{Payload: []byte(`{}`)}}
+	h := &hook{
+		cfg:        &config.HookConfig{},
+		codeDeploy: cd,
+		lambda:     fn,
+		initErr:    errors.New("invalid hook configuration: TARGET_FUNCTION_NAME is required"),
+	}
+
+	if err := h.handle(context.Background(), HookEvent{DeploymentId: "d-1", LifecycleEventHookExecutionId: "h-1"}); err != nil {
+		t.Fatalf("handle() returned error: %v", err)
+	}
+	if len(cd.statuses) != 1 || cd.statuses[0] != types.LifecycleEventStatusFailed {
+		t.Errorf("reported %v, want Failed", cd.statuses)
+	}
+	if fn.qualifier != "" {
+		t.Errorf("invoked %q, want no invocation without a configuration", fn.qualifier)
+	}
+}
+
+func TestHandleWithoutTargetChecksHealthOnly(t *testing.T) {
+	for _, health := range []error{nil, errors.New("unhealthy")} {
+		cd := &fakeCodeDeploy{appSpec: appSpec}
+		fn := &fakeLambda{output: &lambda.InvokeOutput{Payload: []byte(`{}`)}}
+		var checked string
+		h := &hook{
+			cfg:        &config.HookConfig{Phase: config.AfterAllowTraffic, AppHealthCheckURL: "https://api.example.com/health"},
+			codeDeploy: cd,
+			lambda:     fn,
+			healthCheck: func(ctx context.Context, url string) error {
+				checked = url
+				return health
+			},
+		}
+
+		if err := h.handle(context.Background(), HookEvent{DeploymentId: "d-1", LifecycleEventHookExecutionId: "h-1"}); err != nil {
+			t.Fatalf("handle() returned error: %v", err)
+		}
+		want := types.LifecycleEventStatusSucceeded
+		if health != nil {
+			want = types.LifecycleEventStatusFailed
+		}
+		if len(cd.statuses) != 1 || cd.statuses[0] != want {
+			t.Errorf("health %v: reported %v, want %v", health, cd.statuses, want)
+		}
+		if fn.qualifier != "" || checked != "https://api.example.com/health" {
+			t.Errorf("invoked %q and checked %q, want no invocation and the health URL checked", fn.qualifier, checked)
+		}
+	}
+}
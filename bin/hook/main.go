@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// The hook Lambda runs as a CodeDeploy BeforeAllowTraffic or
+// AfterAllowTraffic hook for the deployed function. Like the deploy
+// Lambda, it does not crash on a bad configuration: a crashing hook never
+// reports a status, so the deployment would hang until the hook times
+// out. We report Failed instead, with the reason in the logs.
+func main() {
+	ctx := context.Background()
+	h := &hook{
+		cfg:         &config.HookConfig{},
+		healthCheck: deploy.ValidateApplicationHealth,
+	}
+
+	cfg, err := config.LoadHook()
+	if err != nil {
+		h.initErr = fmt.Errorf("invalid hook configuration: %v", err)
+		log.Printf("%v", h.initErr)
+	} else {
+		h.cfg = cfg
+	}
+
+	awsCfg, err := deploy.LoadAWSConfig(ctx)
+	if err != nil {
+		h.initErr = fmt.Errorf("failed to load AWS config: %v", err)
+		log.Printf("%v", h.initErr)
+	} else {
+		h.codeDeploy = codedeploy.NewFromConfig(awsCfg)
+		h.lambda = awslambda.NewFromConfig(awsCfg)
+		h.bundles = deploy.NewS3Client(awsCfg)
+	}
+
+	lambda.Start(h.handle)
+}
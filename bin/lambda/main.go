@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// The deploy Lambda is the CodePipeline action that runs deploy.Handler.
+// Operators also invoke it directly to deploy, check or roll back a
+// deployment group, and EventBridge sends it CodeDeploy's deployment
+// state changes. deploy.HandleInvocation tells them apart.
+func main() {
+	deploy.Init(context.Background())
+	lambda.Start(deploy.HandleInvocation)
+}
@@ -7,7 +7,7 @@ cd ../lambda
 rm -f bootstrap dummyprinter.zip
 
 # Compile Lambda function and name the output "bootstrap"
-CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o bootstrap pipeline.go
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o bootstrap .
 
 # Make "bootstrap" executable (Important!)
 chmod +x bootstrap
@@ -15,4 +15,12 @@ chmod +x bootstrap
 # Create the zip file including the "bootstrap" binary
 zip -X dummyprinter.zip bootstrap
 
-echo "Lambda deployment package (dummyprinter.zip) created."
\ No newline at end of file
+echo "Lambda deployment package (dummyprinter.zip) created."
+
+# Compile the CodeDeploy traffic hook the same way
+cd ../hook
+rm -f bootstrap
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o bootstrap .
+chmod +x bootstrap
+
+echo "Traffic hook binary created."
\ No newline at end of file
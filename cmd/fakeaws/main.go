@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+// scenarios is the file -scenarios reads: the scripted deployment groups,
+// keyed by application/group, and the faults to inject
+type scenarios struct {
+	Groups map[string]struct {
+		ComputePlatform string `json:"computePlatform"`
+		fakeaws.Scenario
+	} `json:"groups"`
+	Faults []fakeaws.Fault `json:"faults"`
+}
+
+// fakeaws serves fake CodeDeploy, CodePipeline, S3, Secrets Manager and
+// SSM APIs, for pointing the Lambdas or pipelinectl at with
+// AWS_ENDPOINT_URL in end-to-end tests
+func main() {
+	addr := flag.String("addr", "127.0.0.1:4566", "Address to listen on")
+	scenariosPath := flag.String("scenarios", "", "JSON file of deployment group scenarios and faults")
+	flag.Parse()
+
+	server := fakeaws.New()
+	server.AutoCreateGroups = true
+	if *scenariosPath != "" {
+		if err := loadScenarios(server, *scenariosPath); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	log.Printf("Serving fake AWS APIs on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
+
+func loadScenarios(server *fakeaws.Server, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read scenarios: %v", err)
+	}
+	var s scenarios
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to parse scenarios %s: %v", path, err)
+	}
+
+	for key, group := range s.Groups {
+		application, name, ok := strings.Cut(key, "/")
+		if !ok || application == "" || name == "" {
+			return fmt.Errorf("scenario group %q must be application/group", key)
+		}
+		server.SetScenario(application, name, group.Scenario)
+		if group.ComputePlatform != "" {
+			server.AddDeploymentGroup(application, name, group.ComputePlatform)
+		}
+	}
+	for _, fault := range s.Faults {
+		if fault.Operation == "" || fault.Count <= 0 {
+			return fmt.Errorf("fault %+v needs an operation and a positive count", fault)
+		}
+		server.AddFault(fault)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+)
+
+// approvalResult is what approve prints
+type approvalResult struct {
+	Pipeline string `json:"pipeline"`
+	Stage    string `json:"stage"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+	Summary  string `json:"summary"`
+}
+
+// pendingApproval is a manual approval action waiting for a decision
+type pendingApproval struct {
+	stage, action, token string
+}
+
+// approve approves, or with -reject rejects, the manual approval the
+// pipeline is waiting on
+func (c *cli) approve(ctx context.Context, args []string) error {
+	flags := newCommandFlags("approve")
+	pipeline := flags.pipelineFlag()
+	stage := flags.String("stage", "", "stage `name` of the approval, when several are waiting")
+	action := flags.String("action", "", "action `name` of the approval, when several are waiting")
+	reject := flags.Bool("reject", false, "reject instead of approving")
+	summary := flags.String("summary", "", "`comment` recorded with the decision")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	if *pipeline == "" {
+		return errors.New("approve needs -pipeline or PIPELINE_NAME")
+	}
+
+	state, err := c.pipeline.GetPipelineState(ctx, &codepipeline.GetPipelineStateInput{Name: aws.String(*pipeline)})
+	if err != nil {
+		return fmt.Errorf("failed to get the state of pipeline %s: %v", *pipeline, err)
+	}
+
+	// Only an approval waiting for a decision has a token
+	var pending []pendingApproval
+	for _, s := range state.StageStates {
+		for _, a := range s.ActionStates {
+			e := a.LatestExecution
+			if e == nil || e.Status != types.ActionExecutionStatusInProgress || e.Token == nil {
+				continue
+			}
+			if (*stage == "" || aws.ToString(s.StageName) == *stage) && (*action == "" || aws.ToString(a.ActionName) == *action) {
+				pending = append(pending, pendingApproval{aws.ToString(s.StageName), aws.ToString(a.ActionName), aws.ToString(e.Token)})
+			}
+		}
+	}
+	switch len(pending) {
+	case 0:
+		return fmt.Errorf("no approval is waiting in pipeline %s", *pipeline)
+	case 1:
+	default:
+		names := make([]string, len(pending))
+		for i, p := range pending {
+			names[i] = p.stage + "/" + p.action
+		}
+		return fmt.Errorf("%d approvals are waiting (%s), choose one with -stage and -action", len(pending), strings.Join(names, ", "))
+	}
+
+	approval := pending[0]
+	status := types.ApprovalStatusApproved
+	if *reject {
+		status = types.ApprovalStatusRejected
+	}
+	if *summary == "" {
+		*summary = fmt.Sprintf("%s with pipelinectl", status)
+	}
+	_, err = c.pipeline.PutApprovalResult(ctx, &codepipeline.PutApprovalResultInput{
+		PipelineName: aws.String(*pipeline),
+		StageName:    aws.String(approval.stage),
+		ActionName:   aws.String(approval.action),
+		Token:        aws.String(approval.token),
+		Result: &types.ApprovalResult{
+			Status:  status,
+			Summary: aws.String(*summary),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record the approval of %s/%s: %v", approval.stage, approval.action, err)
+	}
+
+	result := approvalResult{Pipeline: *pipeline, Stage: approval.stage, Action: approval.action, Status: string(status), Summary: *summary}
+	return c.print(flags.output, result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s %s/%s in pipeline %s\n", status, approval.stage, approval.action, *pipeline)
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+)
+
+func approvalState(stages ...string) *codepipeline.GetPipelineStateOutput {
+	state := &codepipeline.GetPipelineStateOutput{}
+	for _, stage := range stages {
+		state.StageStates = append(state.StageStates, types.StageState{
+			StageName: aws.String(stage),
+			ActionStates: []types.ActionState{
+				{ActionName: aws.String("Deploy"), LatestExecution: &types.ActionExecution{Status: types.ActionExecutionStatusInProgress}},
+				{ActionName: aws.String("Approve"), LatestExecution: &types.ActionExecution{
+					Status: types.ActionExecutionStatusInProgress,
+					Token:  aws.String("token-" + stage),
+				}},
+			},
+		})
+	}
+	return state
+}
+
+func TestApprove(t *testing.T) {
+	fake := &fakePipeline{state: approvalState("Production")}
+	c, out := testCLI(t, &cli{pipeline: fake})
+
+	if err := c.approve(context.Background(), []string{"-pipeline", "web", "-reject", "-summary", "error rate too high"}); err != nil {
+		t.Fatalf("approve() returned error: %v", err)
+	}
+	if len(fake.approvals) != 1 {
+		t.Fatalf("recorded %d approvals, want 1", len(fake.approvals))
+	}
+	approval := fake.approvals[0]
+	if aws.ToString(approval.Token) != "token-Production" || aws.ToString(approval.ActionName) != "Approve" ||
+		approval.Result.Status != types.ApprovalStatusRejected || aws.ToString(approval.Result.Summary) != "error rate too high" {
+		t.Errorf("approval = %+v, result %+v", approval, approval.Result)
+	}
+	if !strings.Contains(out.String(), "Rejected Production/Approve in pipeline web") {
+		t.Errorf("output %q does not describe the decision", out)
+	}
+}
+
+func TestApproveNeedsOneApproval(t *testing.T) {
+	fake := &fakePipeline{state: approvalState("Staging", "Production")}
+	c, _ := testCLI(t, &cli{pipeline: fake})
+
+	err := c.approve(context.Background(), []string{"-pipeline", "web"})
+	if err == nil || !strings.Contains(err.Error(), "Staging/Approve, Production/Approve") {
+		t.Errorf("approve() = %v, want both waiting approvals listed", err)
+	}
+	if err := c.approve(context.Background(), []string{"-pipeline", "web", "-stage", "Staging"}); err != nil {
+		t.Fatalf("approve() returned error: %v", err)
+	}
+	if len(fake.approvals) != 1 || aws.ToString(fake.approvals[0].Token) != "token-Staging" {
+		t.Errorf("approvals = %+v, want the Staging approval", fake.approvals)
+	}
+
+	fake.state = approvalState()
+	if err := c.approve(context.Background(), []string{"-pipeline", "web"}); err == nil {
+		t.Error("approve() with no waiting approval returned no error")
+	}
+}
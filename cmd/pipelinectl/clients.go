@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// pipelineAPI is the part of the CodePipeline client the CLI uses
+type pipelineAPI interface {
+	GetPipelineState(ctx context.Context, params *codepipeline.GetPipelineStateInput, optFns ...func(*codepipeline.Options)) (*codepipeline.GetPipelineStateOutput, error)
+	StartPipelineExecution(ctx context.Context, params *codepipeline.StartPipelineExecutionInput, optFns ...func(*codepipeline.Options)) (*codepipeline.StartPipelineExecutionOutput, error)
+	PutApprovalResult(ctx context.Context, params *codepipeline.PutApprovalResultInput, optFns ...func(*codepipeline.Options)) (*codepipeline.PutApprovalResultOutput, error)
+}
+
+// codeDeployAPI is the part of the CodeDeploy client the CLI uses
+type codeDeployAPI interface {
+	GetDeploymentGroup(ctx context.Context, params *codedeploy.GetDeploymentGroupInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentGroupOutput, error)
+	GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error)
+	ListDeployments(ctx context.Context, params *codedeploy.ListDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentsOutput, error)
+}
+
+// lambdaAPI is the part of the Lambda client the CLI uses
+type lambdaAPI interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// logsAPI is the part of the CloudWatch Logs client the CLI uses
+type logsAPI interface {
+	FilterLogEvents(ctx context.Context, params *cloudwatchlogs.FilterLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.FilterLogEventsOutput, error)
+	GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
+}
+
+func newCLI(awsCfg aws.Config) *cli {
+	return &cli{
+		pipeline:       codepipeline.NewFromConfig(awsCfg),
+		codeDeploy:     codedeploy.NewFromConfig(awsCfg),
+		lambda:         lambda.NewFromConfig(awsCfg),
+		cloudWatchLogs: cloudwatchlogs.NewFromConfig(awsCfg),
+		auditLog:       deploy.NewS3Client(awsCfg),
+		awsConfig:      awsCfg,
+		out:            os.Stdout,
+		errOut:         os.Stderr,
+		pollInterval:   5 * time.Second,
+	}
+}
+
+// invokeDeployFunction calls the deploy Lambda synchronously and decodes
+// its result. A function error comes back as the handler's error message.
+func (c *cli) invokeDeployFunction(ctx context.Context, function string, payload any, result any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+	output, err := c.lambda.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName: aws.String(function),
+		Payload:      body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to invoke %s: %v", function, err)
+	}
+	if output.FunctionError != nil {
+		var functionErr struct {
+			ErrorMessage string `json:"errorMessage"`
+		}
+		if json.Unmarshal(output.Payload, &functionErr) == nil && functionErr.ErrorMessage != "" {
+			return errors.New(functionErr.ErrorMessage)
+		}
+		return fmt.Errorf("%s failed: %s", function, aws.ToString(output.FunctionError))
+	}
+	if err := json.Unmarshal(output.Payload, result); err != nil {
+		return fmt.Errorf("invalid response from %s: %v", function, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+func TestCLIAgainstEndpointOverride(t *testing.T) {
+	fake := fakeaws.New()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	started := time.Now().UTC().Add(-time.Hour)
+	record, _ := json.Marshal(deploy.AuditRecord{
+		Outcome: "Succeeded",
+		DeploymentReport: &deploy.DeploymentReport{
+			JobID:   "job-1",
+			Timings: deploy.Timings{StartedAt: started, Total: "2m0s"},
+			Targets: []*deploy.TargetResult{{ApplicationName: "api", DeploymentGroupName: "api-live", DeploymentID: "d-1"}},
+		},
+	})
+	fake.PutObject("audit", "deployments/date="+started.Format("2006-01-02")+"/job-1.json", record)
+
+	// Only the endpoint is configured: no credentials, profile or region
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+
+	awsCfg, err := deploy.LoadAWSConfig(context.Background())
+	if err != nil {
+		t.Fatalf("LoadAWSConfig() returned error: %v", err)
+	}
+	c := newCLI(awsCfg)
+	var out bytes.Buffer
+	c.out, c.errOut = &out, io.Discard
+
+	if err := c.history(context.Background(), []string{"-audit-log", "s3://audit/deployments"}); err != nil {
+		t.Fatalf("history() returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "job-1  api/api-live d-1") {
+		t.Errorf("output does not list job-1:\n%s", out.String())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+)
+
+// executionResult is what deploy prints for a pipeline execution
+type executionResult struct {
+	Pipeline    string `json:"pipeline"`
+	ExecutionID string `json:"executionId"`
+}
+
+// deploy starts the pipeline, or with -app deploys a bundle straight to a
+// group through the deploy Lambda
+func (c *cli) deploy(ctx context.Context, args []string) error {
+	flags := newCommandFlags("deploy")
+	pipeline := flags.pipelineFlag()
+	function := flags.functionFlag()
+	var req deploy.DeployRequest
+	flags.targetFlags(&req.TargetRef)
+	flags.StringVar(&req.S3BucketName, "bucket", "", "S3 `bucket` of the bundle to deploy directly")
+	flags.StringVar(&req.S3ObjectKey, "key", "", "S3 `key` of the bundle to deploy directly")
+	flags.StringVar(&req.Reason, "reason", "", "why the bundle is deployed directly, kept in the audit log")
+	flags.StringVar(&req.SourceBranch, "branch", "", "`branch` the bundle was built from, for the deployment policy")
+	flags.StringVar(&req.RequestID, "request-id", "", "`ID` of the direct deployment, to resume it after an interruption (default a new ID)")
+	flags.BoolVar(&req.EmergencyOverride, "emergency-override", false, "deploy directly during a change freeze")
+	flags.StringVar(&req.OverrideReason, "override-reason", "", "why the freeze is overridden, required with -emergency-override")
+	flags.BoolVar(&req.DryRun, "dry-run", false, "validate the direct deployment and print its plan without deploying")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+
+	if req.ApplicationName == "" {
+		if req.DryRun {
+			return errors.New("-dry-run plans a direct deployment, which needs -app, -group, -bucket and -key; use local -dry-run for a pipeline job")
+		}
+		if *pipeline == "" {
+			return errors.New("deploy needs -pipeline or PIPELINE_NAME, or -app, -group, -bucket and -key")
+		}
+		return c.startPipeline(ctx, *pipeline, flags.output)
+	}
+
+	if *function == "" {
+		return errors.New("a direct deployment needs -function or PIPELINE_DEPLOY_FUNCTION")
+	}
+	if req.DeploymentGroupName == "" || req.S3BucketName == "" || req.S3ObjectKey == "" {
+		return errors.New("a direct deployment needs -app, -group, -bucket and -key")
+	}
+	if req.EmergencyOverride && req.OverrideReason == "" {
+		return errors.New("-emergency-override needs -override-reason")
+	}
+	// The ID makes the request safe to retry, so the SDK's retries of a
+	// slow invocation resume one deployment instead of starting several
+	if req.RequestID == "" {
+		req.RequestID = "cli-" + strconv.FormatInt(time.Now().UnixMilli(), 36)
+	}
+
+	verb := "Deploying"
+	if req.DryRun {
+		verb = "Planning a deployment of"
+	}
+	c.progress("%s s3://%s/%s to %s/%s through %s as request %s...",
+		verb, req.S3BucketName, req.S3ObjectKey, req.ApplicationName, req.DeploymentGroupName, *function, req.RequestID)
+	var report deploy.DeploymentReport
+	if err := c.invokeDeployFunction(ctx, *function, deploy.DirectInvocation{Action: "deploy", Deploy: &req}, &report); err != nil {
+		if req.DryRun {
+			return fmt.Errorf("dry run failed: %v", err)
+		}
+		return fmt.Errorf("deployment failed: %v", err)
+	}
+
+	return c.print(flags.output, report, func(w io.Writer) {
+		if report.Plan != nil {
+			fmt.Fprintln(w, report.PlanSummary())
+			return
+		}
+		if report.Unchanged {
+			fmt.Fprintf(w, "No changes: the bundle is already live in %s/%s from deployment %s\n",
+				req.ApplicationName, req.DeploymentGroupName, report.DeploymentID)
+			return
+		}
+		fmt.Fprintf(w, "Deployed s3://%s/%s to %s/%s in deployment %s (%s)\n",
+			req.S3BucketName, req.S3ObjectKey, req.ApplicationName, req.DeploymentGroupName, report.DeploymentID, report.Timings.Total)
+	})
+}
+
+func (c *cli) startPipeline(ctx context.Context, pipeline, format string) error {
+	output, err := c.pipeline.StartPipelineExecution(ctx, &codepipeline.StartPipelineExecutionInput{
+		Name: aws.String(pipeline),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start pipeline %s: %v", pipeline, err)
+	}
+
+	result := executionResult{Pipeline: pipeline, ExecutionID: aws.ToString(output.PipelineExecutionId)}
+	return c.print(format, result, func(w io.Writer) {
+		fmt.Fprintf(w, "Started execution %s of pipeline %s\n", result.ExecutionID, pipeline)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+func TestDeployStartsPipeline(t *testing.T) {
+	fake := &fakePipeline{}
+	c, out := testCLI(t, &cli{pipeline: fake})
+
+	if err := c.deploy(context.Background(), []string{"-pipeline", "web", "-output", "json"}); err != nil {
+		t.Fatalf("deploy() returned error: %v", err)
+	}
+	var result executionResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil || result.ExecutionID != "exec-1" {
+		t.Errorf("output %s, want execution exec-1", out)
+	}
+	if len(fake.started) != 1 || fake.started[0] != "web" {
+		t.Errorf("started %v, want web", fake.started)
+	}
+}
+
+func TestDeployDirect(t *testing.T) {
+	fake := &fakeLambda{output: &lambda.InvokeOutput{Payload: []byte(`{"jobId": "direct-cli-1", "deploymentId": "d-7",
+		"timings": {"total": "3m0s"}, "direct": {"requestId": "cli-1"}}`)}}
+	c, out := testCLI(t, &cli{lambda: fake})
+
+	args := []string{"-function", "deploy", "-app", "api", "-group", "api-live", "-bucket", "artifacts", "-key", "build.zip"}
+	if err := c.deploy(context.Background(), args); err != nil {
+		t.Fatalf("deploy() returned error: %v", err)
+	}
+
+	var sent deploy.DirectInvocation
+	if err := json.Unmarshal(fake.payloads[0], &sent); err != nil || sent.Action != "deploy" {
+		t.Fatalf("payload %s is not a deploy invocation", fake.payloads[0])
+	}
+	if sent.Deploy.S3BucketName != "artifacts" || sent.Deploy.S3ObjectKey != "build.zip" || !strings.HasPrefix(sent.Deploy.RequestID, "cli-") {
+		t.Errorf("deploy request = %+v, want the bundle and a request ID", sent.Deploy)
+	}
+	if !strings.Contains(out.String(), "in deployment d-7 (3m0s)") {
+		t.Errorf("output %q does not describe the deployment", out)
+	}
+
+	args = []string{"-function", "deploy", "-app", "api", "-group", "api-live", "-bucket", "artifacts", "-key", "build.zip", "-emergency-override"}
+	if err := c.deploy(context.Background(), args); err == nil {
+		t.Error("deploy() with -emergency-override but no reason returned no error")
+	}
+}
+
+func TestDeployDryRun(t *testing.T) {
+	fake := &fakeLambda{output: &lambda.InvokeOutput{Payload: []byte(`{"jobId": "direct-cli-1",
+		"plan": {"waves": [{"name": "1", "targets": [{"applicationName": "api", "deploymentGroupName": "api-live",
+			"computePlatform": "Server", "deploymentConfigName": "CodeDeployDefault.OneAtATime", "action": "Create"}]}]}}`)}}
+	c, out := testCLI(t, &cli{lambda: fake})
+
+	args := []string{"-function", "deploy", "-app", "api", "-group", "api-live", "-bucket", "artifacts", "-key", "build.zip", "-dry-run"}
+	if err := c.deploy(context.Background(), args); err != nil {
+		t.Fatalf("deploy() returned error: %v", err)
+	}
+
+	var sent deploy.DirectInvocation
+	if err := json.Unmarshal(fake.payloads[0], &sent); err != nil || sent.Action != "deploy" || !sent.Deploy.DryRun {
+		t.Fatalf("payload %s is not a dry run", fake.payloads[0])
+	}
+	if !strings.Contains(out.String(), "api/api-live: create a Server deployment with CodeDeployDefault.OneAtATime") {
+		t.Errorf("output %q does not print the plan", out)
+	}
+
+	if err := c.deploy(context.Background(), []string{"-pipeline", "web", "-dry-run"}); err == nil {
+		t.Error("deploy() of a pipeline with -dry-run returned no error")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// testCLI is a cli over fakes. Calls to a fake that was not set panic
+// through the nil interface.
+func testCLI(t *testing.T, c *cli) (*cli, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	c.out = &out
+	c.errOut = io.Discard
+	c.pollInterval = time.Millisecond
+	return c, &out
+}
+
+// fakePipeline serves one pipeline state and records what was started and
+// approved
+type fakePipeline struct {
+	state     *codepipeline.GetPipelineStateOutput
+	started   []string
+	approvals []*codepipeline.PutApprovalResultInput
+}
+
+func (f *fakePipeline) GetPipelineState(ctx context.Context, params *codepipeline.GetPipelineStateInput, optFns ...func(*codepipeline.Options)) (*codepipeline.GetPipelineStateOutput, error) {
+	return f.state, nil
+}
+
+func (f *fakePipeline) StartPipelineExecution(ctx context.Context, params *codepipeline.StartPipelineExecutionInput, optFns ...func(*codepipeline.Options)) (*codepipeline.StartPipelineExecutionOutput, error) {
+	f.started = append(f.started, aws.ToString(params.Name))
+	return &codepipeline.StartPipelineExecutionOutput{PipelineExecutionId: aws.String(fmt.Sprintf("exec-%d", len(f.started)))}, nil
+}
+
+func (f *fakePipeline) PutApprovalResult(ctx context.Context, params *codepipeline.PutApprovalResultInput, optFns ...func(*codepipeline.Options)) (*codepipeline.PutApprovalResultOutput, error) {
+	f.approvals = append(f.approvals, params)
+	return &codepipeline.PutApprovalResultOutput{}, nil
+}
+
+// fakeCodeDeploy serves deployments of one group
+type fakeCodeDeploy struct {
+	group       *types.DeploymentGroupInfo
+	deployments map[string]*types.DeploymentInfo
+	active      []string
+}
+
+func (f *fakeCodeDeploy) GetDeploymentGroup(ctx context.Context, params *codedeploy.GetDeploymentGroupInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentGroupOutput, error) {
+	return &codedeploy.GetDeploymentGroupOutput{DeploymentGroupInfo: f.group}, nil
+}
+
+func (f *fakeCodeDeploy) GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error) {
+	d, ok := f.deployments[aws.ToString(params.DeploymentId)]
+	if !ok {
+		return nil, fmt.Errorf("DeploymentDoesNotExistException: %s", aws.ToString(params.DeploymentId))
+	}
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: d}, nil
+}
+
+// ListDeployments only ever lists the active deployments
+func (f *fakeCodeDeploy) ListDeployments(ctx context.Context, params *codedeploy.ListDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentsOutput, error) {
+	return &codedeploy.ListDeploymentsOutput{Deployments: f.active}, nil
+}
+
+// fakeLambda records invocations and returns a canned response
+type fakeLambda struct {
+	output   *lambda.InvokeOutput
+	payloads [][]byte
+}
+
+func (f *fakeLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	f.payloads = append(f.payloads, params.Payload)
+	return f.output, nil
+}
+
+// fakeLogs serves log streams of one group. FilterLogEvents only supports
+// a quoted term as its pattern.
+type fakeLogs struct {
+	streams map[string][]logstypes.OutputLogEvent
+}
+
+func (f *fakeLogs) FilterLogEvents(ctx context.Context, params *cloudwatchlogs.FilterLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	term, err := strconv.Unquote(aws.ToString(params.FilterPattern))
+	if err != nil {
+		return nil, err
+	}
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	for name, events := range f.streams {
+		for _, e := range events {
+			if aws.ToInt64(e.Timestamp) >= aws.ToInt64(params.StartTime) && strings.Contains(aws.ToString(e.Message), term) {
+				out.Events = append(out.Events, logstypes.FilteredLogEvent{LogStreamName: aws.String(name), Timestamp: e.Timestamp, Message: e.Message})
+			}
+		}
+	}
+	return out, nil
+}
+
+// GetLogEvents returns the whole rest of the stream in one page
+func (f *fakeLogs) GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	out := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String("f/end")}
+	if params.NextToken != nil {
+		return out, nil
+	}
+	for _, e := range f.streams[aws.ToString(params.LogStreamName)] {
+		if aws.ToInt64(e.Timestamp) >= aws.ToInt64(params.StartTime) {
+			out.Events = append(out.Events, e)
+		}
+	}
+	return out, nil
+}
+
+// fakeS3 serves objects from memory
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", aws.ToString(params.Key))
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+)
+
+// history lists the jobs in the audit log, oldest first
+func (c *cli) history(ctx context.Context, args []string) error {
+	flags := newCommandFlags("history")
+	location := flags.String("audit-log", os.Getenv("PIPELINE_AUDIT_LOG"), "audit log `location` s3://bucket/prefix (default $PIPELINE_AUDIT_LOG)")
+	var query deploy.AuditQuery
+	flags.StringVar(&query.ApplicationName, "app", "", "only jobs that deployed to this CodeDeploy application")
+	flags.StringVar(&query.DeploymentGroupName, "group", "", "only jobs that deployed to this deployment group")
+	since := flags.Duration("since", 7*24*time.Hour, "how far back to list")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	if *location == "" {
+		return errors.New("history needs -audit-log or PIPELINE_AUDIT_LOG")
+	}
+	query.To = time.Now()
+	query.From = query.To.Add(-*since)
+
+	records, err := deploy.QueryAuditLog(ctx, c.auditLog, *location, query)
+	if err != nil {
+		return err
+	}
+
+	return c.print(flags.output, records, func(w io.Writer) {
+		if len(records) == 0 {
+			fmt.Fprintf(w, "No deployments since %s\n", formatTime(&query.From))
+			return
+		}
+		fmt.Fprintln(w, "STARTED\tOUTCOME\tJOB\tTARGETS\tDURATION\tERROR")
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", formatTime(&r.Timings.StartedAt), r.Outcome, r.JobID,
+				describeTargets(r.Targets), orDash(r.Timings.Total), r.Error)
+		}
+	})
+}
+
+// describeTargets lists a job's groups with their deployments
+func describeTargets(targets []*deploy.TargetResult) string {
+	if len(targets) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(targets))
+	for i, t := range targets {
+		parts[i] = fmt.Sprintf("%s/%s %s", t.ApplicationName, t.DeploymentGroupName, orDash(t.DeploymentID))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+)
+
+func TestHistory(t *testing.T) {
+	started := time.Now().UTC().Add(-time.Hour)
+	record := func(jobID, outcome, group string) string {
+		b, _ := json.Marshal(deploy.AuditRecord{
+			Outcome: outcome,
+			DeploymentReport: &deploy.DeploymentReport{
+				JobID:   jobID,
+				Timings: deploy.Timings{StartedAt: started, Total: "2m0s"},
+				Targets: []*deploy.TargetResult{{ApplicationName: "api", DeploymentGroupName: group, DeploymentID: "d-" + jobID}},
+			},
+		})
+		return string(b)
+	}
+	partition := "deployments/date=" + started.Format("2006-01-02") + "/"
+	fake := &fakeS3{objects: map[string]string{
+		partition + "job-1.json": record("job-1", "Succeeded", "api-live"),
+		partition + "job-2.json": record("job-2", "Failed", "api-staging"),
+	}}
+	c, out := testCLI(t, &cli{auditLog: fake})
+
+	if err := c.history(context.Background(), []string{"-audit-log", "s3://audit/deployments", "-group", "api-live"}); err != nil {
+		t.Fatalf("history() returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Succeeded  job-1  api/api-live d-job-1  2m0s") || strings.Contains(out.String(), "job-2") {
+		t.Errorf("output does not list only job-1:\n%s", out)
+	}
+
+	out.Reset()
+	if err := c.history(context.Background(), []string{"-audit-log", "s3://audit/deployments", "-output", "json"}); err != nil {
+		t.Fatalf("history() returned error: %v", err)
+	}
+	var records []deploy.AuditRecord
+	if err := json.Unmarshal(out.Bytes(), &records); err != nil || len(records) != 2 {
+		t.Errorf("history JSON = %s, want both records", out)
+	}
+}
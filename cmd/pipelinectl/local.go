@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/30Piraten/pipeline/fakeaws"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// localResult is what a local run did: every AWS call the handler made,
+// its report and what it told CodePipeline
+type localResult struct {
+	JobID  string                   `json:"jobId"`
+	Calls  []apiCall                `json:"calls"`
+	Report *deploy.DeploymentReport `json:"report,omitempty"`
+	Job    *jobResult               `json:"job,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+// apiCall is one AWS operation, with its retries
+type apiCall struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+	Attempts  int    `json:"attempts"`
+	Duration  string `json:"duration"`
+	Error     string `json:"error,omitempty"`
+}
+
+// jobResult is the last result the handler reported to CodePipeline
+type jobResult struct {
+	Status            string            `json:"status"`
+	FailureType       string            `json:"failureType,omitempty"`
+	Message           string            `json:"message,omitempty"`
+	ContinuationToken string            `json:"continuationToken,omitempty"`
+	OutputVariables   map[string]string `json:"outputVariables,omitempty"`
+}
+
+// local runs the deploy handler in process on a CodePipeline event, from a
+// fixture such as the event the deploy Lambda logged, or built from flags
+func (c *cli) local(ctx context.Context, args []string) error {
+	flags := newCommandFlags("local")
+	eventFile := flags.String("event", "", "CodePipeline event JSON `file` to replay")
+	jobID := flags.String("job-id", "", "job ID of a generated event (default local-<time>)")
+	bucket := flags.String("bucket", "", "artifact bucket of a generated event")
+	key := flags.String("key", "", "artifact key of a generated event")
+	userParameters := flags.String("user-parameters", "", "deploy action UserParameters of a generated event")
+	fake := flags.Bool("fake", false, "run against in-memory fakes instead of AWS")
+	bundle := flags.String("bundle", "", "zip `file` the fakes serve as the artifact (default a bundle with only an appspec.yml)")
+	app := flags.String("app", "", "CodeDeploy application `name` (default $APPLICATION_NAME)")
+	group := flags.String("group", "", "deployment group `name` (default $DEPLOYMENT_GROUP_NAME)")
+	dryRun := flags.Bool("dry-run", false, "print the deployment plan instead of deploying, as DRY_RUN does")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+
+	event, err := localEvent(*eventFile, *jobID, *bucket, *key, *userParameters)
+	if err != nil {
+		return err
+	}
+
+	// The handler reads its configuration from the environment, as it
+	// does in the Lambda
+	if *app != "" {
+		os.Setenv("APPLICATION_NAME", *app)
+	}
+	if *group != "" {
+		os.Setenv("DEPLOYMENT_GROUP_NAME", *group)
+	}
+	if *dryRun {
+		os.Setenv("DRY_RUN", "true")
+	}
+
+	awsCfg := c.awsConfig.Copy()
+	if *fake {
+		awsCfg, err = fakeConfig(event, *bundle)
+		if err != nil {
+			return err
+		}
+	}
+	recorder := &callRecorder{}
+	awsCfg.APIOptions = append(awsCfg.APIOptions, recorder.register)
+
+	// The handler logs as it would in CloudWatch, kept off out so JSON
+	// output stays parseable
+	log.SetOutput(c.errOut)
+	defer log.SetOutput(os.Stderr)
+
+	id := event.CodePipelineJob.ID
+	c.progress("Running job %s in process...", id)
+	deploy.InitWithConfig(awsCfg)
+	report, runErr := deploy.RunJob(ctx, event)
+
+	result := localResult{JobID: id, Report: report}
+	result.Calls, result.Job = recorder.results()
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+	err = c.print(flags.output, result, func(w io.Writer) {
+		printLocalResult(w, result)
+	})
+	if err != nil {
+		return err
+	}
+	if runErr != nil {
+		return fmt.Errorf("job %s failed: %v", id, runErr)
+	}
+	return nil
+}
+
+// localEvent reads the event fixture, or generates an event for one input
+// artifact
+func localEvent(file, jobID, bucket, key, userParameters string) (deploy.CodePipelineEvent, error) {
+	var event deploy.CodePipelineEvent
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return event, fmt.Errorf("failed to read event: %v", err)
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return event, fmt.Errorf("invalid event %s: %v", file, err)
+		}
+		if event.CodePipelineJob.ID == "" {
+			return event, fmt.Errorf("event %s has no CodePipeline.job id", file)
+		}
+		return event, nil
+	}
+
+	if jobID == "" {
+		jobID = "local-" + strconv.FormatInt(time.Now().UnixMilli(), 36)
+	}
+	if bucket == "" {
+		bucket = "local-artifacts"
+	}
+	if key == "" {
+		key = jobID + "/bundle.zip"
+	}
+	job := &event.CodePipelineJob
+	job.ID = jobID
+	job.Nonce = "1"
+	job.Data.ActionConfiguration.Configuration.UserParameters = userParameters
+	job.Data.InputArtifacts = []deploy.Artifact{{
+		Name:     "BuildArtifact",
+		Revision: "local",
+		Location: deploy.Location{Type: "S3", S3Location: deploy.S3Location{BucketName: bucket, ObjectKey: key}},
+	}}
+	job.Data.OutputArtifacts = []deploy.Artifact{{
+		Name:     "DeployReport",
+		Location: deploy.Location{Type: "S3", S3Location: deploy.S3Location{BucketName: bucket, ObjectKey: jobID + "/report.zip"}},
+	}}
+	return event, nil
+}
+
+// fakeConfig sends every AWS call to in-memory fakes, which serve the
+// bundle at the event's input artifact and have every deployment group
+func fakeConfig(event deploy.CodePipelineEvent, bundleFile string) (aws.Config, error) {
+	bundle, err := localBundle(bundleFile)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	server := fakeaws.New()
+	server.AutoCreateGroups = true
+	for _, artifact := range event.CodePipelineJob.Data.InputArtifacts {
+		location := artifact.Location.S3Location
+		server.PutObject(location.BucketName, location.ObjectKey, bundle)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return aws.Config{
+		Region:      region,
+		Credentials: credentials.NewStaticCredentialsProvider("local", "local", ""),
+		HTTPClient:  server.HTTPClient(),
+		Retryer:     func() aws.Retryer { return retry.NewStandard() },
+	}, nil
+}
+
+// localBundle reads the bundle file, or builds one with only an AppSpec
+func localBundle(file string) ([]byte, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %v", err)
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("appspec.yml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, "version: 0.0\nos: linux\n"); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// callRecorder is SDK middleware that records every operation the handler
+// calls, and the job results it reports. Waves call AWS concurrently.
+type callRecorder struct {
+	mu    sync.Mutex
+	calls []apiCall
+	job   *jobResult
+}
+
+func (r *callRecorder) register(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordCall", r.record), middleware.After)
+}
+
+func (r *callRecorder) record(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+
+	call := apiCall{
+		Service:   awsmiddleware.GetServiceID(ctx),
+		Operation: awsmiddleware.GetOperationName(ctx),
+		Attempts:  1,
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+	}
+	if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 0 {
+		call.Attempts = len(attempts.Results)
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+	if err == nil {
+		r.recordJob(in.Parameters)
+	}
+	return out, metadata, err
+}
+
+// recordJob keeps the job result the handler reported, if it was one
+func (r *callRecorder) recordJob(params any) {
+	switch params := params.(type) {
+	case *codepipeline.PutJobSuccessResultInput:
+		job := &jobResult{Status: "Succeeded", OutputVariables: params.OutputVariables}
+		if params.ContinuationToken != nil {
+			job.Status = "Continued"
+			job.ContinuationToken = *params.ContinuationToken
+		}
+		if params.ExecutionDetails != nil {
+			job.Message = aws.ToString(params.ExecutionDetails.Summary)
+		}
+		r.job = job
+	case *codepipeline.PutJobFailureResultInput:
+		job := &jobResult{Status: "Failed"}
+		if params.FailureDetails != nil {
+			job.FailureType = string(params.FailureDetails.Type)
+			job.Message = aws.ToString(params.FailureDetails.Message)
+		}
+		r.job = job
+	}
+}
+
+func (r *callRecorder) results() ([]apiCall, *jobResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]apiCall{}, r.calls...), r.job
+}
+
+func printLocalResult(w io.Writer, result localResult) {
+	fmt.Fprintf(w, "AWS calls for job %s:\n", result.JobID)
+	for i, call := range result.Calls {
+		status := "ok"
+		if call.Error != "" {
+			status = call.Error
+		}
+		fmt.Fprintf(w, "  %d\t%s\t%s\t%s\t%d attempt(s)\t%s\n", i+1, call.Service, call.Operation, call.Duration, call.Attempts, status)
+	}
+
+	if report := result.Report; report != nil && report.Plan != nil {
+		fmt.Fprintln(w, report.PlanSummary())
+	} else if report != nil {
+		fmt.Fprintln(w, "Validations:")
+		for _, v := range report.Validations {
+			printValidation(w, "job", v)
+		}
+		for _, target := range report.Targets {
+			for _, v := range target.Validations {
+				printValidation(w, target.ApplicationName+"/"+target.DeploymentGroupName, v)
+			}
+		}
+		fmt.Fprintln(w, "Targets:")
+		for _, target := range report.Targets {
+			fmt.Fprintf(w, "  %s/%s\t%s\t%s\t%s\n", target.ApplicationName, target.DeploymentGroupName, orDash(target.DeploymentID), target.Status, target.Message)
+		}
+	}
+
+	switch job := result.Job; {
+	case job == nil:
+		fmt.Fprintln(w, "Job result: none reported")
+	case job.FailureType != "":
+		fmt.Fprintf(w, "Job result: %s (%s): %s\n", job.Status, job.FailureType, job.Message)
+	case result.Report != nil && result.Report.Plan != nil:
+		// The message is the plan printed above
+		fmt.Fprintf(w, "Job result: %s with the plan\n", job.Status)
+	default:
+		fmt.Fprintf(w, "Job result: %s %s\n", job.Status, job.Message)
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "Handler error: %s\n", result.Error)
+	}
+}
+
+func printValidation(w io.Writer, scope string, v deploy.ValidationResult) {
+	status := "passed"
+	if !v.Passed {
+		status = "failed: " + v.Message
+	}
+	fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", scope, v.Name, v.Duration, status)
+}
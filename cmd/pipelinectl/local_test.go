@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalRunsGeneratedEventAgainstFakes(t *testing.T) {
+	t.Setenv("APPLICATION_NAME", "")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "")
+	c, out := testCLI(t, &cli{})
+
+	args := []string{"-fake", "-job-id", "job-1", "-app", "api", "-group", "api-live", "-output", "json"}
+	if err := c.local(context.Background(), args); err != nil {
+		t.Fatalf("local() returned error: %v", err)
+	}
+
+	var result localResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if result.Job == nil || result.Job.Status != "Succeeded" || result.Job.OutputVariables["deploymentId"] == "" {
+		t.Errorf("job result = %+v, want a success with the deployment ID", result.Job)
+	}
+
+	var operations []string
+	for _, call := range result.Calls {
+		operations = append(operations, call.Service+" "+call.Operation)
+	}
+	for _, want := range []string{"CodePipeline AcknowledgeJob", "S3 GetObject", "CodeDeploy CreateDeployment", "CodeDeploy GetDeployment", "CodePipeline PutJobSuccessResult"} {
+		if !strings.Contains(strings.Join(operations, "\n"), want) {
+			t.Errorf("calls %q do not include %s", operations, want)
+		}
+	}
+	if len(result.Report.Targets) != 1 || len(result.Report.Targets[0].Validations) == 0 {
+		t.Errorf("report targets = %+v, want api/api-live with its validations", result.Report.Targets)
+	}
+}
+
+func TestLocalReplaysFailingEvent(t *testing.T) {
+	t.Setenv("APPLICATION_NAME", "api")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "api-live")
+	dir := t.TempDir()
+	event := filepath.Join(dir, "event.json")
+	os.WriteFile(event, []byte(`{"CodePipeline.job": {"id": "job-2", "data": {"inputArtifacts": [
+		{"name": "BuildArtifact", "location": {"type": "S3", "s3Location": {"bucketName": "artifacts", "objectKey": "build.zip"}}}]}}}`), 0o644)
+	bundle := filepath.Join(dir, "bundle.zip")
+	os.WriteFile(bundle, []byte("not a zip"), 0o644)
+	c, out := testCLI(t, &cli{})
+
+	err := c.local(context.Background(), []string{"-fake", "-event", event, "-bundle", bundle})
+	if err == nil {
+		t.Fatal("local() returned no error for a failing job")
+	}
+	text := out.String()
+	if !strings.Contains(text, "appspec") || !strings.Contains(text, "Job result: Failed (JobFailed)") {
+		t.Errorf("output does not show the failed validation and job:\n%s", text)
+	}
+}
+
+func TestLocalDryRun(t *testing.T) {
+	t.Setenv("APPLICATION_NAME", "")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "")
+	t.Setenv("DRY_RUN", "")
+	c, out := testCLI(t, &cli{})
+
+	args := []string{"-fake", "-dry-run", "-job-id", "job-1", "-app", "api", "-group", "api-live"}
+	if err := c.local(context.Background(), args); err != nil {
+		t.Fatalf("local() returned error: %v", err)
+	}
+	for _, want := range []string{"Dry run for job job-1", "api/api-live: create a Server deployment", "Job result: Succeeded with the plan"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "CreateDeployment") {
+		t.Errorf("a dry run created a deployment:\n%s", out)
+	}
+}
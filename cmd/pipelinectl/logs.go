@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+// Lambda ends each invocation's logs with its REPORT line
+const lambdaReportPrefix = "REPORT RequestId:"
+
+// logEvent is one line of the deploy Lambda's logs
+type logEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Stream    string    `json:"stream"`
+	Message   string    `json:"message"`
+}
+
+// logs prints the deploy Lambda's logs of every invocation that handled
+// the job, and with -follow keeps printing new ones
+func (c *cli) logs(ctx context.Context, args []string) error {
+	flags := newCommandFlags("logs")
+	function := flags.functionFlag()
+	jobID := flags.String("job", "", "CodePipeline job `ID`, or the job ID of a direct deployment or rollback")
+	since := flags.Duration("since", 24*time.Hour, "how far back to look for the job")
+	follow := flags.Bool("follow", false, "keep printing new log events until interrupted")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	if *function == "" {
+		return errors.New("logs needs -function or PIPELINE_DEPLOY_FUNCTION")
+	}
+	if *jobID == "" {
+		return errors.New("logs needs -job")
+	}
+
+	tail := &logTail{
+		client:     c.cloudWatchLogs,
+		logGroup:   lambdaLogGroup(*function),
+		jobID:      *jobID,
+		searchFrom: time.Now().Add(-*since).UnixMilli(),
+		streams:    map[string]*logStreamState{},
+	}
+	// JSON output is one event per line, so it can be followed too
+	enc := json.NewEncoder(c.out)
+	for {
+		events, err := tail.poll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if flags.output == outputJSON {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(c.out, "%s %s\n", formatTime(&e.Timestamp), strings.TrimRight(e.Message, "\n"))
+		}
+		if !*follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// lambdaLogGroup is the log group of a function given by name or ARN
+func lambdaLogGroup(function string) string {
+	if parts := strings.Split(function, ":"); len(parts) >= 7 && parts[0] == "arn" {
+		function = parts[6]
+	}
+	return "/aws/lambda/" + function
+}
+
+// logTail finds a job's invocations in a function's log group. The job ID
+// only appears on some lines, so we find the streams that mention it and
+// read each from the first mention to the end of that invocation.
+type logTail struct {
+	client     logsAPI
+	logGroup   string
+	jobID      string
+	searchFrom int64
+	streams    map[string]*logStreamState
+}
+
+// logStreamState is how far we have read a stream, and whether we are
+// inside one of the job's invocations
+type logStreamState struct {
+	next   int64
+	active bool
+}
+
+// poll returns the job's events logged since the last poll, oldest first
+func (t *logTail) poll(ctx context.Context) ([]logEvent, error) {
+	paginator := cloudwatchlogs.NewFilterLogEventsPaginator(t.client, &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(t.logGroup),
+		FilterPattern: aws.String(strconv.Quote(t.jobID)),
+		StartTime:     aws.Int64(t.searchFrom),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search %s for job %s: %v", t.logGroup, t.jobID, err)
+		}
+		for _, e := range page.Events {
+			timestamp := aws.ToInt64(e.Timestamp)
+			name := aws.ToString(e.LogStreamName)
+			if _, ok := t.streams[name]; !ok {
+				t.streams[name] = &logStreamState{next: timestamp}
+			}
+			t.searchFrom = max(t.searchFrom, timestamp+1)
+		}
+	}
+
+	names := make([]string, 0, len(t.streams))
+	for name := range t.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var events []logEvent
+	for _, name := range names {
+		streamEvents, err := t.readStream(ctx, name, t.streams[name])
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, streamEvents...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
+
+// readStream reads a stream from where the last poll stopped, keeping the
+// lines of the job's invocations. Lambda runs one invocation at a time in
+// a stream, so a REPORT line ends the job's lines until it is mentioned again.
+func (t *logTail) readStream(ctx context.Context, name string, state *logStreamState) ([]logEvent, error) {
+	paginator := cloudwatchlogs.NewGetLogEventsPaginator(t.client, &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(t.logGroup),
+		LogStreamName: aws.String(name),
+		StartTime:     aws.Int64(state.next),
+		StartFromHead: aws.Bool(true),
+	}, func(o *cloudwatchlogs.GetLogEventsPaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+
+	var events []logEvent
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log stream %s: %v", name, err)
+		}
+		if len(page.Events) == 0 {
+			break
+		}
+		for _, e := range page.Events {
+			timestamp := aws.ToInt64(e.Timestamp)
+			message := aws.ToString(e.Message)
+			state.next = max(state.next, timestamp+1)
+			if strings.Contains(message, t.jobID) {
+				state.active = true
+			}
+			if state.active {
+				events = append(events, logEvent{Timestamp: time.UnixMilli(timestamp).UTC(), Stream: name, Message: message})
+			}
+			if strings.HasPrefix(message, lambdaReportPrefix) {
+				state.active = false
+			}
+		}
+	}
+	return events, nil
+}
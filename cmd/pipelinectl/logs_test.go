@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	logstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func logLines(start int64, messages ...string) []logstypes.OutputLogEvent {
+	events := make([]logstypes.OutputLogEvent, len(messages))
+	for i, m := range messages {
+		events[i] = logstypes.OutputLogEvent{Timestamp: aws.Int64(start + int64(i)*1000), Message: aws.String(m)}
+	}
+	return events
+}
+
+func TestLogsPrintsTheJobsInvocations(t *testing.T) {
+	// The job was handed back with a continuation token, so it ran in
+	// two invocations, with another job's invocation in between
+	fake := &fakeLogs{streams: map[string][]logstypes.OutputLogEvent{
+		"2026/10/18/[$LATEST]a": logLines(1_000_000,
+			"START RequestId: 1",
+			"Received event: job-1",
+			"Job job-1 is blocked: frozen",
+			"REPORT RequestId: 1 Duration: 60000 ms",
+			"START RequestId: 2",
+			"Received event: job-2",
+			"Creating deployment for job-2",
+			"REPORT RequestId: 2 Duration: 5 ms",
+		),
+		"2026/10/18/[$LATEST]b": logLines(2_000_000,
+			"START RequestId: 3",
+			"Received event: job-1",
+			"Successfully created deployment: d-1",
+			"REPORT RequestId: 3 Duration: 800 ms",
+		),
+	}}
+	c, out := testCLI(t, &cli{cloudWatchLogs: fake})
+
+	if err := c.logs(context.Background(), []string{"-function", "arn:aws:lambda:us-east-1:111111111111:function:deploy:live", "-job", "job-1", "-since", "1000000h"}); err != nil {
+		t.Fatalf("logs() returned error: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{"Job job-1 is blocked", "REPORT RequestId: 1", "Successfully created deployment: d-1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "job-2") || strings.Contains(got, "START RequestId") {
+		t.Errorf("output contains lines of other invocations:\n%s", got)
+	}
+	if strings.Index(got, "blocked") > strings.Index(got, "d-1") {
+		t.Errorf("output is not in time order:\n%s", got)
+	}
+}
+
+func TestLambdaLogGroup(t *testing.T) {
+	for function, want := range map[string]string{
+		"deploy": "/aws/lambda/deploy",
+		"arn:aws:lambda:us-east-1:111111111111:function:deploy":      "/aws/lambda/deploy",
+		"arn:aws:lambda:us-east-1:111111111111:function:deploy:live": "/aws/lambda/deploy",
+	} {
+		if got := lambdaLogGroup(function); got != want {
+			t.Errorf("lambdaLogGroup(%s) = %s, want %s", function, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// command is a pipelinectl subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(c *cli, ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"status", "Show the pipeline's stages and the current deployment", (*cli).status},
+	{"deploy", "Start a pipeline execution, or deploy a bundle straight to a group", (*cli).deploy},
+	{"rollback", "Redeploy a deployment group's last known-good revision", (*cli).rollback},
+	{"approve", "Approve or reject the pipeline's waiting manual approval", (*cli).approve},
+	{"logs", "Print the deploy Lambda's logs for a job", (*cli).logs},
+	{"history", "List past deployments from the audit log", (*cli).history},
+	{"local", "Run the deploy handler in process on a CodePipeline event", (*cli).local},
+}
+
+// cli holds the clients the commands act through, so tests can swap in
+// fakes. Results go to out and progress messages to errOut.
+type cli struct {
+	pipeline       pipelineAPI
+	codeDeploy     codeDeployAPI
+	lambda         lambdaAPI
+	cloudWatchLogs logsAPI
+	auditLog       deploy.AuditLogAPI
+
+	// awsConfig is what local runs the deploy handler with
+	awsConfig aws.Config
+
+	out    io.Writer
+	errOut io.Writer
+
+	// pollInterval is how often logs -follow looks for new events
+	pollInterval time.Duration
+}
+
+// pipelinectl is the operator CLI for the deploy pipeline. Deployments and
+// rollbacks go through the deploy Lambda, so they run with its
+// configuration, role and validation.
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "pipelinectl: unknown command %q\n", name)
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	// An interrupt stops logs -follow and abandons waits, not deployments
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	awsCfg, err := deploy.LoadAWSConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pipelinectl: failed to load AWS config: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = cmd.run(newCLI(awsCfg), ctx, os.Args[2:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "pipelinectl %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: pipelinectl <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command takes -output text or -output json.")
+	fmt.Fprintln(w, "Run pipelinectl <command> -h for the flags of a command.")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/30Piraten/pipeline/deploy"
+)
+
+// Output formats
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// commandFlags are a command's flags plus the -output flag they all share
+type commandFlags struct {
+	*flag.FlagSet
+	output string
+}
+
+func newCommandFlags(name string) *commandFlags {
+	f := &commandFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	f.StringVar(&f.output, "output", outputText, "output `format`, text or json")
+	return f
+}
+
+func (f *commandFlags) parse(args []string) error {
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.output != outputText && f.output != outputJSON {
+		return fmt.Errorf("unknown output format %q, expected text or json", f.output)
+	}
+	if f.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", f.Args())
+	}
+	return nil
+}
+
+// functionFlag is the deploy Lambda that deployments and rollbacks run in
+func (f *commandFlags) functionFlag() *string {
+	return f.String("function", os.Getenv("PIPELINE_DEPLOY_FUNCTION"), "deploy Lambda `name` or ARN (default $PIPELINE_DEPLOY_FUNCTION)")
+}
+
+// pipelineFlag is the pipeline a command acts on
+func (f *commandFlags) pipelineFlag() *string {
+	return f.String("pipeline", os.Getenv("PIPELINE_NAME"), "pipeline `name` (default $PIPELINE_NAME)")
+}
+
+// targetFlags fill in the deployment group of a direct invocation
+func (f *commandFlags) targetFlags(ref *deploy.TargetRef) {
+	f.StringVar(&ref.ApplicationName, "app", "", "CodeDeploy application `name`")
+	f.StringVar(&ref.DeploymentGroupName, "group", "", "deployment group `name`")
+	f.StringVar(&ref.Region, "region", "", "region of a group outside the configured targets")
+	f.StringVar(&ref.RoleARN, "role-arn", "", "role to assume for a group in another account")
+	f.StringVar(&ref.ExternalID, "external-id", "", "external ID for the role")
+}
+
+// print writes v as indented JSON, or calls text to describe it for
+// people. text writes to a tabwriter, so tab-separated columns line up.
+func (c *cli) print(format string, v any, text func(w io.Writer)) error {
+	if format == outputJSON {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	text(tw)
+	return tw.Flush()
+}
+
+// progress tells people what a command is waiting for. It never goes to
+// out, so JSON output stays parseable.
+func (c *cli) progress(format string, args ...any) {
+	fmt.Fprintf(c.errOut, format+"\n", args...)
+}
+
+// formatTime prints times in UTC, or "-" when unknown
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
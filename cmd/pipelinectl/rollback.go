@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/30Piraten/pipeline/deploy"
+)
+
+// rollback asks the deploy Lambda to roll a group back and waits for the
+// rollback deployment to finish
+func (c *cli) rollback(ctx context.Context, args []string) error {
+	flags := newCommandFlags("rollback")
+	function := flags.functionFlag()
+	var req deploy.RollbackRequest
+	flags.targetFlags(&req.TargetRef)
+	flags.StringVar(&req.DeploymentID, "deployment-id", "", "bad deployment to roll back from (default the group's last successful deployment)")
+	flags.StringVar(&req.Reason, "reason", "", "why the group is rolled back, kept in the audit log")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	if *function == "" {
+		return errors.New("rollback needs -function or PIPELINE_DEPLOY_FUNCTION")
+	}
+	if req.ApplicationName == "" || req.DeploymentGroupName == "" {
+		return errors.New("rollback needs -app and -group")
+	}
+
+	c.progress("Rolling back %s/%s through %s...", req.ApplicationName, req.DeploymentGroupName, *function)
+	var report deploy.DeploymentReport
+	if err := c.invokeDeployFunction(ctx, *function, deploy.DirectInvocation{Action: "rollback", Rollback: &req}, &report); err != nil {
+		return fmt.Errorf("rollback failed: %v", err)
+	}
+	if report.Rollback == nil {
+		return fmt.Errorf("rollback failed: %s returned no rollback report", *function)
+	}
+
+	return c.print(flags.output, report, func(w io.Writer) {
+		fmt.Fprintf(w, "Rolled back %s/%s from deployment %s to the revision of %s in deployment %s\n",
+			req.ApplicationName, req.DeploymentGroupName, report.Rollback.FromDeploymentID, report.Rollback.ToDeploymentID, report.DeploymentID)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/30Piraten/pipeline/deploy"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+func TestRollback(t *testing.T) {
+	fake := &fakeLambda{output: &lambda.InvokeOutput{Payload: []byte(`{"jobId": "rollback-d-4-d-2", "deploymentId": "d-6",
+		"rollback": {"fromDeploymentId": "d-4", "toDeploymentId": "d-2"}}`)}}
+	c, out := testCLI(t, &cli{lambda: fake})
+
+	args := []string{"-function", "deploy", "-app", "api", "-group", "api-live", "-reason", "INC-7"}
+	if err := c.rollback(context.Background(), args); err != nil {
+		t.Fatalf("rollback() returned error: %v", err)
+	}
+
+	var sent deploy.DirectInvocation
+	if err := json.Unmarshal(fake.payloads[0], &sent); err != nil || sent.Action != "rollback" {
+		t.Fatalf("payload %s is not a rollback invocation", fake.payloads[0])
+	}
+	if sent.Rollback.ApplicationName != "api" || sent.Rollback.DeploymentGroupName != "api-live" || sent.Rollback.Reason != "INC-7" {
+		t.Errorf("rollback request = %+v", sent.Rollback)
+	}
+	if !strings.Contains(out.String(), "from deployment d-4 to the revision of d-2 in deployment d-6") {
+		t.Errorf("output %q does not describe the rollback", out.String())
+	}
+}
+
+func TestRollbackReportsFunctionError(t *testing.T) {
+	fake := &fakeLambda{output: &lambda.InvokeOutput{
+		FunctionError: aws.String("Unhandled"),
+		Payload:       []byte(`{"errorMessage": "no successful deployment of api/api-live before d-1 has a different revision"}`),
+	}}
+	c, _ := testCLI(t, &cli{lambda: fake})
+
+	err := c.rollback(context.Background(), []string{"-function", "deploy", "-app", "api", "-group", "api-live"})
+	if err == nil || !strings.Contains(err.Error(), "no successful deployment") {
+		t.Errorf("rollback() = %v, want the function's error message", err)
+	}
+
+	if err := c.rollback(context.Background(), []string{"-function", "deploy", "-app", "api"}); err == nil {
+		t.Error("rollback() without -group returned no error")
+	}
+}
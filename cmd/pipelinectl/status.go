@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	pipelinetypes "github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+)
+
+// The deploy Lambda reports its CodeDeploy deployment as the action's
+// external execution ID
+var deploymentIDPattern = regexp.MustCompile(`^d-[A-Z0-9]{9}$`)
+
+// Deployment statuses that mean the deployment has not finished
+var activeDeploymentStatuses = []types.DeploymentStatus{
+	types.DeploymentStatusCreated,
+	types.DeploymentStatusQueued,
+	types.DeploymentStatusInProgress,
+	types.DeploymentStatusBaking,
+	types.DeploymentStatusReady,
+}
+
+// statusResult is what status prints
+type statusResult struct {
+	Pipeline   string            `json:"pipeline,omitempty"`
+	Stages     []stageStatus     `json:"stages,omitempty"`
+	Deployment *deploymentStatus `json:"deployment,omitempty"`
+}
+
+type stageStatus struct {
+	Name        string         `json:"name"`
+	Status      string         `json:"status,omitempty"`
+	ExecutionID string         `json:"executionId,omitempty"`
+	Actions     []actionStatus `json:"actions"`
+}
+
+type actionStatus struct {
+	Name                string     `json:"name"`
+	Status              string     `json:"status,omitempty"`
+	Summary             string     `json:"summary,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	ExternalExecutionID string     `json:"externalExecutionId,omitempty"`
+	LastChange          *time.Time `json:"lastChange,omitempty"`
+}
+
+type deploymentStatus struct {
+	DeploymentID        string          `json:"deploymentId"`
+	ApplicationName     string          `json:"applicationName"`
+	DeploymentGroupName string          `json:"deploymentGroupName"`
+	Status              string          `json:"status"`
+	Description         string          `json:"description,omitempty"`
+	Error               string          `json:"error,omitempty"`
+	Instances           *instanceCounts `json:"instances,omitempty"`
+	CreateTime          *time.Time      `json:"createTime,omitempty"`
+	CompleteTime        *time.Time      `json:"completeTime,omitempty"`
+}
+
+type instanceCounts struct {
+	Pending    int64 `json:"pending"`
+	InProgress int64 `json:"inProgress"`
+	Succeeded  int64 `json:"succeeded"`
+	Failed     int64 `json:"failed"`
+	Skipped    int64 `json:"skipped"`
+}
+
+// status shows where the pipeline's last execution is, and the deployment
+// the pipeline, or the given group, is running or last ran
+func (c *cli) status(ctx context.Context, args []string) error {
+	flags := newCommandFlags("status")
+	pipeline := flags.pipelineFlag()
+	app := flags.String("app", "", "CodeDeploy application `name` whose current deployment to show")
+	group := flags.String("group", "", "deployment group `name` whose current deployment to show")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	if (*app == "") != (*group == "") {
+		return errors.New("-app and -group go together")
+	}
+	if *pipeline == "" && *app == "" {
+		return errors.New("status needs -pipeline or PIPELINE_NAME, or -app and -group")
+	}
+
+	result := statusResult{Pipeline: *pipeline}
+	var deploymentID string
+	if *pipeline != "" {
+		state, err := c.pipeline.GetPipelineState(ctx, &codepipeline.GetPipelineStateInput{Name: aws.String(*pipeline)})
+		if err != nil {
+			return fmt.Errorf("failed to get the state of pipeline %s: %v", *pipeline, err)
+		}
+		result.Stages = stageStatuses(state.StageStates)
+		deploymentID = lastDeploymentID(result.Stages)
+	}
+	if *app != "" {
+		id, err := c.currentDeployment(ctx, *app, *group)
+		if err != nil {
+			return err
+		}
+		deploymentID = id
+	}
+
+	if deploymentID != "" {
+		output, err := c.codeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{DeploymentId: aws.String(deploymentID)})
+		if err != nil {
+			return fmt.Errorf("failed to get deployment %s: %v", deploymentID, err)
+		}
+		result.Deployment = newDeploymentStatus(output.DeploymentInfo)
+	}
+
+	return c.print(flags.output, result, result.writeText)
+}
+
+func stageStatuses(states []pipelinetypes.StageState) []stageStatus {
+	stages := make([]stageStatus, 0, len(states))
+	for _, state := range states {
+		stage := stageStatus{Name: aws.ToString(state.StageName), Actions: []actionStatus{}}
+		if state.LatestExecution != nil {
+			stage.Status = string(state.LatestExecution.Status)
+			stage.ExecutionID = aws.ToString(state.LatestExecution.PipelineExecutionId)
+		}
+		for _, a := range state.ActionStates {
+			action := actionStatus{Name: aws.ToString(a.ActionName)}
+			if e := a.LatestExecution; e != nil {
+				action.Status = string(e.Status)
+				action.Summary = aws.ToString(e.Summary)
+				action.ExternalExecutionID = aws.ToString(e.ExternalExecutionId)
+				action.LastChange = e.LastStatusChange
+				if e.ErrorDetails != nil {
+					action.Error = aws.ToString(e.ErrorDetails.Message)
+				}
+			}
+			stage.Actions = append(stage.Actions, action)
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// lastDeploymentID finds the most recent deployment an action reported
+func lastDeploymentID(stages []stageStatus) string {
+	var id string
+	var latest time.Time
+	for _, stage := range stages {
+		for _, action := range stage.Actions {
+			if !deploymentIDPattern.MatchString(action.ExternalExecutionID) {
+				continue
+			}
+			if id == "" || aws.ToTime(action.LastChange).After(latest) {
+				id = action.ExternalExecutionID
+				latest = aws.ToTime(action.LastChange)
+			}
+		}
+	}
+	return id
+}
+
+// currentDeployment is the group's unfinished deployment, or else its last
+// attempted one. It is empty for a group that never deployed.
+func (c *cli) currentDeployment(ctx context.Context, app, group string) (string, error) {
+	active, err := c.codeDeploy.ListDeployments(ctx, &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String(app),
+		DeploymentGroupName: aws.String(group),
+		IncludeOnlyStatuses: activeDeploymentStatuses,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list deployments of %s/%s: %v", app, group, err)
+	}
+	if len(active.Deployments) > 0 {
+		return active.Deployments[0], nil
+	}
+
+	output, err := c.codeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(app),
+		DeploymentGroupName: aws.String(group),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment group %s/%s: %v", app, group, err)
+	}
+	if last := output.DeploymentGroupInfo.LastAttemptedDeployment; last != nil {
+		return aws.ToString(last.DeploymentId), nil
+	}
+	return "", nil
+}
+
+func newDeploymentStatus(info *types.DeploymentInfo) *deploymentStatus {
+	status := &deploymentStatus{
+		DeploymentID:        aws.ToString(info.DeploymentId),
+		ApplicationName:     aws.ToString(info.ApplicationName),
+		DeploymentGroupName: aws.ToString(info.DeploymentGroupName),
+		Status:              string(info.Status),
+		Description:         aws.ToString(info.Description),
+		CreateTime:          info.CreateTime,
+		CompleteTime:        info.CompleteTime,
+	}
+	if info.ErrorInformation != nil {
+		status.Error = aws.ToString(info.ErrorInformation.Message)
+	}
+	if o := info.DeploymentOverview; o != nil {
+		status.Instances = &instanceCounts{
+			Pending:    o.Pending,
+			InProgress: o.InProgress,
+			Succeeded:  o.Succeeded,
+			Failed:     o.Failed,
+			Skipped:    o.Skipped,
+		}
+	}
+	return status
+}
+
+func (r statusResult) writeText(w io.Writer) {
+	if r.Pipeline != "" {
+		fmt.Fprintf(w, "Pipeline %s\n", r.Pipeline)
+		fmt.Fprintln(w, "STAGE\tACTION\tSTATUS\tLAST CHANGE\tSUMMARY")
+		for _, stage := range r.Stages {
+			for _, action := range stage.Actions {
+				summary := action.Summary
+				if action.Error != "" {
+					summary = action.Error
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", stage.Name, action.Name, orDash(action.Status), formatTime(action.LastChange), summary)
+			}
+		}
+	}
+
+	d := r.Deployment
+	if d == nil {
+		if r.Pipeline == "" {
+			fmt.Fprintln(w, "No deployments")
+		}
+		return
+	}
+	if r.Pipeline != "" {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Deployment %s to %s/%s: %s\n", d.DeploymentID, d.ApplicationName, d.DeploymentGroupName, d.Status)
+	fmt.Fprintf(w, "Started:\t%s\n", formatTime(d.CreateTime))
+	if d.CompleteTime != nil {
+		fmt.Fprintf(w, "Completed:\t%s\n", formatTime(d.CompleteTime))
+	}
+	if i := d.Instances; i != nil {
+		fmt.Fprintf(w, "Instances:\t%d pending, %d in progress, %d succeeded, %d failed, %d skipped\n",
+			i.Pending, i.InProgress, i.Succeeded, i.Failed, i.Skipped)
+	}
+	if d.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", d.Error)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
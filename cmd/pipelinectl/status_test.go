@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	pipelinetypes "github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+)
+
+func testPipelineState() *codepipeline.GetPipelineStateOutput {
+	at := func(minutes int) *time.Time {
+		t := time.Date(2026, 10, 18, 12, minutes, 0, 0, time.UTC)
+		return &t
+	}
+	action := func(name string, status pipelinetypes.ActionExecutionStatus, externalID string, changed *time.Time) pipelinetypes.ActionState {
+		return pipelinetypes.ActionState{
+			ActionName: aws.String(name),
+			LatestExecution: &pipelinetypes.ActionExecution{
+				Status:              status,
+				ExternalExecutionId: aws.String(externalID),
+				LastStatusChange:    changed,
+			},
+		}
+	}
+	return &codepipeline.GetPipelineStateOutput{StageStates: []pipelinetypes.StageState{
+		{
+			StageName:    aws.String("Build"),
+			ActionStates: []pipelinetypes.ActionState{action("Build", pipelinetypes.ActionExecutionStatusSucceeded, "build:1234", at(0))},
+		},
+		{
+			StageName: aws.String("Deploy"),
+			LatestExecution: &pipelinetypes.StageExecution{
+				Status:              pipelinetypes.StageExecutionStatusInProgress,
+				PipelineExecutionId: aws.String("exec-9"),
+			},
+			ActionStates: []pipelinetypes.ActionState{
+				action("Staging", pipelinetypes.ActionExecutionStatusSucceeded, "d-STAGING01", at(10)),
+				action("Production", pipelinetypes.ActionExecutionStatusSucceeded, "d-PRODUCT01", at(20)),
+			},
+		},
+	}}
+}
+
+func TestStatus(t *testing.T) {
+	cd := &fakeCodeDeploy{deployments: map[string]*types.DeploymentInfo{
+		"d-PRODUCT01": {
+			DeploymentId:        aws.String("d-PRODUCT01"),
+			ApplicationName:     aws.String("api"),
+			DeploymentGroupName: aws.String("api-live"),
+			Status:              types.DeploymentStatusInProgress,
+			DeploymentOverview:  &types.DeploymentOverview{Pending: 2, InProgress: 1, Succeeded: 3},
+		},
+	}}
+	c, out := testCLI(t, &cli{pipeline: &fakePipeline{state: testPipelineState()}, codeDeploy: cd})
+
+	if err := c.status(context.Background(), []string{"-pipeline", "web"}); err != nil {
+		t.Fatalf("status() returned error: %v", err)
+	}
+	for _, want := range []string{
+		"Pipeline web",
+		"Deploy  Production  Succeeded",
+		"Deployment d-PRODUCT01 to api/api-live: InProgress",
+		"2 pending, 1 in progress, 3 succeeded",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	out.Reset()
+	if err := c.status(context.Background(), []string{"-pipeline", "web", "-output", "json"}); err != nil {
+		t.Fatalf("status() returned error: %v", err)
+	}
+	var result statusResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("output is not JSON: %v", err)
+	}
+	if len(result.Stages) != 2 || result.Stages[1].ExecutionID != "exec-9" || result.Deployment.DeploymentID != "d-PRODUCT01" {
+		t.Errorf("status = %+v", result)
+	}
+}
+
+func TestStatusOfGroup(t *testing.T) {
+	cd := &fakeCodeDeploy{
+		group: &types.DeploymentGroupInfo{LastAttemptedDeployment: &types.LastDeploymentInfo{DeploymentId: aws.String("d-LAST00001")}},
+		deployments: map[string]*types.DeploymentInfo{
+			"d-LAST00001": {DeploymentId: aws.String("d-LAST00001"), Status: types.DeploymentStatusFailed,
+				ErrorInformation: &types.ErrorInformation{Message: aws.String("health check failed")}},
+		},
+	}
+	c, out := testCLI(t, &cli{codeDeploy: cd})
+
+	if err := c.status(context.Background(), []string{"-app", "api", "-group", "api-live"}); err != nil {
+		t.Fatalf("status() returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "d-LAST00001") || !strings.Contains(out.String(), "health check failed") {
+		t.Errorf("output does not show the last attempted deployment:\n%s", out)
+	}
+
+	if err := c.status(context.Background(), []string{"-app", "api"}); err == nil {
+		t.Error("status() with -app but no -group returned no error")
+	}
+}
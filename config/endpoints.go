@@ -0,0 +1,93 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Static credentials for local stand-ins for AWS, which accept any key
+const (
+	LocalAccessKeyID     = "test"
+	LocalSecretAccessKey = "test"
+)
+
+// Endpoints sends the AWS clients to a local stand-in for AWS, such as
+// LocalStack or moto server, instead of the real service endpoints. The
+// variables are the SDK's own, so the AWS CLI and the clients agree.
+type Endpoints struct {
+	// URL is AWS_ENDPOINT_URL, the endpoint of every service
+	URL string
+
+	// Services holds the AWS_ENDPOINT_URL_<SERVICE> overrides, such as
+	// AWS_ENDPOINT_URL_S3, by variable name
+	Services map[string]string
+
+	// S3UsePathStyle addresses buckets as <endpoint>/<bucket>/<key>, since
+	// emulators do not serve bucket subdomains. It is AWS_S3_USE_PATH_STYLE,
+	// and defaults to on when S3 has an endpoint override.
+	S3UsePathStyle bool
+
+	// StaticCredentials is set when every service goes to the stand-in
+	// and no AWS_ACCESS_KEY_ID is set. We then sign with the test keys
+	// rather than look for real credentials to send to an emulator.
+	StaticCredentials bool
+}
+
+// Enabled reports whether any client has an endpoint override
+func (e Endpoints) Enabled() bool {
+	return e.URL != "" || len(e.Services) > 0
+}
+
+// String lists the overrides for logs
+func (e Endpoints) String() string {
+	var overrides []string
+	for name, endpoint := range e.Services {
+		overrides = append(overrides, strings.TrimPrefix(name, "AWS_ENDPOINT_URL_")+": "+endpoint)
+	}
+	sort.Strings(overrides)
+	if e.URL != "" {
+		overrides = append([]string{"all services: " + e.URL}, overrides...)
+	}
+	return strings.Join(overrides, ", ")
+}
+
+// LoadEndpoints reads the endpoint overrides from the environment
+func LoadEndpoints() (Endpoints, error) {
+	l := &loader{}
+	e := Endpoints{
+		URL:      l.endpoint("AWS_ENDPOINT_URL"),
+		Services: map[string]string{},
+	}
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, "AWS_ENDPOINT_URL_") {
+			if endpoint := l.endpoint(name); endpoint != "" {
+				e.Services[name] = endpoint
+			}
+		}
+	}
+
+	e.S3UsePathStyle = l.boolean("AWS_S3_USE_PATH_STYLE", e.URL != "" || e.Services["AWS_ENDPOINT_URL_S3"] != "")
+	e.StaticCredentials = e.URL != "" && os.Getenv("AWS_ACCESS_KEY_ID") == ""
+
+	if err := l.err(); err != nil {
+		return Endpoints{}, err
+	}
+	return e, nil
+}
+
+// endpoint reads an absolute http or https URL
+func (l *loader) endpoint(key string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.fail("%s must be an http or https URL, got %q", key, value)
+		return ""
+	}
+	return value
+}
@@ -1,14 +1,436 @@
 package config
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func CheckEnv(key string) string {
+// Config is the deploy Lambda's configuration, read from the environment
+// once per cold start and validated as a whole
+type Config struct {
+	ApplicationName         string
+	DeploymentGroupName     string
+	GitHubTokenSecretARN    string
+	GitHubTokenSecretKey    string
+	GitHubTokenVersionStage string
+	SecretsCacheTTL         time.Duration
+	MaxDeploymentWaitTime   time.Duration
+	HealthCheckURL          string
+	AppHealthCheckURL       string
+	SkipUnchangedRevisions  bool
+	Retry                   RetryConfig
+
+	// HealthCheckLambda and AppHealthCheckLambda invoke a function for
+	// targets without a URL to check, such as a Lambda alias
+	HealthCheckLambda    *LambdaHealthCheck
+	AppHealthCheckLambda *LambdaHealthCheck
+
+	// DeploymentMappingLocation points at a document mapping pipelines to
+	// targets (s3://bucket/key or ssm:/name). When it is set, the
+	// application and deployment group come from the mapping instead.
+	DeploymentMappingLocation string
+	DeploymentMappingTTL      time.Duration
+
+	// The single target may live in another region or account, reached
+	// by assuming TargetRoleARN. See the deploy Lambda's deploymentTarget.
+	TargetRegion         string
+	TargetRoleARN        string
+	TargetExternalID     string
+	TargetArtifactBucket string
+
+	// DeploymentPlatform is "ecs" for an ECS blue/green group, which also
+	// needs the container that receives traffic
+	DeploymentPlatform string
+	ECSContainerName   string
+	ECSContainerPort   int
+
+	// MinHealthyHosts is a floor on the hosts of a server deployment that
+	// have not failed, given as a count ("2") or a percentage ("75%")
+	MinHealthyHosts MinHealthyHosts
+
+	// WavePlan is a JSON wave plan that deploys to several groups. Like
+	// the mapping, it replaces the single application and group.
+	WavePlan string
+
+	// The change calendar blocks deployments during freezes. It is given
+	// inline as JSON or read from ChangeCalendarLocation (s3://bucket/key
+	// or ssm:/name). With FreezeWait, a job waits for a freeze that ends
+	// within FreezeMaxWait instead of failing.
+	ChangeCalendar         string
+	ChangeCalendarLocation string
+	ChangeCalendarTTL      time.Duration
+	FreezeWait             bool
+	FreezeMaxWait          time.Duration
+
+	// The deployment policy is a set of rules checked before every
+	// deployment. It is given inline as JSON or YAML or read from
+	// DeploymentPolicyLocation (s3://bucket/key or ssm:/name).
+	DeploymentPolicy         string
+	DeploymentPolicyLocation string
+	DeploymentPolicyTTL      time.Duration
+
+	// DeploymentLockLocation is an s3://bucket/prefix that holds a lease
+	// per deployment group, so pipelines sharing a group take turns. A
+	// lease lasts DeploymentLockTTL unless renewed, and a job waits up to
+	// DeploymentLockWait for a lease held by another job.
+	DeploymentLockLocation string
+	DeploymentLockTTL      time.Duration
+	DeploymentLockWait     time.Duration
+
+	// AuditLogLocation is an s3://bucket/prefix that gets one record per
+	// job, partitioned by date
+	AuditLogLocation string
+
+	// DiagnosticsLocation is an s3://bucket/prefix that gets the
+	// diagnostic bundle of every failed deployment
+	DiagnosticsLocation string
+
+	// The notification webhook gets a JSON message for every CodeDeploy
+	// deployment state-change event in NotificationStates, such as
+	// FAILURE or STOP, that EventBridge delivers to the function. Its URL
+	// carries a credential, so it is read from the secret
+	// NotificationSecretARN, or from its NotificationSecretKey field.
+	NotificationSecretARN string
+	NotificationSecretKey string
+	NotificationStates    []string
+
+	// DryRun makes every job report its deployment plan instead of
+	// deploying, e.g. to review a routing change before it goes live
+	DryRun bool
+}
+
+// MinHealthyHosts mirrors CodeDeploy's HOST_COUNT and FLEET_PERCENT types.
+// An empty Type means there is no floor.
+type MinHealthyHosts struct {
+	Type  string
+	Value int
+}
+
+// LambdaHealthCheck is a health check that invokes a function, alias or
+// version with Payload and asserts on the response. It is read from JSON
+// such as {"functionName":"app","qualifier":"Live","expectStatusCode":200}.
+// By default the invocation must succeed without a function error.
+type LambdaHealthCheck struct {
+	FunctionName string          `json:"functionName"`
+	Qualifier    string          `json:"qualifier,omitempty"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+
+	// ExpectStatusCode is matched against the statusCode of the response,
+	// as returned by API Gateway style handlers
+	ExpectStatusCode int `json:"expectStatusCode,omitempty"`
+
+	// ExpectFields are values the response body must contain, keyed by
+	// dotted path such as "checks.database". A body that is itself a JSON
+	// string, as in API Gateway responses, is decoded first.
+	ExpectFields map[string]any `json:"expectFields,omitempty"`
+
+	// ExpectResponseContains must appear in the raw response
+	ExpectResponseContains string `json:"expectResponseContains,omitempty"`
+
+	// ExpectError instead expects a function error whose message contains
+	// it, for targets that reject the payload. It cannot be combined with
+	// the other assertions.
+	ExpectError string `json:"expectError,omitempty"`
+}
+
+// RetryConfig configures the handler's own retry loops
+type RetryConfig struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Load reads and validates the configuration. Every problem is collected,
+// so a misconfigured function reports all of them in a single error.
+func Load() (*Config, error) {
+	l := &loader{}
+
+	mappingLocation := os.Getenv("DEPLOYMENT_MAPPING_LOCATION")
+	wavePlan := strings.TrimSpace(os.Getenv("WAVE_PLAN"))
+	target := l.required
+	if mappingLocation != "" || wavePlan != "" {
+		target = l.optional
+	}
+
+	cfg := &Config{
+		ApplicationName:         target("APPLICATION_NAME"),
+		DeploymentGroupName:     target("DEPLOYMENT_GROUP_NAME"),
+		GitHubTokenSecretARN:    os.Getenv("GITHUB_TOKEN"),
+		GitHubTokenSecretKey:    os.Getenv("GITHUB_TOKEN_SECRET_KEY"),
+		GitHubTokenVersionStage: os.Getenv("GITHUB_TOKEN_VERSION_STAGE"),
+		SecretsCacheTTL:         l.duration("SECRETS_CACHE_TTL", 5*time.Minute),
+		MaxDeploymentWaitTime:   l.seconds("MAX_DEPLOYMENT_WAIT_TIME", 600*time.Second),
+		HealthCheckURL:          l.url("HEALTH_CHECK_URL"),
+		AppHealthCheckURL:       l.url("APP_HEALTH_CHECK_URL"),
+		SkipUnchangedRevisions:  l.boolean("SKIP_UNCHANGED_REVISIONS", false),
+		HealthCheckLambda:       l.lambdaHealthCheck("HEALTH_CHECK_LAMBDA"),
+		AppHealthCheckLambda:    l.lambdaHealthCheck("APP_HEALTH_CHECK_LAMBDA"),
+		Retry: RetryConfig{
+			MaxAttempts: l.positiveInt("RETRY_MAX_ATTEMPTS", 3),
+			BaseDelay:   l.duration("RETRY_BASE_DELAY", 2*time.Second),
+			MaxDelay:    l.duration("RETRY_MAX_DELAY", 30*time.Second),
+		},
+		DeploymentMappingLocation: mappingLocation,
+		DeploymentMappingTTL:      l.duration("DEPLOYMENT_MAPPING_TTL", 5*time.Minute),
+		TargetRegion:              os.Getenv("TARGET_REGION"),
+		TargetRoleARN:             os.Getenv("TARGET_ROLE_ARN"),
+		TargetExternalID:          os.Getenv("TARGET_EXTERNAL_ID"),
+		TargetArtifactBucket:      os.Getenv("TARGET_ARTIFACT_BUCKET"),
+		DeploymentPlatform:        os.Getenv("DEPLOYMENT_PLATFORM"),
+		ECSContainerName:          os.Getenv("ECS_CONTAINER_NAME"),
+		ECSContainerPort:          l.positiveInt("ECS_CONTAINER_PORT", 0),
+		MinHealthyHosts:           l.minHealthyHosts("MIN_HEALTHY_HOSTS"),
+		WavePlan:                  wavePlan,
+		ChangeCalendar:            strings.TrimSpace(os.Getenv("CHANGE_CALENDAR")),
+		ChangeCalendarLocation:    os.Getenv("CHANGE_CALENDAR_LOCATION"),
+		ChangeCalendarTTL:         l.duration("CHANGE_CALENDAR_TTL", 5*time.Minute),
+		FreezeWait:                l.boolean("FREEZE_WAIT", false),
+		FreezeMaxWait:             l.duration("FREEZE_MAX_WAIT", time.Hour),
+		DeploymentPolicy:          strings.TrimSpace(os.Getenv("DEPLOYMENT_POLICY")),
+		DeploymentPolicyLocation:  os.Getenv("DEPLOYMENT_POLICY_LOCATION"),
+		DeploymentPolicyTTL:       l.duration("DEPLOYMENT_POLICY_TTL", 5*time.Minute),
+		DeploymentLockLocation:    os.Getenv("DEPLOYMENT_LOCK_LOCATION"),
+		DeploymentLockTTL:         l.duration("DEPLOYMENT_LOCK_TTL", 5*time.Minute),
+		DeploymentLockWait:        l.duration("DEPLOYMENT_LOCK_WAIT", 0),
+		AuditLogLocation:          os.Getenv("AUDIT_LOG_LOCATION"),
+		DiagnosticsLocation:       os.Getenv("DIAGNOSTICS_LOCATION"),
+		NotificationSecretARN:     os.Getenv("NOTIFICATION_WEBHOOK_SECRET"),
+		NotificationSecretKey:     os.Getenv("NOTIFICATION_WEBHOOK_SECRET_KEY"),
+		NotificationStates:        l.deploymentStates("NOTIFICATION_STATES", []string{"SUCCESS", "FAILURE", "STOP"}),
+		DryRun:                    l.boolean("DRY_RUN", false),
+	}
+
+	if mappingLocation != "" && !strings.HasPrefix(mappingLocation, "s3://") && !strings.HasPrefix(mappingLocation, "ssm:") {
+		l.fail("DEPLOYMENT_MAPPING_LOCATION must start with s3:// or ssm:, got %q", mappingLocation)
+	}
+
+	if cfg.ChangeCalendar != "" && cfg.ChangeCalendarLocation != "" {
+		l.fail("CHANGE_CALENDAR and CHANGE_CALENDAR_LOCATION cannot both be set")
+	}
+	if cfg.ChangeCalendar != "" && !json.Valid([]byte(cfg.ChangeCalendar)) {
+		l.fail("CHANGE_CALENDAR must be valid JSON")
+	}
+	if loc := cfg.ChangeCalendarLocation; loc != "" && !strings.HasPrefix(loc, "s3://") && !strings.HasPrefix(loc, "ssm:") {
+		l.fail("CHANGE_CALENDAR_LOCATION must start with s3:// or ssm:, got %q", loc)
+	}
+
+	if cfg.DeploymentPolicy != "" && cfg.DeploymentPolicyLocation != "" {
+		l.fail("DEPLOYMENT_POLICY and DEPLOYMENT_POLICY_LOCATION cannot both be set")
+	}
+	if loc := cfg.DeploymentPolicyLocation; loc != "" && !strings.HasPrefix(loc, "s3://") && !strings.HasPrefix(loc, "ssm:") {
+		l.fail("DEPLOYMENT_POLICY_LOCATION must start with s3:// or ssm:, got %q", loc)
+	}
+
+	if loc := cfg.DeploymentLockLocation; loc != "" && (!strings.HasPrefix(loc, "s3://") || strings.TrimPrefix(loc, "s3://") == "") {
+		l.fail("DEPLOYMENT_LOCK_LOCATION must be an s3://bucket/prefix location, got %q", loc)
+	}
+
+	if loc := cfg.AuditLogLocation; loc != "" && (!strings.HasPrefix(loc, "s3://") || strings.TrimPrefix(loc, "s3://") == "") {
+		l.fail("AUDIT_LOG_LOCATION must be an s3://bucket/prefix location, got %q", loc)
+	}
+	if loc := cfg.DiagnosticsLocation; loc != "" && (!strings.HasPrefix(loc, "s3://") || strings.TrimPrefix(loc, "s3://") == "") {
+		l.fail("DIAGNOSTICS_LOCATION must be an s3://bucket/prefix location, got %q", loc)
+	}
+
+	if os.Getenv("NOTIFICATION_WEBHOOK_URL") != "" {
+		l.fail("NOTIFICATION_WEBHOOK_URL is no longer read, store the URL in a secret named by NOTIFICATION_WEBHOOK_SECRET")
+	}
+	if cfg.NotificationSecretKey != "" && cfg.NotificationSecretARN == "" {
+		l.fail("NOTIFICATION_WEBHOOK_SECRET_KEY requires NOTIFICATION_WEBHOOK_SECRET")
+	}
+
+	if cfg.TargetRoleARN != "" && !strings.HasPrefix(cfg.TargetRoleARN, "arn:") {
+		l.fail("TARGET_ROLE_ARN must be an IAM role ARN, got %q", cfg.TargetRoleARN)
+	}
+	if cfg.TargetExternalID != "" && cfg.TargetRoleARN == "" {
+		l.fail("TARGET_EXTERNAL_ID requires TARGET_ROLE_ARN")
+	}
+	if cfg.TargetRoleARN != "" && cfg.TargetArtifactBucket == "" && cfg.DeploymentPlatform != "ecs" {
+		l.fail("TARGET_ROLE_ARN requires TARGET_ARTIFACT_BUCKET, a bucket the target account can read")
+	}
+
+	switch cfg.DeploymentPlatform {
+	case "":
+	case "ecs":
+		if cfg.ECSContainerName == "" || cfg.ECSContainerPort == 0 {
+			l.fail("DEPLOYMENT_PLATFORM=ecs requires ECS_CONTAINER_NAME and ECS_CONTAINER_PORT")
+		}
+	default:
+		l.fail("DEPLOYMENT_PLATFORM must be empty or ecs, got %q", cfg.DeploymentPlatform)
+	}
+
+	if cfg.Retry.MaxDelay < cfg.Retry.BaseDelay {
+		l.fail("RETRY_MAX_DELAY (%s) must not be less than RETRY_BASE_DELAY (%s)", cfg.Retry.MaxDelay, cfg.Retry.BaseDelay)
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loader collects validation errors while reading variables
+type loader struct {
+	errs []error
+}
+
+func (l *loader) fail(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf(format, args...))
+}
+
+func (l *loader) err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %w", errors.Join(l.errs...))
+}
+
+func (l *loader) required(key string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		l.fail("%s environment variable is required", key)
+	}
+	return value
+}
+
+func (l *loader) optional(key string) string {
+	return strings.TrimSpace(os.Getenv(key))
+}
+
+// seconds accepts either a whole number of seconds or a Go duration
+func (l *loader) seconds(key string, def time.Duration) time.Duration {
 	value := os.Getenv(key)
 	if value == "" {
-		log.Fatalf("WARNING: %s environment variable is required!", key)
+		return def
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n <= 0 {
+			l.fail("%s must be positive, got %s", key, value)
+			return def
+		}
+		return time.Duration(n) * time.Second
+	}
+	return l.duration(key, def)
+}
+
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		l.fail("%s must be a positive duration such as 30s, got %q", key, value)
+		return def
+	}
+	return d
+}
+
+func (l *loader) positiveInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		l.fail("%s must be a positive integer, got %q", key, value)
+		return def
+	}
+	return n
+}
+
+func (l *loader) boolean(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.fail("%s must be true or false, got %q", key, value)
+		return def
+	}
+	return b
+}
+
+// deploymentStates reads a comma-separated list of the states in CodeDeploy's
+// deployment state-change events
+func (l *loader) deploymentStates(key string, def []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	var states []string
+	for _, state := range strings.Split(value, ",") {
+		state = strings.ToUpper(strings.TrimSpace(state))
+		switch state {
+		case "START", "SUCCESS", "FAILURE", "STOP", "READY":
+			states = append(states, state)
+		default:
+			l.fail("%s must list START, SUCCESS, FAILURE, STOP or READY, got %q", key, state)
+		}
+	}
+	return states
+}
+
+// minHealthyHosts reads a host count such as "2" or a fleet percentage such as "75%"
+func (l *loader) minHealthyHosts(key string) MinHealthyHosts {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return MinHealthyHosts{}
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		n, err := strconv.Atoi(percent)
+		if err != nil || n < 0 || n > 100 {
+			l.fail("%s must be a percentage between 0%% and 100%%, got %q", key, value)
+			return MinHealthyHosts{}
+		}
+		return MinHealthyHosts{Type: "FLEET_PERCENT", Value: n}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		l.fail("%s must be a host count or a percentage such as 75%%, got %q", key, value)
+		return MinHealthyHosts{}
+	}
+	return MinHealthyHosts{Type: "HOST_COUNT", Value: n}
+}
+
+// url accepts an empty value, since health checks are optional
+func (l *loader) url(key string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return ""
+	}
+	u, err := url.ParseRequestURI(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.fail("%s must be an http or https URL, got %q", key, value)
+		return ""
 	}
 	return value
 }
+
+// lambdaHealthCheck reads an optional Lambda health check from JSON
+func (l *loader) lambdaHealthCheck(key string) *LambdaHealthCheck {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return nil
+	}
+
+	var check LambdaHealthCheck
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&check); err != nil {
+		l.fail("%s must be a Lambda health check: %v", key, err)
+		return nil
+	}
+	if check.FunctionName == "" {
+		l.fail("%s must name a functionName", key)
+		return nil
+	}
+	return &check
+}
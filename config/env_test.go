@@ -0,0 +1,122 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv("APPLICATION_NAME", "app")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "group")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+
+	if cfg.MaxDeploymentWaitTime != 600*time.Second {
+		t.Errorf("MaxDeploymentWaitTime = %v, want 10m", cfg.MaxDeploymentWaitTime)
+	}
+	if cfg.Retry.MaxAttempts != 3 || cfg.Retry.BaseDelay != 2*time.Second || cfg.Retry.MaxDelay != 30*time.Second {
+		t.Errorf("Retry = %+v, want default policy", cfg.Retry)
+	}
+}
+
+func TestLoadCollectsAllErrors(t *testing.T) {
+	t.Setenv("APPLICATION_NAME", "")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "group")
+	t.Setenv("MAX_DEPLOYMENT_WAIT_TIME", "-5")
+	t.Setenv("HEALTH_CHECK_URL", "not a url")
+	t.Setenv("RETRY_BASE_DELAY", "10s")
+	t.Setenv("RETRY_MAX_DELAY", "1s")
+	t.Setenv("APP_HEALTH_CHECK_LAMBDA", `{"qualifier":"Live"}`)
+	t.Setenv("NOTIFICATION_STATES", "FAILURE,DONE")
+	t.Setenv("NOTIFICATION_WEBHOOK_URL", "https://hooks.example.com/secret")
+	t.Setenv("TARGET_ROLE_ARN", "arn:aws:iam::222222222222:role/deploy")
+
+	_, err := Load()
+	if err == nil {
+		t.Fatal("Load() returned no error")
+	}
+
+	for _, want := range []string{"APPLICATION_NAME", "MAX_DEPLOYMENT_WAIT_TIME", "HEALTH_CHECK_URL", "RETRY_MAX_DELAY", "APP_HEALTH_CHECK_LAMBDA", "NOTIFICATION_STATES", "NOTIFICATION_WEBHOOK_URL", "TARGET_ARTIFACT_BUCKET"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestLoadMinHealthyHosts(t *testing.T) {
+	tests := []struct {
+		value string
+		want  MinHealthyHosts
+		ok    bool
+	}{
+		{"", MinHealthyHosts{}, true},
+		{"2", MinHealthyHosts{Type: "HOST_COUNT", Value: 2}, true},
+		{"75%", MinHealthyHosts{Type: "FLEET_PERCENT", Value: 75}, true},
+		{"150%", MinHealthyHosts{}, false},
+		{"most", MinHealthyHosts{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("APPLICATION_NAME", "app")
+			t.Setenv("DEPLOYMENT_GROUP_NAME", "group")
+			t.Setenv("MIN_HEALTHY_HOSTS", tt.value)
+
+			cfg, err := Load()
+			if !tt.ok {
+				if err == nil || !strings.Contains(err.Error(), "MIN_HEALTHY_HOSTS") {
+					t.Errorf("Load() error = %v, want it to mention MIN_HEALTHY_HOSTS", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() returned error: %v", err)
+			}
+			if cfg.MinHealthyHosts != tt.want {
+				t.Errorf("MinHealthyHosts = %+v, want %+v", cfg.MinHealthyHosts, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEndpoints(t *testing.T) {
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	t.Setenv("AWS_ENDPOINT_URL_S3", "")
+	t.Setenv("AWS_S3_USE_PATH_STYLE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+
+	e, err := LoadEndpoints()
+	if err != nil || e.Enabled() || e.S3UsePathStyle || e.StaticCredentials {
+		t.Errorf("LoadEndpoints() without overrides = %+v, %v, want real AWS", e, err)
+	}
+
+	t.Setenv("AWS_ENDPOINT_URL", "http://localhost:4566")
+	e, err = LoadEndpoints()
+	if err != nil || !e.S3UsePathStyle || !e.StaticCredentials {
+		t.Errorf("LoadEndpoints() = %+v, %v, want path-style S3 and static credentials", e, err)
+	}
+
+	// Real keys are kept, and only S3 going elsewhere keeps the default chain
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	if e, _ := LoadEndpoints(); e.StaticCredentials {
+		t.Error("LoadEndpoints() replaced the configured credentials")
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	t.Setenv("AWS_ENDPOINT_URL_S3", "http://localhost:9000")
+	e, err = LoadEndpoints()
+	if err != nil || !e.S3UsePathStyle || e.StaticCredentials || e.String() != "S3: http://localhost:9000" {
+		t.Errorf("LoadEndpoints() = %+v, %v, want only an S3 override", e, err)
+	}
+
+	t.Setenv("AWS_ENDPOINT_URL", "localhost:4566")
+	t.Setenv("AWS_S3_USE_PATH_STYLE", "sometimes")
+	_, err = LoadEndpoints()
+	if err == nil || !strings.Contains(err.Error(), "AWS_ENDPOINT_URL") || !strings.Contains(err.Error(), "AWS_S3_USE_PATH_STYLE") {
+		t.Errorf("LoadEndpoints() returned %v, want both invalid variables", err)
+	}
+}
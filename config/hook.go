@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Lifecycle events the traffic hook can run for
+const (
+	BeforeAllowTraffic = "BeforeAllowTraffic"
+	AfterAllowTraffic  = "AfterAllowTraffic"
+)
+
+// HookConfig is the configuration of the CodeDeploy lifecycle hook Lambda
+type HookConfig struct {
+	// Phase is the lifecycle event this hook function is wired to
+	Phase string
+
+	// TargetFunctionName is the function being deployed. We invoke the
+	// version from the deployment's AppSpec, or TargetFunctionAlias when
+	// the AppSpec does not name one. Without it, only AppHealthCheckURL is
+	// checked, for functions that have no test payload to answer.
+	TargetFunctionName  string
+	TargetFunctionAlias string
+
+	// Check invokes the target with the test payload and asserts on the
+	// response, as the deploy Lambda's health checks do. Its qualifier is
+	// the version under test.
+	Check LambdaHealthCheck
+
+	// AppHealthCheckURL is checked after the invocation, when set
+	AppHealthCheckURL string
+}
+
+// LoadHook reads and validates the hook configuration, collecting every
+// problem like Load does
+func LoadHook() (*HookConfig, error) {
+	l := &loader{}
+
+	cfg := &HookConfig{
+		Phase:               l.required("HOOK_PHASE"),
+		TargetFunctionName:  l.optional("TARGET_FUNCTION_NAME"),
+		TargetFunctionAlias: l.optional("TARGET_FUNCTION_ALIAS"),
+		AppHealthCheckURL:   l.url("APP_HEALTH_CHECK_URL"),
+	}
+	cfg.Check = LambdaHealthCheck{
+		FunctionName:           cfg.TargetFunctionName,
+		Payload:                l.jsonDocument("HOOK_TEST_PAYLOAD", "{}"),
+		ExpectResponseContains: os.Getenv("HOOK_EXPECT_RESPONSE_CONTAINS"),
+		ExpectError:            os.Getenv("HOOK_EXPECT_ERROR"),
+	}
+
+	if cfg.Phase != "" && cfg.Phase != BeforeAllowTraffic && cfg.Phase != AfterAllowTraffic {
+		l.fail("HOOK_PHASE must be %s or %s, got %q", BeforeAllowTraffic, AfterAllowTraffic, cfg.Phase)
+	}
+
+	// HOOK_EXPECT_JSON holds top-level fields of the response, so each key
+	// is a one-segment path
+	if raw := strings.TrimSpace(os.Getenv("HOOK_EXPECT_JSON")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.Check.ExpectFields); err != nil {
+			l.fail("HOOK_EXPECT_JSON must be a JSON object: %v", err)
+		}
+	}
+
+	if cfg.Check.ExpectError != "" && (cfg.Check.ExpectResponseContains != "" || cfg.Check.ExpectFields != nil) {
+		l.fail("HOOK_EXPECT_ERROR cannot be combined with response assertions")
+	}
+
+	// The invocation settings mean nothing without a function to invoke
+	if cfg.TargetFunctionName == "" {
+		for _, key := range []string{"TARGET_FUNCTION_ALIAS", "HOOK_TEST_PAYLOAD", "HOOK_EXPECT_RESPONSE_CONTAINS", "HOOK_EXPECT_ERROR", "HOOK_EXPECT_JSON"} {
+			if os.Getenv(key) != "" {
+				l.fail("%s requires TARGET_FUNCTION_NAME", key)
+			}
+		}
+	}
+
+	if err := l.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// jsonDocument reads a variable that must hold valid JSON
+func (l *loader) jsonDocument(key, def string) []byte {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		value = def
+	}
+	if !json.Valid([]byte(value)) {
+		l.fail("%s must be valid JSON", key)
+	}
+	return []byte(value)
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "target function", env: map[string]string{"TARGET_FUNCTION_NAME": "app", "HOOK_EXPECT_RESPONSE_CONTAINS": "ok"}},
+		// Functions with no test payload to answer only gate on health
+		{name: "health check only", env: map[string]string{"APP_HEALTH_CHECK_URL": "https://api.example.com/health"}},
+		{name: "unknown phase", env: map[string]string{"HOOK_PHASE": "AfterInstall"}, wantErr: "HOOK_PHASE must be"},
+		{name: "payload without a target", env: map[string]string{"HOOK_TEST_PAYLOAD": `{"ping":true}`}, wantErr: "HOOK_TEST_PAYLOAD requires TARGET_FUNCTION_NAME"},
+		{name: "expected error without a target", env: map[string]string{"HOOK_EXPECT_ERROR": "unrecognized event"}, wantErr: "HOOK_EXPECT_ERROR requires TARGET_FUNCTION_NAME"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOOK_PHASE", BeforeAllowTraffic)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := LoadHook()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadHook() = %+v, %v, want an error containing %q", cfg, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadHook() returned error: %v", err)
+			}
+			if cfg.Check.FunctionName != tt.env["TARGET_FUNCTION_NAME"] {
+				t.Errorf("check invokes %q, want %q", cfg.Check.FunctionName, tt.env["TARGET_FUNCTION_NAME"])
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Session name the deploy Lambda uses when it assumes a target's role, so
+// CloudTrail in the target account shows who deployed
+const assumeRoleSessionName = "pipeline-deploy"
+
+// codeDeployAPI is the part of the CodeDeploy client we deploy with, so
+// tests can swap in a fake
+type codeDeployAPI interface {
+	CreateDeployment(ctx context.Context, params *codedeploy.CreateDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.CreateDeploymentOutput, error)
+	GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error)
+	GetDeploymentGroup(ctx context.Context, params *codedeploy.GetDeploymentGroupInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentGroupOutput, error)
+	GetDeploymentTarget(ctx context.Context, params *codedeploy.GetDeploymentTargetInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentTargetOutput, error)
+	ListDeployments(ctx context.Context, params *codedeploy.ListDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentsOutput, error)
+	ListDeploymentTargets(ctx context.Context, params *codedeploy.ListDeploymentTargetsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentTargetsOutput, error)
+	BatchGetDeployments(ctx context.Context, params *codedeploy.BatchGetDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.BatchGetDeploymentsOutput, error)
+	BatchGetDeploymentTargets(ctx context.Context, params *codedeploy.BatchGetDeploymentTargetsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.BatchGetDeploymentTargetsOutput, error)
+	StopDeployment(ctx context.Context, params *codedeploy.StopDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.StopDeploymentOutput, error)
+}
+
+// ecsAPI is the part of the ECS client that ECS deployments need
+type ecsAPI interface {
+	RegisterTaskDefinition(ctx context.Context, params *ecs.RegisterTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.RegisterTaskDefinitionOutput, error)
+	DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error)
+	DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
+}
+
+// s3API is the part of the S3 client used against a target's buckets
+type s3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// targetClients are the clients used to deploy to one target, in the
+// target's region and, when it has a role, with that role's credentials
+type targetClients struct {
+	Region     string
+	CodeDeploy codeDeployAPI
+	ECS        ecsAPI
+	S3         s3API
+	Lambda     LambdaAPI
+}
+
+type clientKey struct {
+	Region     string
+	RoleARN    string
+	ExternalID string
+}
+
+// clientCache keeps per-target clients across warm invocations. The
+// assumed role credentials are cached and refreshed by the SDK, so we only
+// call STS again when they are about to expire.
+type clientCache struct {
+	mu      sync.Mutex
+	base    aws.Config
+	local   *targetClients
+	entries map[clientKey]*targetClients
+}
+
+func newClientCache(base aws.Config) *clientCache {
+	return &clientCache{
+		base: base,
+		local: &targetClients{
+			Region:     base.Region,
+			CodeDeploy: codeDeployClient,
+			ECS:        ecs.NewFromConfig(base),
+			S3:         s3Client,
+			Lambda:     lambda.NewFromConfig(base),
+		},
+		entries: map[clientKey]*targetClients{},
+	}
+}
+
+// Shared cache, created in Init() from the default AWS config
+var targetClientCache *clientCache
+
+// forTarget returns the clients for a target. A target in our own account
+// and region uses the default clients.
+func (c *clientCache) forTarget(ctx context.Context, target deploymentTarget) (*targetClients, error) {
+	key := clientKey{
+		Region:     target.Region,
+		RoleARN:    target.RoleARN,
+		ExternalID: target.ExternalID,
+	}
+	if key.Region == c.base.Region {
+		key.Region = ""
+	}
+	if key == (clientKey{}) {
+		return c.local, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if clients, ok := c.entries[key]; ok {
+		return clients, nil
+	}
+
+	awsCfg := c.base.Copy()
+	if key.Region != "" {
+		awsCfg.Region = key.Region
+	}
+	if key.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.base), key.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = assumeRoleSessionName
+			if key.ExternalID != "" {
+				o.ExternalID = aws.String(key.ExternalID)
+			}
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider)
+
+		// We assume the role now, so a broken trust policy fails the
+		// target up front rather than halfway through the deployment
+		if _, err := awsCfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, fmt.Errorf("failed to assume role %s: %v", key.RoleARN, err)
+		}
+		log.Printf("Assumed role %s for region %s", key.RoleARN, awsCfg.Region)
+	}
+
+	clients := &targetClients{
+		Region:     awsCfg.Region,
+		CodeDeploy: codedeploy.NewFromConfig(awsCfg),
+		ECS:        ecs.NewFromConfig(awsCfg),
+		S3:         NewS3Client(awsCfg),
+		Lambda:     lambda.NewFromConfig(awsCfg),
+	}
+	c.entries[key] = clients
+	return clients, nil
+}
+
+// artifactCopyBucket returns the bucket stageArtifact copies the artifact
+// to, or "" if the target reads it where it is. A target in another account
+// usually cannot read the pipeline's bucket, so it must name its own.
+func artifactCopyBucket(req deployRequest, target deploymentTarget, clients *targetClients) (string, error) {
+	// ECS revisions are sent inline, so there is nothing to copy
+	if req.S3BucketName == "" || req.S3ObjectKey == "" || target.Platform == platformECS {
+		return "", nil
+	}
+	if target.RoleARN != "" && target.ArtifactBucket == "" {
+		return "", fmt.Errorf("target %s/%s assumes %s, which needs an artifactBucket its account can read",
+			target.ApplicationName, target.DeploymentGroupName, target.RoleARN)
+	}
+	if target.ArtifactBucket == "" || target.ArtifactBucket == req.S3BucketName {
+		if clients.Region != targetClientCache.base.Region {
+			return "", fmt.Errorf("target %s/%s is in %s, which needs an artifactBucket in that region",
+				target.ApplicationName, target.DeploymentGroupName, clients.Region)
+		}
+		return "", nil
+	}
+	return target.ArtifactBucket, nil
+}
+
+// stageArtifact makes the artifact available to the target. CodeDeploy
+// only reads revisions from a bucket in the deployment's own region, so a
+// target in another region names a bucket there and we copy the bundle to
+// it. The returned request points at the copy.
+func stageArtifact(ctx context.Context, req deployRequest, target deploymentTarget, clients *targetClients) (deployRequest, error) {
+	copyBucket, err := artifactCopyBucket(req, target, clients)
+	if err != nil || copyBucket == "" {
+		return req, err
+	}
+
+	log.Printf("Copying artifact s3://%s/%s to s3://%s in %s", req.S3BucketName, req.S3ObjectKey, target.ArtifactBucket, clients.Region)
+
+	// We read with our own credentials and write with the target's, since
+	// the target role usually cannot read the pipeline's artifact bucket
+	source, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(req.S3BucketName),
+		Key:    aws.String(req.S3ObjectKey),
+	})
+	if err != nil {
+		return req, fmt.Errorf("failed to download artifact for copy: %v", err)
+	}
+	defer source.Body.Close()
+
+	spool, size, err := spoolArtifact(source.Body)
+	if err != nil {
+		return req, fmt.Errorf("failed to read artifact for copy: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	result, err := clients.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(target.ArtifactBucket),
+		Key:           aws.String(req.S3ObjectKey),
+		Body:          spool,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String("application/zip"),
+	})
+	if err != nil {
+		return req, fmt.Errorf("failed to copy artifact to %s: %v", target.ArtifactBucket, err)
+	}
+
+	// The copy has its own ETag and version, which the revision must name
+	bundle := *req.Bundle
+	bundle.ETag = strings.Trim(aws.ToString(result.ETag), `"`)
+	bundle.Version = aws.ToString(result.VersionId)
+
+	req.S3BucketName = target.ArtifactBucket
+	req.Bundle = &bundle
+	return req, nil
+}
+
+// spoolArtifact writes the artifact to a temporary file, rewound for the
+// upload. The upload needs a body it can seek, to sign and checksum it,
+// and bundles can be larger than we want to hold in memory.
+func spoolArtifact(body io.Reader) (*os.File, int64, error) {
+	spool, err := os.CreateTemp("", "artifact-*.zip")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(spool, body)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, 0, err
+	}
+	return spool, size, nil
+}
@@ -0,0 +1,150 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestForTarget(t *testing.T) {
+	localAWS(t)
+	e2eInit(t)
+	cache := newClientCache(targetClientCache.base)
+	home := cache.base.Region
+
+	tests := []struct {
+		name      string
+		target    deploymentTarget
+		wantLocal bool
+		wantErr   string
+	}{
+		{name: "no region or role", target: deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-live"}, wantLocal: true},
+		{name: "own region", target: deploymentTarget{Region: home}, wantLocal: true},
+		{name: "other region", target: deploymentTarget{Region: "eu-west-9"}},
+		// The role is assumed up front, so a broken trust policy fails here
+		{name: "role that cannot be assumed", target: deploymentTarget{RoleARN: "arn:aws:iam::222222222222:role/deploy", ExternalID: "ext"}, wantErr: "failed to assume role arn:aws:iam::222222222222:role/deploy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients, err := cache.forTarget(context.Background(), tt.target)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("forTarget() = %+v, %v, want an error containing %q", clients, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("forTarget() returned error: %v", err)
+			}
+			if (clients == cache.local) != tt.wantLocal {
+				t.Errorf("forTarget() returned the default clients: %v, want %v", clients == cache.local, tt.wantLocal)
+			}
+			want := tt.target.Region
+			if want == "" {
+				want = home
+			}
+			if clients.Region != want {
+				t.Errorf("clients are for %s, want %s", clients.Region, want)
+			}
+
+			// Warm invocations reuse the clients, and their credentials
+			again, err := cache.forTarget(context.Background(), tt.target)
+			if err != nil || again != clients {
+				t.Errorf("second forTarget() = %p, %v, want the cached %p", again, err, clients)
+			}
+		})
+	}
+
+	// A failed assume is not cached, so a fixed trust policy is picked up
+	if len(cache.entries) != 1 {
+		t.Errorf("%d cached clients, want only the other region's", len(cache.entries))
+	}
+}
+
+func TestStageArtifact(t *testing.T) {
+	fake, _ := localAWS(t)
+	e2eInit(t)
+	artifact := zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"})
+	fake.PutObject("artifacts", "build/bundle.zip", artifact)
+	bundle := &bundleInfo{Sha256: "source-sha", ETag: "source-etag", Version: "source-version"}
+
+	home := targetClientCache.base.Region
+	local := targetClientCache.local
+	remote, err := targetClientCache.forTarget(context.Background(), deploymentTarget{Region: "eu-west-9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := deployRequest{JobID: "job-1", S3BucketName: "artifacts", S3ObjectKey: "build/bundle.zip", Bundle: bundle}
+	spoolDir := t.TempDir()
+	t.Setenv("TMPDIR", spoolDir)
+
+	tests := []struct {
+		name       string
+		req        deployRequest
+		target     deploymentTarget
+		clients    *targetClients
+		wantBucket string
+		wantErr    string
+	}{
+		{name: "own region", req: req, target: deploymentTarget{Region: home}, clients: local, wantBucket: "artifacts"},
+		{name: "own artifact bucket", req: req, target: deploymentTarget{ArtifactBucket: "artifacts"}, clients: local, wantBucket: "artifacts"},
+		{name: "other region", req: req, target: deploymentTarget{Region: "eu-west-9", ArtifactBucket: "artifacts-eu"}, clients: remote, wantBucket: "artifacts-eu"},
+		{name: "other bucket in our region", req: req, target: deploymentTarget{ArtifactBucket: "artifacts-prod"}, clients: local, wantBucket: "artifacts-prod"},
+		// ECS revisions are sent inline, wherever the target is
+		{name: "ECS", req: req, target: deploymentTarget{Region: "eu-west-9", Platform: platformECS}, clients: remote, wantBucket: "artifacts"},
+		{name: "other region without a bucket", req: req, target: deploymentTarget{Region: "eu-west-9"}, clients: remote, wantErr: "needs an artifactBucket in that region"},
+		// The target account usually cannot read the pipeline's bucket
+		{name: "other account without a bucket", req: req, target: deploymentTarget{RoleARN: "arn:aws:iam::222222222222:role/deploy"}, clients: local, wantErr: "needs an artifactBucket its account can read"},
+		{
+			name:    "missing artifact",
+			req:     deployRequest{S3BucketName: "artifacts", S3ObjectKey: "build/missing.zip", Bundle: bundle},
+			target:  deploymentTarget{Region: "eu-west-9", ArtifactBucket: "artifacts-eu"},
+			clients: remote,
+			wantErr: "failed to download artifact for copy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staged, err := stageArtifact(context.Background(), tt.req, tt.target, tt.clients)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("stageArtifact() = %+v, %v, want an error containing %q", staged, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stageArtifact() returned error: %v", err)
+			}
+			if staged.S3BucketName != tt.wantBucket || staged.S3ObjectKey != tt.req.S3ObjectKey {
+				t.Errorf("staged at s3://%s/%s, want s3://%s/%s", staged.S3BucketName, staged.S3ObjectKey, tt.wantBucket, tt.req.S3ObjectKey)
+			}
+			if staged.S3BucketName == tt.req.S3BucketName {
+				if staged.Bundle != tt.req.Bundle {
+					t.Errorf("bundle = %+v, want it unchanged", staged.Bundle)
+				}
+				return
+			}
+
+			// The revision names the copy, which has its own ETag
+			data, ok := fake.Object(tt.wantBucket, tt.req.S3ObjectKey)
+			if !ok || !bytes.Equal(data, artifact) {
+				t.Fatalf("copy = %d bytes, %v, want the %d byte bundle", len(data), ok, len(artifact))
+			}
+			if staged.Bundle.ETag == "" || staged.Bundle.ETag == bundle.ETag || strings.Contains(staged.Bundle.ETag, `"`) {
+				t.Errorf("copy ETag = %q, want the copy's own, unquoted", staged.Bundle.ETag)
+			}
+			if staged.Bundle.Sha256 != bundle.Sha256 || bundle.ETag != "source-etag" {
+				t.Errorf("bundle = %+v, source = %+v, want the hash kept and the source untouched", staged.Bundle, bundle)
+			}
+		})
+	}
+
+	// The bundle is spooled through a temporary file, which is removed
+	if left, err := os.ReadDir(spoolDir); err != nil || len(left) != 0 {
+		t.Errorf("left behind %v, %v, want no spooled artifacts", left, err)
+	}
+}
@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var appSpecVersionPattern = regexp.MustCompile(`"?(CurrentVersion|TargetVersion)"?\s*:\s*"?([^"\s,}]+)"?`)
+
+// A Lambda or ECS revision bundle holds little more than its AppSpec, so
+// we refuse to read one bigger than this to find it
+const maxAppSpecBundleSize = 10 << 20
+
+// BundleAPI is the part of the S3 client that reads revision bundles
+type BundleAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// RevisionAppSpec returns the text of a revision's AppSpec. An
+// AppSpecContent revision carries it; an S3 revision is read with client,
+// either as the AppSpec itself or as a zip with the AppSpec at its root.
+func RevisionAppSpec(ctx context.Context, client BundleAPI, revision *types.RevisionLocation) (string, error) {
+	if revision == nil {
+		return "", fmt.Errorf("the deployment has no revision")
+	}
+	if revision.AppSpecContent != nil {
+		return aws.ToString(revision.AppSpecContent.Content), nil
+	}
+
+	location := revision.S3Location
+	if location == nil || location.Bucket == nil || location.Key == nil {
+		return "", fmt.Errorf("%s revisions have no AppSpec we can read", revision.RevisionType)
+	}
+	uri := fmt.Sprintf("s3://%s/%s", aws.ToString(location.Bucket), aws.ToString(location.Key))
+
+	input := &s3.GetObjectInput{
+		Bucket:    location.Bucket,
+		Key:       location.Key,
+		VersionId: location.Version,
+	}
+	result, err := client.GetObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to download revision %s: %v", uri, err)
+	}
+	defer result.Body.Close()
+	if aws.ToInt64(result.ContentLength) > maxAppSpecBundleSize {
+		return "", fmt.Errorf("revision %s is %d bytes, too big to read its AppSpec", uri, aws.ToInt64(result.ContentLength))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(result.Body, maxAppSpecBundleSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read revision %s: %v", uri, err)
+	}
+	if len(data) > maxAppSpecBundleSize {
+		return "", fmt.Errorf("revision %s is too big to read its AppSpec", uri)
+	}
+
+	switch location.BundleType {
+	case types.BundleTypeYaml, types.BundleTypeJson:
+		return string(data), nil
+	case types.BundleTypeZip, "":
+		content, err := bundleAppSpec(data)
+		if err != nil {
+			return "", fmt.Errorf("revision %s: %v", uri, err)
+		}
+		return content, nil
+	}
+	return "", fmt.Errorf("revision %s is a %s bundle, which we cannot read an AppSpec from", uri, location.BundleType)
+}
+
+// bundleAppSpec returns the appspec.yml, appspec.yaml or appspec.json at
+// the root of a zip bundle
+func bundleAppSpec(bundle []byte) (string, error) {
+	reader, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return "", fmt.Errorf("artifact is not a zip: %v", err)
+	}
+	return zipAppSpec(reader)
+}
+
+// zipAppSpec returns the AppSpec at the root of an opened zip bundle
+func zipAppSpec(reader *zip.Reader) (string, error) {
+	for _, file := range reader.File {
+		switch strings.ToLower(path.Clean(file.Name)) {
+		case "appspec.yml", "appspec.yaml", "appspec.json":
+		default:
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s: %v", file.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", file.Name, err)
+		}
+		return string(content), nil
+	}
+
+	return "", fmt.Errorf("no AppSpec found at the root of the artifact")
+}
+
+// ParseAppSpecVersions reads CurrentVersion and TargetVersion from the
+// text of a YAML or JSON Lambda AppSpec. Both use the same keys, so a
+// pattern is enough.
+func ParseAppSpecVersions(content string) VersionInfo {
+	var versions VersionInfo
+	for _, match := range appSpecVersionPattern.FindAllStringSubmatch(content, -1) {
+		switch match[1] {
+		case "CurrentVersion":
+			versions.CurrentVersion = match[2]
+		case "TargetVersion":
+			versions.TargetVersion = match[2]
+		}
+	}
+	return versions
+}
@@ -0,0 +1,235 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Outcomes recorded in the audit log
+const (
+	auditSucceeded = "Succeeded"
+	auditFailed    = "Failed"
+)
+
+// auditDateLayout names the daily partitions, e.g. date=2026-10-18
+const auditDateLayout = "2006-01-02"
+
+// AuditRecord is one job's entry in the audit log: its deployment report,
+// the pipeline execution it belongs to and how it ended
+type AuditRecord struct {
+	Outcome             string `json:"outcome"`
+	Error               string `json:"error,omitempty"`
+	PipelineName        string `json:"pipelineName,omitempty"`
+	PipelineExecutionID string `json:"pipelineExecutionId,omitempty"`
+	StageName           string `json:"stageName,omitempty"`
+	ActionName          string `json:"actionName,omitempty"`
+
+	*DeploymentReport
+}
+
+// auditKey places a record in the partition of the day the job started.
+// There is one record per job, so the job ID is enough to name it.
+func auditKey(prefix string, report *DeploymentReport) string {
+	date := report.Timings.StartedAt.UTC().Format(auditDateLayout)
+	return path.Join(prefix, "date="+date, report.JobID+".json")
+}
+
+// parseS3Location splits s3://bucket/prefix
+func parseS3Location(location string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid S3 location %s, expected s3://bucket/prefix", location)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 location %s, expected s3://bucket/prefix", location)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// recordAudit writes the job's audit record when an audit log is
+// configured. The job's outcome does not depend on it, so a failed write
+// is only logged.
+func recordAudit(ctx context.Context, report *DeploymentReport, jobErr error) {
+	if cfg.AuditLogLocation == "" {
+		return
+	}
+	if report.Timings.CompletedAt.IsZero() {
+		report.complete()
+	}
+
+	record := AuditRecord{Outcome: auditSucceeded, DeploymentReport: report}
+	if jobErr != nil {
+		record.Outcome = auditFailed
+		record.Error = jobErr.Error()
+	}
+
+	// Rollbacks and direct deployments are not CodePipeline jobs, so they
+	// have no pipeline context
+	if report.Rollback == nil && report.Direct == nil {
+		job, err := getJobContext(ctx, report.JobID)
+		if err != nil {
+			log.Printf("Warning: Audit record for job %s has no pipeline context: %v", report.JobID, err)
+		} else {
+			record.PipelineName = job.PipelineName
+			record.PipelineExecutionID = job.PipelineExecutionID
+			record.StageName = job.StageName
+			record.ActionName = job.ActionName
+		}
+	}
+
+	if err := writeAuditRecord(ctx, s3Client, cfg.AuditLogLocation, record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// writeAuditRecord stores the record only if no record exists for the job,
+// so the log is append-only: a redelivered job can never rewrite history
+func writeAuditRecord(ctx context.Context, client s3API, location string, record AuditRecord) error {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+
+	key := auditKey(prefix, record.DeploymentReport)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		IfNoneMatch: aws.String("*"),
+	})
+	if isPreconditionFailed(err) {
+		log.Printf("Audit record s3://%s/%s already exists, leaving it as it is", bucket, key)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit record to s3://%s/%s: %v", bucket, key, err)
+	}
+
+	log.Printf("Audit record written to s3://%s/%s", bucket, key)
+	return nil
+}
+
+// AuditLogAPI is the part of the S3 client that reads the audit log
+type AuditLogAPI interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// AuditQuery selects jobs from the audit log. Empty names match every
+// application or group; a zero To means now, and a zero From a week
+// before To.
+type AuditQuery struct {
+	ApplicationName     string
+	DeploymentGroupName string
+	From                time.Time
+	To                  time.Time
+}
+
+// matches reports whether the job started in the query's time range and
+// deployed to a matching group
+func (q AuditQuery) matches(record AuditRecord) bool {
+	started := record.Timings.StartedAt
+	if started.Before(q.From) || started.After(q.To) {
+		return false
+	}
+	if q.ApplicationName == "" && q.DeploymentGroupName == "" {
+		return true
+	}
+	for _, t := range record.Targets {
+		if (q.ApplicationName == "" || t.ApplicationName == q.ApplicationName) &&
+			(q.DeploymentGroupName == "" || t.DeploymentGroupName == q.DeploymentGroupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryAuditLog returns the audit records under location that match the
+// query, oldest first. It only reads the daily partitions in the range.
+func QueryAuditLog(ctx context.Context, client AuditLogAPI, location string, query AuditQuery) ([]AuditRecord, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	if query.To.IsZero() {
+		query.To = time.Now()
+	}
+	if query.From.IsZero() {
+		query.From = query.To.AddDate(0, 0, -7)
+	}
+	if query.To.Before(query.From) {
+		return nil, fmt.Errorf("audit query ends before it starts")
+	}
+
+	records := []AuditRecord{}
+	last := query.To.UTC().Truncate(24 * time.Hour)
+	for day := query.From.UTC().Truncate(24 * time.Hour); !day.After(last); day = day.AddDate(0, 0, 1) {
+		partition := path.Join(prefix, "date="+day.Format(auditDateLayout)) + "/"
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(partition),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list audit records in s3://%s/%s: %v", bucket, partition, err)
+			}
+			for _, object := range page.Contents {
+				record, err := readAuditRecord(ctx, client, bucket, aws.ToString(object.Key))
+				if err != nil {
+					return nil, err
+				}
+				if query.matches(record) {
+					records = append(records, record)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timings.StartedAt.Before(records[j].Timings.StartedAt)
+	})
+	return records, nil
+}
+
+func readAuditRecord(ctx context.Context, client AuditLogAPI, bucket, key string) (AuditRecord, error) {
+	var record AuditRecord
+	result, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return record, fmt.Errorf("failed to read audit record s3://%s/%s: %v", bucket, key, err)
+	}
+	defer result.Body.Close()
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return record, fmt.Errorf("failed to read audit record s3://%s/%s: %v", bucket, key, err)
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return record, fmt.Errorf("invalid audit record s3://%s/%s: %v", bucket, key, err)
+	}
+	if record.DeploymentReport == nil {
+		record.DeploymentReport = &DeploymentReport{}
+	}
+	return record, nil
+}
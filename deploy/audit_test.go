@@ -0,0 +1,75 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditReport(jobID, group string, started time.Time) *DeploymentReport {
+	report := newDeploymentReport(jobID)
+	report.Timings.StartedAt = started
+	report.Targets = append(report.Targets, &TargetResult{
+		ApplicationName:     "app",
+		DeploymentGroupName: group,
+		DeploymentID:        "d-" + jobID,
+		Status:              targetSucceeded,
+	})
+	report.complete()
+	return report
+}
+
+func TestWriteAuditRecordNeverOverwrites(t *testing.T) {
+	store := &fakeS3{}
+	started := time.Date(2026, 10, 18, 23, 30, 0, 0, time.UTC)
+	record := AuditRecord{Outcome: auditSucceeded, DeploymentReport: auditReport("job-1", "live", started)}
+
+	if err := writeAuditRecord(context.Background(), store, "s3://audit/deployments", record); err != nil {
+		t.Fatalf("writeAuditRecord() returned error: %v", err)
+	}
+	key := "audit/deployments/date=2026-10-18/job-1.json"
+	if _, ok := store.objects[key]; !ok {
+		t.Fatalf("objects = %v, want %s", store.objects, key)
+	}
+
+	record.Outcome = auditFailed
+	if err := writeAuditRecord(context.Background(), store, "s3://audit/deployments", record); err != nil {
+		t.Fatalf("second writeAuditRecord() returned error: %v", err)
+	}
+	if !strings.Contains(string(store.objects[key]), `"outcome":"Succeeded"`) {
+		t.Errorf("record was overwritten: %s", store.objects[key])
+	}
+}
+
+func TestQueryAuditLog(t *testing.T) {
+	store := &fakeS3{}
+	day := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for i, group := range []string{"live", "canary", "live", "live"} {
+		record := AuditRecord{Outcome: auditSucceeded, DeploymentReport: auditReport("job-"+string(rune('a'+i)), group, day.AddDate(0, 0, i))}
+		if err := writeAuditRecord(context.Background(), store, "s3://audit/log", record); err != nil {
+			t.Fatalf("writeAuditRecord() returned error: %v", err)
+		}
+	}
+
+	records, err := QueryAuditLog(context.Background(), store, "s3://audit/log", AuditQuery{
+		ApplicationName:     "app",
+		DeploymentGroupName: "live",
+		From:                day,
+		To:                  day.AddDate(0, 0, 2),
+	})
+	if err != nil {
+		t.Fatalf("QueryAuditLog() returned error: %v", err)
+	}
+
+	var jobs []string
+	for _, r := range records {
+		jobs = append(jobs, r.JobID)
+	}
+	if strings.Join(jobs, ",") != "job-a,job-c" {
+		t.Errorf("jobs = %v, want job-a and job-c, oldest first", jobs)
+	}
+	if records[0].Targets[0].DeploymentID != "d-job-a" {
+		t.Errorf("Targets = %+v, want the recorded deployment", records[0].Targets[0])
+	}
+}
@@ -0,0 +1,324 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	// Lambda's provided runtimes do not ship zoneinfo, so calendar time
+	// zones come from the embedded database
+	_ "time/tzdata"
+)
+
+// How far ahead we look for the end of a freeze. A calendar that stays
+// frozen for longer is reported as frozen past the horizon.
+const freezeHorizon = 90 * 24 * time.Hour
+
+// While waiting for a freeze to end, we sleep this long before handing the
+// job back to CodePipeline with a continuation token
+var freezePollInterval = time.Minute
+
+// changeCalendar says when deployments may go out. A deployment is blocked
+// during any blackout or freeze window, and, when there are allowed
+// windows, at any time outside them. For example:
+//
+//	{"timezone": "Europe/Berlin",
+//	 "allowedWindows": [{"name": "business hours", "schedule": "* 9-16 * * MON-FRI"}],
+//	 "blackouts": [{"name": "year end", "start": "2026-12-19", "end": "2027-01-03"}]}
+type changeCalendar struct {
+	Timezone       string           `json:"timezone,omitempty"`
+	AllowedWindows []calendarWindow `json:"allowedWindows,omitempty"`
+	FreezeWindows  []calendarWindow `json:"freezeWindows,omitempty"`
+	Blackouts      []blackout       `json:"blackouts,omitempty"`
+}
+
+// calendarWindow is a recurring window: every minute matched by its cron
+// schedule, in its own time zone or the calendar's
+type calendarWindow struct {
+	Name     string `json:"name,omitempty"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone,omitempty"`
+
+	schedule *cronSchedule
+	location *time.Location
+}
+
+// blackout is a one-off freeze. Start and End are RFC 3339 times or dates;
+// a date-only End includes the whole of that day.
+type blackout struct {
+	Name  string `json:"name,omitempty"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	start, end time.Time
+}
+
+// parseChangeCalendar reads a calendar from JSON and resolves its
+// schedules, time zones and dates
+func parseChangeCalendar(raw []byte) (*changeCalendar, error) {
+	var c changeCalendar
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("invalid change calendar: %v", err)
+	}
+	if err := c.compile(); err != nil {
+		return nil, fmt.Errorf("invalid change calendar: %v", err)
+	}
+	return &c, nil
+}
+
+func (c *changeCalendar) compile() error {
+	location, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q", c.Timezone)
+	}
+
+	for _, windows := range [][]calendarWindow{c.AllowedWindows, c.FreezeWindows} {
+		for i := range windows {
+			w := &windows[i]
+			if w.schedule, err = parseCronSchedule(w.Schedule); err != nil {
+				return fmt.Errorf("window %s: %v", w.label(), err)
+			}
+			w.location = location
+			if w.Timezone != "" {
+				if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+					return fmt.Errorf("window %s has unknown timezone %q", w.label(), w.Timezone)
+				}
+			}
+		}
+	}
+
+	for i := range c.Blackouts {
+		b := &c.Blackouts[i]
+		if b.start, err = parseCalendarTime(b.Start, location, false); err != nil {
+			return fmt.Errorf("blackout %s: start: %v", b.label(), err)
+		}
+		if b.end, err = parseCalendarTime(b.End, location, true); err != nil {
+			return fmt.Errorf("blackout %s: end: %v", b.label(), err)
+		}
+		if !b.end.After(b.start) {
+			return fmt.Errorf("blackout %s ends before it starts", b.label())
+		}
+	}
+	return nil
+}
+
+// parseCalendarTime reads an RFC 3339 time, or a date in the calendar's
+// time zone. endOfDay moves a date to the start of the following day.
+func parseCalendarTime(s string, location *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or a date", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (w calendarWindow) label() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	return fmt.Sprintf("%q", w.Schedule)
+}
+
+func (b blackout) label() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return b.Start + "/" + b.End
+}
+
+// blockedBy returns why deployments are blocked at t, or "" if they are not
+func (c *changeCalendar) blockedBy(t time.Time) string {
+	for _, b := range c.Blackouts {
+		if !t.Before(b.start) && t.Before(b.end) {
+			return "blackout " + b.label()
+		}
+	}
+	for _, w := range c.FreezeWindows {
+		if w.schedule.matches(t.In(w.location)) {
+			return "freeze window " + w.label()
+		}
+	}
+	if len(c.AllowedWindows) == 0 {
+		return ""
+	}
+	for _, w := range c.AllowedWindows {
+		if w.schedule.matches(t.In(w.location)) {
+			return ""
+		}
+	}
+	return "outside the allowed deployment windows"
+}
+
+// frozenUntil returns when deployments blocked at now may next go out,
+// stepping a minute at a time and skipping over blackouts. ok is false
+// when the calendar stays frozen past the horizon.
+func (c *changeCalendar) frozenUntil(now time.Time) (until time.Time, ok bool) {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	horizon := now.Add(freezeHorizon)
+	for t.Before(horizon) {
+		if b, inBlackout := c.blackoutAt(t); inBlackout {
+			t = b.end
+			continue
+		}
+		if c.blockedBy(t) == "" {
+			return t, true
+		}
+		t = t.Add(time.Minute)
+	}
+	return t, false
+}
+
+func (c *changeCalendar) blackoutAt(t time.Time) (blackout, bool) {
+	for _, b := range c.Blackouts {
+		if !t.Before(b.start) && t.Before(b.end) {
+			return b, true
+		}
+	}
+	return blackout{}, false
+}
+
+// freezeError is a blocked deployment. Its message says when the freeze
+// ends, so the pipeline's failure tells people when to retry.
+type freezeError struct {
+	Reason string
+	Until  time.Time
+	Known  bool
+}
+
+func (e *freezeError) Error() string {
+	if !e.Known {
+		return fmt.Sprintf("deployments are frozen (%s) beyond %s", e.Reason, e.Until.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("deployments are frozen (%s) until %s", e.Reason, e.Until.UTC().Format(time.RFC3339))
+}
+
+// checkFreeze returns a freezeError if the calendar blocks deployments now
+func (c *changeCalendar) checkFreeze(now time.Time) *freezeError {
+	reason := c.blockedBy(now)
+	if reason == "" {
+		return nil
+	}
+	until, known := c.frozenUntil(now)
+	return &freezeError{Reason: reason, Until: until, Known: known}
+}
+
+// calendarCache keeps a calendar read from S3 or SSM across warm invocations
+type calendarCache struct {
+	mu        sync.Mutex
+	calendar  *changeCalendar
+	fetchedAt time.Time
+}
+
+var calendars calendarCache
+
+// get returns the configured calendar, or nil when there is none
+func (c *calendarCache) get(ctx context.Context) (*changeCalendar, error) {
+	if cfg.ChangeCalendar != "" {
+		return parseChangeCalendar([]byte(cfg.ChangeCalendar))
+	}
+	if cfg.ChangeCalendarLocation == "" {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.calendar != nil && time.Since(c.fetchedAt) < cfg.ChangeCalendarTTL {
+		return c.calendar, nil
+	}
+
+	raw, err := readDocument(ctx, cfg.ChangeCalendarLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change calendar from %s: %v", cfg.ChangeCalendarLocation, err)
+	}
+	calendar, err := parseChangeCalendar(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v at %s", err, cfg.ChangeCalendarLocation)
+	}
+	c.calendar = calendar
+	c.fetchedAt = time.Now()
+	return calendar, nil
+}
+
+// errWaitingForFreeze means the job was handed back to CodePipeline to
+// resume once the freeze ends
+type errWaitingForFreeze struct {
+	freeze       *freezeError
+	continuation jobContinuation
+}
+
+func (e *errWaitingForFreeze) Error() string {
+	return "waiting for the change freeze to end: " + e.freeze.Error()
+}
+
+// checkChangeCalendar blocks the job while the calendar is frozen, unless
+// the pipeline passes an emergency override. With FREEZE_WAIT, a freeze
+// that ends within FREEZE_MAX_WAIT returns errWaitingForFreeze instead of
+// failing the job.
+func checkChangeCalendar(ctx context.Context, jobID string, params userParameters, continuation jobContinuation, report *DeploymentReport) error {
+	checkStart := time.Now()
+	calendar, err := calendars.get(ctx)
+	if err != nil || calendar == nil {
+		return err
+	}
+
+	freeze := calendar.checkFreeze(time.Now())
+	if freeze != nil && params.EmergencyOverride {
+		// The override is the audit trail for deploying during a freeze,
+		// so it is logged in full and kept in the report
+		log.Printf("EMERGENCY OVERRIDE: job %s deploys despite %v, reason: %s", jobID, freeze, params.OverrideReason)
+		report.EmergencyOverride = &emergencyOverride{
+			Reason: params.OverrideReason,
+			Freeze: freeze.Error(),
+		}
+		freeze = nil
+	}
+
+	if freeze != nil && cfg.FreezeWait && freeze.Known {
+		if continuation.WaitingSince.IsZero() {
+			continuation.WaitingSince = checkStart
+		}
+		if freeze.Until.Sub(continuation.WaitingSince) <= cfg.FreezeMaxWait {
+			// We sleep through short freezes here, and hand longer ones
+			// back to CodePipeline so the job resumes in a later invocation
+			wait := time.Until(freeze.Until)
+			if wait > freezePollInterval {
+				log.Printf("Job %s is blocked: %v, checking again in %v", jobID, freeze, freezePollInterval)
+				if err := sleep(ctx, freezePollInterval); err != nil {
+					return err
+				}
+				return &errWaitingForFreeze{freeze: freeze, continuation: continuation}
+			}
+			log.Printf("Job %s is blocked: %v, waiting %v", jobID, freeze, wait)
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+			freeze = calendar.checkFreeze(time.Now())
+		}
+	}
+
+	if freeze != nil {
+		report.addValidation("change calendar", freeze, time.Since(checkStart))
+		return freeze
+	}
+	if !continuation.WaitingSince.IsZero() {
+		log.Printf("Change freeze ended, job %s waited %v", jobID, time.Since(continuation.WaitingSince).Round(time.Second))
+	}
+	report.addValidation("change calendar", nil, time.Since(checkStart))
+	return nil
+}
+
+// emergencyOverride records a deployment that went out during a freeze
+type emergencyOverride struct {
+	Reason string `json:"reason"`
+	Freeze string `json:"freeze"`
+}
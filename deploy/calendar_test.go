@@ -0,0 +1,183 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+)
+
+func TestCronSchedule(t *testing.T) {
+	tests := []struct {
+		expr string
+		at   string
+		want bool
+	}{
+		{"* 9-16 * * MON-FRI", "2026-10-19T09:00:00Z", true},  // Monday
+		{"* 9-16 * * MON-FRI", "2026-10-19T17:00:00Z", false}, // after hours
+		{"* 9-16 * * MON-FRI", "2026-10-18T10:00:00Z", false}, // Sunday
+		{"*/15 * * * *", "2026-10-19T10:45:00Z", true},
+		{"*/15 * * * *", "2026-10-19T10:46:00Z", false},
+		{"0 0 * * 7", "2026-10-18T00:00:00Z", true}, // 7 is Sunday too
+		{"* * 24-31 DEC *", "2026-12-25T12:00:00Z", true},
+		{"* * 1 * FRI", "2026-10-23T12:00:00Z", true}, // either day field matches
+		{"* * 1 * FRI", "2026-10-22T12:00:00Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr+" at "+tt.at, func(t *testing.T) {
+			schedule, err := parseCronSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCronSchedule() returned error: %v", err)
+			}
+			at, _ := time.Parse(time.RFC3339, tt.at)
+			if got := schedule.matches(at); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * * FUNDAY", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("parseCronSchedule(%q) returned no error", expr)
+		}
+	}
+}
+
+const testCalendar = `{
+	"timezone": "Europe/Berlin",
+	"allowedWindows": [{"name": "business hours", "schedule": "* 9-16 * * MON-FRI"}],
+	"blackouts": [{"name": "year end", "start": "2026-12-19", "end": "2027-01-03"}]
+}`
+
+func TestChangeCalendarFreezes(t *testing.T) {
+	calendar, err := parseChangeCalendar([]byte(testCalendar))
+	if err != nil {
+		t.Fatalf("parseChangeCalendar() returned error: %v", err)
+	}
+
+	tests := []struct {
+		at     string
+		reason string
+		until  string
+	}{
+		// 10:00 in Berlin, a Monday
+		{"2026-10-19T08:00:00Z", "", ""},
+		// 17:30 in Berlin opens at 09:00 the next morning
+		{"2026-10-19T15:30:00Z", "outside the allowed deployment windows", "2026-10-20T07:00:00Z"},
+		// Friday evening opens on Monday morning
+		{"2026-10-23T16:00:00Z", "outside the allowed deployment windows", "2026-10-26T08:00:00Z"},
+		// The blackout includes its last day, then waits for business hours
+		{"2027-01-03T10:00:00Z", "blackout year end", "2027-01-04T08:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, tt.at)
+			freeze := calendar.checkFreeze(at)
+			if tt.reason == "" {
+				if freeze != nil {
+					t.Errorf("checkFreeze() = %v, want no freeze", freeze)
+				}
+				return
+			}
+			if freeze == nil || freeze.Reason != tt.reason {
+				t.Fatalf("checkFreeze() = %v, want a freeze for %s", freeze, tt.reason)
+			}
+			if got := freeze.Until.UTC().Format(time.RFC3339); !freeze.Known || got != tt.until {
+				t.Errorf("frozen until %s, want %s", got, tt.until)
+			}
+			if !strings.Contains(freeze.Error(), "frozen ("+tt.reason+") until "+tt.until) {
+				t.Errorf("error %q does not say when the freeze ends", freeze)
+			}
+		})
+	}
+}
+
+func TestParseChangeCalendarRejectsBadWindows(t *testing.T) {
+	for _, raw := range []string{
+		`{"timezone": "Mars/Olympus"}`,
+		`{"freezeWindows": [{"schedule": "* * *"}]}`,
+		`{"blackouts": [{"start": "2027-01-03", "end": "2026-12-19"}]}`,
+		`{"blackouts": [{"start": "soon", "end": "2026-12-19"}]}`,
+	} {
+		if _, err := parseChangeCalendar([]byte(raw)); err == nil {
+			t.Errorf("parseChangeCalendar(%s) returned no error", raw)
+		}
+	}
+}
+
+func TestCheckChangeCalendar(t *testing.T) {
+	frozen := `{"freezeWindows": [{"name": "always", "schedule": "* * * * *"}]}`
+
+	t.Run("blocked", func(t *testing.T) {
+		cfg = &config.Config{ChangeCalendar: frozen}
+		report := newDeploymentReport("job-1")
+
+		err := checkChangeCalendar(context.Background(), "job-1", userParameters{}, jobContinuation{}, report)
+		var freeze *freezeError
+		if !errors.As(err, &freeze) || freeze.Reason != "freeze window always" {
+			t.Fatalf("checkChangeCalendar() = %v, want a freeze", err)
+		}
+		if len(report.Validations) != 1 || report.Validations[0].Passed {
+			t.Errorf("Validations = %+v, want a failed change calendar check", report.Validations)
+		}
+	})
+
+	t.Run("emergency override", func(t *testing.T) {
+		cfg = &config.Config{ChangeCalendar: frozen}
+		report := newDeploymentReport("job-1")
+		params := userParameters{EmergencyOverride: true, OverrideReason: "INC-42 hotfix"}
+
+		if err := checkChangeCalendar(context.Background(), "job-1", params, jobContinuation{}, report); err != nil {
+			t.Fatalf("checkChangeCalendar() returned error: %v", err)
+		}
+		if report.EmergencyOverride == nil || report.EmergencyOverride.Reason != "INC-42 hotfix" {
+			t.Errorf("EmergencyOverride = %+v, want the override recorded", report.EmergencyOverride)
+		}
+	})
+
+	t.Run("waits with a continuation", func(t *testing.T) {
+		defer func(interval time.Duration) { freezePollInterval = interval }(freezePollInterval)
+		freezePollInterval = time.Millisecond
+		cfg = &config.Config{
+			ChangeCalendar: `{"blackouts": [{"start": "2000-01-01", "end": "` + time.Now().Add(30*time.Minute).UTC().Format(time.RFC3339) + `"}]}`,
+			FreezeWait:     true,
+			FreezeMaxWait:  time.Hour,
+		}
+
+		err := checkChangeCalendar(context.Background(), "job-1", userParameters{}, jobContinuation{}, newDeploymentReport("job-1"))
+		var waiting *errWaitingForFreeze
+		if !errors.As(err, &waiting) || waiting.continuation.WaitingSince.IsZero() {
+			t.Fatalf("checkChangeCalendar() = %v, want a continuation", err)
+		}
+
+		// A wait that has already gone on too long fails instead
+		expired := jobContinuation{WaitingSince: time.Now().Add(-time.Hour)}.token()
+		err = checkChangeCalendar(context.Background(), "job-2", userParameters{}, parseContinuation(expired), newDeploymentReport("job-2"))
+		var freeze *freezeError
+		if !errors.As(err, &freeze) {
+			t.Errorf("checkChangeCalendar() = %v, want a freeze once FREEZE_MAX_WAIT is spent", err)
+		}
+	})
+}
+
+func TestParseUserParameters(t *testing.T) {
+	if params, err := parseUserParameters(""); err != nil || params.EmergencyOverride {
+		t.Errorf("parseUserParameters(\"\") = %+v, %v, want no override", params, err)
+	}
+	if params, err := parseUserParameters(`{"emergencyOverride": true, "overrideReason": "INC-42"}`); err != nil || !params.EmergencyOverride {
+		t.Errorf("parseUserParameters() = %+v, %v, want an override", params, err)
+	}
+	if params, err := parseUserParameters(`{"dryRun": true}`); err != nil || !params.DryRun {
+		t.Errorf("parseUserParameters() = %+v, %v, want a dry run", params, err)
+	}
+	for _, raw := range []string{`{"emergencyOverride": true}`, `{"emergencyOveride": true}`, `not json`} {
+		if _, err := parseUserParameters(raw); err == nil {
+			t.Errorf("parseUserParameters(%s) returned no error", raw)
+		}
+	}
+}
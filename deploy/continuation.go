@@ -0,0 +1,142 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// CodePipeline caps continuation tokens at 2048 characters
+const maxContinuationTokenLength = 2048
+
+// While a wave bakes, we sleep this long before handing the job back to
+// CodePipeline with a continuation token
+var bakePollInterval = time.Minute
+
+// jobContinuation is the continuation token of a job that CodePipeline
+// hands back to us. A job waiting out a freeze remembers when the wait
+// began, so FREEZE_MAX_WAIT holds across invocations. A wave plan deploys
+// one wave per invocation, and remembers which wave is next, when the
+// last one's bake ends and what it has deployed so far.
+type jobContinuation struct {
+	WaitingSince time.Time `json:"waitingSince"`
+
+	// Wave is the wave to deploy next, or the one baking until BakeUntil
+	Wave      int        `json:"wave,omitempty"`
+	BakeUntil *time.Time `json:"bakeUntil,omitempty"`
+
+	// Targets are the results of the waves already deployed
+	Targets []continuedTarget `json:"targets,omitempty"`
+}
+
+// continuedTarget is a target result carried from an earlier invocation.
+// The keys are short to keep large plans under the token's cap.
+type continuedTarget struct {
+	Wave   int    `json:"w"`
+	Target int    `json:"t"`
+	Status string `json:"s"`
+
+	DeploymentID         string `json:"d,omitempty"`
+	PreviousDeploymentID string `json:"p,omitempty"`
+}
+
+func parseContinuation(token string) jobContinuation {
+	var c jobContinuation
+	if token == "" {
+		return c
+	}
+	if err := json.Unmarshal([]byte(token), &c); err != nil {
+		log.Printf("Warning: Ignoring unreadable continuation token: %v", err)
+	}
+	return c
+}
+
+func (c jobContinuation) token() string {
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// started says whether the job has already deployed a wave
+func (c jobContinuation) started() bool {
+	return c.Wave > 0 || c.BakeUntil != nil || len(c.Targets) > 0
+}
+
+// errWaveInProgress means the job was handed back to CodePipeline to carry
+// on with its wave plan in a later invocation
+type errWaveInProgress struct {
+	continuation jobContinuation
+	status       string
+}
+
+func (e *errWaveInProgress) Error() string {
+	return e.status
+}
+
+// restoreTargets rebuilds the results of the waves deployed by earlier
+// invocations, so the report and any rollback cover them too
+func (c jobContinuation) restoreTargets(plan wavePlan) ([]*TargetResult, error) {
+	results := make([]*TargetResult, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		if t.Wave < 0 || t.Wave >= len(plan.Waves) || t.Target < 0 || t.Target >= len(plan.Waves[t.Wave].Targets) {
+			return nil, fmt.Errorf("continuation token does not match the wave plan: wave %d has no target %d", t.Wave+1, t.Target+1)
+		}
+		w := plan.Waves[t.Wave]
+		target := w.Targets[t.Target]
+		results = append(results, &TargetResult{
+			Wave:                 w.label(t.Wave),
+			ApplicationName:      target.ApplicationName,
+			DeploymentGroupName:  target.DeploymentGroupName,
+			Region:               target.Region,
+			DeploymentID:         t.DeploymentID,
+			Status:               t.Status,
+			Message:              "deployed in an earlier invocation",
+			Validations:          []ValidationResult{},
+			waveIndex:            t.Wave,
+			targetIndex:          t.Target,
+			previousDeploymentID: t.PreviousDeploymentID,
+		})
+	}
+	if c.Wave < 0 || c.Wave >= len(plan.Waves) {
+		return nil, fmt.Errorf("continuation token does not match the wave plan: it has no wave %d", c.Wave+1)
+	}
+	return results, nil
+}
+
+// continueWith records the results in the continuation, and hands the job
+// back with it unless the token would be too long for CodePipeline
+func (c jobContinuation) continueWith(results []*TargetResult, status string) error {
+	c.Targets = nil
+	for _, r := range results {
+		c.Targets = append(c.Targets, continuedTarget{
+			Wave:                 r.waveIndex,
+			Target:               r.targetIndex,
+			Status:               r.Status,
+			DeploymentID:         r.DeploymentID,
+			PreviousDeploymentID: r.previousDeploymentID,
+		})
+	}
+	if n := len(c.token()); n > maxContinuationTokenLength {
+		return fmt.Errorf("the wave plan is too large to carry across invocations: its continuation token is %d characters, CodePipeline allows %d", n, maxContinuationTokenLength)
+	}
+	return &errWaveInProgress{continuation: c, status: status}
+}
+
+// maxContinuationLength is the longest continuation token the plan can
+// need, which is the one for the bake of its last wave
+func (p wavePlan) maxContinuationLength() int {
+	until := time.Now()
+	c := jobContinuation{Wave: len(p.Waves) - 1, BakeUntil: &until}
+	for i, w := range p.Waves {
+		for j := range w.Targets {
+			c.Targets = append(c.Targets, continuedTarget{
+				Wave:                 i,
+				Target:               j,
+				Status:               targetSucceeded,
+				DeploymentID:         "d-XXXXXXXXX",
+				PreviousDeploymentID: "d-XXXXXXXXX",
+			})
+		}
+	}
+	return len(c.token())
+}
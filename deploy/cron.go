@@ -0,0 +1,134 @@
+package deploy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a five-field cron expression (minute, hour, day of month,
+// month, day of week) describing a set of minutes, such as
+// "* 9-17 * * MON-FRI" for business hours
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+
+	// As in cron, when both day fields are restricted a time matches if
+	// either of them does
+	anyDay, anyWeekday bool
+}
+
+var (
+	monthNames   = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	weekdayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+)
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &cronSchedule{}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q: minute: %v", expr, err)
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q: hour: %v", expr, err)
+	}
+	if s.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron expression %q: day of month: %v", expr, err)
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("cron expression %q: month: %v", expr, err)
+	}
+	// Sunday is both 0 and 7
+	if s.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, fmt.Errorf("cron expression %q: day of week: %v", expr, err)
+	}
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	s.anyDay = fields[2] == "*"
+	s.anyWeekday = fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField reads a comma-separated list of values, ranges and steps
+// into a bit set. names, when given, are aliases for values from min up.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		first, last := min, max
+		if rangePart != "*" {
+			lo, hi, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if first, err = cronValue(lo, min, max, names); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = cronValue(hi, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				last = max
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("value %q must be between %d and %d", s, min, max)
+	}
+	return n, nil
+}
+
+// matches reports whether the minute containing t is in the schedule. t
+// should already be in the schedule's time zone.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 ||
+		s.hours&(1<<uint(t.Hour())) == 0 ||
+		s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
@@ -0,0 +1,440 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A diagnostic bundle has every lifecycle event of up to this many failed
+// targets. The failure message names at most maxSummarizedTargets of them.
+const (
+	maxDiagnosedTargets  = 100
+	maxSummarizedTargets = 3
+)
+
+// CodeDeploy names the alarms that stopped a deployment at the end of the
+// error message, e.g. "... Activated alarms: api-5xx, api-latency"
+const activatedAlarmsPrefix = "Activated alarms:"
+
+// failureDiagnostics is the diagnostic bundle of a deployment that failed
+// or was stopped: what CodeDeploy tells us about why, in one document
+type failureDiagnostics struct {
+	JobID               string               `json:"jobId"`
+	ApplicationName     string               `json:"applicationName"`
+	DeploymentGroupName string               `json:"deploymentGroupName"`
+	Region              string               `json:"region,omitempty"`
+	DeploymentID        string               `json:"deploymentId"`
+	ComputePlatform     string               `json:"computePlatform,omitempty"`
+	Status              string               `json:"status"`
+	ErrorCode           string               `json:"errorCode,omitempty"`
+	ErrorMessage        string               `json:"errorMessage,omitempty"`
+	StatusMessages      []string             `json:"statusMessages,omitempty"`
+	Instances           *instanceSummary     `json:"instances,omitempty"`
+	Targets             []targetDiagnostics  `json:"targets,omitempty"`
+	Rollback            *rollbackDiagnostics `json:"rollback,omitempty"`
+	Alarms              *alarmDiagnostics    `json:"alarms,omitempty"`
+	CollectedAt         time.Time            `json:"collectedAt"`
+
+	// CollectionErrors are the parts of the bundle we could not gather
+	CollectionErrors []string `json:"collectionErrors,omitempty"`
+}
+
+// targetDiagnostics is one failed target, with all its lifecycle events
+type targetDiagnostics struct {
+	TargetID        string                      `json:"targetId"`
+	TargetType      string                      `json:"targetType"`
+	Status          string                      `json:"status"`
+	LifecycleEvents []lifecycleEventDiagnostics `json:"lifecycleEvents"`
+}
+
+type lifecycleEventDiagnostics struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	StartTime  *time.Time `json:"startTime,omitempty"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+	ErrorCode  string     `json:"errorCode,omitempty"`
+	ScriptName string     `json:"scriptName,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	LogTail    string     `json:"logTail,omitempty"`
+}
+
+// failedEvent returns the lifecycle event the target failed in, if any
+func (t targetDiagnostics) failedEvent() *lifecycleEventDiagnostics {
+	for i := range t.LifecycleEvents {
+		if t.LifecycleEvents[i].Status == string(types.LifecycleEventStatusFailed) {
+			return &t.LifecycleEvents[i]
+		}
+	}
+	return nil
+}
+
+func (t targetDiagnostics) String() string {
+	s := t.TargetID
+	event := t.failedEvent()
+	if event == nil {
+		return s + " " + strings.ToLower(t.Status)
+	}
+	s += " failed " + event.Name
+	if event.ScriptName != "" {
+		s += " in " + event.ScriptName
+	}
+	if event.Message != "" {
+		s += ": " + event.Message
+	}
+	return s
+}
+
+// rollbackDiagnostics is CodeDeploy's own rollback of the deployment
+type rollbackDiagnostics struct {
+	DeploymentID string `json:"deploymentId,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// alarmDiagnostics are the CloudWatch alarms watching the deployment and
+// the ones that stopped it
+type alarmDiagnostics struct {
+	Enabled    bool     `json:"enabled"`
+	Configured []string `json:"configured,omitempty"`
+	Triggered  []string `json:"triggered,omitempty"`
+}
+
+// diagnoseFailure gathers the diagnostic bundle of a deployment that
+// failed or was stopped, writes it to the diagnostics location and adds a
+// summary of it to the error. A server deployment's failed instances are
+// added to its result. Timeouts and API errors leave the deployment
+// running, so unless instances have already failed there is nothing to
+// diagnose and the error is returned as it is.
+func diagnoseFailure(ctx context.Context, clients *targetClients, jobID string, target deploymentTarget, deploymentID string, result *TargetResult, err error) error {
+	output, getErr := clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(deploymentID),
+	})
+	if getErr != nil {
+		log.Printf("Warning: Could not get deployment %s for diagnostics: %v", deploymentID, getErr)
+		return err
+	}
+	info := output.DeploymentInfo
+	finished := deploymentFailed(info)
+	instancesFailed := result.Instances != nil && result.Instances.Failed > 0
+	if !finished && !instancesFailed {
+		return err
+	}
+
+	// We list the failed targets once, for the bundle and the instances
+	var diagnostics *failureDiagnostics
+	var targets []targetDiagnostics
+	if finished {
+		diagnostics, result.Diagnostics = recordFailureDiagnostics(ctx, clients, jobID, target, info)
+		targets = diagnostics.Targets
+	} else {
+		var listErr error
+		targets, listErr = failedTargets(ctx, clients, deploymentID)
+		if listErr != nil {
+			log.Printf("Warning: Could not get instance diagnostics: %v", listErr)
+		}
+	}
+	if instancesFailed {
+		err = diagnoseServerFailure(result, targets, err)
+	}
+	if diagnostics == nil {
+		return err
+	}
+
+	// Server deployments already name their failed instances
+	summary := diagnostics.summary(result.FailedInstances != nil, result.Diagnostics)
+	if summary == "" {
+		return err
+	}
+	log.Printf("Diagnostics for deployment %s: %s", deploymentID, summary)
+	return fmt.Errorf("%v (%s)", err, summary)
+}
+
+// deploymentFailed reports whether the deployment failed or was stopped,
+// which are the deployments we diagnose
+func deploymentFailed(info *types.DeploymentInfo) bool {
+	return info.Status == types.DeploymentStatusFailed || info.Status == types.DeploymentStatusStopped
+}
+
+// recordFailureDiagnostics collects the bundle of a failed or stopped
+// deployment and writes it to the diagnostics location, if there is one.
+// It returns the bundle and where it went. Jobs and deployment events both
+// record their diagnostics through it.
+func recordFailureDiagnostics(ctx context.Context, clients *targetClients, jobID string, target deploymentTarget, info *types.DeploymentInfo) (*failureDiagnostics, string) {
+	diagnostics := collectFailureDiagnostics(ctx, clients, jobID, target, info)
+	if cfg.DiagnosticsLocation == "" {
+		return diagnostics, ""
+	}
+	location, err := writeDiagnostics(ctx, s3Client, cfg.DiagnosticsLocation, diagnostics)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return diagnostics, location
+}
+
+// collectFailureDiagnostics builds the bundle from the deployment, its
+// failed targets and its group's alarms. What it cannot get is noted in
+// the bundle rather than failing the collection.
+func collectFailureDiagnostics(ctx context.Context, clients *targetClients, jobID string, target deploymentTarget, info *types.DeploymentInfo) *failureDiagnostics {
+	d := &failureDiagnostics{
+		JobID:               jobID,
+		ApplicationName:     target.ApplicationName,
+		DeploymentGroupName: target.DeploymentGroupName,
+		Region:              target.Region,
+		DeploymentID:        aws.ToString(info.DeploymentId),
+		ComputePlatform:     string(info.ComputePlatform),
+		Status:              string(info.Status),
+		StatusMessages:      info.DeploymentStatusMessages,
+		CollectedAt:         time.Now().UTC(),
+	}
+	if e := info.ErrorInformation; e != nil {
+		d.ErrorCode = string(e.Code)
+		d.ErrorMessage = aws.ToString(e.Message)
+	}
+	if info.DeploymentOverview != nil {
+		d.Instances = newInstanceSummary(info.DeploymentOverview)
+	}
+	if r := info.RollbackInfo; r != nil && (r.RollbackDeploymentId != nil || r.RollbackMessage != nil) {
+		d.Rollback = &rollbackDiagnostics{
+			DeploymentID: aws.ToString(r.RollbackDeploymentId),
+			Message:      aws.ToString(r.RollbackMessage),
+		}
+	}
+
+	targets, err := failedTargets(ctx, clients, d.DeploymentID)
+	if err != nil {
+		d.CollectionErrors = append(d.CollectionErrors, err.Error())
+	}
+	d.Targets = targets
+
+	alarms, err := deploymentAlarms(ctx, clients, target, info)
+	if err != nil {
+		d.CollectionErrors = append(d.CollectionErrors, err.Error())
+	}
+	d.Alarms = alarms
+
+	for _, e := range d.CollectionErrors {
+		log.Printf("Warning: Incomplete diagnostics for deployment %s: %s", d.DeploymentID, e)
+	}
+	return d
+}
+
+// failedTargets returns the failed targets of a deployment of any compute
+// platform, with all their lifecycle events
+func failedTargets(ctx context.Context, clients *targetClients, deploymentID string) ([]targetDiagnostics, error) {
+	var targetIDs []string
+	input := &codedeploy.ListDeploymentTargetsInput{
+		DeploymentId: aws.String(deploymentID),
+		TargetFilters: map[string][]string{
+			string(types.TargetFilterNameTargetStatus): {string(types.TargetStatusFailed)},
+		},
+	}
+	for {
+		page, err := clients.CodeDeploy.ListDeploymentTargets(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list failed targets: %v", err)
+		}
+		targetIDs = append(targetIDs, page.TargetIds...)
+		if page.NextToken == nil || len(targetIDs) >= maxDiagnosedTargets {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	if len(targetIDs) > maxDiagnosedTargets {
+		targetIDs = targetIDs[:maxDiagnosedTargets]
+	}
+
+	var targets []targetDiagnostics
+	for start := 0; start < len(targetIDs); start += batchGetDeploymentTargetsLimit {
+		end := min(start+batchGetDeploymentTargetsLimit, len(targetIDs))
+		result, err := clients.CodeDeploy.BatchGetDeploymentTargets(ctx, &codedeploy.BatchGetDeploymentTargetsInput{
+			DeploymentId: aws.String(deploymentID),
+			TargetIds:    targetIDs[start:end],
+		})
+		if err != nil {
+			return targets, fmt.Errorf("failed to get failed targets: %v", err)
+		}
+		for _, target := range result.DeploymentTargets {
+			targets = append(targets, newTargetDiagnostics(target))
+		}
+	}
+	return targets, nil
+}
+
+func newTargetDiagnostics(target types.DeploymentTarget) targetDiagnostics {
+	t := targetDiagnostics{TargetType: string(target.DeploymentTargetType)}
+	var events []types.LifecycleEvent
+	switch {
+	case target.InstanceTarget != nil:
+		t.TargetID, t.Status, events = aws.ToString(target.InstanceTarget.TargetId), string(target.InstanceTarget.Status), target.InstanceTarget.LifecycleEvents
+	case target.LambdaTarget != nil:
+		t.TargetID, t.Status, events = aws.ToString(target.LambdaTarget.TargetId), string(target.LambdaTarget.Status), target.LambdaTarget.LifecycleEvents
+	case target.EcsTarget != nil:
+		t.TargetID, t.Status, events = aws.ToString(target.EcsTarget.TargetId), string(target.EcsTarget.Status), target.EcsTarget.LifecycleEvents
+	case target.CloudFormationTarget != nil:
+		t.TargetID, t.Status, events = aws.ToString(target.CloudFormationTarget.TargetId), string(target.CloudFormationTarget.Status), target.CloudFormationTarget.LifecycleEvents
+	}
+
+	t.LifecycleEvents = []lifecycleEventDiagnostics{}
+	for _, event := range events {
+		e := lifecycleEventDiagnostics{
+			Name:      aws.ToString(event.LifecycleEventName),
+			Status:    string(event.Status),
+			StartTime: event.StartTime,
+			EndTime:   event.EndTime,
+		}
+		if diag := event.Diagnostics; diag != nil {
+			e.ErrorCode = string(diag.ErrorCode)
+			e.ScriptName = aws.ToString(diag.ScriptName)
+			e.Message = aws.ToString(diag.Message)
+			e.LogTail = aws.ToString(diag.LogTail)
+		}
+		t.LifecycleEvents = append(t.LifecycleEvents, e)
+	}
+	return t
+}
+
+// deploymentAlarms returns the alarms watching the deployment: its own
+// override, or else its group's. If an alarm stopped it, CodeDeploy names
+// the alarm in the error message.
+func deploymentAlarms(ctx context.Context, clients *targetClients, target deploymentTarget, info *types.DeploymentInfo) (*alarmDiagnostics, error) {
+	var alarms *alarmDiagnostics
+	if e := info.ErrorInformation; e != nil && e.Code == types.ErrorCodeAlarmActive {
+		alarms = &alarmDiagnostics{Triggered: activatedAlarms(aws.ToString(e.Message))}
+	}
+
+	config := info.OverrideAlarmConfiguration
+	if config == nil || !config.Enabled {
+		group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+			ApplicationName:     aws.String(target.ApplicationName),
+			DeploymentGroupName: aws.String(target.DeploymentGroupName),
+		})
+		if err != nil {
+			return alarms, fmt.Errorf("failed to get the alarms of %s: %v", target, err)
+		}
+		config = group.DeploymentGroupInfo.AlarmConfiguration
+	}
+	if config == nil || len(config.Alarms) == 0 {
+		return alarms, nil
+	}
+
+	if alarms == nil {
+		alarms = &alarmDiagnostics{}
+	}
+	alarms.Enabled = config.Enabled
+	for _, alarm := range config.Alarms {
+		alarms.Configured = append(alarms.Configured, aws.ToString(alarm.Name))
+	}
+	return alarms, nil
+}
+
+// activatedAlarms parses the alarm names out of an ALARM_ACTIVE message
+func activatedAlarms(message string) []string {
+	_, names, ok := strings.Cut(message, activatedAlarmsPrefix)
+	if !ok {
+		return nil
+	}
+	var alarms []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(name), ".")); name != "" {
+			alarms = append(alarms, name)
+		}
+	}
+	return alarms
+}
+
+// summary is the part of the bundle that fits in a failure message: the
+// alarms that stopped the deployment, its failed targets, its rollback and
+// where to find the rest. skipInstances leaves out instance targets
+// already reported elsewhere.
+func (d *failureDiagnostics) summary(skipInstances bool, location string) string {
+	var parts []string
+
+	if a := d.Alarms; a != nil && d.ErrorCode == string(types.ErrorCodeAlarmActive) {
+		switch {
+		case len(a.Triggered) > 0:
+			parts = append(parts, "stopped by alarm "+strings.Join(a.Triggered, ", "))
+		case len(a.Configured) > 0:
+			parts = append(parts, "stopped by one of the alarms "+strings.Join(a.Configured, ", "))
+		default:
+			parts = append(parts, "stopped by an alarm")
+		}
+	} else if d.ErrorCode != "" {
+		parts = append(parts, "error code "+d.ErrorCode)
+	}
+
+	var failed []string
+	for _, t := range d.Targets {
+		if skipInstances && t.TargetType == string(types.DeploymentTargetTypeInstanceTarget) {
+			continue
+		}
+		failed = append(failed, t.String())
+	}
+	if len(failed) > maxSummarizedTargets {
+		failed = append(failed[:maxSummarizedTargets], fmt.Sprintf("and %d more", len(failed)-maxSummarizedTargets))
+	}
+	if len(failed) > 0 {
+		parts = append(parts, "failed targets: "+strings.Join(failed, "; "))
+	}
+
+	if r := d.Rollback; r != nil {
+		rollback := "rollback"
+		if r.DeploymentID != "" {
+			rollback += " " + r.DeploymentID
+		}
+		if r.Message != "" {
+			rollback += ": " + r.Message
+		}
+		parts = append(parts, rollback)
+	}
+
+	if location != "" {
+		parts = append(parts, "diagnostics at "+location)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// diagnosticsKey places a bundle by group and deployment ID, so it can be
+// found from the deployment alone
+func diagnosticsKey(prefix string, d *failureDiagnostics) string {
+	return path.Join(prefix, d.ApplicationName, d.DeploymentGroupName, d.DeploymentID+".json")
+}
+
+// writeDiagnostics stores the bundle under location and returns where it
+// went. A redelivered job diagnoses the same deployment again, so a bundle
+// is simply replaced.
+func writeDiagnostics(ctx context.Context, client s3API, location string, d *failureDiagnostics) (string, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal diagnostics: %v", err)
+	}
+
+	key := diagnosticsKey(prefix, d)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write diagnostics to s3://%s/%s: %v", bucket, key, err)
+	}
+
+	location = fmt.Sprintf("s3://%s/%s", bucket, key)
+	log.Printf("Diagnostics for deployment %s written to %s", d.DeploymentID, location)
+	return location, nil
+}
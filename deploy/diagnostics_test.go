@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+func TestFailureDiagnostics(t *testing.T) {
+	tests := []struct {
+		name        string
+		scenario    fakeaws.Scenario
+		wantFailure []string
+		check       func(t *testing.T, d failureDiagnostics)
+	}{
+		{
+			name: "failed instance",
+			scenario: fakeaws.Scenario{
+				Outcome:        fakeaws.StatusFailed,
+				Instances:      []string{"i-1", "i-2"},
+				FailedInstance: "i-2",
+				ScriptName:     "scripts/migrate.sh",
+				LogTail:        "migration 42 failed",
+			},
+			wantFailure: []string{"i-2 failed AfterInstall in scripts/migrate.sh"},
+			check: func(t *testing.T, d failureDiagnostics) {
+				if len(d.Targets) != 1 || d.Targets[0].TargetID != "i-2" || len(d.Targets[0].LifecycleEvents) != 4 {
+					t.Fatalf("targets = %+v, want i-2 with its 4 lifecycle events", d.Targets)
+				}
+				event := d.Targets[0].failedEvent()
+				if event == nil || event.Name != "AfterInstall" || event.ErrorCode != "ScriptFailed" || event.LogTail != "migration 42 failed" {
+					t.Errorf("failed event = %+v, want AfterInstall with the script's log tail", event)
+				}
+				if d.Instances == nil || d.Instances.Failed != 1 || d.Instances.Succeeded != 1 {
+					t.Errorf("instances = %+v, want 1 failed and 1 succeeded", d.Instances)
+				}
+			},
+		},
+		{
+			name: "stopped by an alarm and rolled back",
+			scenario: fakeaws.Scenario{
+				Outcome:        fakeaws.StatusStopped,
+				Alarms:         []string{"api-5xx", "api-latency"},
+				TriggeredAlarm: "api-5xx",
+				AutoRollback:   true,
+			},
+			wantFailure: []string{"stopped by alarm api-5xx", "rollback: Automatic rollback was skipped"},
+			check: func(t *testing.T, d failureDiagnostics) {
+				want := &alarmDiagnostics{Enabled: true, Configured: []string{"api-5xx", "api-latency"}, Triggered: []string{"api-5xx"}}
+				if !reflect.DeepEqual(d.Alarms, want) {
+					t.Errorf("alarms = %+v, want %+v", d.Alarms, want)
+				}
+				if d.Status != "Stopped" || d.ErrorCode != "ALARM_ACTIVE" || d.Rollback == nil {
+					t.Errorf("diagnostics = %+v, want a stop by an alarm with rollback info", d)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, _ := localAWS(t)
+			fake.SetScenario("api", "api-live", tt.scenario)
+			t.Setenv("DIAGNOSTICS_LOCATION", "s3://diagnostics/failures")
+
+			report, job, err := e2eJob(t, fake, "")
+			if err == nil || job.Status != "Failed" {
+				t.Fatalf("job = %+v, want a failure", job)
+			}
+
+			deploymentID := report.Targets[0].DeploymentID
+			location := "s3://diagnostics/failures/api/api-live/" + deploymentID + ".json"
+			for _, want := range append(tt.wantFailure, "diagnostics at "+location) {
+				if strings.Count(job.FailureMessage, want) != 1 {
+					t.Errorf("failure message %q does not contain %q once", job.FailureMessage, want)
+				}
+			}
+			if got := report.Targets[0].Diagnostics; got != location {
+				t.Errorf("report diagnostics = %q, want %q", got, location)
+			}
+
+			data, ok := fake.Object("diagnostics", "failures/api/api-live/"+deploymentID+".json")
+			if !ok {
+				t.Fatalf("no diagnostic bundle at %s", location)
+			}
+			var d failureDiagnostics
+			if err := json.Unmarshal(data, &d); err != nil {
+				t.Fatalf("invalid diagnostic bundle: %v", err)
+			}
+			if d.JobID != "job-1" || d.DeploymentID != deploymentID {
+				t.Errorf("bundle is for job %s and deployment %s, want job-1 and %s", d.JobID, d.DeploymentID, deploymentID)
+			}
+			tt.check(t, d)
+		})
+	}
+}
+
+func TestActivatedAlarms(t *testing.T) {
+	message := "One or more alarms have been activated according to the Amazon CloudWatch metrics you selected, and the affected deployments have been stopped. Activated alarms: api-5xx, api-latency."
+	if got, want := activatedAlarms(message), []string{"api-5xx", "api-latency"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("activatedAlarms() = %v, want %v", got, want)
+	}
+	if got := activatedAlarms("The deployment was stopped"); got != nil {
+		t.Errorf("activatedAlarms() = %v, want none", got)
+	}
+}
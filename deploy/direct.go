@@ -0,0 +1,246 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DirectInvocation is a payload sent straight to the deploy Lambda, rather
+// than by CodePipeline. Action names what to run, and the fields of its
+// request sit beside it, e.g.
+// {"action":"rollback","applicationName":"api","deploymentGroupName":"api-live"}.
+// Only the request of the action is set.
+type DirectInvocation struct {
+	Action   string           `json:"-"`
+	Deploy   *DeployRequest   `json:"-"`
+	Status   *StatusRequest   `json:"-"`
+	Rollback *RollbackRequest `json:"-"`
+}
+
+// request returns the request of the action, which is left for decoding
+// into when it is not set yet
+func (d *DirectInvocation) request() (any, error) {
+	switch d.Action {
+	case "deploy":
+		if d.Deploy == nil {
+			d.Deploy = &DeployRequest{}
+		}
+		return d.Deploy, nil
+	case "status":
+		if d.Status == nil {
+			d.Status = &StatusRequest{}
+		}
+		return d.Status, nil
+	case "rollback":
+		if d.Rollback == nil {
+			d.Rollback = &RollbackRequest{}
+		}
+		return d.Rollback, nil
+	}
+	return nil, fmt.Errorf("unknown action %q: expected deploy, status or rollback", d.Action)
+}
+
+// MarshalJSON writes the action beside its request's fields
+func (d DirectInvocation) MarshalJSON() ([]byte, error) {
+	req, err := d.request()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["action"], _ = json.Marshal(d.Action)
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON reads the action, then its request from the same fields
+func (d *DirectInvocation) UnmarshalJSON(data []byte) error {
+	var head struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return err
+	}
+	*d = DirectInvocation{Action: head.Action}
+	req, err := d.request()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, req); err != nil {
+		return fmt.Errorf("invalid %s action: %v", d.Action, err)
+	}
+	return nil
+}
+
+// TargetRef names the deployment group of a direct invocation
+type TargetRef struct {
+	ApplicationName     string `json:"applicationName"`
+	DeploymentGroupName string `json:"deploymentGroupName"`
+
+	// Region, RoleARN and ExternalID reach a group in another region or
+	// account that is not in the configured targets
+	Region     string `json:"region,omitempty"`
+	RoleARN    string `json:"roleArn,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+}
+
+// DeployRequest deploys an S3 bundle to one group without a pipeline. It is
+// the request of a direct invocation's "deploy" action.
+type DeployRequest struct {
+	TargetRef
+
+	S3BucketName string `json:"s3BucketName"`
+	S3ObjectKey  string `json:"s3ObjectKey"`
+
+	// RequestID names the deployment, so a retried request resumes the
+	// deployment it already created instead of starting another
+	RequestID string `json:"requestId,omitempty"`
+
+	// Reason is kept in the report and the audit log
+	Reason string `json:"reason,omitempty"`
+
+	// EmergencyOverride deploys during a change freeze, as the pipeline's
+	// UserParameters do
+	EmergencyOverride bool   `json:"emergencyOverride,omitempty"`
+	OverrideReason    string `json:"overrideReason,omitempty"`
+
+	// DryRun returns the deployment plan in the report instead of deploying
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// SourceBranch is the branch the bundle was built from, which the
+	// deployment policy may restrict
+	SourceBranch string `json:"sourceBranch,omitempty"`
+}
+
+// DirectDeployInfo records a direct deployment in its report
+type DirectDeployInfo struct {
+	RequestID string `json:"requestId"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Deploy deploys a bundle to one group with the same change calendar,
+// validation, monitoring and audit as a pipeline job, and returns the report
+func Deploy(ctx context.Context, req DeployRequest) (*DeploymentReport, error) {
+	if awsCfgErr != nil {
+		return nil, awsCfgErr
+	}
+	if cfgErr != nil {
+		return nil, cfgErr
+	}
+	if req.ApplicationName == "" || req.DeploymentGroupName == "" || req.S3BucketName == "" || req.S3ObjectKey == "" {
+		return nil, fmt.Errorf("deploy needs an applicationName, a deploymentGroupName, an s3BucketName and an s3ObjectKey")
+	}
+	if req.EmergencyOverride && req.OverrideReason == "" {
+		return nil, fmt.Errorf("emergencyOverride needs an overrideReason")
+	}
+
+	requestID := req.RequestID
+	if requestID == "" {
+		requestID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	jobID := "direct-" + requestID
+	report := newDeploymentReport(jobID)
+	report.Direct = &DirectDeployInfo{RequestID: requestID, Reason: req.Reason}
+	report.Revision.BucketName = req.S3BucketName
+	report.Revision.ObjectKey = req.S3ObjectKey
+	report.Revision.SourceBranch = req.SourceBranch
+
+	// There is no CodePipeline job to hand a long freeze back to, so a
+	// direct deployment fails instead of waiting
+	params := userParameters{EmergencyOverride: req.EmergencyOverride, OverrideReason: req.OverrideReason}
+	dryRun := req.DryRun || cfg.DryRun
+	if !dryRun {
+		if err := checkChangeCalendar(ctx, jobID, params, jobContinuation{}, report); err != nil {
+			var waiting *errWaitingForFreeze
+			if errors.As(err, &waiting) {
+				err = waiting.freeze
+			}
+			recordAudit(ctx, report, err)
+			return report, err
+		}
+	}
+
+	bundle := inspectArtifact(ctx, req.S3BucketName, req.S3ObjectKey, report)
+	target := findTarget(ctx, req.TargetRef)
+	deployReq := deployRequest{
+		JobID:        jobID,
+		S3BucketName: req.S3BucketName,
+		S3ObjectKey:  req.S3ObjectKey,
+		Bundle:       bundle,
+		Description:  "Direct deployment " + requestID,
+		SourceBranch: req.SourceBranch,
+	}
+	if dryRun {
+		err := planDeployment(ctx, deployReq, singleTargetPlan(target), params, report)
+		report.complete()
+		log.Printf("%s", report.PlanSummary())
+		if err != nil {
+			return report, fmt.Errorf("%v\n%s", err, report.PlanSummary())
+		}
+		return report, nil
+	}
+
+	log.Printf("Deploying s3://%s/%s to %s for request %s", req.S3BucketName, req.S3ObjectKey, target, requestID)
+	if err := runDirect(ctx, deployReq, target, report); err != nil {
+		return report, fmt.Errorf("deployment to %s failed: %v", target, err)
+	}
+	return report, nil
+}
+
+// runDirect deploys to a single target outside of a pipeline and records
+// the outcome in the audit log
+func runDirect(ctx context.Context, req deployRequest, target deploymentTarget, report *DeploymentReport) error {
+	err := runPlan(ctx, req, singleTargetPlan(target), jobContinuation{}, report)
+	report.complete()
+	recordAudit(ctx, report, err)
+	return err
+}
+
+// findTarget finds the group among the configured targets, so a direct
+// invocation runs the same health checks, and otherwise targets it by name
+func findTarget(ctx context.Context, ref TargetRef) deploymentTarget {
+	var candidates []deploymentTarget
+	if cfg.ApplicationName != "" {
+		candidates = append(candidates, defaultTarget())
+	}
+	if cfg.WavePlan != "" {
+		if plan, err := parseWavePlan(cfg.WavePlan); err == nil {
+			candidates = append(candidates, plan.targets()...)
+		}
+	}
+	if cfg.DeploymentMappingLocation != "" {
+		doc, err := mappings.get(ctx)
+		if err != nil {
+			log.Printf("Warning: Could not load the mapping document to find %s/%s: %v", ref.ApplicationName, ref.DeploymentGroupName, err)
+		} else {
+			for _, m := range doc.Pipelines {
+				candidates = append(candidates, m.plan().targets()...)
+			}
+		}
+	}
+
+	for _, t := range candidates {
+		if t.ApplicationName == ref.ApplicationName && t.DeploymentGroupName == ref.DeploymentGroupName &&
+			(ref.Region == "" || t.Region == ref.Region) {
+			return t
+		}
+	}
+
+	return deploymentTarget{
+		ApplicationName:     ref.ApplicationName,
+		DeploymentGroupName: ref.DeploymentGroupName,
+		Region:              ref.Region,
+		RoleARN:             ref.RoleARN,
+		ExternalID:          ref.ExternalID,
+	}
+}
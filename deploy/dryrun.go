@@ -0,0 +1,371 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// What a dry run plans to do with a target
+const (
+	planCreate = "Create"
+	planResume = "Resume"
+	planSkip   = "Skip"
+)
+
+// DeploymentPlan is what a dry run reports instead of deploying: the
+// deployment each target would get and the checks it would go through.
+// The job-level checks, such as the change calendar, are in the report's
+// Validations.
+type DeploymentPlan struct {
+	Waves             []*PlannedWave `json:"waves"`
+	RollbackOnFailure bool           `json:"rollbackOnFailure,omitempty"`
+}
+
+// PlannedWave is one wave of a dry run
+type PlannedWave struct {
+	Name     string           `json:"name"`
+	Targets  []*PlannedTarget `json:"targets"`
+	BakeTime string           `json:"bakeTime,omitempty"`
+
+	// Checks run after the bake, before the next wave starts
+	Checks []string `json:"checks,omitempty"`
+}
+
+// PlannedTarget is the deployment a dry run would make to one group
+type PlannedTarget struct {
+	ApplicationName      string `json:"applicationName"`
+	DeploymentGroupName  string `json:"deploymentGroupName"`
+	Region               string `json:"region,omitempty"`
+	ComputePlatform      string `json:"computePlatform,omitempty"`
+	DeploymentConfigName string `json:"deploymentConfigName,omitempty"`
+
+	// Action is Create for a new deployment, Resume for the one an earlier
+	// delivery of the job created, or Skip when the revision is already live
+	Action       string          `json:"action"`
+	DeploymentID string          `json:"deploymentId,omitempty"`
+	Revision     PlannedRevision `json:"revision"`
+
+	// Checks are what the deployment would go through, and Validations
+	// the results of the ones the dry run ran
+	Checks      []string           `json:"checks"`
+	Validations []ValidationResult `json:"validations"`
+}
+
+// PlannedRevision is the revision a deployment would be created with
+type PlannedRevision struct {
+	Type           string `json:"type,omitempty"`
+	BucketName     string `json:"bucketName,omitempty"`
+	ObjectKey      string `json:"objectKey,omitempty"`
+	ETag           string `json:"eTag,omitempty"`
+	VersionID      string `json:"versionId,omitempty"`
+	TaskDefinition string `json:"taskDefinition,omitempty"`
+}
+
+// planDeployment runs everything a deployment of the wave plan would run
+// before CreateDeployment, and records the plan in the report. It returns
+// an error if any check failed, since the deployment would have too.
+func planDeployment(ctx context.Context, req deployRequest, plan wavePlan, params userParameters, report *DeploymentReport) error {
+	log.Printf("Dry run for job %s: planning %d waves without deploying", req.JobID, len(plan.Waves))
+	req.DryRun = true
+	report.Plan = &DeploymentPlan{RollbackOnFailure: plan.RollbackOnFailure}
+	planChangeCalendar(ctx, params, report)
+
+	for i, w := range plan.Waves {
+		planned := &PlannedWave{Name: w.label(i), Checks: w.plannedChecks()}
+		if w.BakeTime > 0 {
+			planned.BakeTime = time.Duration(w.BakeTime).String()
+		}
+		for _, target := range w.Targets {
+			planned.Targets = append(planned.Targets, planTarget(ctx, req, target))
+		}
+		report.Plan.Waves = append(report.Plan.Waves, planned)
+	}
+
+	var failures []string
+	for _, v := range report.Validations {
+		if !v.Passed {
+			failures = append(failures, fmt.Sprintf("%s: %s", v.Name, v.Message))
+		}
+	}
+	for _, w := range report.Plan.Waves {
+		for _, t := range w.Targets {
+			for _, v := range t.Validations {
+				if !v.Passed {
+					failures = append(failures, fmt.Sprintf("%s/%s %s: %s", t.ApplicationName, t.DeploymentGroupName, v.Name, v.Message))
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("dry run found %d problems: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// planChangeCalendar checks the calendar as checkChangeCalendar does, but
+// reports a freeze instead of waiting for it to end
+func planChangeCalendar(ctx context.Context, params userParameters, report *DeploymentReport) {
+	checkStart := time.Now()
+	calendar, err := calendars.get(ctx)
+	if err == nil && calendar == nil {
+		return
+	}
+	if err == nil {
+		if freeze := calendar.checkFreeze(time.Now()); freeze != nil {
+			if params.EmergencyOverride {
+				report.EmergencyOverride = &emergencyOverride{Reason: params.OverrideReason, Freeze: freeze.Error()}
+			} else {
+				err = freeze
+			}
+		}
+	}
+	report.addValidation("change calendar", err, time.Since(checkStart))
+}
+
+// planTarget works out the deployment deployToTarget would make, running
+// its validation but nothing that changes the target
+func planTarget(ctx context.Context, req deployRequest, target deploymentTarget) *PlannedTarget {
+	planned := &PlannedTarget{
+		ApplicationName:     target.ApplicationName,
+		DeploymentGroupName: target.DeploymentGroupName,
+		Region:              target.Region,
+		Action:              planCreate,
+		Checks:              target.plannedChecks(),
+		Validations:         []ValidationResult{},
+	}
+	fail := func(name string, err error) *PlannedTarget {
+		planned.Validations = append(planned.Validations, newValidationResult(name, err, 0))
+		return planned
+	}
+
+	clients, err := targetClientCache.forTarget(ctx, target)
+	if err != nil {
+		return fail("target clients", err)
+	}
+
+	// A missing group fails the pre-deployment validation below
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+	})
+	if err == nil {
+		planned.ComputePlatform = string(group.DeploymentGroupInfo.ComputePlatform)
+		planned.DeploymentConfigName = aws.ToString(group.DeploymentGroupInfo.DeploymentConfigName)
+	}
+
+	deploymentID, err := findDeploymentForJob(ctx, clients, target.ApplicationName, target.DeploymentGroupName, req.JobID)
+	if err != nil {
+		log.Printf("Warning: Could not check for an existing deployment for job %s: %v", req.JobID, err)
+	} else if deploymentID != "" {
+		planned.Action, planned.DeploymentID = planResume, deploymentID
+		return planned
+	}
+	if target.SkipUnchangedRevisions {
+		liveDeploymentID, err := findLiveRevision(ctx, clients, target.ApplicationName, target.DeploymentGroupName, req.Bundle)
+		if err != nil {
+			log.Printf("Warning: Could not compare with the live revision: %v", err)
+		} else if liveDeploymentID != "" {
+			planned.Action, planned.DeploymentID = planSkip, liveDeploymentID
+			return planned
+		}
+	}
+
+	copyBucket, err := artifactCopyBucket(req, target, clients)
+	if err != nil {
+		return fail("artifact staging", err)
+	}
+
+	result := &TargetResult{Validations: []ValidationResult{}}
+	input, err := prepareDeployment(ctx, clients, req, target, result)
+	planned.Validations = result.Validations
+	if err != nil {
+		// Validation failures are recorded already, anything else is not
+		if n := len(planned.Validations); n == 0 || planned.Validations[n-1].Passed {
+			return fail("revision", err)
+		}
+		return planned
+	}
+
+	planned.Revision = plannedRevision(input.Revision, result.TaskDefinitionArn)
+	if copyBucket != "" {
+		// The copy gets its own ETag and version when it is made
+		planned.Revision.BucketName, planned.Revision.ETag, planned.Revision.VersionID = copyBucket, "", ""
+		planned.Checks = append([]string{fmt.Sprintf("staging: the artifact is copied to s3://%s in %s", copyBucket, clients.Region)}, planned.Checks...)
+	}
+	return planned
+}
+
+func plannedRevision(revision *types.RevisionLocation, taskDefinition string) PlannedRevision {
+	if revision == nil {
+		return PlannedRevision{}
+	}
+	planned := PlannedRevision{Type: string(revision.RevisionType), TaskDefinition: taskDefinition}
+	if location := revision.S3Location; location != nil {
+		planned.BucketName = aws.ToString(location.Bucket)
+		planned.ObjectKey = aws.ToString(location.Key)
+		planned.ETag = aws.ToString(location.ETag)
+		planned.VersionID = aws.ToString(location.Version)
+	}
+	return planned
+}
+
+// plannedChecks lists what deployToTarget checks, in order
+func (t deploymentTarget) plannedChecks() []string {
+	checks := []string{"pre-deployment: the deployment group exists, the artifact is readable and no deployment is in progress"}
+	if t.HealthCheckURL != "" {
+		checks = append(checks, "pre-deployment: GET "+t.HealthCheckURL)
+	}
+	if t.HealthCheck != nil {
+		checks = append(checks, "pre-deployment: invoke "+t.HealthCheck.String())
+	}
+	if policyConfigured() {
+		checks = append(checks, "policy: the deployment passes the deployment policy's rules")
+	}
+	if t.Platform != platformECS {
+		checks = append(checks, "appspec: the bundle has an AppSpec at its root")
+	}
+	checks = append(checks, fmt.Sprintf("monitoring: the deployment succeeds within %v", cfg.MaxDeploymentWaitTime))
+	if t.MinHealthyHosts != nil {
+		checks = append(checks, "monitoring: at least "+t.MinHealthyHosts.String()+" of the hosts stay healthy")
+	}
+	checks = append(checks, "post-deployment: every deployment target succeeded")
+	if t.AppHealthCheckURL != "" {
+		checks = append(checks, "post-deployment: GET "+t.AppHealthCheckURL)
+	}
+	if t.AppHealthCheck != nil {
+		checks = append(checks, "post-deployment: invoke "+t.AppHealthCheck.String())
+	}
+	return checks
+}
+
+// plannedChecks lists what checkWaveHealth checks after the bake
+func (w wave) plannedChecks() []string {
+	if w.BakeTime == 0 && w.HealthCheckURL == "" && w.HealthCheck == nil {
+		return nil
+	}
+	var checks []string
+	for _, t := range w.Targets {
+		if t.AppHealthCheckURL != "" {
+			checks = append(checks, fmt.Sprintf("%s: GET %s", t, t.AppHealthCheckURL))
+		}
+		if t.AppHealthCheck != nil {
+			checks = append(checks, fmt.Sprintf("%s: invoke %s", t, t.AppHealthCheck))
+		}
+	}
+	if w.HealthCheckURL != "" {
+		checks = append(checks, "wave: GET "+w.HealthCheckURL)
+	}
+	if w.HealthCheck != nil {
+		checks = append(checks, "wave: invoke "+w.HealthCheck.String())
+	}
+	return checks
+}
+
+// PlanSummary describes a dry run's plan, one line per item, for the
+// CodePipeline console, the logs and pipelinectl
+func (r *DeploymentReport) PlanSummary() string {
+	if r.Plan == nil {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dry run for job %s, nothing was deployed\n", r.JobID)
+	if r.Revision.BucketName != "" {
+		fmt.Fprintf(&b, "Artifact: s3://%s/%s", r.Revision.BucketName, r.Revision.ObjectKey)
+		if r.Revision.ETag != "" {
+			fmt.Fprintf(&b, " etag %s", r.Revision.ETag)
+		}
+		if r.Revision.VersionID != "" {
+			fmt.Fprintf(&b, " version %s", r.Revision.VersionID)
+		}
+		if r.Revision.BundleSha256 != "" {
+			fmt.Fprintf(&b, " sha256 %s", r.Revision.BundleSha256)
+		}
+		b.WriteString("\n")
+	}
+	if r.Versions.TargetVersion != "" {
+		fmt.Fprintf(&b, "AppSpec versions: %s -> %s\n", orNone(r.Versions.CurrentVersion), r.Versions.TargetVersion)
+	}
+	for _, v := range r.Validations {
+		fmt.Fprintf(&b, "Check %s: %s\n", v.Name, validationStatus(v))
+	}
+	if r.EmergencyOverride != nil {
+		fmt.Fprintf(&b, "Emergency override of %s: %s\n", r.EmergencyOverride.Freeze, r.EmergencyOverride.Reason)
+	}
+
+	for _, w := range r.Plan.Waves {
+		fmt.Fprintf(&b, "Wave %s:\n", w.Name)
+		for _, t := range w.Targets {
+			fmt.Fprintf(&b, "  %s/%s", t.ApplicationName, t.DeploymentGroupName)
+			if t.Region != "" {
+				fmt.Fprintf(&b, "@%s", t.Region)
+			}
+			switch t.Action {
+			case planResume:
+				fmt.Fprintf(&b, ": resume deployment %s\n", t.DeploymentID)
+			case planSkip:
+				fmt.Fprintf(&b, ": skip, the revision is already live from deployment %s\n", t.DeploymentID)
+			default:
+				fmt.Fprintf(&b, ": create a %s deployment with %s\n", orNone(t.ComputePlatform), orNone(t.DeploymentConfigName))
+			}
+			if rev := t.Revision; rev.Type != "" {
+				fmt.Fprintf(&b, "    revision: %s", rev.Type)
+				if rev.BucketName != "" {
+					fmt.Fprintf(&b, " s3://%s/%s", rev.BucketName, rev.ObjectKey)
+				}
+				if rev.ETag != "" {
+					fmt.Fprintf(&b, " etag %s", rev.ETag)
+				}
+				if rev.VersionID != "" {
+					fmt.Fprintf(&b, " version %s", rev.VersionID)
+				}
+				if rev.TaskDefinition != "" {
+					fmt.Fprintf(&b, " task definition %s", rev.TaskDefinition)
+				}
+				b.WriteString("\n")
+			}
+			for _, v := range t.Validations {
+				fmt.Fprintf(&b, "    %s: %s\n", v.Name, validationStatus(v))
+			}
+			if t.Action == planCreate {
+				b.WriteString("    then:\n")
+				for _, check := range t.Checks {
+					fmt.Fprintf(&b, "      - %s\n", check)
+				}
+			}
+		}
+		if w.BakeTime != "" {
+			fmt.Fprintf(&b, "  bake for %s\n", w.BakeTime)
+		}
+		if len(w.Checks) > 0 {
+			b.WriteString("  then check the wave:\n")
+			for _, check := range w.Checks {
+				fmt.Fprintf(&b, "    - %s\n", check)
+			}
+		}
+	}
+	if r.Plan.RollbackOnFailure {
+		b.WriteString("On failure, roll back the groups already deployed\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func validationStatus(v ValidationResult) string {
+	if v.Passed {
+		return "passed"
+	}
+	return "failed: " + v.Message
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
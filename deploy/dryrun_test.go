@@ -0,0 +1,62 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDryRunPlansWithoutDeploying(t *testing.T) {
+	fake, _ := localAWS(t)
+	report, job, err := e2eJob(t, fake, `{"dryRun": true}`)
+	if err != nil {
+		t.Fatalf("RunJob() returned error: %v", err)
+	}
+
+	if job.Status != "Succeeded" || job.OutputVariables["dryRun"] != "true" || !strings.HasPrefix(job.Summary, "Dry run for job job-1") {
+		t.Errorf("job = %+v, want a success with the plan", job)
+	}
+	if calls := fake.Calls("CreateDeployment"); calls != 0 {
+		t.Errorf("CreateDeployment was called %d times, want none", calls)
+	}
+	if report.Plan == nil || len(report.Plan.Waves) != 1 || len(report.Plan.Waves[0].Targets) != 1 {
+		t.Fatalf("plan = %+v, want one wave with one target", report.Plan)
+	}
+
+	target := report.Plan.Waves[0].Targets[0]
+	if target.Action != planCreate || target.ComputePlatform != "Server" || target.DeploymentConfigName != "CodeDeployDefault.OneAtATime" {
+		t.Errorf("target = %+v, want a new Server deployment with the group's config", target)
+	}
+	rev := target.Revision
+	if rev.Type != "S3" || rev.BucketName != "artifacts" || rev.ObjectKey != "build/bundle.zip" || rev.ETag != report.Revision.ETag || rev.ETag == "" {
+		t.Errorf("revision = %+v, want the artifact with its ETag", rev)
+	}
+	if len(target.Validations) != 2 || !target.Validations[0].Passed || !target.Validations[1].Passed {
+		t.Errorf("validations = %+v, want the pre-deployment and AppSpec checks to pass", target.Validations)
+	}
+	if !strings.Contains(report.PlanSummary(), "api/api-live: create a Server deployment with CodeDeployDefault.OneAtATime") {
+		t.Errorf("summary does not describe the deployment:\n%s", report.PlanSummary())
+	}
+}
+
+func TestDryRunReportsFailedChecks(t *testing.T) {
+	fake, _ := localAWS(t)
+	t.Setenv("DRY_RUN", "true")
+	e2eInit(t)
+
+	report, err := Deploy(context.Background(), DeployRequest{
+		TargetRef:    TargetRef{ApplicationName: "api", DeploymentGroupName: "api-live"},
+		S3BucketName: "artifacts",
+		S3ObjectKey:  "missing.zip",
+		RequestID:    "1",
+	})
+	if err == nil || !strings.Contains(err.Error(), "artifact validation failed") || !strings.Contains(err.Error(), "Dry run for job direct-1") {
+		t.Errorf("Deploy() error = %v, want the failed artifact check and the plan", err)
+	}
+	if report == nil || report.Plan == nil {
+		t.Fatalf("report = %+v, want a plan", report)
+	}
+	if calls := fake.Calls("CreateDeployment"); calls != 0 {
+		t.Errorf("CreateDeployment was called %d times, want none", calls)
+	}
+}
@@ -0,0 +1,222 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// e2eInit initializes the handler for the fake AWS server that localAWS
+// serves, so it runs through the SDK's config, retries and wire protocols
+// as the Lambda would. The polling and retry delays are shortened so the
+// scenarios run quickly.
+func e2eInit(t *testing.T) {
+	t.Helper()
+	t.Setenv("APPLICATION_NAME", "api")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "api-live")
+	t.Setenv("RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("RETRY_BASE_DELAY", "1ms")
+	t.Setenv("RETRY_MAX_DELAY", "1ms")
+
+	savedCfg, savedUsePathStyle := cfg, s3UsePathStyle
+	savedInterval, savedMaxInterval := monitorPollInterval, monitorMaxPollInterval
+	t.Cleanup(func() {
+		cfg, cfgErr, s3UsePathStyle = savedCfg, nil, savedUsePathStyle
+		monitorPollInterval, monitorMaxPollInterval = savedInterval, savedMaxInterval
+	})
+	monitorPollInterval, monitorMaxPollInterval = time.Millisecond, time.Millisecond
+
+	awsCfg, err := LoadAWSConfig(context.Background())
+	if err != nil {
+		t.Fatalf("LoadAWSConfig() returned error: %v", err)
+	}
+	awsCfg.Retryer = func() aws.Retryer {
+		return retry.AddWithMaxBackoffDelay(retry.NewStandard(), time.Millisecond)
+	}
+	InitWithConfig(awsCfg)
+	if cfgErr != nil {
+		t.Fatalf("InitWithConfig() failed: %v", cfgErr)
+	}
+}
+
+// e2eJob runs a job with the given UserParameters end to end
+func e2eJob(t *testing.T, fake *fakeaws.Server, userParameters string) (*DeploymentReport, fakeaws.Job, error) {
+	t.Helper()
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}))
+	e2eInit(t)
+
+	var event CodePipelineEvent
+	event.CodePipelineJob.ID = "job-1"
+	event.CodePipelineJob.Nonce = "1"
+	event.CodePipelineJob.Data.ActionConfiguration.Configuration.UserParameters = userParameters
+	event.CodePipelineJob.Data.InputArtifacts = []Artifact{{
+		Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "build/bundle.zip"}},
+	}}
+	report, err := RunJob(context.Background(), event)
+	job, _ := fake.Job("job-1")
+	return report, job, err
+}
+
+func TestEndToEndScenarios(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario fakeaws.Scenario
+		faults   []fakeaws.Fault
+		waitTime string
+
+		// wantFailure is in the job's failure message, or the job succeeds
+		wantFailure []string
+		wantCalls   map[string]int
+	}{
+		{
+			// The post-deployment validation checks the deployment once more
+			name:      "slow success",
+			scenario:  fakeaws.Scenario{InProgressPolls: 3, Instances: []string{"i-1", "i-2"}},
+			wantCalls: map[string]int{"CreateDeployment": 1, "GetDeployment": 5},
+		},
+		{
+			name: "failure on a target",
+			scenario: fakeaws.Scenario{
+				InProgressPolls: 1,
+				Outcome:         fakeaws.StatusFailed,
+				Instances:       []string{"i-1", "i-2"},
+				FailedInstance:  "i-2",
+				ScriptName:      "scripts/migrate.sh",
+				LogTail:         "migration 42 failed",
+			},
+			wantFailure: []string{"i-2 failed AfterInstall in scripts/migrate.sh"},
+		},
+		{
+			name:        "stopped",
+			scenario:    fakeaws.Scenario{InProgressPolls: 1, Outcome: fakeaws.StatusStopped},
+			wantFailure: []string{"stopped"},
+		},
+		{
+			// The SDK retries twice, then our own retry policy tries again
+			name:      "throttled create",
+			faults:    []fakeaws.Fault{{Operation: "CreateDeployment", Count: 4}},
+			wantCalls: map[string]int{"CreateDeployment": 5},
+		},
+		{
+			name:      "burst of server errors while monitoring",
+			scenario:  fakeaws.Scenario{InProgressPolls: 1},
+			faults:    []fakeaws.Fault{{Operation: "GetDeployment", Count: 5, Status: 503}},
+			wantCalls: map[string]int{"CreateDeployment": 1, "GetDeployment": 8},
+		},
+		{
+			name:        "server errors outlast the retries",
+			faults:      []fakeaws.Fault{{Operation: "GetDeployment", Count: 9, Status: 500}},
+			wantFailure: []string{"failed to get deployment status after 3 attempts"},
+		},
+		{
+			name:        "timeout",
+			scenario:    fakeaws.Scenario{InProgressPolls: -1},
+			waitTime:    "50ms",
+			wantFailure: []string{"timed out waiting for deployment"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, _ := localAWS(t)
+			fake.SetScenario("api", "api-live", tt.scenario)
+			for _, fault := range tt.faults {
+				fake.AddFault(fault)
+			}
+			t.Setenv("MAX_DEPLOYMENT_WAIT_TIME", tt.waitTime)
+
+			report, job, err := e2eJob(t, fake, "")
+
+			if len(tt.wantFailure) == 0 {
+				if err != nil {
+					t.Fatalf("RunJob() returned error: %v", err)
+				}
+				if job.Status != "Succeeded" || job.OutputVariables["deploymentId"] != report.DeploymentID {
+					t.Errorf("job = %+v, want a success for deployment %s", job, report.DeploymentID)
+				}
+			} else {
+				if job.Status != "Failed" {
+					t.Fatalf("job = %+v, want a failure", job)
+				}
+				for _, want := range tt.wantFailure {
+					if !strings.Contains(job.FailureMessage, want) {
+						t.Errorf("failure message %q does not contain %q", job.FailureMessage, want)
+					}
+				}
+			}
+
+			for operation, want := range tt.wantCalls {
+				if got := fake.Calls(operation); got != want {
+					t.Errorf("%s was called %d times, want %d", operation, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedeliveredJobResumesDeployment(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.SetScenario("api", "api-live", fakeaws.Scenario{InProgressPolls: 50})
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}))
+	e2eInit(t)
+
+	var event CodePipelineEvent
+	event.CodePipelineJob.ID = "job-1"
+	event.CodePipelineJob.Nonce = "1"
+	event.CodePipelineJob.Data.InputArtifacts = []Artifact{{
+		Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "build/bundle.zip"}},
+	}}
+
+	// The first delivery times out while its deployment is in progress,
+	// too late to report anything to CodePipeline
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for deadline := time.Now().Add(time.Second); fake.Calls("CreateDeployment") == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if _, err := RunJob(ctx, event); err == nil {
+		t.Fatal("RunJob() of the interrupted delivery returned no error")
+	}
+	if job, _ := fake.Job("job-1"); !job.Acknowledged || job.Status != "InProgress" {
+		t.Fatalf("job = %+v, want it acknowledged and nothing reported", job)
+	}
+
+	// Lambda delivers the job again, and it follows the same deployment
+	report, err := RunJob(context.Background(), event)
+	job, _ := fake.Job("job-1")
+	if err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want a success", job, err)
+	}
+	if got := fake.Calls("CreateDeployment"); got != 1 {
+		t.Errorf("%d deployments created, want the first delivery's only", got)
+	}
+	if report.DeploymentID != "d-FAKE00001" {
+		t.Errorf("report deployment = %s, want the first delivery's d-FAKE00001", report.DeploymentID)
+	}
+}
+
+func TestRedeliveredFinishedJobIsIgnored(t *testing.T) {
+	fake, _ := localAWS(t)
+	if _, job, err := e2eJob(t, fake, ""); err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want a success", job, err)
+	}
+
+	// CodePipeline delivers the finished job again, and it is acknowledged
+	// but neither deployed nor reported a second time
+	_, job, err := e2eJob(t, fake, "")
+	if err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want the first delivery's success", job, err)
+	}
+	for operation, want := range map[string]int{"AcknowledgeJob": 2, "CreateDeployment": 1, "PutJobSuccessResult": 1} {
+		if got := fake.Calls(operation); got != want {
+			t.Errorf("%s was called %d times, want %d", operation, got, want)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package deploy
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// platformECS marks a target as an ECS blue/green deployment group. Other
+// targets deploy the bundle itself as an S3 revision.
+const platformECS = "ecs"
+
+// The files a build writes for ECS, named as the CodePipeline ECS
+// blue/green action names them
+const (
+	defaultTaskDefinitionFile = "taskdef.json"
+	defaultImageDetailFile    = "imageDetail.json"
+	defaultImagePlaceholder   = "<IMAGE1_NAME>"
+)
+
+// ecsHooks are the AppSpec lifecycle hooks of an ECS deployment, in the
+// order CodeDeploy runs them
+var ecsHooks = []string{
+	"BeforeInstall",
+	"AfterInstall",
+	"AfterAllowTestTraffic",
+	"BeforeAllowTraffic",
+	"AfterAllowTraffic",
+}
+
+// ecsSettings describe how to build the AppSpec for an ECS target
+type ecsSettings struct {
+	ContainerName   string `json:"containerName"`
+	ContainerPort   int32  `json:"containerPort"`
+	PlatformVersion string `json:"platformVersion,omitempty"`
+
+	// Hooks maps lifecycle hooks to the Lambda functions that run them
+	Hooks map[string]string `json:"hooks,omitempty"`
+
+	// Overrides for the build output file names and image placeholder
+	TaskDefinitionFile string `json:"taskDefinitionFile,omitempty"`
+	ImageDetailFile    string `json:"imageDetailFile,omitempty"`
+	ImagePlaceholder   string `json:"imagePlaceholder,omitempty"`
+}
+
+func (s *ecsSettings) validate() error {
+	if s == nil {
+		return fmt.Errorf("ECS targets need ecs settings with containerName and containerPort")
+	}
+	if s.ContainerName == "" || s.ContainerPort <= 0 {
+		return fmt.Errorf("ECS targets need a containerName and a positive containerPort")
+	}
+	for hook := range s.Hooks {
+		if !slices.Contains(ecsHooks, hook) {
+			return fmt.Errorf("unknown ECS lifecycle hook %q, expected one of %s", hook, strings.Join(ecsHooks, ", "))
+		}
+	}
+	return nil
+}
+
+func (s *ecsSettings) taskDefinitionFile() string {
+	if s.TaskDefinitionFile != "" {
+		return s.TaskDefinitionFile
+	}
+	return defaultTaskDefinitionFile
+}
+
+func (s *ecsSettings) imageDetailFile() string {
+	if s.ImageDetailFile != "" {
+		return s.ImageDetailFile
+	}
+	return defaultImageDetailFile
+}
+
+func (s *ecsSettings) imagePlaceholder() string {
+	if s.ImagePlaceholder != "" {
+		return s.ImagePlaceholder
+	}
+	return defaultImagePlaceholder
+}
+
+// imageDetail is the imageDetail.json a build writes after pushing an image
+type imageDetail struct {
+	ImageURI string `json:"ImageURI"`
+}
+
+// ecsRevision registers the task definition for the bundle and returns an
+// AppSpec revision that points the target's service at it, along with the
+// new task definition ARN
+func ecsRevision(ctx context.Context, clients *targetClients, target deploymentTarget, bundle *bundleInfo) (*types.RevisionLocation, string, error) {
+	input, err := ecsTaskDefinition(ctx, clients, target, bundle)
+	if err != nil {
+		return nil, "", err
+	}
+
+	registered, err := clients.ECS.RegisterTaskDefinition(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to register task definition: %v", err)
+	}
+	taskDefinitionArn := aws.ToString(registered.TaskDefinition.TaskDefinitionArn)
+	log.Printf("Registered task definition %s", taskDefinitionArn)
+
+	content, err := ecsAppSpec(target.ECS, taskDefinitionArn)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(content)
+
+	return &types.RevisionLocation{
+		RevisionType: types.RevisionLocationTypeAppSpecContent,
+		AppSpecContent: &types.AppSpecContent{
+			Content: aws.String(string(content)),
+			Sha256:  aws.String(hex.EncodeToString(sum[:])),
+		},
+	}, taskDefinitionArn, nil
+}
+
+// ecsTaskDefinition reads the task definition to register for the bundle
+func ecsTaskDefinition(ctx context.Context, clients *targetClients, target deploymentTarget, bundle *bundleInfo) (*ecs.RegisterTaskDefinitionInput, error) {
+	archive, err := bundle.files()
+	if err != nil {
+		return nil, err
+	}
+	if archive == nil {
+		return nil, fmt.Errorf("the input artifact could not be read")
+	}
+	settings := target.ECS
+
+	files, err := readBundleFiles(archive, settings.taskDefinitionFile(), settings.imageDetailFile())
+	if err != nil {
+		return nil, err
+	}
+	return taskDefinitionInput(ctx, clients, target, files)
+}
+
+// readBundleFiles returns the named files from anywhere in the bundle,
+// keyed by base name. Missing files are simply left out.
+func readBundleFiles(archive *zip.Reader, names ...string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		name := path.Base(file.Name)
+		if !slices.Contains(names, name) || files[name] != nil {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", file.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file.Name, err)
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// taskDefinitionInput builds the task definition to register. A
+// taskdef.json is used as-is, with the image from imageDetail.json filled
+// in. With only an imageDetail.json, we update the image in the service's
+// current task definition.
+func taskDefinitionInput(ctx context.Context, clients *targetClients, target deploymentTarget, files map[string][]byte) (*ecs.RegisterTaskDefinitionInput, error) {
+	settings := target.ECS
+
+	var image string
+	if raw, ok := files[settings.imageDetailFile()]; ok {
+		var detail imageDetail
+		if err := json.Unmarshal(raw, &detail); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", settings.imageDetailFile(), err)
+		}
+		if detail.ImageURI == "" {
+			return nil, fmt.Errorf("%s has no ImageURI", settings.imageDetailFile())
+		}
+		image = detail.ImageURI
+	}
+
+	if raw, ok := files[settings.taskDefinitionFile()]; ok {
+		text := string(raw)
+		if image != "" {
+			text = strings.ReplaceAll(text, settings.imagePlaceholder(), image)
+		}
+		if strings.Contains(text, settings.imagePlaceholder()) {
+			return nil, fmt.Errorf("%s still contains %s, but the bundle has no %s",
+				settings.taskDefinitionFile(), settings.imagePlaceholder(), settings.imageDetailFile())
+		}
+
+		// The SDK types have no JSON tags, but encoding/json matches field
+		// names case-insensitively, so ECS's own task definition JSON fits
+		var input ecs.RegisterTaskDefinitionInput
+		if err := json.Unmarshal([]byte(text), &input); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", settings.taskDefinitionFile(), err)
+		}
+		if aws.ToString(input.Family) == "" || len(input.ContainerDefinitions) == 0 {
+			return nil, fmt.Errorf("%s needs a family and at least one container definition", settings.taskDefinitionFile())
+		}
+		return &input, nil
+	}
+
+	if image == "" {
+		return nil, fmt.Errorf("the bundle has neither %s nor %s", settings.taskDefinitionFile(), settings.imageDetailFile())
+	}
+
+	input, err := currentTaskDefinition(ctx, clients, target)
+	if err != nil {
+		return nil, err
+	}
+	if err := setContainerImage(input.ContainerDefinitions, settings.ContainerName, image); err != nil {
+		return nil, err
+	}
+	return input, nil
+}
+
+// currentTaskDefinition copies the task definition the group's service
+// runs now, ready to register again
+func currentTaskDefinition(ctx context.Context, clients *targetClients, target deploymentTarget) (*ecs.RegisterTaskDefinitionInput, error) {
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment group: %v", err)
+	}
+	if len(group.DeploymentGroupInfo.EcsServices) == 0 {
+		return nil, fmt.Errorf("deployment group %s has no ECS service", target)
+	}
+	service := group.DeploymentGroupInfo.EcsServices[0]
+
+	services, err := clients.ECS.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Cluster:  service.ClusterName,
+		Services: []string{aws.ToString(service.ServiceName)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe service %s: %v", aws.ToString(service.ServiceName), err)
+	}
+	if len(services.Services) == 0 {
+		return nil, fmt.Errorf("service %s not found in cluster %s", aws.ToString(service.ServiceName), aws.ToString(service.ClusterName))
+	}
+
+	current, err := clients.ECS.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: services.Services[0].TaskDefinition,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe task definition: %v", err)
+	}
+
+	// A task definition and its registration input share field names, so
+	// a JSON round trip copies every field that can be registered
+	raw, err := json.Marshal(current.TaskDefinition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy task definition: %v", err)
+	}
+	var input ecs.RegisterTaskDefinitionInput
+	if err := json.Unmarshal(raw, &input); err != nil {
+		return nil, fmt.Errorf("failed to copy task definition: %v", err)
+	}
+	return &input, nil
+}
+
+func setContainerImage(containers []ecstypes.ContainerDefinition, name, image string) error {
+	for i := range containers {
+		if aws.ToString(containers[i].Name) == name {
+			containers[i].Image = aws.String(image)
+			return nil
+		}
+	}
+	return fmt.Errorf("task definition has no container named %s", name)
+}
+
+// The ECS AppSpec, written as JSON. See
+// https://docs.aws.amazon.com/codedeploy/latest/userguide/reference-appspec-file-structure-resources.html
+type ecsAppSpecFile struct {
+	Version   json.Number                    `json:"version"`
+	Resources []map[string]ecsAppSpecService `json:"Resources"`
+	Hooks     []map[string]string            `json:"Hooks,omitempty"`
+}
+
+type ecsAppSpecService struct {
+	Type       string               `json:"Type"`
+	Properties ecsAppSpecProperties `json:"Properties"`
+}
+
+type ecsAppSpecProperties struct {
+	TaskDefinition   string                     `json:"TaskDefinition"`
+	LoadBalancerInfo ecsAppSpecLoadBalancerInfo `json:"LoadBalancerInfo"`
+	PlatformVersion  string                     `json:"PlatformVersion,omitempty"`
+}
+
+type ecsAppSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int32  `json:"ContainerPort"`
+}
+
+// ecsAppSpec renders the AppSpec that moves the service to the task definition
+func ecsAppSpec(settings *ecsSettings, taskDefinitionArn string) ([]byte, error) {
+	spec := ecsAppSpecFile{
+		Version: "0.0",
+		Resources: []map[string]ecsAppSpecService{{
+			"TargetService": {
+				Type: "AWS::ECS::Service",
+				Properties: ecsAppSpecProperties{
+					TaskDefinition: taskDefinitionArn,
+					LoadBalancerInfo: ecsAppSpecLoadBalancerInfo{
+						ContainerName: settings.ContainerName,
+						ContainerPort: settings.ContainerPort,
+					},
+					PlatformVersion: settings.PlatformVersion,
+				},
+			},
+		}},
+	}
+
+	// Hooks run in lifecycle order, whatever order the mapping lists them in
+	for _, hook := range ecsHooks {
+		if function, ok := settings.Hooks[hook]; ok {
+			spec.Hooks = append(spec.Hooks, map[string]string{hook: function})
+		}
+	}
+
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render AppSpec: %v", err)
+	}
+	return content, nil
+}
+
+// validateECSTarget checks that the replacement (green) task set took over:
+// it is the primary task set, runs every desired task and has all traffic
+func validateECSTarget(target *types.ECSTarget) error {
+	if target.Status != types.TargetStatusSucceeded {
+		return fmt.Errorf("ECS target %s has status %s", aws.ToString(target.TargetId), target.Status)
+	}
+
+	for _, taskSet := range target.TaskSetsInfo {
+		if taskSet.TaskSetLabel != types.TargetLabelGreen {
+			continue
+		}
+		id := aws.ToString(taskSet.Identifer)
+		if status := aws.ToString(taskSet.Status); status != "PRIMARY" {
+			return fmt.Errorf("replacement task set %s has status %s, expected PRIMARY", id, status)
+		}
+		if taskSet.RunningCount < taskSet.DesiredCount {
+			return fmt.Errorf("replacement task set %s runs %d of %d tasks", id, taskSet.RunningCount, taskSet.DesiredCount)
+		}
+		if taskSet.TrafficWeight < 100 {
+			return fmt.Errorf("replacement task set %s only receives %.0f%% of traffic", id, taskSet.TrafficWeight)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("ECS target %s has no replacement task set", aws.ToString(target.TargetId))
+}
@@ -0,0 +1,244 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+const testTaskDefinition = `{
+  "family": "web",
+  "networkMode": "awsvpc",
+  "requiresCompatibilities": ["FARGATE"],
+  "cpu": "256",
+  "memory": "512",
+  "containerDefinitions": [
+    {"name": "web", "image": "<IMAGE1_NAME>", "essential": true,
+     "portMappings": [{"containerPort": 8080, "protocol": "tcp"}]},
+    {"name": "sidecar", "image": "public.ecr.aws/envoy:v1"}
+  ]
+}`
+
+func ecsTarget() deploymentTarget {
+	return deploymentTarget{
+		ApplicationName:     "web",
+		DeploymentGroupName: "web-live",
+		Platform:            platformECS,
+		ECS: &ecsSettings{
+			ContainerName: "web",
+			ContainerPort: 8080,
+			Hooks: map[string]string{
+				"AfterAllowTraffic":     "smoke-test",
+				"AfterAllowTestTraffic": "test-traffic-check",
+			},
+		},
+	}
+}
+
+func ecsClients(cd *fakeCodeDeploy, e *fakeECS) *targetClients {
+	return &targetClients{Region: "us-east-1", CodeDeploy: cd, ECS: e}
+}
+
+func TestECSRevisionFromTaskDefinition(t *testing.T) {
+	fake := &fakeECS{}
+	bundle := zipBundle(t, map[string]string{
+		"taskdef.json":     testTaskDefinition,
+		"imageDetail.json": `{"ImageURI": "111111111111.dkr.ecr.us-east-1.amazonaws.com/web:abc123"}`,
+	})
+
+	revision, arn, err := ecsRevision(context.Background(), ecsClients(&fakeCodeDeploy{}, fake), ecsTarget(), bundle)
+	if err != nil {
+		t.Fatalf("ecsRevision() returned error: %v", err)
+	}
+
+	if len(fake.registered) != 1 {
+		t.Fatalf("registered %d task definitions, want 1", len(fake.registered))
+	}
+	input := fake.registered[0]
+	if aws.ToString(input.Family) != "web" || aws.ToString(input.Cpu) != "256" || input.NetworkMode != ecstypes.NetworkModeAwsvpc {
+		t.Errorf("task definition = %+v, want family web, cpu 256, awsvpc", input)
+	}
+	if got := aws.ToString(input.ContainerDefinitions[0].Image); got != "111111111111.dkr.ecr.us-east-1.amazonaws.com/web:abc123" {
+		t.Errorf("web image = %s, want the image from imageDetail.json", got)
+	}
+	if got := aws.ToInt32(input.ContainerDefinitions[0].PortMappings[0].ContainerPort); got != 8080 {
+		t.Errorf("container port = %d, want 8080", got)
+	}
+
+	if revision.RevisionType != types.RevisionLocationTypeAppSpecContent {
+		t.Fatalf("revision type = %s, want AppSpecContent", revision.RevisionType)
+	}
+	var spec struct {
+		Resources []map[string]struct {
+			Type       string
+			Properties struct {
+				TaskDefinition   string
+				LoadBalancerInfo struct {
+					ContainerName string
+					ContainerPort int32
+				}
+			}
+		}
+		Hooks []map[string]string
+	}
+	if err := json.Unmarshal([]byte(aws.ToString(revision.AppSpecContent.Content)), &spec); err != nil {
+		t.Fatalf("AppSpec is not JSON: %v", err)
+	}
+	service := spec.Resources[0]["TargetService"]
+	if service.Type != "AWS::ECS::Service" || service.Properties.TaskDefinition != arn {
+		t.Errorf("TargetService = %+v, want the ECS service on %s", service, arn)
+	}
+	if lb := service.Properties.LoadBalancerInfo; lb.ContainerName != "web" || lb.ContainerPort != 8080 {
+		t.Errorf("LoadBalancerInfo = %+v, want web:8080", lb)
+	}
+	if len(spec.Hooks) != 2 || spec.Hooks[0]["AfterAllowTestTraffic"] != "test-traffic-check" || spec.Hooks[1]["AfterAllowTraffic"] != "smoke-test" {
+		t.Errorf("Hooks = %v, want both hooks in lifecycle order", spec.Hooks)
+	}
+}
+
+func TestECSRevisionFromImageDetail(t *testing.T) {
+	cd := &fakeCodeDeploy{groups: map[string]*types.DeploymentGroupInfo{
+		"web/web-live": {EcsServices: []types.ECSService{{
+			ClusterName: aws.String("prod"),
+			ServiceName: aws.String("web"),
+		}}},
+	}}
+	fake := &fakeECS{
+		service: ecstypes.Service{TaskDefinition: aws.String("arn:aws:ecs:us-east-1:111111111111:task-definition/web:7")},
+		taskDefinition: &ecstypes.TaskDefinition{
+			TaskDefinitionArn: aws.String("arn:aws:ecs:us-east-1:111111111111:task-definition/web:7"),
+			Family:            aws.String("web"),
+			Revision:          7,
+			Status:            ecstypes.TaskDefinitionStatusActive,
+			ExecutionRoleArn:  aws.String("arn:aws:iam::111111111111:role/web-exec"),
+			ContainerDefinitions: []ecstypes.ContainerDefinition{
+				{Name: aws.String("web"), Image: aws.String("web:old")},
+				{Name: aws.String("sidecar"), Image: aws.String("envoy:v1")},
+			},
+		},
+	}
+	bundle := zipBundle(t, map[string]string{
+		"build/imageDetail.json": `{"ImageURI": "web:new"}`,
+	})
+
+	_, _, err := ecsRevision(context.Background(), ecsClients(cd, fake), ecsTarget(), bundle)
+	if err != nil {
+		t.Fatalf("ecsRevision() returned error: %v", err)
+	}
+
+	input := fake.registered[0]
+	if aws.ToString(input.ExecutionRoleArn) != "arn:aws:iam::111111111111:role/web-exec" {
+		t.Errorf("ExecutionRoleArn = %s, want it copied from the current task definition", aws.ToString(input.ExecutionRoleArn))
+	}
+	if got := aws.ToString(input.ContainerDefinitions[0].Image); got != "web:new" {
+		t.Errorf("web image = %s, want web:new", got)
+	}
+	if got := aws.ToString(input.ContainerDefinitions[1].Image); got != "envoy:v1" {
+		t.Errorf("sidecar image = %s, want it unchanged", got)
+	}
+}
+
+func TestECSRevisionErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"no build output", map[string]string{"appspec.yml": "version: 0.0"}, "neither taskdef.json nor imageDetail.json"},
+		{"unfilled placeholder", map[string]string{"taskdef.json": testTaskDefinition}, "still contains <IMAGE1_NAME>"},
+		{"empty image", map[string]string{"imageDetail.json": `{}`}, "has no ImageURI"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ecsRevision(context.Background(), ecsClients(&fakeCodeDeploy{}, &fakeECS{}), ecsTarget(), zipBundle(t, tt.files))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ecsRevision() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartDeploymentECS(t *testing.T) {
+	cfg = &config.Config{Retry: config.RetryConfig{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	cd := &fakeCodeDeploy{groups: map[string]*types.DeploymentGroupInfo{"web/web-live": {}}}
+	fake := &fakeECS{}
+	req := deployRequest{
+		JobID:        "job-1",
+		S3BucketName: "artifacts",
+		S3ObjectKey:  "build.zip",
+		Bundle: zipBundle(t, map[string]string{
+			"taskdef.json":     testTaskDefinition,
+			"imageDetail.json": `{"ImageURI": "web:new"}`,
+		}),
+	}
+	result := &TargetResult{}
+
+	deploymentID, err := startDeployment(context.Background(), ecsClients(cd, fake), req, ecsTarget(), result)
+	if err != nil {
+		t.Fatalf("startDeployment() returned error: %v", err)
+	}
+
+	if deploymentID != "d-1" || len(cd.created) != 1 {
+		t.Fatalf("deployment = %s with %d created, want d-1", deploymentID, len(cd.created))
+	}
+	created := cd.created[0]
+	if created.Revision.RevisionType != types.RevisionLocationTypeAppSpecContent || created.Revision.S3Location != nil {
+		t.Errorf("revision = %+v, want inline AppSpec content only", created.Revision)
+	}
+	if !strings.Contains(aws.ToString(created.Description), jobTag("job-1")) {
+		t.Errorf("description %q does not carry the job tag", aws.ToString(created.Description))
+	}
+	if result.TaskDefinitionArn == "" || !strings.Contains(aws.ToString(created.Revision.AppSpecContent.Content), result.TaskDefinitionArn) {
+		t.Errorf("AppSpec does not use the registered task definition %s", result.TaskDefinitionArn)
+	}
+}
+
+func TestValidateECSTarget(t *testing.T) {
+	green := func(status string, running int64, weight float64) types.ECSTaskSet {
+		return types.ECSTaskSet{
+			Identifer:     aws.String("ecs-svc/green"),
+			TaskSetLabel:  types.TargetLabelGreen,
+			Status:        aws.String(status),
+			DesiredCount:  2,
+			RunningCount:  running,
+			TrafficWeight: weight,
+		}
+	}
+	blue := types.ECSTaskSet{Identifer: aws.String("ecs-svc/blue"), TaskSetLabel: types.TargetLabelBlue, Status: aws.String("ACTIVE")}
+
+	tests := []struct {
+		name   string
+		target types.ECSTarget
+		want   string
+	}{
+		{"healthy", types.ECSTarget{Status: types.TargetStatusSucceeded, TaskSetsInfo: []types.ECSTaskSet{blue, green("PRIMARY", 2, 100)}}, ""},
+		{"target failed", types.ECSTarget{Status: types.TargetStatusFailed}, "has status Failed"},
+		{"not primary", types.ECSTarget{Status: types.TargetStatusSucceeded, TaskSetsInfo: []types.ECSTaskSet{green("ACTIVE", 2, 100)}}, "expected PRIMARY"},
+		{"tasks missing", types.ECSTarget{Status: types.TargetStatusSucceeded, TaskSetsInfo: []types.ECSTaskSet{green("PRIMARY", 1, 100)}}, "runs 1 of 2 tasks"},
+		{"traffic not shifted", types.ECSTarget{Status: types.TargetStatusSucceeded, TaskSetsInfo: []types.ECSTaskSet{green("PRIMARY", 2, 10)}}, "10% of traffic"},
+		{"no green task set", types.ECSTarget{Status: types.TargetStatusSucceeded, TaskSetsInfo: []types.ECSTaskSet{blue}}, "no replacement task set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateECSTarget(&tt.target)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("validateECSTarget() returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validateECSTarget() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+//go:build integration
+
+package deploy
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// These tests run against an emulator such as LocalStack, which CI starts
+// and points AWS_ENDPOINT_URL at:
+//
+//	go test -tags integration ./deploy
+
+func emulatorConfig(t *testing.T) aws.Config {
+	t.Helper()
+	if os.Getenv("AWS_ENDPOINT_URL") == "" {
+		t.Skip("AWS_ENDPOINT_URL is not set")
+	}
+	awsCfg, err := LoadAWSConfig(context.Background())
+	if err != nil {
+		t.Fatalf("LoadAWSConfig() returned error: %v", err)
+	}
+	return awsCfg
+}
+
+func TestEmulatorAuditLog(t *testing.T) {
+	ctx := context.Background()
+	client := NewS3Client(emulatorConfig(t))
+	bucket := "audit-" + time.Now().Format("20060102150405")
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("CreateBucket() returned error: %v", err)
+	}
+
+	location := "s3://" + bucket + "/deployments"
+	started := time.Now().UTC()
+	record := AuditRecord{Outcome: auditSucceeded, DeploymentReport: auditReport("job-1", "live", started)}
+	for i := 0; i < 2; i++ {
+		if err := writeAuditRecord(ctx, client, location, record); err != nil {
+			t.Fatalf("writeAuditRecord() returned error: %v", err)
+		}
+	}
+
+	records, err := QueryAuditLog(ctx, client, location, AuditQuery{DeploymentGroupName: "live", From: started.Add(-time.Hour), To: started.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("QueryAuditLog() returned error: %v", err)
+	}
+	if len(records) != 1 || records[0].JobID != "job-1" {
+		t.Errorf("QueryAuditLog() = %+v, want the one record for job-1", records)
+	}
+}
+
+func TestEmulatorSecretsAndParameters(t *testing.T) {
+	ctx := context.Background()
+	awsCfg := emulatorConfig(t)
+	secretsManagerClient = secretsmanager.NewFromConfig(awsCfg)
+	ssmClient = ssm.NewFromConfig(awsCfg)
+	name := "pipeline-" + time.Now().Format("20060102150405")
+
+	_, err := secretsManagerClient.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		SecretString: aws.String(`{"token": "abc"}`),
+	})
+	if err != nil {
+		t.Fatalf("CreateSecret() returned error: %v", err)
+	}
+	value, err := fetchSecret(ctx, secretRef{SecretID: name, JSONKey: "token"})
+	if err != nil || value != "abc" {
+		t.Errorf("fetchSecret() = %q, %v, want abc", value, err)
+	}
+
+	_, err = ssmClient.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:  aws.String("/" + name + "/mapping"),
+		Value: aws.String(`{"pipelines": {}}`),
+		Type:  "String",
+	})
+	if err != nil {
+		t.Fatalf("PutParameter() returned error: %v", err)
+	}
+	doc, err := readDocument(ctx, "ssm:/"+name+"/mapping")
+	if err != nil || string(doc) != `{"pipelines": {}}` {
+		t.Errorf("readDocument() = %s, %v, want the parameter value", doc, err)
+	}
+}
@@ -0,0 +1,53 @@
+package deploy
+
+import (
+	"context"
+	"log"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3UsePathStyle is set when S3 goes to a local stand-in for AWS
+var s3UsePathStyle bool
+
+// LoadAWSConfig loads the AWS config the Lambdas and pipelinectl share.
+// AWS_ENDPOINT_URL, or AWS_ENDPOINT_URL_<SERVICE> for a single service,
+// sends the clients to a local stand-in for AWS instead of the real
+// endpoints, such as LocalStack or moto server in CI.
+func LoadAWSConfig(ctx context.Context) (aws.Config, error) {
+	endpoints, err := config.LoadEndpoints()
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	// Adaptive mode lets the SDK slow down client-side when it is throttled
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRetryMode(aws.RetryModeAdaptive)}
+	if endpoints.Enabled() {
+		log.Printf("Using AWS endpoint overrides: %s", endpoints)
+		opts = append(opts, awsconfig.WithDefaultRegion("us-east-1"))
+	}
+	if endpoints.StaticCredentials {
+		provider := credentials.NewStaticCredentialsProvider(config.LocalAccessKeyID, config.LocalSecretAccessKey, "")
+		opts = append(opts, awsconfig.WithCredentialsProvider(provider))
+	}
+
+	// The SDK reads the endpoint variables itself, for every client
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	s3UsePathStyle = endpoints.S3UsePathStyle
+	return awsCfg, nil
+}
+
+// NewS3Client creates an S3 client that addresses buckets the way the
+// endpoint expects
+func NewS3Client(awsCfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = s3UsePathStyle
+	})
+}
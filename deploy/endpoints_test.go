@@ -0,0 +1,88 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+// localAWS serves the fakes over HTTP and points the SDK's environment at
+// them, as CI points it at an emulator. It records the S3 request paths.
+func localAWS(t *testing.T) (*fakeaws.Server, func() []string) {
+	t.Helper()
+	fake := fakeaws.New()
+	fake.AutoCreateGroups = true
+
+	var mu sync.Mutex
+	var s3Paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "" {
+			mu.Lock()
+			s3Paths = append(s3Paths, r.URL.Path)
+			mu.Unlock()
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	// No real credentials or profiles are needed, or read
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_S3_USE_PATH_STYLE", "")
+
+	return fake, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, s3Paths...)
+	}
+}
+
+func TestHandlerAgainstEndpointOverride(t *testing.T) {
+	fake, s3Paths := localAWS(t)
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}))
+	t.Setenv("APPLICATION_NAME", "api")
+	t.Setenv("DEPLOYMENT_GROUP_NAME", "api-live")
+	savedCfg, savedUsePathStyle := cfg, s3UsePathStyle
+	t.Cleanup(func() { cfg, cfgErr, s3UsePathStyle = savedCfg, nil, savedUsePathStyle })
+
+	Init(context.Background())
+	if awsCfgErr != nil || cfgErr != nil {
+		t.Fatalf("Init() failed: %v %v", awsCfgErr, cfgErr)
+	}
+
+	var event CodePipelineEvent
+	event.CodePipelineJob.ID = "job-1"
+	event.CodePipelineJob.Data.InputArtifacts = []Artifact{{
+		Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "build/bundle.zip"}},
+	}}
+	report, err := RunJob(context.Background(), event)
+	if err != nil {
+		t.Fatalf("RunJob() returned error: %v", err)
+	}
+
+	job, _ := fake.Job("job-1")
+	if job.Status != "Succeeded" || job.OutputVariables["deploymentId"] != report.DeploymentID {
+		t.Errorf("job = %+v, want a success for deployment %s", job, report.DeploymentID)
+	}
+	paths := s3Paths()
+	if len(paths) == 0 {
+		t.Fatal("no S3 requests reached the endpoint")
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/artifacts/") {
+			t.Errorf("S3 request to %s is not path-style", path)
+		}
+	}
+}
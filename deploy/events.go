@@ -0,0 +1,251 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Deployment events are kept in the audit log beside the job records,
+// partitioned by date like them
+const auditEventsPrefix = "events"
+
+// What a notification says happened for each state
+var deploymentStateVerbs = map[events.CodeDeployDeploymentState]string{
+	events.CodeDeployDeploymentStateStart:   "started",
+	events.CodeDeployDeploymentStateSuccess: "succeeded",
+	events.CodeDeployDeploymentStateFailure: "failed",
+	events.CodeDeployDeploymentStateStop:    "was stopped",
+	events.CodeDeployDeploymentStateReady:   "is ready for traffic",
+}
+
+// DeploymentEvent is what we make of a CodeDeploy deployment state-change
+// event: the event, and the deployment as CodeDeploy reports it now. It
+// is kept in the audit log and sent to the notification webhook.
+type DeploymentEvent struct {
+	EventID   string    `json:"eventId"`
+	Time      time.Time `json:"time"`
+	State     string    `json:"state"`
+	AccountID string    `json:"accountId,omitempty"`
+	DeploymentStatus
+
+	// Summary is what the notification says, e.g. the failed targets of a
+	// failed deployment, and Diagnostics where its bundle went
+	Summary     string `json:"summary"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// notification is the webhook's JSON body. Text is for chat webhooks,
+// which show it as the message.
+type notification struct {
+	Text  string           `json:"text"`
+	Event *DeploymentEvent `json:"event"`
+}
+
+// HandleDeploymentEvent processes a CodeDeploy deployment state-change
+// event from EventBridge. Failed and stopped deployments are diagnosed as
+// a job's are, whoever created them. The event goes to the audit log,
+// then to the notification webhook if its state is one we notify about.
+// EventBridge may deliver an event twice, and the audit log tells us when
+// it has, so we notify once.
+func HandleDeploymentEvent(ctx context.Context, event events.CodeDeployEvent) (*DeploymentEvent, error) {
+	if awsCfgErr != nil {
+		return nil, awsCfgErr
+	}
+	if cfgErr != nil {
+		return nil, cfgErr
+	}
+	detail := event.Detail
+	if detail.DeploymentID == "" || detail.Application == "" || detail.DeploymentGroup == "" || detail.State == "" {
+		return nil, fmt.Errorf("invalid deployment state-change event %s: it needs a deploymentId, an application, a deploymentGroup and a state", event.ID)
+	}
+	log.Printf("Deployment %s of %s/%s is now %s", detail.DeploymentID, detail.Application, detail.DeploymentGroup, detail.State)
+
+	target := findTarget(ctx, TargetRef{ApplicationName: detail.Application, DeploymentGroupName: detail.DeploymentGroup})
+	if target.Region == "" {
+		target.Region = detail.Region
+	}
+	result := &DeploymentEvent{
+		EventID:   event.ID,
+		Time:      event.Time,
+		State:     string(detail.State),
+		AccountID: event.AccountID,
+		DeploymentStatus: DeploymentStatus{
+			ApplicationName:     detail.Application,
+			DeploymentGroupName: detail.DeploymentGroup,
+			Region:              detail.Region,
+			DeploymentID:        detail.DeploymentID,
+		},
+	}
+	if result.Time.IsZero() {
+		result.Time = time.Now().UTC()
+	}
+
+	// The event only names the deployment, so we look it up. Without it,
+	// the event is still worth recording.
+	var diagnostics *failureDiagnostics
+	clients, err := targetClientCache.forTarget(ctx, target)
+	if err == nil {
+		var output *codedeploy.GetDeploymentOutput
+		output, err = clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(detail.DeploymentID),
+		})
+		if err == nil {
+			info := output.DeploymentInfo
+			result.setDeployment(info)
+			if deploymentFailed(info) {
+				diagnostics, result.Diagnostics = recordFailureDiagnostics(ctx, clients, result.JobID, target, info)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Could not get deployment %s: %v", detail.DeploymentID, err)
+	}
+
+	result.Summary = result.summarize(diagnostics)
+
+	if cfg.AuditLogLocation != "" {
+		created, err := writeDeploymentEvent(ctx, s3Client, cfg.AuditLogLocation, result)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		} else if !created {
+			log.Printf("Event %s was already processed, not notifying again", event.ID)
+			return result, nil
+		}
+	}
+
+	if cfg.NotificationSecretARN != "" && slices.Contains(cfg.NotificationStates, result.State) {
+		if err := notify(ctx, result); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// summarize says what happened to the deployment in a line
+func (e *DeploymentEvent) summarize(diagnostics *failureDiagnostics) string {
+	verb, ok := deploymentStateVerbs[events.CodeDeployDeploymentState(e.State)]
+	if !ok {
+		verb = "is " + e.State
+	}
+	summary := fmt.Sprintf("Deployment %s of %s/%s %s", e.DeploymentID, e.ApplicationName, e.DeploymentGroupName, verb)
+	if e.JobID != "" {
+		summary += fmt.Sprintf(" (job %s)", e.JobID)
+	}
+
+	switch {
+	case diagnostics != nil:
+		if details := diagnostics.summary(false, e.Diagnostics); details != "" {
+			summary += ": " + details
+		}
+	case e.ErrorMessage != "":
+		summary += ": " + e.ErrorMessage
+	}
+	return summary
+}
+
+// deploymentEventKey places an event by the day it happened. There is one
+// event per deployment and state, so those are enough to name it.
+func deploymentEventKey(prefix string, e *DeploymentEvent) string {
+	date := e.Time.UTC().Format(auditDateLayout)
+	return path.Join(prefix, auditEventsPrefix, "date="+date, e.DeploymentID+"-"+e.State+".json")
+}
+
+// writeDeploymentEvent stores the event only if it is not stored yet, as
+// writeAuditRecord does, and reports whether it was
+func writeDeploymentEvent(ctx context.Context, client s3API, location string, e *DeploymentEvent) (bool, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal deployment event: %v", err)
+	}
+
+	key := deploymentEventKey(prefix, e)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		IfNoneMatch: aws.String("*"),
+	})
+	if isPreconditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to write deployment event to s3://%s/%s: %v", bucket, key, err)
+	}
+
+	log.Printf("Deployment event written to s3://%s/%s", bucket, key)
+	return true, nil
+}
+
+// webhookRef points at the secret holding the notification webhook's URL
+func webhookRef() secretRef {
+	return secretRef{
+		SecretID: cfg.NotificationSecretARN,
+		JSONKey:  cfg.NotificationSecretKey,
+	}
+}
+
+// notify posts the event to the webhook. Its URL is a credential, so it
+// is kept out of our errors and logs. Chat services answer a revoked
+// webhook with 401, 403, 404 or 410, and the URL may have been rotated,
+// so the secrets cache fetches it again and we retry once.
+func notify(ctx context.Context, e *DeploymentEvent) error {
+	body, err := json.Marshal(notification{Text: e.Summary, Event: e})
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %v", err)
+	}
+
+	return secrets.use(ctx, webhookRef(), func(webhookURL string) error {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("notification webhook secret %s is not an http(s) URL", webhookRef())
+		}
+
+		client := &http.Client{
+			Timeout: 10 * time.Second,
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create notification request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return fmt.Errorf("notification failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+			return fmt.Errorf("notification webhook returned %d: %w", resp.StatusCode, errSecretRejected)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("notification webhook returned non-success status code: %d", resp.StatusCode)
+		}
+		log.Printf("Notified the webhook of deployment %s %s", e.DeploymentID, e.State)
+		return nil
+	})
+}
@@ -0,0 +1,223 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeCodeDeploy serves deployment groups and records created deployments.
+// Calls it does not implement panic through the nil embedded interface.
+type fakeCodeDeploy struct {
+	codeDeployAPI
+
+	groups      map[string]*types.DeploymentGroupInfo
+	instances   map[string]*types.InstanceTarget
+	deployments map[string]*types.DeploymentInfo
+	created     []*codedeploy.CreateDeploymentInput
+	stopped     []string
+}
+
+func (f *fakeCodeDeploy) GetDeploymentGroup(ctx context.Context, params *codedeploy.GetDeploymentGroupInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentGroupOutput, error) {
+	key := aws.ToString(params.ApplicationName) + "/" + aws.ToString(params.DeploymentGroupName)
+	group, ok := f.groups[key]
+	if !ok {
+		return nil, fmt.Errorf("DeploymentGroupDoesNotExistException: %s", key)
+	}
+	return &codedeploy.GetDeploymentGroupOutput{DeploymentGroupInfo: group}, nil
+}
+
+// ListDeployments filters the served deployments by group and status only
+func (f *fakeCodeDeploy) ListDeployments(ctx context.Context, params *codedeploy.ListDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentsOutput, error) {
+	var ids []string
+	for id, d := range f.deployments {
+		if aws.ToString(d.ApplicationName) != aws.ToString(params.ApplicationName) ||
+			aws.ToString(d.DeploymentGroupName) != aws.ToString(params.DeploymentGroupName) {
+			continue
+		}
+		if len(params.IncludeOnlyStatuses) > 0 && !slices.Contains(params.IncludeOnlyStatuses, d.Status) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return &codedeploy.ListDeploymentsOutput{Deployments: ids}, nil
+}
+
+func (f *fakeCodeDeploy) GetDeployment(ctx context.Context, params *codedeploy.GetDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.GetDeploymentOutput, error) {
+	d, ok := f.deployments[aws.ToString(params.DeploymentId)]
+	if !ok {
+		return nil, fmt.Errorf("DeploymentDoesNotExistException: %s", aws.ToString(params.DeploymentId))
+	}
+	return &codedeploy.GetDeploymentOutput{DeploymentInfo: d}, nil
+}
+
+func (f *fakeCodeDeploy) BatchGetDeployments(ctx context.Context, params *codedeploy.BatchGetDeploymentsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.BatchGetDeploymentsOutput, error) {
+	out := &codedeploy.BatchGetDeploymentsOutput{}
+	for _, id := range params.DeploymentIds {
+		if d, ok := f.deployments[id]; ok {
+			out.DeploymentsInfo = append(out.DeploymentsInfo, *d)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeCodeDeploy) CreateDeployment(ctx context.Context, params *codedeploy.CreateDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.CreateDeploymentOutput, error) {
+	f.created = append(f.created, params)
+	return &codedeploy.CreateDeploymentOutput{DeploymentId: aws.String(fmt.Sprintf("d-%d", len(f.created)))}, nil
+}
+
+func (f *fakeCodeDeploy) StopDeployment(ctx context.Context, params *codedeploy.StopDeploymentInput, optFns ...func(*codedeploy.Options)) (*codedeploy.StopDeploymentOutput, error) {
+	f.stopped = append(f.stopped, aws.ToString(params.DeploymentId))
+	return &codedeploy.StopDeploymentOutput{}, nil
+}
+
+// ListDeploymentTargets ignores filters and returns every instance target
+func (f *fakeCodeDeploy) ListDeploymentTargets(ctx context.Context, params *codedeploy.ListDeploymentTargetsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentTargetsOutput, error) {
+	var ids []string
+	for id := range f.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return &codedeploy.ListDeploymentTargetsOutput{TargetIds: ids}, nil
+}
+
+func (f *fakeCodeDeploy) BatchGetDeploymentTargets(ctx context.Context, params *codedeploy.BatchGetDeploymentTargetsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.BatchGetDeploymentTargetsOutput, error) {
+	out := &codedeploy.BatchGetDeploymentTargetsOutput{}
+	for _, id := range params.TargetIds {
+		out.DeploymentTargets = append(out.DeploymentTargets, types.DeploymentTarget{
+			DeploymentTargetType: types.DeploymentTargetTypeInstanceTarget,
+			InstanceTarget:       f.instances[id],
+		})
+	}
+	return out, nil
+}
+
+// fakeECS serves one service and task definition, and records registrations
+type fakeECS struct {
+	ecsAPI
+
+	service        ecstypes.Service
+	taskDefinition *ecstypes.TaskDefinition
+	registered     []*ecs.RegisterTaskDefinitionInput
+}
+
+func (f *fakeECS) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	return &ecs.DescribeServicesOutput{Services: []ecstypes.Service{f.service}}, nil
+}
+
+func (f *fakeECS) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if aws.ToString(params.TaskDefinition) != aws.ToString(f.taskDefinition.TaskDefinitionArn) {
+		return nil, fmt.Errorf("ClientException: unknown task definition %s", aws.ToString(params.TaskDefinition))
+	}
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: f.taskDefinition}, nil
+}
+
+func (f *fakeECS) RegisterTaskDefinition(ctx context.Context, params *ecs.RegisterTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.RegisterTaskDefinitionOutput, error) {
+	f.registered = append(f.registered, params)
+	arn := fmt.Sprintf("arn:aws:ecs:us-east-1:111111111111:task-definition/%s:%d", aws.ToString(params.Family), len(f.registered)+1)
+	return &ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecstypes.TaskDefinition{TaskDefinitionArn: aws.String(arn)},
+	}, nil
+}
+
+// fakeS3 keeps objects in memory and honours If-None-Match on PutObject,
+// as S3 conditional writes do
+type fakeS3 struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(body)))}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.objects == nil {
+		f.objects = map[string][]byte{}
+	}
+	key := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Key)
+	if _, exists := f.objects[key]; exists && aws.ToString(params.IfNoneMatch) == "*" {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[key] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	prefix := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Prefix)
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, strings.TrimPrefix(key, aws.ToString(params.Bucket)+"/"))
+		}
+	}
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	return output, nil
+}
+
+// zipBundle builds an inspected bundle holding the given files
+func zipBundle(t *testing.T, files map[string]string) *bundleInfo {
+	t.Helper()
+	data := zipBytes(t, files)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bundleInfo{archive: archive}
+}
+
+// zipBytes zips the given files, as an artifact uploaded to S3
+func zipBytes(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,198 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// Health checks are retried to give a new version time to warm up
+var (
+	healthCheckAttempts  = 3
+	healthCheckRetryWait = 5 * time.Second
+)
+
+// LambdaAPI is the part of the Lambda client that health checks need
+type LambdaAPI interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// lambdaHealthCheck invokes a function, alias or version and checks the
+// response, for services that have no HTTP endpoint to probe. The check
+// itself is configuration, so config defines its fields.
+type lambdaHealthCheck struct {
+	config.LambdaHealthCheck
+}
+
+// String names the check in logs and errors
+func (c *lambdaHealthCheck) String() string {
+	if c.Qualifier == "" {
+		return c.FunctionName
+	}
+	return c.FunctionName + ":" + c.Qualifier
+}
+
+func (c *lambdaHealthCheck) validate() error {
+	if c.FunctionName == "" {
+		return fmt.Errorf("a Lambda health check needs a functionName")
+	}
+	if len(c.Payload) > 0 && !json.Valid(c.Payload) {
+		return fmt.Errorf("the Lambda health check of %s has an invalid payload", c)
+	}
+	if c.ExpectError != "" && (c.ExpectResponseContains != "" || c.ExpectStatusCode != 0 || len(c.ExpectFields) > 0) {
+		return fmt.Errorf("the Lambda health check of %s cannot combine expectError with response assertions", c)
+	}
+	return nil
+}
+
+// run invokes the function until the response passes or the attempts run
+// out. A nil check passes, so callers need not test for one.
+func (c *lambdaHealthCheck) run(ctx context.Context, client LambdaAPI) error {
+	if c == nil {
+		return nil
+	}
+	return retryHealthCheck(ctx, "Lambda health check "+c.String(), func(ctx context.Context) error {
+		return c.invoke(ctx, client)
+	})
+}
+
+// InvokeLambdaHealthCheck invokes the check's function once and applies
+// its assertions. The traffic hook checks new versions this way, without
+// retries, since a failed hook rolls the deployment back.
+func InvokeLambdaHealthCheck(ctx context.Context, client LambdaAPI, check config.LambdaHealthCheck) error {
+	c := &lambdaHealthCheck{check}
+	return c.invoke(ctx, client)
+}
+
+func (c *lambdaHealthCheck) invoke(ctx context.Context, client LambdaAPI) error {
+	payload := []byte(c.Payload)
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(c.FunctionName),
+		InvocationType: lambdatypes.InvocationTypeRequestResponse,
+		Payload:        payload,
+	}
+	if c.Qualifier != "" {
+		input.Qualifier = aws.String(c.Qualifier)
+	}
+
+	output, err := client.Invoke(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to invoke %s: %v", c, err)
+	}
+	if err := c.checkResponse(output); err != nil {
+		return err
+	}
+
+	log.Printf("Lambda health check %s succeeded", c)
+	return nil
+}
+
+// checkResponse applies the check's assertions to an invocation
+func (c *lambdaHealthCheck) checkResponse(output *lambda.InvokeOutput) error {
+	if c.ExpectError != "" {
+		if output.FunctionError == nil {
+			return fmt.Errorf("%s succeeded, expected an error containing %q", c, c.ExpectError)
+		}
+		if !strings.Contains(string(output.Payload), c.ExpectError) {
+			return fmt.Errorf("%s returned error %s, expected one containing %q", c, output.Payload, c.ExpectError)
+		}
+		return nil
+	}
+	if output.FunctionError != nil {
+		return fmt.Errorf("%s returned %s error: %s", c, aws.ToString(output.FunctionError), output.Payload)
+	}
+	if c.ExpectResponseContains != "" && !strings.Contains(string(output.Payload), c.ExpectResponseContains) {
+		return fmt.Errorf("%s response %s does not contain %q", c, output.Payload, c.ExpectResponseContains)
+	}
+	if c.ExpectStatusCode == 0 && len(c.ExpectFields) == 0 {
+		return nil
+	}
+
+	var response map[string]any
+	if err := json.Unmarshal(output.Payload, &response); err != nil {
+		return fmt.Errorf("%s response is not a JSON object: %v", c, err)
+	}
+
+	if c.ExpectStatusCode != 0 {
+		statusCode, ok := response["statusCode"].(float64)
+		if !ok {
+			return fmt.Errorf("%s response has no statusCode", c)
+		}
+		if int(statusCode) != c.ExpectStatusCode {
+			return fmt.Errorf("%s returned status code %d, want %d", c, int(statusCode), c.ExpectStatusCode)
+		}
+	}
+
+	body := responseBody(response)
+	for path, want := range c.ExpectFields {
+		got, ok := lookupField(body, path)
+		if !ok {
+			return fmt.Errorf("%s response has no field %q", c, path)
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("%s response field %q = %v, want %v", c, path, got, want)
+		}
+	}
+	return nil
+}
+
+// responseBody returns the body of an API Gateway style response, or the
+// response itself when it has no body
+func responseBody(response map[string]any) map[string]any {
+	switch body := response["body"].(type) {
+	case map[string]any:
+		return body
+	case string:
+		var decoded map[string]any
+		if err := json.Unmarshal([]byte(body), &decoded); err == nil {
+			return decoded
+		}
+	}
+	return response
+}
+
+// lookupField follows a dotted path through nested JSON objects
+func lookupField(body map[string]any, path string) (any, bool) {
+	var value any = body
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// retryHealthCheck runs check until it passes, waiting between attempts so
+// that an application that is still starting up can come good
+func retryHealthCheck(ctx context.Context, name string, check func(ctx context.Context) error) error {
+	var lastErr error
+	for attempt := 1; attempt <= healthCheckAttempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("%s failed (attempt %d): %v, retrying in %v", name, attempt-1, lastErr, healthCheckRetryWait)
+			if err := sleep(ctx, healthCheckRetryWait); err != nil {
+				return fmt.Errorf("%s interrupted: %v", name, err)
+			}
+		}
+		if lastErr = check(ctx); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s failed after %d attempts: %v", name, healthCheckAttempts, lastErr)
+}
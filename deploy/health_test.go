@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// fakeLambda answers invocations with the given outputs in turn
+type fakeLambda struct {
+	outputs []*lambda.InvokeOutput
+	calls   []*lambda.InvokeInput
+}
+
+func (f *fakeLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	f.calls = append(f.calls, params)
+	output := f.outputs[0]
+	if len(f.outputs) > 1 {
+		f.outputs = f.outputs[1:]
+	}
+	return output, nil
+}
+
+func TestLambdaHealthCheckResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   config.LambdaHealthCheck
+		output  *lambda.InvokeOutput
+		wantErr string
+	}{
+		{"no assertions", config.LambdaHealthCheck{}, &lambda.InvokeOutput{Payload: []byte(`null`)}, ""},
+		{"function error", config.LambdaHealthCheck{}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"boom"}`)}, "Unhandled error"},
+		{"status code", config.LambdaHealthCheck{ExpectStatusCode: 200}, &lambda.InvokeOutput{Payload: []byte(`{"statusCode":200}`)}, ""},
+		{"wrong status code", config.LambdaHealthCheck{ExpectStatusCode: 200}, &lambda.InvokeOutput{Payload: []byte(`{"statusCode":503}`)}, "status code 503"},
+		{"missing status code", config.LambdaHealthCheck{ExpectStatusCode: 200}, &lambda.InvokeOutput{Payload: []byte(`{}`)}, "no statusCode"},
+		{"fields in string body", config.LambdaHealthCheck{ExpectFields: map[string]any{"checks.database": "ok"}}, &lambda.InvokeOutput{Payload: []byte(`{"statusCode":200,"body":"{\"checks\":{\"database\":\"ok\"}}"}`)}, ""},
+		{"fields in payload", config.LambdaHealthCheck{ExpectFields: map[string]any{"healthy": true}}, &lambda.InvokeOutput{Payload: []byte(`{"healthy":true}`)}, ""},
+		{"field differs", config.LambdaHealthCheck{ExpectFields: map[string]any{"healthy": true}}, &lambda.InvokeOutput{Payload: []byte(`{"healthy":false}`)}, `field "healthy"`},
+		{"response contains", config.LambdaHealthCheck{ExpectResponseContains: "ok"}, &lambda.InvokeOutput{Payload: []byte(`"ok"`)}, ""},
+		{"response does not contain", config.LambdaHealthCheck{ExpectResponseContains: "ok"}, &lambda.InvokeOutput{Payload: []byte(`"nope"`)}, `does not contain "ok"`},
+		{"expected error", config.LambdaHealthCheck{ExpectError: "not found"}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"job not found"}`)}, ""},
+		{"expected error missing", config.LambdaHealthCheck{ExpectError: "not found"}, &lambda.InvokeOutput{Payload: []byte(`null`)}, "expected an error"},
+		{"other error", config.LambdaHealthCheck{ExpectError: "not found"}, &lambda.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"boom"}`)}, "expected one containing"},
+		{"field missing", config.LambdaHealthCheck{ExpectFields: map[string]any{"checks.cache": "ok"}}, &lambda.InvokeOutput{Payload: []byte(`{"checks":{}}`)}, `no field "checks.cache"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := &lambdaHealthCheck{tt.check}
+			check.FunctionName = "app"
+			err := check.checkResponse(tt.output)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkResponse() returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkResponse() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLambdaHealthCheckRetries(t *testing.T) {
+	defer func(wait time.Duration) { healthCheckRetryWait = wait }(healthCheckRetryWait)
+	healthCheckRetryWait = 0
+
+	fn := &fakeLambda{outputs: []*lambda.InvokeOutput{
+		{Payload: []byte(`{"statusCode":503}`)},
+		{Payload: []byte(`{"statusCode":200}`)},
+	}}
+	check := &lambdaHealthCheck{config.LambdaHealthCheck{FunctionName: "app", Qualifier: "Live", ExpectStatusCode: 200}}
+
+	if err := check.run(context.Background(), fn); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+	if len(fn.calls) != 2 {
+		t.Fatalf("invoked %d times, want a retry after the failure", len(fn.calls))
+	}
+	if aws.ToString(fn.calls[0].Qualifier) != "Live" || string(fn.calls[0].Payload) != "{}" {
+		t.Errorf("invoked %s with %s, want Live with an empty object", aws.ToString(fn.calls[0].Qualifier), fn.calls[0].Payload)
+	}
+
+	fn = &fakeLambda{outputs: []*lambda.InvokeOutput{{Payload: []byte(`{"statusCode":503}`)}}}
+	if err := check.run(context.Background(), fn); err == nil || len(fn.calls) != healthCheckAttempts {
+		t.Errorf("run() = %v after %d calls, want failure after %d", err, len(fn.calls), healthCheckAttempts)
+	}
+}
+
+func TestWavePlanValidatesLambdaHealthChecks(t *testing.T) {
+	raw := `{"waves":[{"targets":[{"applicationName":"app","deploymentGroupName":"group","appHealthCheck":{"qualifier":"Live"}}]}]}`
+	if _, err := parseWavePlan(raw); err == nil || !strings.Contains(err.Error(), "functionName") {
+		t.Errorf("parseWavePlan() = %v, want a functionName error", err)
+	}
+
+	raw = `{"waves":[{"targets":[{"applicationName":"app","deploymentGroupName":"group","appHealthCheck":{"functionName":"app","payload":{"ping":true}}}]}]}`
+	plan, err := parseWavePlan(raw)
+	if err != nil {
+		t.Fatalf("parseWavePlan() returned error: %v", err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(plan.Waves[0].Targets[0].AppHealthCheck.Payload, &payload); err != nil || payload["ping"] != true {
+		t.Errorf("payload = %s, want the configured object", plan.Waves[0].Targets[0].AppHealthCheck.Payload)
+	}
+}
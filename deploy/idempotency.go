@@ -0,0 +1,95 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	pipelinetypes "github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+)
+
+// How far back we look for a deployment created by an earlier delivery of
+// the same job. CodePipeline jobs time out long before this.
+const jobLookbackWindow = 24 * time.Hour
+
+// BatchGetDeployments accepts at most 25 deployment IDs per call
+const batchGetDeploymentsLimit = 25
+
+// jobTag marks a deployment description with the CodePipeline job ID, so a
+// redelivered job can find the deployment it already created
+func jobTag(jobID string) string {
+	return fmt.Sprintf("[codepipeline-job:%s]", jobID)
+}
+
+// acknowledgeJob tells CodePipeline we picked up the job. A job that has
+// already succeeded, failed or timed out was finished by an
+// earlier delivery, which the caller must not process again. A job that is
+// still in progress may have been acknowledged by an earlier delivery that
+// died, so the caller resumes its deployment through the job tag instead.
+func acknowledgeJob(ctx context.Context, jobID, nonce string) (bool, error) {
+	if nonce == "" {
+		log.Printf("No nonce in event for job %s, skipping acknowledgement", jobID)
+		return true, nil
+	}
+
+	result, err := codePipelineClient.AcknowledgeJob(ctx, &codepipeline.AcknowledgeJobInput{
+		JobId: aws.String(jobID),
+		Nonce: aws.String(nonce),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to acknowledge job %s: %v", jobID, err)
+	}
+
+	log.Printf("Acknowledged job %s, status: %s", jobID, result.Status)
+	switch result.Status {
+	case pipelinetypes.JobStatusSucceeded, pipelinetypes.JobStatusFailed, pipelinetypes.JobStatusTimedOut:
+		return false, nil
+	}
+	return true, nil
+}
+
+// findDeploymentForJob looks for a deployment in the group that was created
+// for this job by an earlier invocation. It returns the deployment ID, or
+// an empty string if there is none.
+func findDeploymentForJob(ctx context.Context, clients *targetClients, applicationName, deploymentGroupName, jobID string) (string, error) {
+	tag := jobTag(jobID)
+	input := &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String(applicationName),
+		DeploymentGroupName: aws.String(deploymentGroupName),
+		CreateTimeRange: &types.TimeRange{
+			Start: aws.Time(time.Now().Add(-jobLookbackWindow)),
+		},
+	}
+
+	paginator := codedeploy.NewListDeploymentsPaginator(clients.CodeDeploy, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to list deployments: %v", err)
+		}
+
+		for start := 0; start < len(page.Deployments); start += batchGetDeploymentsLimit {
+			end := min(start+batchGetDeploymentsLimit, len(page.Deployments))
+			result, err := clients.CodeDeploy.BatchGetDeployments(ctx, &codedeploy.BatchGetDeploymentsInput{
+				DeploymentIds: page.Deployments[start:end],
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to get deployments: %v", err)
+			}
+
+			for _, deployment := range result.DeploymentsInfo {
+				if strings.Contains(aws.ToString(deployment.Description), tag) {
+					return aws.ToString(deployment.DeploymentId), nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,74 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// invocation has the fields that tell the kinds of payload apart
+type invocation struct {
+	Job        json.RawMessage `json:"CodePipeline.job"`
+	Action     *string         `json:"action"`
+	Source     string          `json:"source"`
+	DetailType string          `json:"detail-type"`
+}
+
+// HandleInvocation routes any payload the deploy Lambda is invoked with,
+// so one function is both the pipeline's deploy action and the processor
+// of deployment events:
+//   - a CodePipeline job runs through Handler, and returns nothing
+//   - a DirectInvocation runs its action and returns its report or
+//     status
+//   - a CodeDeploy deployment state-change event from EventBridge runs
+//     through HandleDeploymentEvent, and returns what was recorded
+//
+// Any other payload is rejected.
+func HandleInvocation(ctx context.Context, payload json.RawMessage) (any, error) {
+	var in invocation
+	if err := json.Unmarshal(payload, &in); err != nil {
+		return nil, fmt.Errorf("invalid event: %v", err)
+	}
+
+	switch {
+	case in.Job != nil:
+		var event CodePipelineEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("invalid CodePipeline job: %v", err)
+		}
+		return nil, Handler(ctx, event)
+
+	case in.Action != nil:
+		var direct DirectInvocation
+		if err := json.Unmarshal(payload, &direct); err != nil {
+			return nil, fmt.Errorf("invalid direct invocation: %v", err)
+		}
+		return runAction(ctx, direct)
+
+	case in.Source == events.CodeDeployEventSource && in.DetailType == events.CodeDeployDeploymentEventDetailType:
+		var event events.CodeDeployEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("invalid deployment state-change event: %v", err)
+		}
+		return HandleDeploymentEvent(ctx, event)
+
+	case in.Source != "" || in.DetailType != "":
+		return nil, fmt.Errorf("unsupported EventBridge event %q from %s: only %q events from %s are handled",
+			in.DetailType, in.Source, events.CodeDeployDeploymentEventDetailType, events.CodeDeployEventSource)
+	}
+
+	return nil, fmt.Errorf("unrecognized event: expected a CodePipeline job, a direct invocation with an action, or a CodeDeploy deployment state-change event")
+}
+
+// runAction runs the action of a direct invocation
+func runAction(ctx context.Context, direct DirectInvocation) (any, error) {
+	switch direct.Action {
+	case "deploy":
+		return Deploy(ctx, *direct.Deploy)
+	case "status":
+		return Status(ctx, *direct.Status)
+	}
+	return Rollback(ctx, *direct.Rollback)
+}
@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+func TestHandleInvocationRejectsUnknownEvents(t *testing.T) {
+	tests := []struct {
+		name, payload, want string
+	}{
+		{"not an object", `"deploy"`, "invalid event"},
+		{"empty", `{}`, "unrecognized event"},
+		{"unknown action", `{"action": "destroy", "applicationName": "api"}`, `unknown action "destroy": expected deploy, status or rollback`},
+		{"other EventBridge event", `{"source": "aws.s3", "detail-type": "Object Created", "detail": {}}`, `unsupported EventBridge event "Object Created" from aws.s3`},
+		{"instance state change", `{"source": "aws.codedeploy", "detail-type": "CodeDeploy Instance State-change Notification", "detail": {}}`, "unsupported EventBridge event"},
+		{"invalid request", `{"action": "deploy", "applicationName": 7}`, "invalid deploy action"},
+		{"request without an action", `{"deploy": {"applicationName": "api"}}`, "unrecognized event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := HandleInvocation(context.Background(), json.RawMessage(tt.payload))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("HandleInvocation() error = %v, want one containing %q", err, tt.want)
+			}
+			if result != nil {
+				t.Errorf("HandleInvocation() = %v, want no result", result)
+			}
+		})
+	}
+}
+
+func TestHandleInvocationActions(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.SetScenario("api", "api-live", fakeaws.Scenario{Instances: []string{"i-1"}})
+	report, job, err := e2eJob(t, fake, "")
+	if err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want a success", job, err)
+	}
+
+	result, err := HandleInvocation(context.Background(), json.RawMessage(`{"action": "status", "applicationName": "api", "deploymentGroupName": "api-live"}`))
+	if err != nil {
+		t.Fatalf("status action returned error: %v", err)
+	}
+	status, ok := result.(*DeploymentStatus)
+	if !ok || status.DeploymentID != report.DeploymentID || status.Status != "Succeeded" || status.JobID != "job-1" ||
+		status.LastSuccessfulDeploymentID != report.DeploymentID || status.Instances == nil || status.Instances.Succeeded != 1 {
+		t.Errorf("status = %+v, want job-1's successful deployment %s", result, report.DeploymentID)
+	}
+
+	result, err = HandleInvocation(context.Background(), json.RawMessage(`{"action": "deploy", "applicationName": "api", "deploymentGroupName": "api-live",
+		"s3BucketName": "artifacts", "s3ObjectKey": "build/bundle.zip", "requestId": "r-1"}`))
+	if err != nil {
+		t.Fatalf("deploy action returned error: %v", err)
+	}
+	direct, ok := result.(*DeploymentReport)
+	if !ok || direct.Direct == nil || direct.Direct.RequestID != "r-1" || direct.DeploymentID == report.DeploymentID {
+		t.Errorf("deploy report = %+v, want a new direct deployment for r-1", result)
+	}
+
+	_, err = HandleInvocation(context.Background(), json.RawMessage(`{"action": "status", "applicationName": "api", "deploymentGroupName": "api-live", "deploymentId": "d-NOPE"}`))
+	if err == nil || !strings.Contains(err.Error(), "d-NOPE") {
+		t.Errorf("status of an unknown deployment returned error %v, want one naming it", err)
+	}
+}
+
+func TestDirectInvocationJSON(t *testing.T) {
+	in := DirectInvocation{Action: "rollback", Rollback: &RollbackRequest{
+		TargetRef: TargetRef{ApplicationName: "api", DeploymentGroupName: "api-live"},
+		Reason:    "INC-7",
+	}}
+	body, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal() returned error: %v", err)
+	}
+	if want := `{"action":"rollback","applicationName":"api","deploymentGroupName":"api-live","reason":"INC-7"}`; string(body) != want {
+		t.Errorf("Marshal() = %s, want %s", body, want)
+	}
+
+	var out DirectInvocation
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("Unmarshal() returned error: %v", err)
+	}
+	if out.Action != "rollback" || out.Deploy != nil || out.Status != nil || *out.Rollback != *in.Rollback {
+		t.Errorf("Unmarshal() = %+v, want the rollback back", out)
+	}
+
+	if _, err := json.Marshal(DirectInvocation{Action: "destroy"}); err == nil {
+		t.Error("Marshal() of an unknown action returned no error")
+	}
+}
+
+func TestHandleInvocationPipelineJob(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}))
+	e2eInit(t)
+
+	payload := `{"CodePipeline.job": {"id": "job-7", "data": {"inputArtifacts": [
+		{"location": {"type": "S3", "s3Location": {"bucketName": "artifacts", "objectKey": "build/bundle.zip"}}}]}}}`
+	if _, err := HandleInvocation(context.Background(), json.RawMessage(payload)); err != nil {
+		t.Fatalf("HandleInvocation() returned error: %v", err)
+	}
+	if job, _ := fake.Job("job-7"); job.Status != "Succeeded" {
+		t.Errorf("job = %+v, want a success", job)
+	}
+}
+
+func TestHandleDeploymentEvent(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.SetScenario("api", "api-live", fakeaws.Scenario{
+		Outcome:        fakeaws.StatusFailed,
+		Instances:      []string{"i-1", "i-2"},
+		FailedInstance: "i-2",
+		ScriptName:     "scripts/migrate.sh",
+	})
+
+	var mu sync.Mutex
+	var notifications []notification
+	var revoked int
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/revoked" {
+			mu.Lock()
+			revoked++
+			mu.Unlock()
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var n notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("invalid notification %s: %v", body, err)
+		}
+		mu.Lock()
+		notifications = append(notifications, n)
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+	t.Setenv("AUDIT_LOG_LOCATION", "s3://audit/deployments")
+	t.Setenv("NOTIFICATION_WEBHOOK_SECRET", "webhook")
+	t.Setenv("NOTIFICATION_WEBHOOK_SECRET_KEY", "url")
+
+	report, _, err := e2eJob(t, fake, "")
+	if err == nil {
+		t.Fatal("job succeeded, want a failure")
+	}
+
+	// The cached webhook URL has since been revoked and rotated
+	fake.PutSecret("webhook", `{"url": "`+webhook.URL+`/revoked"}`)
+	if _, err := secrets.get(context.Background(), webhookRef()); err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	fake.PutSecret("webhook", `{"url": "`+webhook.URL+`"}`)
+	deploymentID := report.Targets[0].DeploymentID
+
+	event := func(id, state string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"version": "0", "id": %q, "detail-type": "CodeDeploy Deployment State-change Notification",
+			"source": "aws.codedeploy", "account": "111111111111", "time": "2026-10-19T12:00:00Z", "region": "us-east-1",
+			"detail": {"region": "us-east-1", "deploymentId": %q, "instanceGroupId": "ig-1", "deploymentGroup": "api-live", "state": %q, "application": "api"}}`,
+			id, deploymentID, state))
+	}
+
+	// EventBridge may deliver the same event twice, and we notify once
+	for range 2 {
+		result, err := HandleInvocation(context.Background(), event("event-1", "FAILURE"))
+		if err != nil {
+			t.Fatalf("HandleInvocation() returned error: %v", err)
+		}
+		e, ok := result.(*DeploymentEvent)
+		if !ok || e.Status != "Failed" || e.JobID != "job-1" {
+			t.Fatalf("event = %+v, want job-1's failed deployment", result)
+		}
+	}
+	// START is not a state we notify about by default
+	if _, err := HandleInvocation(context.Background(), event("event-0", "START")); err != nil {
+		t.Fatalf("HandleInvocation() returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if revoked != 1 {
+		t.Errorf("the revoked webhook was posted to %d times, want once before the URL was refreshed", revoked)
+	}
+	if len(notifications) != 1 {
+		t.Fatalf("got %d notifications, want 1: %+v", len(notifications), notifications)
+	}
+	n := notifications[0]
+	for _, want := range []string{"Deployment " + deploymentID + " of api/api-live failed (job job-1)", "i-2 failed AfterInstall in scripts/migrate.sh"} {
+		if !strings.Contains(n.Text, want) {
+			t.Errorf("notification %q does not contain %q", n.Text, want)
+		}
+	}
+	if n.Event == nil || n.Event.EventID != "event-1" || n.Event.State != "FAILURE" {
+		t.Errorf("notification event = %+v, want event-1", n.Event)
+	}
+
+	for _, state := range []string{"FAILURE", "START"} {
+		data, ok := fake.Object("audit", "deployments/events/date=2026-10-19/"+deploymentID+"-"+state+".json")
+		if !ok {
+			t.Fatalf("no audit record of the %s event", state)
+		}
+		var recorded DeploymentEvent
+		if err := json.Unmarshal(data, &recorded); err != nil || recorded.DeploymentID != deploymentID || recorded.State != state {
+			t.Errorf("audit record = %s, want the %s event of %s", data, state, deploymentID)
+		}
+	}
+
+	// Deployment events live beside the job records, not among them
+	records, err := QueryAuditLog(context.Background(), s3Client, "s3://audit/deployments", AuditQuery{})
+	if err != nil || len(records) != 1 || records[0].JobID != "job-1" {
+		t.Errorf("QueryAuditLog() = %d records, %v, want job-1's only", len(records), err)
+	}
+}
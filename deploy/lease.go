@@ -0,0 +1,349 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// While waiting for another job's lease, we check it this often. A
+// variable so tests can wait quickly.
+var leasePollInterval = 10 * time.Second
+
+// Taking a lease over can race with other jobs doing the same, so we
+// give up after this many conflicting attempts in a row
+const maxLeaseConflicts = 5
+
+// leaseAPI is the part of the S3 client that leases need
+type leaseAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// leaseRecord is the lease object. Token tells one holder's lease from
+// another's when both are for the same job.
+type leaseRecord struct {
+	Owner      string    `json:"owner"`
+	JobID      string    `json:"jobId"`
+	Token      string    `json:"token"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// deploymentLease is a job's lock on one deployment group. S3 conditional
+// writes make it safe: the lease is created with If-None-Match, and
+// renewed, taken over and released with If-Match on the ETag we last saw,
+// so only one job can hold it at a time.
+type deploymentLease struct {
+	client leaseAPI
+	bucket string
+	key    string
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	record leaseRecord
+	etag   string
+	lost   bool
+}
+
+// leaseHeldError is a lease another job holds
+type leaseHeldError struct {
+	Location string
+	Holder   leaseRecord
+}
+
+func (e *leaseHeldError) Error() string {
+	return fmt.Sprintf("deployment group is locked by job %s (%s) until %s, lease %s",
+		e.Holder.JobID, e.Holder.Owner, e.Holder.ExpiresAt.UTC().Format(time.RFC3339), e.Location)
+}
+
+// errLeaseLost means another job took the lease over, e.g. because we
+// could not renew it before it expired
+var errLeaseLost = errors.New("deployment group lease was taken over by another job")
+
+// leaseKey places a group's lease under the prefix. Groups in other
+// regions may share a name, so the region is part of the key.
+func leaseKey(prefix string, target deploymentTarget) string {
+	region := target.Region
+	if region == "" {
+		region = "default"
+	}
+	return path.Join(prefix, region, target.ApplicationName, target.DeploymentGroupName+".json")
+}
+
+// leaseOwner names this process in a lease, for whoever finds it held
+func leaseOwner() string {
+	if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s[%d]", host, os.Getpid())
+}
+
+func newLeaseToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// acquireDeploymentLease locks the target's group for the job when
+// deployment locks are configured, and returns nil when they are not
+func acquireDeploymentLease(ctx context.Context, target deploymentTarget, jobID string) (*deploymentLease, error) {
+	if cfg.DeploymentLockLocation == "" {
+		return nil, nil
+	}
+	return acquireLease(ctx, s3Client, cfg.DeploymentLockLocation, target, jobID, cfg.DeploymentLockTTL, cfg.DeploymentLockWait)
+}
+
+// acquireLease takes the group's lease for the job, waiting up to wait
+// for a lease another job holds. A lease that expired, or that an earlier
+// delivery of the same job holds, is taken over.
+func acquireLease(ctx context.Context, client leaseAPI, location string, target deploymentTarget, jobID string, ttl, wait time.Duration) (*deploymentLease, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	l := &deploymentLease{
+		client: client,
+		bucket: bucket,
+		key:    leaseKey(prefix, target),
+		ttl:    ttl,
+		record: leaseRecord{Owner: leaseOwner(), JobID: jobID, Token: newLeaseToken()},
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := l.tryAcquire(ctx)
+		var held *leaseHeldError
+		if !errors.As(err, &held) {
+			if err == nil {
+				log.Printf("Acquired lease %s for job %s until %s", l.location(), jobID, l.record.ExpiresAt.Format(time.RFC3339))
+			}
+			return l, err
+		}
+		if time.Now().Add(leasePollInterval).After(deadline) {
+			return nil, held
+		}
+		log.Printf("Waiting for lease: %v", held)
+		if err := sleep(ctx, leasePollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *deploymentLease) location() string {
+	return fmt.Sprintf("s3://%s/%s", l.bucket, l.key)
+}
+
+// tryAcquire creates the lease, or takes over one that has expired or
+// belongs to the same job. It returns a leaseHeldError if another job
+// holds it.
+func (l *deploymentLease) tryAcquire(ctx context.Context) error {
+	for conflicts := 0; conflicts < maxLeaseConflicts; conflicts++ {
+		err := l.write(ctx, "")
+		if err == nil {
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return fmt.Errorf("failed to create lease %s: %v", l.location(), err)
+		}
+
+		current, etag, err := l.read(ctx)
+		if isNoSuchKey(err) {
+			// Released since we tried to create it
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read lease %s: %v", l.location(), err)
+		}
+		if current.JobID != l.record.JobID && time.Now().Before(current.ExpiresAt) {
+			return &leaseHeldError{Location: l.location(), Holder: current}
+		}
+
+		if current.JobID == l.record.JobID {
+			log.Printf("Taking over lease %s from an earlier delivery of job %s", l.location(), current.JobID)
+		} else {
+			log.Printf("Taking over lease %s from job %s (%s), which expired at %s", l.location(), current.JobID, current.Owner, current.ExpiresAt.Format(time.RFC3339))
+		}
+		err = l.write(ctx, etag)
+		if err == nil {
+			return nil
+		}
+		if !isPreconditionFailed(err) && !isNoSuchKey(err) {
+			return fmt.Errorf("failed to take over lease %s: %v", l.location(), err)
+		}
+		// Someone else changed it since we read it, so we look again
+	}
+	return fmt.Errorf("failed to acquire lease %s: it kept changing under us", l.location())
+}
+
+// write stores the lease with a fresh expiry: created if ifMatch is
+// empty, or else only if it is still the version with that ETag
+func (l *deploymentLease) write(ctx context.Context, ifMatch string) error {
+	record := l.record
+	now := time.Now().UTC()
+	if record.AcquiredAt.IsZero() || ifMatch != l.etag {
+		record.AcquiredAt = now
+	}
+	record.ExpiresAt = now.Add(l.ttl)
+	body, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %v", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(l.bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if ifMatch == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(ifMatch)
+	}
+	result, err := l.client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	l.record, l.etag = record, aws.ToString(result.ETag)
+	return nil
+}
+
+// read returns the lease as it is stored, with its ETag
+func (l *deploymentLease) read(ctx context.Context) (leaseRecord, string, error) {
+	var record leaseRecord
+	result, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	})
+	if err != nil {
+		return record, "", err
+	}
+	defer result.Body.Close()
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return record, "", err
+	}
+	if err := json.Unmarshal(body, &record); err != nil {
+		// We cannot tell who holds an unreadable lease, so it is treated
+		// as expired and taken over
+		log.Printf("Warning: Lease %s is not valid JSON: %v", l.location(), err)
+	}
+	return record, aws.ToString(result.ETag), nil
+}
+
+// renew extends the lease by its TTL. It returns errLeaseLost if another
+// job has taken the lease over.
+func (l *deploymentLease) renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return errLeaseLost
+	}
+
+	err := l.write(ctx, l.etag)
+	if isPreconditionFailed(err) || isNoSuchKey(err) {
+		l.lost = true
+		return errLeaseLost
+	}
+	if err != nil {
+		return fmt.Errorf("failed to renew lease %s: %v", l.location(), err)
+	}
+	return nil
+}
+
+// keepAlive renews the lease in the background, three times per TTL,
+// until the returned function is called. If another job takes the lease
+// over, it stops renewing and calls lost with errLeaseLost, so the job
+// can stop relying on the group being its own.
+func (l *deploymentLease) keepAlive(ctx context.Context, lost func(error)) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := l.renew(ctx)
+			if errors.Is(err, errLeaseLost) {
+				log.Printf("Lease %s was lost, another job may deploy to the group", l.location())
+				lost(err)
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// leaseLost returns errLeaseLost if ctx was cancelled because the job
+// lost its lease on the group
+func leaseLost(ctx context.Context) error {
+	if err := context.Cause(ctx); errors.Is(err, errLeaseLost) {
+		return err
+	}
+	return nil
+}
+
+// release deletes the lease, unless another job has taken it over
+func (l *deploymentLease) release(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return
+	}
+
+	_, err := l.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(l.bucket),
+		Key:     aws.String(l.key),
+		IfMatch: aws.String(l.etag),
+	})
+	switch {
+	case isPreconditionFailed(err) || isNoSuchKey(err):
+		log.Printf("Lease %s was taken over by another job, leaving it", l.location())
+	case err != nil:
+		log.Printf("Warning: Failed to release lease %s, it expires at %s: %v", l.location(), l.record.ExpiresAt.Format(time.RFC3339), err)
+	default:
+		log.Printf("Released lease %s", l.location())
+	}
+	l.lost = true
+}
+
+// isPreconditionFailed reports whether a conditional S3 write lost to
+// another writer
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict")
+}
+
+func isNoSuchKey(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey"
+}
@@ -0,0 +1,226 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+var leaseTarget = deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-live"}
+
+// leaseAWS serves leases from the fake AWS server's S3
+func leaseAWS(t *testing.T) (*fakeaws.Server, leaseAPI) {
+	t.Helper()
+	fake, _ := localAWS(t)
+	e2eInit(t)
+	return fake, s3Client
+}
+
+// storedLease reads the group's lease from the fake, if there is one
+func storedLease(t *testing.T, fake *fakeaws.Server) (leaseRecord, bool) {
+	t.Helper()
+	var record leaseRecord
+	data, ok := fake.Object("locks", leaseKey("groups", leaseTarget))
+	if !ok {
+		return record, false
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("invalid lease: %v", err)
+	}
+	return record, true
+}
+
+func TestLeaseContention(t *testing.T) {
+	fake, client := leaseAWS(t)
+
+	// Every job tries at once, and exactly one gets the lease
+	const jobs = 8
+	leases := make([]*deploymentLease, jobs)
+	errs := make([]error, jobs)
+	var wg sync.WaitGroup
+	for i := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leases[i], errs[i] = acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, fmt.Sprintf("job-%d", i), time.Hour, 0)
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	for i := range jobs {
+		if errs[i] == nil {
+			if winner >= 0 {
+				t.Fatalf("jobs %d and %d both hold the lease", winner, i)
+			}
+			winner = i
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("no job got the lease: %v", errs)
+	}
+	for i := range jobs {
+		var held *leaseHeldError
+		if i != winner && (!errors.As(errs[i], &held) || held.Holder.JobID != leases[winner].record.JobID) {
+			t.Errorf("job-%d error = %v, want the lease held by job-%d", i, errs[i], winner)
+		}
+	}
+	record, ok := storedLease(t, fake)
+	if !ok || record.JobID != fmt.Sprintf("job-%d", winner) || record.Owner == "" || !record.ExpiresAt.After(time.Now()) {
+		t.Errorf("stored lease = %+v, want job-%d's", record, winner)
+	}
+
+	// The lease goes to the next job once released
+	leases[winner].release(context.Background())
+	if _, ok := storedLease(t, fake); ok {
+		t.Fatal("lease still exists after release")
+	}
+	if _, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-next", time.Hour, 0); err != nil {
+		t.Errorf("acquireLease() after release returned error: %v", err)
+	}
+}
+
+func TestLeaseHeldError(t *testing.T) {
+	_, client := leaseAWS(t)
+	if _, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-a", time.Hour, 0); err != nil {
+		t.Fatalf("acquireLease() returned error: %v", err)
+	}
+
+	_, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-b", time.Hour, 0)
+	if err == nil || !strings.Contains(err.Error(), "locked by job job-a") || !strings.Contains(err.Error(), "s3://locks/groups/default/api/api-live.json") {
+		t.Errorf("acquireLease() error = %v, want one naming job-a and the lease", err)
+	}
+
+	// A redelivery of the same job takes its own lease back
+	if _, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-a", time.Hour, 0); err != nil {
+		t.Errorf("acquireLease() for the same job returned error: %v", err)
+	}
+}
+
+func TestLeaseExpiredTakeover(t *testing.T) {
+	fake, client := leaseAWS(t)
+	stale, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-a", 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("acquireLease() returned error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	lease, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-b", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("acquireLease() of an expired lease returned error: %v", err)
+	}
+
+	// The old holder finds out when it renews, and leaves the lease alone
+	if err := stale.renew(context.Background()); !errors.Is(err, errLeaseLost) {
+		t.Errorf("renew() of a lease taken over = %v, want errLeaseLost", err)
+	}
+	stale.release(context.Background())
+	if record, ok := storedLease(t, fake); !ok || record.JobID != "job-b" || record.Token != lease.record.Token {
+		t.Errorf("stored lease = %+v, want job-b's", record)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	fake, client := leaseAWS(t)
+	lease, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-a", 30*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("acquireLease() returned error: %v", err)
+	}
+	first, _ := storedLease(t, fake)
+
+	// Renewed in the background, the lease outlives its TTL
+	stop := lease.keepAlive(context.Background(), func(err error) { t.Errorf("lease lost: %v", err) })
+	time.Sleep(100 * time.Millisecond)
+	_, err = acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-b", time.Hour, 0)
+	stop()
+	var held *leaseHeldError
+	if !errors.As(err, &held) {
+		t.Errorf("acquireLease() of a renewed lease = %v, want it held", err)
+	}
+	renewed, _ := storedLease(t, fake)
+	if !renewed.ExpiresAt.After(first.ExpiresAt) || !renewed.AcquiredAt.Equal(first.AcquiredAt) {
+		t.Errorf("renewed lease = %+v, want a later expiry than %+v", renewed, first)
+	}
+}
+
+func TestLeaseWait(t *testing.T) {
+	_, client := leaseAWS(t)
+	saved := leasePollInterval
+	t.Cleanup(func() { leasePollInterval = saved })
+	leasePollInterval = 5 * time.Millisecond
+
+	lease, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-a", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("acquireLease() returned error: %v", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lease.release(context.Background())
+	}()
+
+	if _, err := acquireLease(context.Background(), client, "s3://locks/groups", leaseTarget, "job-b", time.Hour, time.Minute); err != nil {
+		t.Errorf("acquireLease() while waiting returned error: %v", err)
+	}
+}
+
+func TestDeploymentLeaseAroundJob(t *testing.T) {
+	t.Run("released after the deployment", func(t *testing.T) {
+		fake, _ := localAWS(t)
+		fake.SetScenario("api", "api-live", fakeaws.Scenario{InProgressPolls: 2})
+		t.Setenv("DEPLOYMENT_LOCK_LOCATION", "s3://locks/groups")
+
+		_, job, err := e2eJob(t, fake, "")
+		if err != nil || job.Status != "Succeeded" {
+			t.Fatalf("job = %+v, err = %v, want a success", job, err)
+		}
+		if record, ok := storedLease(t, fake); ok {
+			t.Errorf("lease %+v was not released", record)
+		}
+	})
+
+	t.Run("held by another job", func(t *testing.T) {
+		fake, _ := localAWS(t)
+		t.Setenv("DEPLOYMENT_LOCK_LOCATION", "s3://locks/groups")
+		held, _ := json.Marshal(leaseRecord{Owner: "other-pipeline", JobID: "job-other", ExpiresAt: time.Now().Add(time.Hour)})
+		fake.PutObject("locks", leaseKey("groups", leaseTarget), held)
+
+		_, job, err := e2eJob(t, fake, "")
+		if err == nil || job.Status != "Failed" || !strings.Contains(job.FailureMessage, "locked by job job-other (other-pipeline)") {
+			t.Fatalf("job = %+v, want a failure naming the lease holder", job)
+		}
+		if fake.Calls("CreateDeployment") != 0 {
+			t.Errorf("CreateDeployment was called while the group was locked")
+		}
+	})
+
+	t.Run("lost during the deployment", func(t *testing.T) {
+		fake, _ := localAWS(t)
+		fake.SetScenario("api", "api-live", fakeaws.Scenario{InProgressPolls: 1000})
+		t.Setenv("DEPLOYMENT_LOCK_LOCATION", "s3://locks/groups")
+		t.Setenv("DEPLOYMENT_LOCK_TTL", "30ms")
+
+		// Another job takes the lease over once the deployment is running
+		go func() {
+			for deadline := time.Now().Add(time.Second); fake.Calls("CreateDeployment") == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			taken, _ := json.Marshal(leaseRecord{Owner: "other-pipeline", JobID: "job-other", ExpiresAt: time.Now().Add(time.Hour)})
+			fake.PutObject("locks", leaseKey("groups", leaseTarget), taken)
+		}()
+
+		_, job, err := e2eJob(t, fake, "")
+		if err == nil || job.Status != "Failed" || !strings.Contains(job.FailureMessage, errLeaseLost.Error()) {
+			t.Fatalf("job = %+v, err = %v, want it failed for losing the lease", job, err)
+		}
+		if record, ok := storedLease(t, fake); !ok || record.JobID != "job-other" {
+			t.Errorf("stored lease = %+v, want job-other's left in place", record)
+		}
+	})
+}
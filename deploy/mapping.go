@@ -0,0 +1,328 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// deploymentTarget is what a job deploys to, and how it is validated
+type deploymentTarget struct {
+	ApplicationName        string `json:"applicationName"`
+	DeploymentGroupName    string `json:"deploymentGroupName"`
+	HealthCheckURL         string `json:"healthCheckUrl,omitempty"`
+	AppHealthCheckURL      string `json:"appHealthCheckUrl,omitempty"`
+	SkipUnchangedRevisions bool   `json:"skipUnchangedRevisions,omitempty"`
+
+	// HealthCheck and AppHealthCheck invoke a function instead of, or as
+	// well as, requesting the matching URL
+	HealthCheck    *lambdaHealthCheck `json:"healthCheck,omitempty"`
+	AppHealthCheck *lambdaHealthCheck `json:"appHealthCheck,omitempty"`
+
+	// Region, RoleARN and ExternalID reach a group in another region or
+	// account. ArtifactBucket is a bucket in the target's region that the
+	// bundle is copied to, since CodeDeploy cannot read across regions.
+	Region         string `json:"region,omitempty"`
+	RoleARN        string `json:"roleArn,omitempty"`
+	ExternalID     string `json:"externalId,omitempty"`
+	ArtifactBucket string `json:"artifactBucket,omitempty"`
+
+	// Platform is "ecs" for ECS blue/green groups, whose AppSpec is built
+	// from the ECS settings and the bundle's task definition
+	Platform string       `json:"platform,omitempty"`
+	ECS      *ecsSettings `json:"ecs,omitempty"`
+
+	// MinHealthyHosts stops a server deployment once too many hosts fail
+	MinHealthyHosts *minHealthyHosts `json:"minHealthyHosts,omitempty"`
+}
+
+// String names the target in logs and errors
+func (t deploymentTarget) String() string {
+	s := t.ApplicationName + "/" + t.DeploymentGroupName
+	if t.Region != "" {
+		s += "@" + t.Region
+	}
+	return s
+}
+
+// defaultTarget is the single target configured through the environment
+func defaultTarget() deploymentTarget {
+	target := deploymentTarget{
+		ApplicationName:        cfg.ApplicationName,
+		DeploymentGroupName:    cfg.DeploymentGroupName,
+		HealthCheckURL:         cfg.HealthCheckURL,
+		AppHealthCheckURL:      cfg.AppHealthCheckURL,
+		SkipUnchangedRevisions: cfg.SkipUnchangedRevisions,
+		Region:                 cfg.TargetRegion,
+		RoleARN:                cfg.TargetRoleARN,
+		ExternalID:             cfg.TargetExternalID,
+		ArtifactBucket:         cfg.TargetArtifactBucket,
+		Platform:               cfg.DeploymentPlatform,
+	}
+	if cfg.HealthCheckLambda != nil {
+		check := lambdaHealthCheck{*cfg.HealthCheckLambda}
+		target.HealthCheck = &check
+	}
+	if cfg.AppHealthCheckLambda != nil {
+		check := lambdaHealthCheck{*cfg.AppHealthCheckLambda}
+		target.AppHealthCheck = &check
+	}
+	if cfg.MinHealthyHosts.Type != "" {
+		target.MinHealthyHosts = &minHealthyHosts{
+			Type:  cfg.MinHealthyHosts.Type,
+			Value: cfg.MinHealthyHosts.Value,
+		}
+	}
+	if target.Platform == platformECS {
+		target.ECS = &ecsSettings{
+			ContainerName: cfg.ECSContainerName,
+			ContainerPort: int32(cfg.ECSContainerPort),
+		}
+	}
+	return target
+}
+
+// jobContext says which pipeline, stage and action a job belongs to
+type jobContext struct {
+	PipelineName        string
+	PipelineExecutionID string
+	StageName           string
+	ActionName          string
+}
+
+// mappingDocument maps pipelines (and optionally stages) to targets, so
+// one deploy Lambda can serve many pipelines. For example:
+//
+//	{"pipelines": [{"pipeline": "orders", "stage": "Deploy",
+//	  "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}}]}
+type mappingDocument struct {
+	Pipelines []pipelineMapping `json:"pipelines"`
+}
+
+// pipelineMapping routes one pipeline to a single target, or to a wave
+// plan across several, and sets exactly one of them. An empty stage
+// matches every stage of the pipeline. Deployment policies are not part of
+// a mapping: every mapped target is checked against the one policy.
+type pipelineMapping struct {
+	Pipeline string           `json:"pipeline"`
+	Stage    string           `json:"stage,omitempty"`
+	Target   deploymentTarget `json:"target"`
+	Plan     *wavePlan        `json:"plan,omitempty"`
+}
+
+// plan returns the mapping's wave plan, wrapping a single target in one
+func (m pipelineMapping) plan() wavePlan {
+	if m.Plan != nil {
+		return *m.Plan
+	}
+	return singleTargetPlan(m.Target)
+}
+
+// validate checks the whole document, so a bad edit is caught on load
+// rather than when a particular pipeline runs
+func (d *mappingDocument) validate() error {
+	if len(d.Pipelines) == 0 {
+		return fmt.Errorf("mapping document has no pipelines")
+	}
+	seen := map[string]bool{}
+	for i, m := range d.Pipelines {
+		if m.Pipeline == "" {
+			return fmt.Errorf("mapping %d has no pipeline name", i)
+		}
+		hasTarget := m.Target != deploymentTarget{}
+		if hasTarget == (m.Plan != nil) {
+			return fmt.Errorf("mapping for pipeline %s must have either a target or a plan", m.Pipeline)
+		}
+		plan := m.plan()
+		if err := plan.validate(); err != nil {
+			return fmt.Errorf("mapping for pipeline %s: %v", m.Pipeline, err)
+		}
+		for _, w := range plan.Waves {
+			urls := []string{w.HealthCheckURL}
+			for _, t := range w.Targets {
+				urls = append(urls, t.HealthCheckURL, t.AppHealthCheckURL)
+			}
+			for _, healthCheckURL := range urls {
+				if healthCheckURL == "" {
+					continue
+				}
+				if u, err := url.ParseRequestURI(healthCheckURL); err != nil || u.Host == "" {
+					return fmt.Errorf("mapping for pipeline %s has an invalid health check URL %q", m.Pipeline, healthCheckURL)
+				}
+			}
+		}
+		key := m.Pipeline + "/" + m.Stage
+		if seen[key] {
+			return fmt.Errorf("duplicate mapping for pipeline %s stage %q", m.Pipeline, m.Stage)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// resolve finds the plan for a job, preferring a stage-specific mapping
+func (d *mappingDocument) resolve(job jobContext) (wavePlan, error) {
+	var fallback *pipelineMapping
+	for i, m := range d.Pipelines {
+		if m.Pipeline != job.PipelineName {
+			continue
+		}
+		if m.Stage == job.StageName {
+			return m.plan(), nil
+		}
+		if m.Stage == "" {
+			fallback = &d.Pipelines[i]
+		}
+	}
+	if fallback != nil {
+		return fallback.plan(), nil
+	}
+	return wavePlan{}, fmt.Errorf("no mapping for pipeline %s stage %s", job.PipelineName, job.StageName)
+}
+
+// mappingCache keeps the mapping document across warm invocations
+type mappingCache struct {
+	mu        sync.Mutex
+	doc       *mappingDocument
+	fetchedAt time.Time
+}
+
+var mappings mappingCache
+
+// get returns the mapping document, loading it if it is missing or expired
+func (c *mappingCache) get(ctx context.Context) (*mappingDocument, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.doc != nil && time.Since(c.fetchedAt) < cfg.DeploymentMappingTTL {
+		return c.doc, nil
+	}
+
+	doc, err := loadMappingDocument(ctx, cfg.DeploymentMappingLocation)
+	if err != nil {
+		return nil, err
+	}
+	c.doc = doc
+	c.fetchedAt = time.Now()
+	return doc, nil
+}
+
+// loadMappingDocument reads and validates the mapping document
+func loadMappingDocument(ctx context.Context, location string) (*mappingDocument, error) {
+	raw, err := readDocument(ctx, location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping document from %s: %v", location, err)
+	}
+
+	var doc mappingDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid mapping document at %s: %v", location, err)
+	}
+	if err := doc.validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping document at %s: %v", location, err)
+	}
+
+	log.Printf("Loaded deployment mapping with %d pipelines from %s", len(doc.Pipelines), location)
+	return &doc, nil
+}
+
+// readDocument reads a configuration document from s3://bucket/key or from
+// an SSM parameter given as ssm:/parameter/name
+func readDocument(ctx context.Context, location string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		bucket, key, ok := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if !ok || bucket == "" || key == "" {
+			return nil, fmt.Errorf("invalid S3 location %s", location)
+		}
+		result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer result.Body.Close()
+		return io.ReadAll(result.Body)
+
+	case strings.HasPrefix(location, "ssm:"):
+		result, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(strings.TrimPrefix(location, "ssm:")),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []byte(aws.ToString(result.Parameter.Value)), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported location %s, expected s3://bucket/key or ssm:/name", location)
+	}
+}
+
+// getJobContext asks CodePipeline which pipeline and stage the job is for
+func getJobContext(ctx context.Context, jobID string) (jobContext, error) {
+	result, err := codePipelineClient.GetJobDetails(ctx, &codepipeline.GetJobDetailsInput{
+		JobId: aws.String(jobID),
+	})
+	if err != nil {
+		return jobContext{}, fmt.Errorf("failed to get job details: %v", err)
+	}
+
+	var job jobContext
+	if result.JobDetails == nil || result.JobDetails.Data == nil || result.JobDetails.Data.PipelineContext == nil {
+		return job, fmt.Errorf("job %s has no pipeline context", jobID)
+	}
+
+	pipeline := result.JobDetails.Data.PipelineContext
+	job.PipelineName = aws.ToString(pipeline.PipelineName)
+	job.PipelineExecutionID = aws.ToString(pipeline.PipelineExecutionId)
+	if pipeline.Stage != nil {
+		job.StageName = aws.ToString(pipeline.Stage.Name)
+	}
+	if pipeline.Action != nil {
+		job.ActionName = aws.ToString(pipeline.Action.Name)
+	}
+	return job, nil
+}
+
+// resolvePlan works out where this job deploys to. Without a mapping
+// document, that is the wave plan or the single target configured
+// through the environment.
+func resolvePlan(ctx context.Context, jobID string) (wavePlan, error) {
+	if cfg.DeploymentMappingLocation == "" {
+		if cfg.WavePlan != "" {
+			return parseWavePlan(cfg.WavePlan)
+		}
+		return singleTargetPlan(defaultTarget()), nil
+	}
+
+	job, err := getJobContext(ctx, jobID)
+	if err != nil {
+		return wavePlan{}, err
+	}
+
+	doc, err := mappings.get(ctx)
+	if err != nil {
+		return wavePlan{}, err
+	}
+
+	plan, err := doc.resolve(job)
+	if err != nil {
+		return wavePlan{}, err
+	}
+
+	log.Printf("Pipeline %s stage %s maps to %d waves", job.PipelineName, job.StageName, len(plan.Waves))
+	return plan, nil
+}
@@ -0,0 +1,208 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMappingDocumentValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{
+			name: "single target",
+			doc:  `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}}]}`,
+		},
+		{
+			name: "stage mappings",
+			doc: `{"pipelines": [
+				{"pipeline": "orders", "stage": "Beta", "target": {"applicationName": "orders", "deploymentGroupName": "orders-beta"}},
+				{"pipeline": "orders", "stage": "Prod", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}}]}`,
+		},
+		{
+			name: "wave plan",
+			doc: `{"pipelines": [{"pipeline": "orders", "plan": {"waves": [
+				{"targets": [{"applicationName": "orders", "deploymentGroupName": "orders-eu"}], "healthCheckUrl": "https://eu.example.com/health"}]}}]}`,
+		},
+		{name: "no pipelines", doc: `{"pipelines": []}`, wantErr: "has no pipelines"},
+		{
+			name:    "no pipeline name",
+			doc:     `{"pipelines": [{"target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}}]}`,
+			wantErr: "mapping 0 has no pipeline name",
+		},
+		{
+			name: "target and plan",
+			doc: `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"},
+				"plan": {"waves": [{"targets": [{"applicationName": "orders", "deploymentGroupName": "orders-eu"}]}]}}]}`,
+			wantErr: "mapping for pipeline orders must have either a target or a plan",
+		},
+		{
+			name:    "neither target nor plan",
+			doc:     `{"pipelines": [{"pipeline": "orders", "stage": "Prod"}]}`,
+			wantErr: "mapping for pipeline orders must have either a target or a plan",
+		},
+		{
+			name:    "target without a group",
+			doc:     `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders"}}]}`,
+			wantErr: "mapping for pipeline orders: wave 1 has a target without applicationName",
+		},
+		{
+			name: "other account without an artifact bucket",
+			doc: `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live",
+				"roleArn": "arn:aws:iam::222222222222:role/deploy", "externalId": "ext"}}]}`,
+			wantErr: "has a roleArn but no artifactBucket",
+		},
+		{
+			name: "other account with an artifact bucket",
+			doc: `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live",
+				"roleArn": "arn:aws:iam::222222222222:role/deploy", "externalId": "ext", "artifactBucket": "artifacts-prod"}}]}`,
+		},
+		{
+			name: "relative health check URL",
+			doc: `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live",
+				"healthCheckUrl": "/health"}}]}`,
+			wantErr: `invalid health check URL "/health"`,
+		},
+		{
+			name: "bad app health check URL",
+			doc: `{"pipelines": [{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live",
+				"appHealthCheckUrl": "not a url"}}]}`,
+			wantErr: `invalid health check URL "not a url"`,
+		},
+		{
+			name: "bad wave health check URL",
+			doc: `{"pipelines": [{"pipeline": "orders", "plan": {"waves": [
+				{"targets": [{"applicationName": "orders", "deploymentGroupName": "orders-eu"}], "healthCheckUrl": "eu.example.com"}]}}]}`,
+			wantErr: `invalid health check URL "eu.example.com"`,
+		},
+		{
+			name: "duplicate stage",
+			doc: `{"pipelines": [
+				{"pipeline": "orders", "stage": "Prod", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}},
+				{"pipeline": "orders", "stage": "Prod", "target": {"applicationName": "orders", "deploymentGroupName": "orders-dr"}}]}`,
+			wantErr: `duplicate mapping for pipeline orders stage "Prod"`,
+		},
+		{
+			name: "duplicate fallback",
+			doc: `{"pipelines": [
+				{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-live"}},
+				{"pipeline": "orders", "target": {"applicationName": "orders", "deploymentGroupName": "orders-dr"}}]}`,
+			wantErr: `duplicate mapping for pipeline orders stage ""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, _ := localAWS(t)
+			e2eInit(t)
+			fake.PutParameter("/deploy/mapping", tt.doc)
+
+			_, err := loadMappingDocument(context.Background(), "ssm:/deploy/mapping")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("loadMappingDocument() returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadMappingDocument() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMappingDocumentResolve(t *testing.T) {
+	doc := &mappingDocument{Pipelines: []pipelineMapping{
+		{Pipeline: "orders", Target: deploymentTarget{ApplicationName: "orders", DeploymentGroupName: "orders-default"}},
+		{Pipeline: "orders", Stage: "Prod", Target: deploymentTarget{ApplicationName: "orders", DeploymentGroupName: "orders-live"}},
+		{Pipeline: "billing", Stage: "Prod", Plan: &wavePlan{Waves: []wave{
+			{Targets: []deploymentTarget{{ApplicationName: "billing", DeploymentGroupName: "billing-eu"}}},
+			{Targets: []deploymentTarget{{ApplicationName: "billing", DeploymentGroupName: "billing-us"}}},
+		}}},
+	}}
+
+	tests := []struct {
+		name       string
+		job        jobContext
+		wantGroups []string
+		wantErr    string
+	}{
+		// The stage mapping wins even though the fallback is listed first
+		{name: "stage mapping", job: jobContext{PipelineName: "orders", StageName: "Prod"}, wantGroups: []string{"orders-live"}},
+		{name: "fallback", job: jobContext{PipelineName: "orders", StageName: "Beta"}, wantGroups: []string{"orders-default"}},
+		{name: "wave plan", job: jobContext{PipelineName: "billing", StageName: "Prod"}, wantGroups: []string{"billing-eu", "billing-us"}},
+		{name: "unmapped stage", job: jobContext{PipelineName: "billing", StageName: "Beta"}, wantErr: "no mapping for pipeline billing stage Beta"},
+		{name: "unmapped pipeline", job: jobContext{PipelineName: "search", StageName: "Prod"}, wantErr: "no mapping for pipeline search stage Prod"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := doc.resolve(tt.job)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() = %+v, %v, want an error containing %q", plan, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() returned error: %v", err)
+			}
+			var groups []string
+			for _, w := range plan.Waves {
+				for _, target := range w.Targets {
+					groups = append(groups, target.DeploymentGroupName)
+				}
+			}
+			if strings.Join(groups, ",") != strings.Join(tt.wantGroups, ",") {
+				t.Errorf("resolve() deploys to %v, want %v", groups, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestReadDocument(t *testing.T) {
+	fake, _ := localAWS(t)
+	e2eInit(t)
+	fake.PutObject("config", "deploy/mapping.json", []byte(`{"pipelines": []}`))
+	fake.PutParameter("/deploy/mapping", `{"pipelines": []}`)
+
+	tests := []struct {
+		name     string
+		location string
+		wantErr  string
+	}{
+		{name: "S3 object", location: "s3://config/deploy/mapping.json"},
+		{name: "SSM parameter", location: "ssm:/deploy/mapping"},
+		{name: "S3 bucket only", location: "s3://config", wantErr: "invalid S3 location s3://config"},
+		{name: "S3 without a bucket", location: "s3:///mapping.json", wantErr: "invalid S3 location"},
+		{name: "S3 without a key", location: "s3://config/", wantErr: "invalid S3 location"},
+		{name: "missing object", location: "s3://config/deploy/missing.json", wantErr: "NoSuchKey"},
+		{name: "missing parameter", location: "ssm:/deploy/missing", wantErr: "ParameterNotFound"},
+		{name: "HTTPS", location: "https://example.com/mapping.json", wantErr: "unsupported location"},
+		{name: "bare path", location: "/deploy/mapping", wantErr: "unsupported location"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := readDocument(context.Background(), tt.location)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readDocument() = %s, %v, want an error containing %q", raw, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || string(raw) != `{"pipelines": []}` {
+				t.Errorf("readDocument() = %s, %v, want the document", raw, err)
+			}
+		})
+	}
+
+	// A document that is read but not a mapping names its location
+	fake.PutParameter("/deploy/broken", `{"pipelines": {}}`)
+	if _, err := loadMappingDocument(context.Background(), "ssm:/deploy/broken"); err == nil || !strings.Contains(err.Error(), "invalid mapping document at ssm:/deploy/broken") {
+		t.Errorf("loadMappingDocument() = %v, want the document rejected", err)
+	}
+}
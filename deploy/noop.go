@@ -0,0 +1,63 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+)
+
+// bundleTag marks a deployment description with the bundle's SHA-256, so a
+// later run can tell whether the same bundle is already live
+func bundleTag(sha256 string) string {
+	return fmt.Sprintf("[bundle-sha256:%s]", sha256)
+}
+
+var bundleTagPattern = regexp.MustCompile(`\[bundle-sha256:([0-9a-f]{64})\]`)
+
+// findLiveRevision checks whether the bundle is the same one the group's
+// last successful deployment used. It compares the S3 ETag and the bundle
+// hash we tag every deployment with, since CodePipeline stores each run's
+// artifact under a new key. It returns the live deployment ID on a match.
+func findLiveRevision(ctx context.Context, clients *targetClients, applicationName, deploymentGroupName string, bundle *bundleInfo) (string, error) {
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(applicationName),
+		DeploymentGroupName: aws.String(deploymentGroupName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment group: %v", err)
+	}
+
+	last := group.DeploymentGroupInfo.LastSuccessfulDeployment
+	if last == nil || last.DeploymentId == nil {
+		log.Printf("No successful deployment found for %s/%s", applicationName, deploymentGroupName)
+		return "", nil
+	}
+
+	result, err := clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: last.DeploymentId,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get last successful deployment %s: %v", *last.DeploymentId, err)
+	}
+
+	deployment := result.DeploymentInfo
+	if match := bundleTagPattern.FindStringSubmatch(aws.ToString(deployment.Description)); match != nil {
+		if bundle.Sha256 != "" && match[1] == bundle.Sha256 {
+			return *last.DeploymentId, nil
+		}
+	}
+
+	if deployment.Revision != nil && deployment.Revision.S3Location != nil {
+		liveETag := strings.Trim(aws.ToString(deployment.Revision.S3Location.ETag), `"`)
+		if bundle.ETag != "" && liveETag == bundle.ETag {
+			return *last.DeploymentId, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+func TestFindLiveRevision(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	otherSha := strings.Repeat("cd", 32)
+
+	tests := []struct {
+		name   string
+		live   *types.DeploymentInfo
+		bundle bundleInfo
+		want   string
+	}{
+		{
+			name:   "same bundle hash",
+			live:   &types.DeploymentInfo{Description: aws.String("Deployment for job-1 " + bundleTag(sha))},
+			bundle: bundleInfo{Sha256: sha},
+			want:   "d-live",
+		},
+		{
+			name:   "different bundle hash",
+			live:   &types.DeploymentInfo{Description: aws.String("Deployment for job-1 " + bundleTag(otherSha))},
+			bundle: bundleInfo{Sha256: sha},
+		},
+		{
+			// CodeDeploy keeps the ETag quoted, as S3 returns it
+			name: "same ETag",
+			live: &types.DeploymentInfo{Revision: &types.RevisionLocation{
+				S3Location: &types.S3Location{ETag: aws.String(`"etag-1"`)},
+			}},
+			bundle: bundleInfo{ETag: "etag-1"},
+			want:   "d-live",
+		},
+		{
+			name: "different ETag",
+			live: &types.DeploymentInfo{Revision: &types.RevisionLocation{
+				S3Location: &types.S3Location{ETag: aws.String(`"etag-2"`)},
+			}},
+			bundle: bundleInfo{ETag: "etag-1"},
+		},
+		{
+			// A bundle we could not inspect matches nothing
+			name: "nothing known about the bundle",
+			live: &types.DeploymentInfo{Revision: &types.RevisionLocation{
+				S3Location: &types.S3Location{},
+			}},
+		},
+		{
+			name:   "AppSpecContent revision",
+			live:   &types.DeploymentInfo{Revision: &types.RevisionLocation{RevisionType: types.RevisionLocationTypeAppSpecContent}},
+			bundle: bundleInfo{Sha256: sha, ETag: "etag-1"},
+		},
+		{
+			name:   "never deployed",
+			bundle: bundleInfo{Sha256: sha},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := &types.DeploymentGroupInfo{}
+			cd := &fakeCodeDeploy{
+				groups:      map[string]*types.DeploymentGroupInfo{"api/api-live": group},
+				deployments: map[string]*types.DeploymentInfo{},
+			}
+			if tt.live != nil {
+				group.LastSuccessfulDeployment = &types.LastDeploymentInfo{DeploymentId: aws.String("d-live")}
+				cd.deployments["d-live"] = tt.live
+			}
+
+			got, err := findLiveRevision(context.Background(), &targetClients{CodeDeploy: cd}, "api", "api-live", &tt.bundle)
+			if err != nil || got != tt.want {
+				t.Errorf("findLiveRevision() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing group", func(t *testing.T) {
+		cd := &fakeCodeDeploy{}
+		if _, err := findLiveRevision(context.Background(), &targetClients{CodeDeploy: cd}, "api", "api-live", &bundleInfo{Sha256: sha}); err == nil {
+			t.Error("findLiveRevision() of a missing group returned no error")
+		}
+	})
+}
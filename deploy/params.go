@@ -0,0 +1,43 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// userParameters are the deploy action's UserParameters, a JSON object
+// set on the action in the pipeline definition
+type userParameters struct {
+	// EmergencyOverride deploys through a change freeze. It needs an
+	// OverrideReason, which is logged and kept in the report.
+	EmergencyOverride bool   `json:"emergencyOverride,omitempty"`
+	OverrideReason    string `json:"overrideReason,omitempty"`
+
+	// DryRun reports the deployment plan instead of deploying, as DRY_RUN
+	// does for every job
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// SourceBranch is the branch the revision was built from, for the
+	// deployment policy, e.g. "#{SourceVariables.BranchName}"
+	SourceBranch string `json:"sourceBranch,omitempty"`
+}
+
+// parseUserParameters reads the action's UserParameters. Unknown fields
+// are rejected, so a misspelt override fails loudly instead of being ignored.
+func parseUserParameters(raw string) (userParameters, error) {
+	var params userParameters
+	if strings.TrimSpace(raw) == "" {
+		return params, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		return params, fmt.Errorf("invalid UserParameters: %v", err)
+	}
+	if params.EmergencyOverride && strings.TrimSpace(params.OverrideReason) == "" {
+		return params, fmt.Errorf("invalid UserParameters: emergencyOverride requires an overrideReason")
+	}
+	return params, nil
+}
@@ -0,0 +1,781 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	pipelinetypes "github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Global AWS clients
+var (
+	codeDeployClient     *codedeploy.Client
+	codePipelineClient   *codepipeline.Client
+	secretsManagerClient *secretsmanager.Client
+	s3Client             *s3.Client
+	ssmClient            *ssm.Client
+)
+
+// Configuration loaded once per cold start. A load failure is kept rather
+// than panicking, so every invocation can report it to CodePipeline.
+var (
+	cfg       *config.Config
+	cfgErr    error
+	awsCfgErr error
+)
+
+// Init loads the AWS and deploy configuration and creates the clients.
+// Binaries call it once at startup, before the first Handler call.
+func Init(ctx context.Context) {
+	awsCfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		awsCfgErr = fmt.Errorf("failed to load AWS config: %v", err)
+		log.Printf("%v", awsCfgErr)
+		return
+	}
+	InitWithConfig(awsCfg)
+}
+
+// InitWithConfig is Init with an AWS config of the caller's, e.g. one that
+// sends every call to a local stand-in for AWS
+func InitWithConfig(awsCfg aws.Config) {
+	awsCfgErr = nil
+
+	// Here, we initialize AWS clients once
+	codeDeployClient = codedeploy.NewFromConfig(awsCfg)
+	codePipelineClient = codepipeline.NewFromConfig(awsCfg)
+	secretsManagerClient = secretsmanager.NewFromConfig(awsCfg)
+	s3Client = NewS3Client(awsCfg)
+	ssmClient = ssm.NewFromConfig(awsCfg)
+	targetClientCache = newClientCache(awsCfg)
+
+	cfg, cfgErr = config.Load()
+	if cfgErr != nil {
+		log.Printf("%v", cfgErr)
+	} else {
+		secrets = newSecretCache(cfg.SecretsCacheTTL)
+	}
+
+	log.Printf("Lambda initialization completed")
+}
+
+// CodePipelineEvent is the structure of the event received from CodePipeline
+type CodePipelineEvent struct {
+	CodePipelineJob struct {
+		ID    string  `json:"id"`
+		Nonce string  `json:"nonce,omitempty"`
+		Data  JobData `json:"data"`
+	} `json:"CodePipeline.job"`
+}
+
+type JobData struct {
+	ActionConfiguration ActionConfiguration `json:"actionConfiguration"`
+	InputArtifacts      []Artifact          `json:"inputArtifacts"`
+	OutputArtifacts     []Artifact          `json:"outputArtifacts"`
+	ContinuationToken   string              `json:"continuationToken,omitempty"`
+}
+
+type ActionConfiguration struct {
+	Configuration struct {
+		UserParameters string `json:"UserParameters,omitempty"`
+	} `json:"configuration"`
+}
+
+type Artifact struct {
+	Location Location `json:"location"`
+	Name     string   `json:"name"`
+	Revision string   `json:"revision"`
+}
+
+type Location struct {
+	S3Location S3Location `json:"s3Location"`
+	Type       string     `json:"type"`
+}
+
+type S3Location struct {
+	BucketName string `json:"bucketName"`
+	ObjectKey  string `json:"objectKey"`
+}
+
+// We retrieve the GitHub token through the secrets cache
+func getGitHubToken(ctx context.Context) (string, error) {
+	ref := gitHubTokenRef()
+	if ref.SecretID == "" {
+		return "", fmt.Errorf("GITHUB_TOKEN environment variable not set")
+	}
+	return secrets.get(ctx, ref)
+}
+
+// gitHubTokenRef points at the GitHub token secret in the configuration
+func gitHubTokenRef() secretRef {
+	return secretRef{
+		SecretID:     cfg.GitHubTokenSecretARN,
+		JSONKey:      cfg.GitHubTokenSecretKey,
+		VersionStage: cfg.GitHubTokenVersionStage,
+	}
+}
+
+// How often monitorDeployment checks a deployment's status. The interval
+// doubles after every check up to the maximum. Variables so tests can poll
+// quickly.
+var (
+	monitorPollInterval    = 2 * time.Second
+	monitorMaxPollInterval = 30 * time.Second
+)
+
+// monitorDeployment waits for the deployment to reach a terminal state
+// This state could be (failed, succeeded or stopped). If observe is set, it
+// sees every status we poll, and an error from it ends the monitoring.
+func monitorDeployment(ctx context.Context, clients *targetClients, deploymentID string, observe func(*types.DeploymentInfo) error) error {
+	log.Printf("Monitoring deployment status for: %s", deploymentID)
+	startTime := time.Now()
+	endTime := startTime.Add(cfg.MaxDeploymentWaitTime)
+
+	// Initial wait time for exponential backoff
+	waitTime := monitorPollInterval
+
+	// Status check errors are retried by the shared policy, while the
+	// polling interval above only paces checks that succeeded
+	policy := newRetryPolicy(cfg.Retry)
+	attempt := 1
+	consecutiveErrors := 0
+
+	for time.Now().Before(endTime) {
+		input := &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(deploymentID),
+		}
+
+		log.Printf("Checking deployment status (attempt %d): %s", attempt, deploymentID)
+		result, err := clients.CodeDeploy.GetDeployment(ctx, input)
+		if err != nil {
+			// Dont fail immediately on retryable API errors, retry with backoff
+			consecutiveErrors++
+			if !isRetryable(err) {
+				return fmt.Errorf("failed to get deployment status: %v", err)
+			}
+			if consecutiveErrors >= policy.MaxAttempts {
+				return fmt.Errorf("failed to get deployment status after %d attempts: %v", consecutiveErrors, err)
+			}
+			delay := policy.backoff(consecutiveErrors)
+			log.Printf("Failed to get deployment status: %v, retrying in %v", err, delay)
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+			attempt++
+			continue
+		}
+		consecutiveErrors = 0
+
+		status := result.DeploymentInfo.Status
+		log.Printf("Current deployment status: %s", status)
+
+		if observe != nil {
+			if err := observe(result.DeploymentInfo); err != nil {
+				return err
+			}
+		}
+
+		// Check if the deployment has reached a terminal state
+		switch status {
+		case types.DeploymentStatusSucceeded:
+			log.Printf("Deployment %s succeeded", deploymentID)
+			return nil
+		case types.DeploymentStatusFailed:
+			errInfo := "No error information available"
+			if result.DeploymentInfo.ErrorInformation != nil && result.DeploymentInfo.ErrorInformation.Message != nil {
+				errInfo = *result.DeploymentInfo.ErrorInformation.Message
+			}
+			return fmt.Errorf("deployment %s failed: %s", deploymentID, errInfo)
+		case types.DeploymentStatusStopped:
+			return fmt.Errorf("deployment %s stopped with status: %s", deploymentID, status)
+		}
+
+		// Use exponential backoff for the next attempt
+		waitTime = time.Duration(math.Min(float64(waitTime*2), float64(monitorMaxPollInterval)))
+		log.Printf("Waiting %v before next status check", waitTime)
+		if err := sleep(ctx, waitTime); err != nil {
+			return err
+		}
+		attempt++
+	}
+
+	return fmt.Errorf("timed out waiting for deployment %s to complete", deploymentID)
+}
+
+// runPreDeploymentValidation performs validation checks before deployment
+func runPreDeploymentValidation(ctx context.Context, clients *targetClients, target deploymentTarget, s3BucketName, s3ObjectKey string) error {
+	applicationName, deploymentGroupName := target.ApplicationName, target.DeploymentGroupName
+	log.Printf("Running pre-deployment validation for %s/%s", applicationName, deploymentGroupName)
+
+	// 1. Validate application and deployment group exist
+	_, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(applicationName),
+		DeploymentGroupName: aws.String(deploymentGroupName),
+	})
+	if err != nil {
+		return fmt.Errorf("deployment group validation failed: %v", err)
+	}
+
+	// 2. Validate S3 artifact exists and is accessible
+	if s3BucketName != "" && s3ObjectKey != "" {
+		_, err := clients.S3.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(s3ObjectKey),
+		})
+		if err != nil {
+			return fmt.Errorf("artifact validation failed: %v", err)
+		}
+	}
+
+	// 3. Check if there's already an in-progress deployment for this group
+	listDeploymentsInput := &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String(applicationName),
+		DeploymentGroupName: aws.String(deploymentGroupName),
+		IncludeOnlyStatuses: []types.DeploymentStatus{
+			types.DeploymentStatusCreated,
+			types.DeploymentStatusQueued,
+			types.DeploymentStatusInProgress,
+		},
+	}
+
+	listResult, err := clients.CodeDeploy.ListDeployments(ctx, listDeploymentsInput)
+	if err != nil {
+		log.Printf("Warning: Could not check for in-progress deployments: %v", err)
+	} else if len(listResult.Deployments) > 0 {
+		log.Printf("Warning: There are %d in-progress deployments for this group", len(listResult.Deployments))
+	}
+
+	// 4. Validate any custom pre-deployment requirements
+	// This could include checking infrastructure readiness, database status, etc.
+	// For example:
+	err = validateRequiredInfrastructure(ctx, target.HealthCheckURL)
+	if err != nil {
+		return fmt.Errorf("infrastructure validation failed: %v", err)
+	}
+	if err := target.HealthCheck.run(ctx, clients.Lambda); err != nil {
+		return fmt.Errorf("infrastructure validation failed: %v", err)
+	}
+
+	log.Printf("Pre-deployment validation completed successfully")
+	return nil
+}
+
+// validateRequiredInfrastructure checks if required infrastructure is available
+func validateRequiredInfrastructure(ctx context.Context, healthCheckURL string) error {
+	if healthCheckURL == "" {
+		log.Printf("No health check URL configured, skipping infrastructure validation")
+		return nil
+	}
+
+	// Perform a simple health check
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", healthCheckURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create health check request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check returned non-success status code: %d", resp.StatusCode)
+	}
+
+	log.Printf("Infrastructure validation succeeded: health check returned %d", resp.StatusCode)
+	return nil
+}
+
+// runPostDeploymentValidation performs validation checks after deployment
+func runPostDeploymentValidation(ctx context.Context, clients *targetClients, target deploymentTarget, deploymentID string) error {
+	log.Printf("Running post-deployment validation for deployment: %s", deploymentID)
+
+	// 1. Get deployment information to find deployment targets
+	deploymentInfo, err := clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(deploymentID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get deployment info: %v", err)
+	}
+
+	// 2. Verify deployment succeeded on all targets
+	targetsInput := &codedeploy.ListDeploymentTargetsInput{
+		DeploymentId: aws.String(deploymentID),
+	}
+
+	targetsResult, err := clients.CodeDeploy.ListDeploymentTargets(ctx, targetsInput)
+	if err != nil {
+		return fmt.Errorf("failed to list deployment targets: %v", err)
+	}
+
+	// 3. Check each target's status
+	for _, targetId := range targetsResult.TargetIds {
+		targetInfo, err := clients.CodeDeploy.GetDeploymentTarget(ctx, &codedeploy.GetDeploymentTargetInput{
+			DeploymentId: aws.String(deploymentID),
+			TargetId:     aws.String(targetId),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get target info for %s: %v", targetId, err)
+		}
+
+		// Check if this target succeeded
+		if targetInfo.DeploymentTarget.InstanceTarget != nil &&
+			targetInfo.DeploymentTarget.InstanceTarget.Status != "Succeeded" {
+			return fmt.Errorf("deployment failed on target %s with status: %s",
+				targetId, targetInfo.DeploymentTarget.InstanceTarget.Status)
+		}
+
+		// ECS targets must have moved all traffic to the new task set
+		if ecsTarget := targetInfo.DeploymentTarget.EcsTarget; ecsTarget != nil {
+			if err := validateECSTarget(ecsTarget); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 4. Perform application-specific health checks
+	err = ValidateApplicationHealth(ctx, target.AppHealthCheckURL)
+	if err != nil {
+		return fmt.Errorf("application health validation failed: %v", err)
+	}
+	if err := target.AppHealthCheck.run(ctx, clients.Lambda); err != nil {
+		return fmt.Errorf("application health validation failed: %v", err)
+	}
+
+	log.Printf("Post-deployment validation completed successfully")
+
+	log.Printf("Deployment %s succeeded", deploymentID)
+	log.Printf("DeploymentInfo %v", deploymentInfo)
+
+	return nil
+}
+
+// ValidateApplicationHealth checks if the application is healthy after deployment
+func ValidateApplicationHealth(ctx context.Context, appHealthCheckURL string) error {
+	if appHealthCheckURL == "" {
+		log.Printf("No application health check URL configured, skipping application health validation")
+		return nil
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	// Retry the health check a few times to allow the application to start up
+	return retryHealthCheck(ctx, "application health validation", func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", appHealthCheckURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create health check request: %v", err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("health check returned non-success status code: %d", resp.StatusCode)
+		}
+
+		log.Printf("Application health check succeeded: status code %d", resp.StatusCode)
+		return nil
+	})
+}
+
+// Handler runs one CodePipeline job: it deploys the job's artifact through
+// CodeDeploy and reports the outcome back to CodePipeline
+func Handler(ctx context.Context, event CodePipelineEvent) error {
+	_, err := RunJob(ctx, event)
+	return err
+}
+
+// RunJob is Handler, and also returns the job's report once it has one
+func RunJob(ctx context.Context, event CodePipelineEvent) (*DeploymentReport, error) {
+	// Logging sanitized version of the event for debugging
+	sanitizedEventVersion := event
+	if len(sanitizedEventVersion.CodePipelineJob.Data.InputArtifacts) > 0 {
+		for i := range sanitizedEventVersion.CodePipelineJob.Data.InputArtifacts {
+			if len(sanitizedEventVersion.CodePipelineJob.Data.InputArtifacts[i].Revision) > 10 {
+				sanitizedEventVersion.CodePipelineJob.Data.InputArtifacts[i].Revision = sanitizedEventVersion.CodePipelineJob.Data.InputArtifacts[i].Revision[:10] + "..."
+			}
+		}
+	}
+
+	eventJSON, _ := json.MarshalIndent(event, "", "  ")
+	log.Printf("Received event: %s", eventJSON)
+
+	// We extract the CodePipeline job ID from the event
+	jobID := event.CodePipelineJob.ID
+	if jobID == "" {
+		log.Println("Error: Missing Job ID")
+		return nil, fmt.Errorf("job ID not found in event")
+	}
+
+	// Without AWS clients we cannot even report back to CodePipeline
+	if awsCfgErr != nil {
+		return nil, awsCfgErr
+	}
+
+	// A bad configuration fails the job with every problem listed
+	if cfgErr != nil {
+		reportConfigurationFailure(ctx, jobID, cfgErr.Error())
+		return nil, cfgErr
+	}
+
+	// We work out which deployment groups this job targets, and in which
+	// waves. A job we cannot route is a configuration problem, not a failed deploy.
+	plan, err := resolvePlan(ctx, jobID)
+	if err != nil {
+		log.Printf("Failed to resolve deployment plan: %v", err)
+		reportConfigurationFailure(ctx, jobID, fmt.Sprintf("Failed to resolve deployment plan: %v", err))
+		return nil, err
+	}
+
+	params, err := parseUserParameters(event.CodePipelineJob.Data.ActionConfiguration.Configuration.UserParameters)
+	if err != nil {
+		reportConfigurationFailure(ctx, jobID, err.Error())
+		return nil, err
+	}
+
+	report := newDeploymentReport(jobID)
+	report.Revision.SourceBranch = params.SourceBranch
+
+	// Here we extract the S3 artifact information
+	var s3BucketName, s3ObjectKey string
+	if len(event.CodePipelineJob.Data.InputArtifacts) > 0 {
+		artifact := event.CodePipelineJob.Data.InputArtifacts[0]
+		s3BucketName = artifact.Location.S3Location.BucketName
+		s3ObjectKey = artifact.Location.S3Location.ObjectKey
+		report.Revision.SourceRevision = artifact.Revision
+		report.Revision.BucketName = s3BucketName
+		report.Revision.ObjectKey = s3ObjectKey
+		log.Printf("Using artifact from S3: bucket=%s, key=%s", s3BucketName, s3ObjectKey)
+	} else {
+		log.Println("Warning: No input artifacts found in the CodePipeline event")
+	}
+
+	// Lambda and CodePipeline may both redeliver a job, so we acknowledge
+	// it first and bail out if an earlier delivery already finished it
+	active, err := acknowledgeJob(ctx, jobID, event.CodePipelineJob.Nonce)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	} else if !active {
+		log.Printf("Job %s is no longer active, nothing to do", jobID)
+		return report, nil
+	}
+
+	// Deployments wait for, or fail during, a change freeze unless the
+	// action overrides it. A dry run only reports the freeze, and a job
+	// whose waves have started is past the check.
+	dryRun := params.DryRun || cfg.DryRun
+	continuation := parseContinuation(event.CodePipelineJob.Data.ContinuationToken)
+	if !dryRun && !continuation.started() {
+		err = checkChangeCalendar(ctx, jobID, params, continuation, report)
+		var waiting *errWaitingForFreeze
+		switch {
+		case errors.As(err, &waiting):
+			return report, reportContinuation(ctx, jobID, waiting.continuation.token(), waiting.Error())
+		case err != nil:
+			reportFailure(ctx, jobID, err.Error())
+			recordAudit(ctx, report, err)
+			return report, err
+		}
+	}
+
+	// We hash the bundle and read its AppSpec so the report can say
+	// exactly what was deployed, and so we can tell if it is already live
+	bundle := inspectArtifact(ctx, s3BucketName, s3ObjectKey, report)
+
+	// And try to get the GitHub token (for potential future use)
+	// But continue anyway, as we might not need it for this particular deployment
+	_, err = getGitHubToken(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to get GitHub token: %v", err)
+	}
+
+	// Deploy every wave of the plan, halting at the first failure
+	req := deployRequest{
+		JobID:        jobID,
+		S3BucketName: s3BucketName,
+		S3ObjectKey:  s3ObjectKey,
+		Bundle:       bundle,
+		SourceBranch: params.SourceBranch,
+	}
+	if dryRun {
+		return report, planJob(ctx, event, req, plan, params, report)
+	}
+	err = runPlan(ctx, req, plan, continuation, report)
+	var inProgress *errWaveInProgress
+	if errors.As(err, &inProgress) {
+		return report, reportContinuation(ctx, jobID, inProgress.continuation.token(), inProgress.Error())
+	}
+	if err != nil {
+		reportFailure(ctx, jobID, report.failureSummary(err))
+		recordAudit(ctx, report, err)
+		return report, err
+	}
+
+	// The deployment is successful if we make it here
+	return report, completeJob(ctx, event, report)
+}
+
+// completeJob hands the report to later stages through the output artifact
+// and reports success. The deployment itself succeeded, so a failed upload
+// is only logged.
+func completeJob(ctx context.Context, event CodePipelineEvent, report *DeploymentReport) error {
+	report.complete()
+
+	if len(event.CodePipelineJob.Data.OutputArtifacts) > 0 {
+		err := writeDeploymentReport(ctx, event.CodePipelineJob.Data.OutputArtifacts[0], report)
+		if err != nil {
+			log.Printf("Warning: Failed to write deployment report: %v", err)
+		}
+	}
+	recordAudit(ctx, report, nil)
+
+	return reportSuccess(ctx, event.CodePipelineJob.ID, report)
+}
+
+// planJob plans the job's deployments instead of making them, and reports
+// the plan to CodePipeline. A check that failed fails the job, as it would
+// have failed the deployment. Dry runs are not audited.
+func planJob(ctx context.Context, event CodePipelineEvent, req deployRequest, plan wavePlan, params userParameters, report *DeploymentReport) error {
+	jobID := event.CodePipelineJob.ID
+	err := planDeployment(ctx, req, plan, params, report)
+	report.complete()
+	log.Printf("%s", report.PlanSummary())
+	if err != nil {
+		reportFailure(ctx, jobID, err.Error()+"\n"+report.PlanSummary())
+		return err
+	}
+
+	if len(event.CodePipelineJob.Data.OutputArtifacts) > 0 {
+		err := writeDeploymentReport(ctx, event.CodePipelineJob.Data.OutputArtifacts[0], report)
+		if err != nil {
+			log.Printf("Warning: Failed to write deployment report: %v", err)
+		}
+	}
+	return reportSuccess(ctx, jobID, report)
+}
+
+// startDeployment validates the artifact and creates a new deployment for
+// the target, recording the validation on the target's result
+func startDeployment(ctx context.Context, clients *targetClients, req deployRequest, target deploymentTarget, result *TargetResult) (string, error) {
+	deployInput, err := prepareDeployment(ctx, clients, req, target, result)
+	if err != nil {
+		return "", err
+	}
+
+	// We create the deployment with the shared retry policy
+	var deploymentID string
+	err = newRetryPolicy(cfg.Retry).do(ctx, "CreateDeployment", func(ctx context.Context) error {
+		log.Printf("Creating deployment to %s for job: %s", target, req.JobID)
+		resp, err := clients.CodeDeploy.CreateDeployment(ctx, deployInput)
+		if err != nil {
+			return err
+		}
+		deploymentID = *resp.DeploymentId
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to create deployment: %v", err)
+		return "", fmt.Errorf("failed to create deployment: %v", err)
+	}
+	log.Printf("Successfully created deployment: %s", deploymentID)
+
+	return deploymentID, nil
+}
+
+// prepareDeployment runs the pre-deployment validation and resolves the
+// revision, returning the deployment startDeployment would create. A dry
+// run stops here.
+func prepareDeployment(ctx context.Context, clients *targetClients, req deployRequest, target deploymentTarget, result *TargetResult) (*codedeploy.CreateDeploymentInput, error) {
+	// Run pre-deployment validation. An ECS bundle has already been read
+	// with our own credentials, so only S3 revisions check the artifact.
+	s3BucketName, s3ObjectKey := req.S3BucketName, req.S3ObjectKey
+	if target.Platform == platformECS {
+		s3BucketName, s3ObjectKey = "", ""
+	}
+	// A redeployed S3 revision may have expired from its bucket since
+	if req.Revision != nil && req.Revision.S3Location != nil {
+		s3BucketName, s3ObjectKey = aws.ToString(req.Revision.S3Location.Bucket), aws.ToString(req.Revision.S3Location.Key)
+	}
+	// A dry run does not copy the artifact to the target's bucket, and we
+	// have already read the original
+	if req.DryRun && target.ArtifactBucket != "" && target.ArtifactBucket != req.S3BucketName {
+		s3BucketName, s3ObjectKey = "", ""
+	}
+	phaseStart := time.Now()
+	err := runPreDeploymentValidation(ctx, clients, target, s3BucketName, s3ObjectKey)
+	result.Validations = append(result.Validations, newValidationResult("pre-deployment", err, time.Since(phaseStart)))
+	if err != nil {
+		log.Printf("Pre-deployment validation failed: %v", err)
+		return nil, fmt.Errorf("pre-deployment validation failed: %v", err)
+	}
+
+	// The deployment policy is part of the pre-deployment validation.
+	// Rollbacks redeploy a revision that already passed it, and must not
+	// be blocked by the failures they recover from.
+	if req.Revision == nil && policyConfigured() {
+		phaseStart = time.Now()
+		err = checkPolicy(ctx, clients, req, target)
+		result.Validations = append(result.Validations, newValidationResult("policy", err, time.Since(phaseStart)))
+		if err != nil {
+			log.Printf("Deployment policy check failed: %v", err)
+			return nil, fmt.Errorf("pre-deployment validation failed: %v", err)
+		}
+	}
+
+	// Server bundles need an AppSpec, and a bundle without one gets a scaffold
+	if target.Platform != platformECS && req.S3BucketName != "" && req.Revision == nil {
+		phaseStart = time.Now()
+		err = validateAppSpec(ctx, clients, target, req.Bundle)
+		result.Validations = append(result.Validations, newValidationResult("appspec", err, time.Since(phaseStart)))
+		if err != nil {
+			log.Printf("AppSpec validation failed: %v", err)
+			return nil, fmt.Errorf("appspec validation failed: %w", err)
+		}
+	}
+
+	// Create deployment request. The description carries the job and
+	// bundle tags that redelivery and no-op detection look for.
+	description := fmt.Sprintf("Deployment triggered by CodePipeline job %s %s", req.JobID, jobTag(req.JobID))
+	if req.Description != "" {
+		description = fmt.Sprintf("%s %s", req.Description, jobTag(req.JobID))
+	}
+	if req.Bundle.Sha256 != "" {
+		description += " " + bundleTag(req.Bundle.Sha256)
+	}
+	deployInput := &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+		Description:         aws.String(description),
+	}
+
+	// ECS targets get an AppSpec for a newly registered task definition,
+	// and everything else an S3 revision if we have valid artifact information
+	switch {
+	case req.Revision != nil:
+		deployInput.Revision = req.Revision
+	case target.Platform == platformECS && req.DryRun:
+		// A dry run reads the task definition but does not register it
+		input, err := ecsTaskDefinition(ctx, clients, target, req.Bundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare ECS revision: %v", err)
+		}
+		result.TaskDefinitionArn = aws.ToString(input.Family) + ":(next revision)"
+		deployInput.Revision = &types.RevisionLocation{RevisionType: types.RevisionLocationTypeAppSpecContent}
+	case target.Platform == platformECS:
+		revision, taskDefinitionArn, err := ecsRevision(ctx, clients, target, req.Bundle)
+		if err != nil {
+			log.Printf("Failed to prepare ECS revision: %v", err)
+			return nil, fmt.Errorf("failed to prepare ECS revision: %v", err)
+		}
+		result.TaskDefinitionArn = taskDefinitionArn
+		deployInput.Revision = revision
+	case req.S3BucketName != "" && req.S3ObjectKey != "":
+		deployInput.Revision = &types.RevisionLocation{
+			RevisionType: types.RevisionLocationTypeS3,
+			S3Location: &types.S3Location{
+				Bucket:     aws.String(req.S3BucketName),
+				Key:        aws.String(req.S3ObjectKey),
+				BundleType: types.BundleTypeZip,
+			},
+		}
+		if req.Bundle.ETag != "" {
+			deployInput.Revision.S3Location.ETag = aws.String(req.Bundle.ETag)
+		}
+		if req.Bundle.Version != "" {
+			deployInput.Revision.S3Location.Version = aws.String(req.Bundle.Version)
+		}
+	default:
+		log.Println("Warning: No S3 location available for deployment, continuing without revision specification")
+	}
+
+	return deployInput, nil
+}
+
+// We notify CodePipeline of success, exporting the report's output
+// variables and execution details to the rest of the pipeline
+func reportSuccess(ctx context.Context, jobID string, report *DeploymentReport) error {
+	log.Printf("Reporting success for job: %s", jobID)
+	_, err := codePipelineClient.PutJobSuccessResult(ctx, &codepipeline.PutJobSuccessResultInput{
+		JobId:            aws.String(jobID),
+		OutputVariables:  report.outputVariables(),
+		ExecutionDetails: report.executionDetails(),
+	})
+	if err != nil {
+		log.Printf("Failed to report success to CodePipeline: %v", err)
+		return fmt.Errorf("failed to report success to CodePipeline: %v", err)
+	}
+	log.Printf("Successfully reported job completion to CodePipeline")
+	return nil
+}
+
+// reportContinuation hands the job back to CodePipeline, which invokes us
+// again with the token to carry on where we left off
+func reportContinuation(ctx context.Context, jobID, token, summary string) error {
+	log.Printf("Reporting continuation for job %s: %s", jobID, summary)
+	_, err := codePipelineClient.PutJobSuccessResult(ctx, &codepipeline.PutJobSuccessResultInput{
+		JobId:             aws.String(jobID),
+		ContinuationToken: aws.String(token),
+		ExecutionDetails: &pipelinetypes.ExecutionDetails{
+			Summary: aws.String(truncate(summary, maxSummaryLength)),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to report continuation to CodePipeline: %v", err)
+		return fmt.Errorf("failed to report continuation to CodePipeline: %v", err)
+	}
+	return nil
+}
+
+// As well as notify CodePipeline of failure
+func reportFailure(ctx context.Context, jobID string, message string) {
+	putJobFailure(ctx, jobID, pipelinetypes.FailureTypeJobFailed, message)
+}
+
+// reportConfigurationFailure tells CodePipeline the action is misconfigured,
+// rather than that the deployment itself failed
+func reportConfigurationFailure(ctx context.Context, jobID string, message string) {
+	putJobFailure(ctx, jobID, pipelinetypes.FailureTypeConfigurationError, message)
+}
+
+// CodePipeline caps failure messages at 5000 characters
+const maxFailureMessageLength = 5000
+
+func putJobFailure(ctx context.Context, jobID string, failureType pipelinetypes.FailureType, message string) {
+	log.Printf("Reporting failure for job %s: %s", jobID, message)
+	_, err := codePipelineClient.PutJobFailureResult(ctx, &codepipeline.PutJobFailureResultInput{
+		JobId: aws.String(jobID),
+		FailureDetails: &pipelinetypes.FailureDetails{
+			Type:    failureType,
+			Message: aws.String(truncate(message, maxFailureMessageLength)),
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to report failure to CodePipeline: %v", err)
+		return
+	}
+	log.Printf("Successfully reported job failure to CodePipeline")
+}
@@ -0,0 +1,430 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule types of a deployment policy
+const (
+	ruleAllowedBranches        = "allowedBranches"
+	ruleMaxArtifactSize        = "maxArtifactSize"
+	ruleMaxConsecutiveFailures = "maxConsecutiveFailures"
+	ruleMinInterval            = "minInterval"
+)
+
+// We look this far back for a group's recent deployments
+const policyLookback = 30 * 24 * time.Hour
+
+// deploymentPolicy is a set of rules every deployment must pass, checked
+// in pre-deployment validation. It is JSON or YAML, for example:
+//
+//	rules:
+//	  - name: prod-from-main
+//	    type: allowedBranches
+//	    deploymentGroups: ["*-prod"]
+//	    parameters: {branches: [main]}
+//	    message: Only main may reach production
+//	  - name: small-bundles
+//	    type: maxArtifactSize
+//	    parameters: {maxMB: 200}
+type deploymentPolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policyRule is one rule of a policy. Applications and DeploymentGroups
+// limit it to some targets, as path.Match patterns; empty matches every
+// target. Message tells people what to do about a violation.
+type policyRule struct {
+	Name             string          `json:"name"`
+	Type             string          `json:"type"`
+	Applications     []string        `json:"applications,omitempty"`
+	DeploymentGroups []string        `json:"deploymentGroups,omitempty"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+	Message          string          `json:"message,omitempty"`
+
+	check policyCheck
+}
+
+// policyCheck is a rule's compiled parameters. It returns how the
+// deployment breaks the rule, or "" if it does not.
+type policyCheck interface {
+	evaluate(ctx context.Context, in policyInput) (string, error)
+}
+
+// policyInput is the deployment a policy is checked against
+type policyInput struct {
+	target  deploymentTarget
+	clients *targetClients
+	branch  string
+	bundle  *bundleInfo
+	now     time.Time
+}
+
+// allowedBranches only lets revisions from matching branches through
+type allowedBranches struct {
+	Branches []string `json:"branches"`
+}
+
+func (r *allowedBranches) evaluate(ctx context.Context, in policyInput) (string, error) {
+	if in.branch == "" {
+		return "the revision's branch is unknown", nil
+	}
+	if matchesAny(r.Branches, in.branch) {
+		return "", nil
+	}
+	return fmt.Sprintf("branch %s is not one of %s", in.branch, strings.Join(r.Branches, ", ")), nil
+}
+
+// maxArtifactSize caps the size of the bundle
+type maxArtifactSize struct {
+	MaxMB float64 `json:"maxMB"`
+}
+
+func (r *maxArtifactSize) evaluate(ctx context.Context, in policyInput) (string, error) {
+	if in.bundle == nil || in.bundle.Size == 0 {
+		return "the artifact's size is unknown", nil
+	}
+	size := float64(in.bundle.Size) / (1 << 20)
+	if size <= r.MaxMB {
+		return "", nil
+	}
+	return fmt.Sprintf("the artifact is %.1f MB, over the limit of %g MB", size, r.MaxMB), nil
+}
+
+// maxConsecutiveFailures blocks a group whose last Count deployments all
+// failed or were stopped, until someone looks into it
+type maxConsecutiveFailures struct {
+	Count int `json:"count"`
+}
+
+func (r *maxConsecutiveFailures) evaluate(ctx context.Context, in policyInput) (string, error) {
+	recent, err := recentDeployments(ctx, in.clients, in.target, in.now, r.Count)
+	if err != nil {
+		return "", err
+	}
+	if len(recent) < r.Count {
+		return "", nil
+	}
+	for _, d := range recent {
+		if d.Status == types.DeploymentStatusSucceeded {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("the last %d deployments of %s failed, most recently %s", r.Count, in.target, aws.ToString(recent[0].DeploymentId)), nil
+}
+
+// minInterval spaces out a group's deployments
+type minInterval struct {
+	Interval string `json:"interval"`
+
+	interval time.Duration
+}
+
+func (r *minInterval) evaluate(ctx context.Context, in policyInput) (string, error) {
+	recent, err := recentDeployments(ctx, in.clients, in.target, in.now, 1)
+	if err != nil || len(recent) == 0 {
+		return "", err
+	}
+	last := aws.ToTime(recent[0].CreateTime)
+	since := in.now.Sub(last)
+	if since >= r.interval {
+		return "", nil
+	}
+	return fmt.Sprintf("the last deployment of %s, %s, was %v ago; deployments must be %v apart until %s",
+		in.target, aws.ToString(recent[0].DeploymentId), since.Round(time.Second), r.interval,
+		last.Add(r.interval).UTC().Format(time.RFC3339)), nil
+}
+
+// recentDeployments returns up to n of the group's deployments that have
+// finished, newest first
+func recentDeployments(ctx context.Context, clients *targetClients, target deploymentTarget, now time.Time, n int) ([]types.DeploymentInfo, error) {
+	input := &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+		IncludeOnlyStatuses: []types.DeploymentStatus{
+			types.DeploymentStatusSucceeded,
+			types.DeploymentStatusFailed,
+			types.DeploymentStatusStopped,
+		},
+		CreateTimeRange: &types.TimeRange{Start: aws.Time(now.Add(-policyLookback))},
+	}
+
+	var deployments []types.DeploymentInfo
+	paginator := codedeploy.NewListDeploymentsPaginator(clients.CodeDeploy, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list deployments: %v", err)
+		}
+		for start := 0; start < len(page.Deployments); start += batchGetDeploymentsLimit {
+			end := min(start+batchGetDeploymentsLimit, len(page.Deployments))
+			batch, err := clients.CodeDeploy.BatchGetDeployments(ctx, &codedeploy.BatchGetDeploymentsInput{
+				DeploymentIds: page.Deployments[start:end],
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get deployments: %v", err)
+			}
+			deployments = append(deployments, batch.DeploymentsInfo...)
+		}
+	}
+
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return aws.ToTime(deployments[i].CreateTime).After(aws.ToTime(deployments[j].CreateTime))
+	})
+	if len(deployments) > n {
+		deployments = deployments[:n]
+	}
+	return deployments, nil
+}
+
+// parseDeploymentPolicy reads a policy from JSON or YAML and compiles its
+// rules, so a bad edit is caught on load
+func parseDeploymentPolicy(raw []byte) (*deploymentPolicy, error) {
+	data, err := policyJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deployment policy: %v", err)
+	}
+
+	var p deploymentPolicy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid deployment policy: %v", err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("invalid deployment policy: %v", err)
+	}
+	return &p, nil
+}
+
+// policyJSON converts a YAML policy to JSON, so both are read through the
+// same field names. JSON is already YAML, so it is kept as it is.
+func policyJSON(raw []byte) ([]byte, error) {
+	if json.Valid(raw) {
+		return raw, nil
+	}
+	var doc any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("policy is not a JSON-compatible document: %v", err)
+	}
+	return data, nil
+}
+
+func (p *deploymentPolicy) compile() error {
+	names := map[string]bool{}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %s is defined twice", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *policyRule) compile() error {
+	for _, pattern := range append(append([]string{}, r.Applications...), r.DeploymentGroups...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	switch r.Type {
+	case ruleAllowedBranches:
+		check := &allowedBranches{}
+		if err := decodeParameters(r.Parameters, check); err != nil {
+			return err
+		}
+		if len(check.Branches) == 0 {
+			return fmt.Errorf("%s needs at least one branch", r.Type)
+		}
+		for _, pattern := range check.Branches {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid branch pattern %q", pattern)
+			}
+		}
+		r.check = check
+	case ruleMaxArtifactSize:
+		check := &maxArtifactSize{}
+		if err := decodeParameters(r.Parameters, check); err != nil {
+			return err
+		}
+		if check.MaxMB <= 0 {
+			return fmt.Errorf("%s needs a positive maxMB", r.Type)
+		}
+		r.check = check
+	case ruleMaxConsecutiveFailures:
+		check := &maxConsecutiveFailures{}
+		if err := decodeParameters(r.Parameters, check); err != nil {
+			return err
+		}
+		if check.Count <= 0 {
+			return fmt.Errorf("%s needs a positive count", r.Type)
+		}
+		r.check = check
+	case ruleMinInterval:
+		check := &minInterval{}
+		if err := decodeParameters(r.Parameters, check); err != nil {
+			return err
+		}
+		interval, err := time.ParseDuration(check.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("%s needs a positive interval, such as 30m", r.Type)
+		}
+		check.interval = interval
+		r.check = check
+	default:
+		return fmt.Errorf("unknown rule type %q, expected %s, %s, %s or %s", r.Type,
+			ruleAllowedBranches, ruleMaxArtifactSize, ruleMaxConsecutiveFailures, ruleMinInterval)
+	}
+	return nil
+}
+
+// decodeParameters reads a rule's parameters, rejecting unknown ones so a
+// misspelt parameter is not silently ignored
+func decodeParameters(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid parameters: %v", err)
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule covers the target
+func (r *policyRule) appliesTo(target deploymentTarget) bool {
+	return (len(r.Applications) == 0 || matchesAny(r.Applications, target.ApplicationName)) &&
+		(len(r.DeploymentGroups) == 0 || matchesAny(r.DeploymentGroups, target.DeploymentGroupName))
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// policyViolation is a deployment that breaks one or more rules. It names
+// every rule, so one failed job shows everything there is to fix.
+type policyViolation struct {
+	Violations []string
+}
+
+func (e *policyViolation) Error() string {
+	return "deployment policy violated: " + strings.Join(e.Violations, "; ")
+}
+
+// evaluate checks every rule that covers the target. A rule that cannot
+// be checked counts as broken, so an outage does not waive the policy.
+func (p *deploymentPolicy) evaluate(ctx context.Context, in policyInput) error {
+	var violations []string
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.appliesTo(in.target) {
+			continue
+		}
+		detail, err := r.check.evaluate(ctx, in)
+		if err != nil {
+			detail = "could not be checked: " + err.Error()
+		}
+		if detail == "" {
+			continue
+		}
+		violation := "rule " + r.Name
+		if r.Message != "" {
+			violation += ": " + r.Message
+		}
+		violations = append(violations, violation+" ("+detail+")")
+	}
+	if len(violations) > 0 {
+		return &policyViolation{Violations: violations}
+	}
+	return nil
+}
+
+// policyConfigured reports whether deployments have a policy to pass
+func policyConfigured() bool {
+	return cfg.DeploymentPolicy != "" || cfg.DeploymentPolicyLocation != ""
+}
+
+// checkPolicy checks the deployment of the request to the target against
+// the configured policy, if there is one
+func checkPolicy(ctx context.Context, clients *targetClients, req deployRequest, target deploymentTarget) error {
+	policy, err := policies.get(ctx)
+	if err != nil || policy == nil {
+		return err
+	}
+	return policy.evaluate(ctx, policyInput{
+		target:  target,
+		clients: clients,
+		branch:  req.SourceBranch,
+		bundle:  req.Bundle,
+		now:     time.Now(),
+	})
+}
+
+// policyCache keeps a policy read from S3 or SSM across warm invocations
+type policyCache struct {
+	mu        sync.Mutex
+	policy    *deploymentPolicy
+	fetchedAt time.Time
+}
+
+var policies policyCache
+
+// get returns the configured policy, or nil when there is none
+func (c *policyCache) get(ctx context.Context) (*deploymentPolicy, error) {
+	if cfg.DeploymentPolicy != "" {
+		return parseDeploymentPolicy([]byte(cfg.DeploymentPolicy))
+	}
+	if cfg.DeploymentPolicyLocation == "" {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.policy != nil && time.Since(c.fetchedAt) < cfg.DeploymentPolicyTTL {
+		return c.policy, nil
+	}
+
+	raw, err := readDocument(ctx, cfg.DeploymentPolicyLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment policy from %s: %v", cfg.DeploymentPolicyLocation, err)
+	}
+	policy, err := parseDeploymentPolicy(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v at %s", err, cfg.DeploymentPolicyLocation)
+	}
+	c.policy = policy
+	c.fetchedAt = time.Now()
+	return policy, nil
+}
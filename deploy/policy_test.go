@@ -0,0 +1,241 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+func TestParseDeploymentPolicy(t *testing.T) {
+	yamlPolicy := `
+rules:
+  - name: prod-from-main
+    type: allowedBranches
+    deploymentGroups: ["*-prod"]
+    parameters:
+      branches: [main, "release/*"]
+    message: Only main and release branches may reach production
+  - name: cooldown
+    type: minInterval
+    parameters: {interval: 30m}
+`
+	jsonPolicy := `{"rules": [
+		{"name": "prod-from-main", "type": "allowedBranches", "deploymentGroups": ["*-prod"],
+		 "parameters": {"branches": ["main", "release/*"]},
+		 "message": "Only main and release branches may reach production"},
+		{"name": "cooldown", "type": "minInterval", "parameters": {"interval": "30m"}}]}`
+
+	fromYAML, err := parseDeploymentPolicy([]byte(yamlPolicy))
+	if err != nil {
+		t.Fatalf("parseDeploymentPolicy(YAML) returned error: %v", err)
+	}
+	fromJSON, err := parseDeploymentPolicy([]byte(jsonPolicy))
+	if err != nil {
+		t.Fatalf("parseDeploymentPolicy(JSON) returned error: %v", err)
+	}
+	if len(fromYAML.Rules) != 2 || len(fromJSON.Rules) != 2 {
+		t.Fatalf("got %d and %d rules, want 2", len(fromYAML.Rules), len(fromJSON.Rules))
+	}
+	for i := range fromYAML.Rules {
+		y, j := fromYAML.Rules[i], fromJSON.Rules[i]
+		if y.Name != j.Name || y.Type != j.Type || y.Message != j.Message || !reflect.DeepEqual(y.check, j.check) {
+			t.Errorf("YAML rule %+v differs from JSON rule %+v", y, j)
+		}
+	}
+	if got := fromYAML.Rules[1].check.(*minInterval).interval; got != 30*time.Minute {
+		t.Errorf("interval = %v, want 30m", got)
+	}
+
+	invalid := []struct {
+		name, policy, want string
+	}{
+		{"unknown type", `{"rules": [{"name": "a", "type": "maxBlastRadius"}]}`, "unknown rule type"},
+		{"no name", `{"rules": [{"type": "maxArtifactSize", "parameters": {"maxMB": 1}}]}`, "rule 1 has no name"},
+		{"duplicate name", `{"rules": [{"name": "a", "type": "maxArtifactSize", "parameters": {"maxMB": 1}}, {"name": "a", "type": "maxArtifactSize", "parameters": {"maxMB": 2}}]}`, "defined twice"},
+		{"misspelt parameter", `{"rules": [{"name": "a", "type": "maxArtifactSize", "parameters": {"maxSize": 1}}]}`, "unknown field"},
+		{"missing parameter", `{"rules": [{"name": "a", "type": "maxConsecutiveFailures"}]}`, "positive count"},
+		{"bad interval", "rules:\n  - {name: a, type: minInterval, parameters: {interval: soon}}", "positive interval"},
+		{"bad pattern", `{"rules": [{"name": "a", "type": "allowedBranches", "parameters": {"branches": ["[main"]}}]}`, "invalid branch pattern"},
+		{"not a policy", "rules: [", "invalid deployment policy"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDeploymentPolicy([]byte(tt.policy))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseDeploymentPolicy() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentPolicyRules(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	deployment := func(id string, status types.DeploymentStatus, age time.Duration) *types.DeploymentInfo {
+		return &types.DeploymentInfo{
+			DeploymentId:        aws.String(id),
+			ApplicationName:     aws.String("api"),
+			DeploymentGroupName: aws.String("api-prod"),
+			Status:              status,
+			CreateTime:          aws.Time(now.Add(-age)),
+		}
+	}
+	failing := map[string]*types.DeploymentInfo{
+		"d-1": deployment("d-1", types.DeploymentStatusSucceeded, 4*time.Hour),
+		"d-2": deployment("d-2", types.DeploymentStatusFailed, 3*time.Hour),
+		"d-3": deployment("d-3", types.DeploymentStatusStopped, 2*time.Hour),
+		"d-4": deployment("d-4", types.DeploymentStatusFailed, time.Hour),
+	}
+
+	tests := []struct {
+		name        string
+		rule        string
+		branch      string
+		size        int64
+		deployments map[string]*types.DeploymentInfo
+
+		// wantViolation is in the violation, or the rule passes
+		wantViolation string
+	}{
+		{
+			name:   "branch allowed",
+			rule:   `{"name": "main-only", "type": "allowedBranches", "parameters": {"branches": ["main", "release/*"]}}`,
+			branch: "release/2026.10",
+		},
+		{
+			name:          "branch not allowed",
+			rule:          `{"name": "main-only", "type": "allowedBranches", "parameters": {"branches": ["main"]}, "message": "Merge to main first"}`,
+			branch:        "feature/login",
+			wantViolation: "rule main-only: Merge to main first (branch feature/login is not one of main)",
+		},
+		{
+			name:          "branch unknown",
+			rule:          `{"name": "main-only", "type": "allowedBranches", "parameters": {"branches": ["main"]}}`,
+			wantViolation: "rule main-only (the revision's branch is unknown)",
+		},
+		{
+			name: "rule for other groups",
+			rule: `{"name": "staging-only", "type": "allowedBranches", "deploymentGroups": ["*-staging"], "parameters": {"branches": ["main"]}}`,
+		},
+		{
+			name: "artifact small enough",
+			rule: `{"name": "small", "type": "maxArtifactSize", "parameters": {"maxMB": 1}}`,
+			size: 1 << 20,
+		},
+		{
+			name:          "artifact too large",
+			rule:          `{"name": "small", "type": "maxArtifactSize", "parameters": {"maxMB": 1}}`,
+			size:          3 << 19,
+			wantViolation: "the artifact is 1.5 MB, over the limit of 1 MB",
+		},
+		{
+			name:        "failures broken by a success",
+			rule:        `{"name": "streak", "type": "maxConsecutiveFailures", "parameters": {"count": 4}}`,
+			deployments: failing,
+		},
+		{
+			name:          "too many failures",
+			rule:          `{"name": "streak", "type": "maxConsecutiveFailures", "parameters": {"count": 3}}`,
+			deployments:   failing,
+			wantViolation: "the last 3 deployments of api/api-prod failed, most recently d-4",
+		},
+		{
+			name:        "interval passed",
+			rule:        `{"name": "cooldown", "type": "minInterval", "parameters": {"interval": "1h"}}`,
+			deployments: failing,
+		},
+		{
+			name:          "interval not passed",
+			rule:          `{"name": "cooldown", "type": "minInterval", "parameters": {"interval": "90m"}}`,
+			deployments:   failing,
+			wantViolation: "was 1h0m0s ago; deployments must be 1h30m0s apart until 2026-10-19T12:30:00Z",
+		},
+		{
+			name: "first deployment of a group",
+			rule: `{"name": "cooldown", "type": "minInterval", "parameters": {"interval": "90m"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := parseDeploymentPolicy([]byte(`{"rules": [` + tt.rule + `]}`))
+			if err != nil {
+				t.Fatalf("parseDeploymentPolicy() returned error: %v", err)
+			}
+			cd := &fakeCodeDeploy{deployments: tt.deployments}
+			err = policy.evaluate(context.Background(), policyInput{
+				target:  deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-prod"},
+				clients: &targetClients{CodeDeploy: cd},
+				branch:  tt.branch,
+				bundle:  &bundleInfo{Size: tt.size},
+				now:     now,
+			})
+
+			if tt.wantViolation == "" {
+				if err != nil {
+					t.Errorf("evaluate() returned error: %v", err)
+				}
+				return
+			}
+			var violation *policyViolation
+			if !errors.As(err, &violation) || !strings.Contains(err.Error(), tt.wantViolation) {
+				t.Errorf("evaluate() error = %v, want a violation containing %q", err, tt.wantViolation)
+			}
+		})
+	}
+}
+
+func TestDeploymentPolicyFailsJob(t *testing.T) {
+	fake, _ := localAWS(t)
+	t.Setenv("DEPLOYMENT_POLICY", `
+rules:
+  - name: prod-from-main
+    type: allowedBranches
+    parameters: {branches: [main]}
+    message: Only main may reach production
+  - name: small-bundles
+    type: maxArtifactSize
+    parameters: {maxMB: 200}
+`)
+
+	report, job, err := e2eJob(t, fake, `{"sourceBranch": "feature/login"}`)
+	if err == nil || job.Status != "Failed" {
+		t.Fatalf("job = %+v, want a failure", job)
+	}
+	if !strings.Contains(job.FailureMessage, "rule prod-from-main: Only main may reach production (branch feature/login is not one of main)") {
+		t.Errorf("failure message %q does not name the broken rule", job.FailureMessage)
+	}
+	if strings.Contains(job.FailureMessage, "small-bundles") {
+		t.Errorf("failure message %q names a rule that passed", job.FailureMessage)
+	}
+	if fake.Calls("CreateDeployment") != 0 {
+		t.Errorf("CreateDeployment was called despite the violation")
+	}
+	if report.Revision.SourceBranch != "feature/login" {
+		t.Errorf("report revision = %+v, want the source branch", report.Revision)
+	}
+}
+
+func TestDeploymentPolicyAllowsJob(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.SetScenario("api", "api-live", fakeaws.Scenario{})
+	t.Setenv("DEPLOYMENT_POLICY", `{"rules": [{"name": "prod-from-main", "type": "allowedBranches", "parameters": {"branches": ["main"]}}]}`)
+
+	report, job, err := e2eJob(t, fake, `{"sourceBranch": "main"}`)
+	if err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want a success", job, err)
+	}
+	found := false
+	for _, v := range report.Targets[0].Validations {
+		found = found || v.Name == "policy" && v.Passed
+	}
+	if !found {
+		t.Errorf("validations = %+v, want a passed policy check", report.Targets[0].Validations)
+	}
+}
@@ -0,0 +1,452 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// reportFileName is the name of the report inside the output artifact zip
+const reportFileName = "deployment-report.json"
+
+// CodePipeline caps the execution details summary at 2048 characters
+const maxSummaryLength = 2048
+
+// DeploymentReport is the JSON document written to the output artifact
+// once a deployment has succeeded. Later pipeline stages can read it.
+// The top-level application, group and deployment ID are only set when
+// the job deployed to a single group; Targets always lists every group.
+type DeploymentReport struct {
+	JobID               string             `json:"jobId"`
+	ApplicationName     string             `json:"applicationName,omitempty"`
+	DeploymentGroupName string             `json:"deploymentGroupName,omitempty"`
+	DeploymentID        string             `json:"deploymentId,omitempty"`
+	Unchanged           bool               `json:"unchanged,omitempty"`
+	Revision            RevisionInfo       `json:"revision"`
+	Versions            VersionInfo        `json:"versions"`
+	Validations         []ValidationResult `json:"validations"`
+	Targets             []*TargetResult    `json:"targets"`
+	Timings             Timings            `json:"timings"`
+
+	// EmergencyOverride is set when the job deployed through a freeze
+	EmergencyOverride *emergencyOverride `json:"emergencyOverride,omitempty"`
+
+	// Rollback is set when the job rolled a group back
+	Rollback *RollbackInfo `json:"rollback,omitempty"`
+
+	// Direct is set when the job was a direct deployment
+	Direct *DirectDeployInfo `json:"direct,omitempty"`
+
+	// Plan is set when the job was a dry run, which deployed nothing
+	Plan *DeploymentPlan `json:"plan,omitempty"`
+}
+
+// RevisionInfo describes the artifact that was deployed
+type RevisionInfo struct {
+	SourceRevision string `json:"sourceRevision,omitempty"`
+	SourceBranch   string `json:"sourceBranch,omitempty"`
+	BucketName     string `json:"bucketName,omitempty"`
+	ObjectKey      string `json:"objectKey,omitempty"`
+	ETag           string `json:"eTag,omitempty"`
+	VersionID      string `json:"versionId,omitempty"`
+	BundleSize     int64  `json:"bundleSize,omitempty"`
+	BundleSha256   string `json:"bundleSha256,omitempty"`
+}
+
+// VersionInfo holds the Lambda versions taken from the bundle's AppSpec
+type VersionInfo struct {
+	CurrentVersion string `json:"currentVersion,omitempty"`
+	TargetVersion  string `json:"targetVersion,omitempty"`
+}
+
+// ValidationResult records the outcome of a single validation step
+type ValidationResult struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Timings records when the job started and how long each phase took
+type Timings struct {
+	StartedAt   time.Time         `json:"startedAt"`
+	CompletedAt time.Time         `json:"completedAt"`
+	Total       string            `json:"total"`
+	Phases      map[string]string `json:"phases"`
+}
+
+func newDeploymentReport(jobID string) *DeploymentReport {
+	return &DeploymentReport{
+		JobID:       jobID,
+		Validations: []ValidationResult{},
+		Targets:     []*TargetResult{},
+		Timings: Timings{
+			StartedAt: time.Now().UTC(),
+			Phases:    map[string]string{},
+		},
+	}
+}
+
+// newValidationResult records a validation step. A nil error means it passed.
+func newValidationResult(name string, err error, duration time.Duration) ValidationResult {
+	result := ValidationResult{
+		Name:     name,
+		Passed:   err == nil,
+		Duration: duration.Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// addValidation records a job-level validation step, such as a wave's
+// health check after its bake time
+func (r *DeploymentReport) addValidation(name string, err error, duration time.Duration) {
+	r.Validations = append(r.Validations, newValidationResult(name, err, duration))
+}
+
+// addPhase records how long a phase of the job took
+func (r *DeploymentReport) addPhase(name string, duration time.Duration) {
+	r.Timings.Phases[name] = duration.Round(time.Millisecond).String()
+}
+
+// complete stamps the report with the completion time, and lifts the
+// target's details to the top level when there is only one
+func (r *DeploymentReport) complete() {
+	r.Timings.CompletedAt = time.Now().UTC()
+	r.Timings.Total = r.Timings.CompletedAt.Sub(r.Timings.StartedAt).Round(time.Millisecond).String()
+
+	if len(r.Targets) == 1 {
+		target := r.Targets[0]
+		r.ApplicationName = target.ApplicationName
+		r.DeploymentGroupName = target.DeploymentGroupName
+		r.DeploymentID = target.DeploymentID
+		r.Unchanged = target.Status == targetUnchanged
+	}
+	if r.Plan != nil && len(r.Plan.Waves) == 1 && len(r.Plan.Waves[0].Targets) == 1 {
+		target := r.Plan.Waves[0].Targets[0]
+		r.ApplicationName = target.ApplicationName
+		r.DeploymentGroupName = target.DeploymentGroupName
+	}
+}
+
+// targetSummary lists each group's result, one per line
+func (r *DeploymentReport) targetSummary() string {
+	var lines []string
+	for _, t := range r.Targets {
+		line := fmt.Sprintf("wave %s: %s/%s %s", t.Wave, t.ApplicationName, t.DeploymentGroupName, t.Status)
+		if t.DeploymentID != "" {
+			line += " (" + t.DeploymentID + ")"
+		}
+		if t.Message != "" {
+			line += ": " + t.Message
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failureSummary is the failure message for CodePipeline, with the
+// result of every group the job touched
+func (r *DeploymentReport) failureSummary(err error) string {
+	if len(r.Targets) <= 1 {
+		return err.Error()
+	}
+	return err.Error() + "\n" + r.targetSummary()
+}
+
+// outputVariables returns the variables exported to later pipeline stages.
+// CodePipeline rejects empty values, so only the known ones are set.
+func (r *DeploymentReport) outputVariables() map[string]string {
+	variables := map[string]string{}
+	if r.DeploymentID != "" {
+		variables["deploymentId"] = r.DeploymentID
+	}
+	if len(r.Targets) > 1 {
+		var ids []string
+		for _, t := range r.Targets {
+			if t.DeploymentID != "" {
+				ids = append(ids, t.DeploymentID)
+			}
+		}
+		if len(ids) > 0 {
+			variables["deploymentIds"] = strings.Join(ids, ",")
+		}
+	}
+	if r.Versions.TargetVersion != "" {
+		variables["targetVersion"] = r.Versions.TargetVersion
+	}
+	if r.Revision.BundleSha256 != "" {
+		variables["bundleSha256"] = r.Revision.BundleSha256
+	}
+	if r.Plan != nil {
+		variables["dryRun"] = "true"
+	}
+	return variables
+}
+
+// executionDetails summarizes the report for the CodePipeline console
+func (r *DeploymentReport) executionDetails() *types.ExecutionDetails {
+	summary := fmt.Sprintf("Deployment %s to %s/%s succeeded in %s",
+		r.DeploymentID, r.ApplicationName, r.DeploymentGroupName, r.Timings.Total)
+	if r.Unchanged {
+		summary = fmt.Sprintf("No changes: revision is already live in %s/%s from deployment %s",
+			r.ApplicationName, r.DeploymentGroupName, r.DeploymentID)
+	}
+	if len(r.Targets) > 1 {
+		summary = fmt.Sprintf("Deployed to %d deployment groups in %s\n%s",
+			len(r.Targets), r.Timings.Total, r.targetSummary())
+	}
+	if r.Versions.TargetVersion != "" {
+		summary += fmt.Sprintf(" (target version %s)", r.Versions.TargetVersion)
+	}
+	if r.Plan != nil {
+		summary = r.PlanSummary()
+	}
+
+	details := &types.ExecutionDetails{
+		Summary:         aws.String(truncate(summary, maxSummaryLength)),
+		PercentComplete: aws.Int32(100),
+	}
+	if r.DeploymentID != "" {
+		details.ExternalExecutionId = aws.String(r.DeploymentID)
+	}
+	return details
+}
+
+// bundleInfo is what we learn by downloading the input artifact
+type bundleInfo struct {
+	Size     int64
+	Sha256   string
+	ETag     string
+	Version  string
+	Versions VersionInfo
+
+	// archive reads the bundle's files from S3 as they are needed. ECS
+	// deployments read their task definition from it. archiveErr says why
+	// the bundle could not be read as a zip.
+	archive    *zip.Reader
+	archiveErr error
+}
+
+// files returns the bundle's files, or nil if the bundle was not inspected
+func (b *bundleInfo) files() (*zip.Reader, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return b.archive, b.archiveErr
+}
+
+// inspectArtifact inspects the bundle and records what it is in the report.
+// A bundle we cannot read is only logged, since the deployment does not
+// need the details.
+func inspectArtifact(ctx context.Context, bucketName, objectKey string, report *DeploymentReport) *bundleInfo {
+	if bucketName == "" || objectKey == "" {
+		return &bundleInfo{}
+	}
+	bundle, err := inspectBundle(ctx, bucketName, objectKey)
+	if err != nil {
+		log.Printf("Warning: Could not inspect artifact: %v", err)
+		return &bundleInfo{}
+	}
+	report.Revision.ETag = bundle.ETag
+	report.Revision.VersionID = bundle.Version
+	report.Revision.BundleSize = bundle.Size
+	report.Revision.BundleSha256 = bundle.Sha256
+	report.Versions = bundle.Versions
+	return bundle
+}
+
+// inspectBundle hashes the input artifact as it streams past, then opens
+// it as a zip to read the Lambda versions from the AppSpec at its root (if
+// any). The bundle is never held in memory; its files are read by range.
+func inspectBundle(ctx context.Context, bucketName, objectKey string) (*bundleInfo, error) {
+	result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download artifact: %v", err)
+	}
+	defer result.Body.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact: %v", err)
+	}
+
+	info := &bundleInfo{
+		Size:    size,
+		Sha256:  hex.EncodeToString(hash.Sum(nil)),
+		ETag:    strings.Trim(aws.ToString(result.ETag), `"`),
+		Version: aws.ToString(result.VersionId),
+	}
+
+	object := &s3ReaderAt{
+		ctx:     ctx,
+		bucket:  bucketName,
+		key:     objectKey,
+		version: info.Version,
+		etag:    aws.ToString(result.ETag),
+		size:    size,
+	}
+	info.archive, err = zip.NewReader(object, size)
+	if err != nil {
+		info.archive, info.archiveErr = nil, fmt.Errorf("artifact is not a zip: %v", err)
+		log.Printf("Warning: Could not read AppSpec from artifact: %v", info.archiveErr)
+		return info, nil
+	}
+
+	versions, err := appSpecVersions(info.archive)
+	if err != nil {
+		log.Printf("Warning: Could not read AppSpec from artifact: %v", err)
+	} else {
+		info.Versions = versions
+	}
+
+	return info, nil
+}
+
+// appSpecVersions extracts CurrentVersion and TargetVersion from the
+// AppSpec at the root of the bundle
+func appSpecVersions(archive *zip.Reader) (VersionInfo, error) {
+	content, err := zipAppSpec(archive)
+	if err != nil {
+		return VersionInfo{}, err
+	}
+	return ParseAppSpecVersions(content), nil
+}
+
+// s3ReadBlockSize is how much s3ReaderAt fetches at a time. The zip reader
+// reads the directory a few KB at a time, so we read ahead.
+const s3ReadBlockSize = 1 << 20
+
+// s3ReaderAt reads an object in S3 by range, so a zip reader only fetches
+// the directory and the files it opens. Every read is pinned to the
+// version, or else the ETag, that was hashed, so a bundle replaced in the
+// meantime fails the read rather than mixing two bundles.
+type s3ReaderAt struct {
+	// ctx is the job's, which outlives the reads
+	ctx     context.Context
+	bucket  string
+	key     string
+	version string
+	etag    string
+	size    int64
+
+	mu     sync.Mutex
+	offset int64
+	block  []byte
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < r.offset || pos >= r.offset+int64(len(r.block)) {
+			if err := r.fetch(pos, max(int64(len(p)-n), s3ReadBlockSize)); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.block[pos-r.offset:])
+	}
+	return n, nil
+}
+
+// fetch reads length bytes from pos, or up to the end of the object
+func (r *s3ReaderAt) fetch(pos, length int64) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", pos, min(pos+length, r.size)-1)),
+	}
+	if r.version != "" {
+		input.VersionId = aws.String(r.version)
+	} else if r.etag != "" {
+		input.IfMatch = aws.String(r.etag)
+	}
+
+	result, err := s3Client.GetObject(r.ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to read s3://%s/%s at %d: %v", r.bucket, r.key, pos, err)
+	}
+	defer result.Body.Close()
+
+	block, err := io.ReadAll(result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read s3://%s/%s at %d: %v", r.bucket, r.key, pos, err)
+	}
+	if len(block) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.offset, r.block = pos, block
+	return nil
+}
+
+// writeDeploymentReport zips the report and uploads it to the output
+// artifact location, which is where CodePipeline expects a zip archive
+func writeDeploymentReport(ctx context.Context, artifact Artifact, report *DeploymentReport) error {
+	location := artifact.Location.S3Location
+	if location.BucketName == "" || location.ObjectKey == "" {
+		return fmt.Errorf("output artifact %s has no S3 location", artifact.Name)
+	}
+
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal deployment report: %v", err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(reportFileName)
+	if err != nil {
+		return fmt.Errorf("failed to create report archive: %v", err)
+	}
+	if _, err := w.Write(reportJSON); err != nil {
+		return fmt.Errorf("failed to write report archive: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to close report archive: %v", err)
+	}
+
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(location.BucketName),
+		Key:         aws.String(location.ObjectKey),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/zip"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload deployment report: %v", err)
+	}
+
+	log.Printf("Deployment report written to s3://%s/%s", location.BucketName, location.ObjectKey)
+	return nil
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
@@ -0,0 +1,194 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestAppSpecVersions(t *testing.T) {
+	yamlAppSpec := `version: 0.0
+Resources:
+  - app:
+      Type: AWS::Lambda::Function
+      Properties:
+        Name: "api"
+        Alias: "Live"
+        CurrentVersion: "4"
+        TargetVersion: "5"
+`
+	jsonAppSpec := `{"version": 0.0, "Resources": [{"app": {"Type": "AWS::Lambda::Function",
+		"Properties": {"Name": "api", "Alias": "Live", "CurrentVersion": "4", "TargetVersion": 5}}}]}`
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    VersionInfo
+		wantErr string
+	}{
+		{name: "YAML", files: map[string]string{"appspec.yml": yamlAppSpec}, want: VersionInfo{CurrentVersion: "4", TargetVersion: "5"}},
+		{name: "JSON", files: map[string]string{"appspec.json": jsonAppSpec}, want: VersionInfo{CurrentVersion: "4", TargetVersion: "5"}},
+		{name: "yaml extension", files: map[string]string{"appspec.yaml": "TargetVersion: 7"}, want: VersionInfo{TargetVersion: "7"}},
+		{name: "server AppSpec", files: map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}},
+		{name: "AppSpec not at the root", files: map[string]string{"app/appspec.yml": yamlAppSpec}, wantErr: "no AppSpec found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appSpecVersions(zipBundle(t, tt.files).archive)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("appSpecVersions() = %+v, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("appSpecVersions() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputVariables(t *testing.T) {
+	tests := []struct {
+		name   string
+		report DeploymentReport
+		want   map[string]string
+	}{
+		{name: "nothing known", want: map[string]string{}},
+		{
+			name: "single target",
+			report: DeploymentReport{
+				DeploymentID: "d-1",
+				Versions:     VersionInfo{CurrentVersion: "4", TargetVersion: "5"},
+				Revision:     RevisionInfo{BundleSha256: "abc"},
+				Targets:      []*TargetResult{{DeploymentID: "d-1"}},
+			},
+			want: map[string]string{"deploymentId": "d-1", "targetVersion": "5", "bundleSha256": "abc"},
+		},
+		{
+			// A target that failed before deploying has no ID to list
+			name:   "several targets",
+			report: DeploymentReport{Targets: []*TargetResult{{DeploymentID: "d-1"}, {}, {DeploymentID: "d-3"}}},
+			want:   map[string]string{"deploymentIds": "d-1,d-3"},
+		},
+		{
+			name:   "several targets without deployments",
+			report: DeploymentReport{Targets: []*TargetResult{{}, {}}},
+			want:   map[string]string{},
+		},
+		{
+			name:   "dry run",
+			report: DeploymentReport{Plan: &DeploymentPlan{}},
+			want:   map[string]string{"dryRun": "true"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.report.outputVariables()
+			if len(got) != len(tt.want) {
+				t.Fatalf("outputVariables() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("outputVariables()[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestInspectBundle(t *testing.T) {
+	fake, _ := localAWS(t)
+	e2eInit(t)
+
+	// Random padding does not compress, so the bundle spans several reads
+	padding := make([]byte, 3*s3ReadBlockSize)
+	rand.New(rand.NewSource(1)).Read(padding)
+	bundle := zipBytes(t, map[string]string{
+		"appspec.yml":  "CurrentVersion: 4\nTargetVersion: 5\n",
+		"padding.bin":  string(padding),
+		"taskdef.json": `{"family": "api"}`,
+	})
+	fake.PutObject("artifacts", "build/bundle.zip", bundle)
+
+	info, err := inspectBundle(context.Background(), "artifacts", "build/bundle.zip")
+	if err != nil {
+		t.Fatalf("inspectBundle() returned error: %v", err)
+	}
+	sum := sha256.Sum256(bundle)
+	if info.Size != int64(len(bundle)) || info.Sha256 != hex.EncodeToString(sum[:]) || info.ETag == "" {
+		t.Errorf("bundle = %+v, want its size, hash and ETag", info)
+	}
+	if info.Versions != (VersionInfo{CurrentVersion: "4", TargetVersion: "5"}) {
+		t.Errorf("versions = %+v, want 4 to 5", info.Versions)
+	}
+	files, err := readBundleFiles(info.archive, "taskdef.json", "padding.bin")
+	if err != nil || string(files["taskdef.json"]) != `{"family": "api"}` || !bytes.Equal(files["padding.bin"], padding) {
+		t.Errorf("readBundleFiles() = %d files, %v, want the task definition and padding read back", len(files), err)
+	}
+
+	// Reads are pinned to the bundle that was hashed
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"taskdef.json": `{"family": "other"}`}))
+	if files, err := readBundleFiles(info.archive, "padding.bin"); err == nil || !strings.Contains(err.Error(), "PreconditionFailed") {
+		t.Errorf("readBundleFiles() of a replaced bundle = %d files, %v, want PreconditionFailed", len(files), err)
+	}
+
+	fake.PutObject("artifacts", "build/notzip.zip", []byte("TargetVersion: 5"))
+	info, err = inspectBundle(context.Background(), "artifacts", "build/notzip.zip")
+	if err != nil || info.Size != 16 || info.Versions != (VersionInfo{}) {
+		t.Fatalf("inspectBundle() of a non-zip = %+v, %v, want it hashed without versions", info, err)
+	}
+	if _, err := info.files(); err == nil || !strings.Contains(err.Error(), "not a zip") {
+		t.Errorf("files() = %v, want the artifact rejected as not a zip", err)
+	}
+
+	if _, err := inspectBundle(context.Background(), "artifacts", "build/missing.zip"); err == nil {
+		t.Error("inspectBundle() of a missing artifact returned no error")
+	}
+}
+
+func TestWriteDeploymentReport(t *testing.T) {
+	fake, _ := localAWS(t)
+	e2eInit(t)
+	report := newDeploymentReport("job-1")
+	report.Targets = []*TargetResult{{ApplicationName: "api", DeploymentGroupName: "api-live", DeploymentID: "d-1", Status: targetSucceeded}}
+	report.complete()
+
+	output := Artifact{Name: "DeployReport", Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "out/report.zip"}}}
+	if err := writeDeploymentReport(context.Background(), output, report); err != nil {
+		t.Fatalf("writeDeploymentReport() returned error: %v", err)
+	}
+
+	// CodePipeline hands later stages the zip, with the report inside
+	data, ok := fake.Object("artifacts", "out/report.zip")
+	if !ok {
+		t.Fatal("no report uploaded")
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != reportFileName {
+		t.Fatalf("report archive = %v, %v, want only %s", archive, err, reportFileName)
+	}
+	rc, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	raw, _ := io.ReadAll(rc)
+	var uploaded DeploymentReport
+	if err := json.Unmarshal(raw, &uploaded); err != nil || uploaded.JobID != "job-1" || uploaded.DeploymentID != "d-1" {
+		t.Errorf("uploaded report = %s, %v, want job-1's deployment d-1", raw, err)
+	}
+
+	if err := writeDeploymentReport(context.Background(), Artifact{Name: "DeployReport"}, report); err == nil {
+		t.Error("writeDeploymentReport() without an S3 location returned no error")
+	}
+}
@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// retryPolicy controls how our own retry loops (around CreateDeployment and
+// the deployment status checks) back off. The SDK retries each call on its
+// own as well; this covers failures that outlast the SDK's attempts.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// nonRetryableErrorCodes fail immediately. Retrying them can only burn the
+// time budget, since nothing about the request will change.
+var nonRetryableErrorCodes = map[string]bool{
+	"AccessDenied":                          true,
+	"AccessDeniedException":                 true,
+	"UnauthorizedOperation":                 true,
+	"ApplicationDoesNotExistException":      true,
+	"DeploymentGroupDoesNotExistException":  true,
+	"DeploymentConfigDoesNotExistException": true,
+	"DeploymentDoesNotExistException":       true,
+	"InvalidApplicationNameException":       true,
+	"InvalidDeploymentGroupNameException":   true,
+	"InvalidDeploymentIdException":          true,
+	"InvalidRevisionException":              true,
+	"RevisionDoesNotExistException":         true,
+	"InvalidRoleException":                  true,
+	"InvalidJobIdException":                 true,
+	"InvalidJobStateException":              true,
+	"JobNotFoundException":                  true,
+	"ValidationException":                   true,
+}
+
+// newRetryPolicy builds the policy from the validated configuration
+func newRetryPolicy(c config.RetryConfig) retryPolicy {
+	return retryPolicy{
+		MaxAttempts: c.MaxAttempts,
+		BaseDelay:   c.BaseDelay,
+		MaxDelay:    c.MaxDelay,
+	}
+}
+
+// backoff returns the delay before the given retry (1-based) using
+// exponential backoff with full jitter
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// do calls fn until it succeeds, returns a non-retryable error, or runs
+// out of attempts. The last error is returned wrapped with the attempt count.
+func (p retryPolicy) do(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= p.MaxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return fmt.Errorf("%s failed with a non-retryable error: %w", name, err)
+		}
+		if attempt == p.MaxAttempts {
+			break
+		}
+
+		delay := p.backoff(attempt)
+		log.Printf("%s failed (attempt %d/%d): %v, retrying in %v", name, attempt, p.MaxAttempts, err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%s failed after %d attempts: %w", name, p.MaxAttempts, err)
+}
+
+// isRetryable classifies an AWS SDK error. Known client errors fail fast,
+// while throttling, 5xx responses and connection errors are retried using
+// the SDK's own classification.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if nonRetryableErrorCodes[apiErr.ErrorCode()] {
+			return false
+		}
+		if apiErr.ErrorFault() == smithy.FaultServer {
+			return true
+		}
+	}
+
+	for _, retryable := range retry.DefaultRetryables {
+		if retryable.IsErrorRetryable(err) == aws.TrueTernary {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for the delay, returning early if the context is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDeniedException", Fault: smithy.FaultClient}, false},
+		{"missing group", &smithy.GenericAPIError{Code: "DeploymentGroupDoesNotExistException", Fault: smithy.FaultClient}, false},
+		{"wrapped client error", fmt.Errorf("CreateDeployment: %w", &smithy.GenericAPIError{Code: "InvalidRevisionException"}), false},
+		{"throttled", &smithy.GenericAPIError{Code: "ThrottlingException", Fault: smithy.FaultClient}, true},
+		{"too many requests", &smithy.GenericAPIError{Code: "TooManyRequestsException"}, true},
+		{"server fault", &smithy.GenericAPIError{Code: "InternalFailure", Fault: smithy.FaultServer}, true},
+		{"unknown client error", &smithy.GenericAPIError{Code: "SomethingNewException", Fault: smithy.FaultClient}, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"cancelled", fmt.Errorf("waiting: %w", context.Canceled), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"plain error", errors.New("bundle has no AppSpec"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	// A code we know is permanent fails fast even when the service calls
+	// it a server fault
+	for code := range nonRetryableErrorCodes {
+		if isRetryable(&smithy.GenericAPIError{Code: code, Fault: smithy.FaultServer}) {
+			t.Errorf("isRetryable(%s) = true, want it to fail fast", code)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Fault: smithy.FaultClient}
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Fault: smithy.FaultClient}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "succeeds at once", errs: []error{nil}, wantCalls: 1},
+		{name: "succeeds after a throttle", errs: []error{throttled, nil}, wantCalls: 2},
+		{name: "stays throttled", errs: []error{throttled, throttled, throttled}, wantCalls: 3, wantErr: throttled},
+		{name: "fails fast", errs: []error{denied}, wantCalls: 1, wantErr: denied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := policy.do(context.Background(), "CreateDeployment", func(ctx context.Context) error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("do() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 10, BaseDelay: 2 * time.Second, MaxDelay: 30 * time.Second}
+	for attempt := 1; attempt <= 64; attempt++ {
+		ceiling := min(policy.BaseDelay<<(min(attempt, 30)-1), policy.MaxDelay)
+		if delay := policy.backoff(attempt); delay < 0 || delay > ceiling {
+			t.Errorf("backoff(%d) = %v, want at most %v", attempt, delay, ceiling)
+		}
+	}
+}
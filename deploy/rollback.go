@@ -0,0 +1,207 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// RollbackRequest asks for a deployment group to go back to its last
+// known-good revision. It is the request of a direct invocation's
+// "rollback" action.
+type RollbackRequest struct {
+	TargetRef
+
+	// DeploymentID is the bad deployment to roll back from. By default it
+	// is the group's last successful deployment, which is what is live.
+	DeploymentID string `json:"deploymentId,omitempty"`
+
+	// Reason is kept in the report and the audit log
+	Reason string `json:"reason,omitempty"`
+}
+
+// RollbackInfo records a rollback in its report
+type RollbackInfo struct {
+	FromDeploymentID string `json:"fromDeploymentId"`
+	ToDeploymentID   string `json:"toDeploymentId"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+// Rollback redeploys the revision of the group's last successful deployment
+// before the current one. It goes through the same validation, monitoring
+// and audit as a pipeline job, and returns the report.
+func Rollback(ctx context.Context, req RollbackRequest) (*DeploymentReport, error) {
+	if awsCfgErr != nil {
+		return nil, awsCfgErr
+	}
+	if cfgErr != nil {
+		return nil, cfgErr
+	}
+	if req.ApplicationName == "" || req.DeploymentGroupName == "" {
+		return nil, fmt.Errorf("rollback needs an applicationName and a deploymentGroupName")
+	}
+
+	target := findTarget(ctx, req.TargetRef)
+	clients, err := targetClientCache.forTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	current, good, err := findLastKnownGood(ctx, clients, target, req.DeploymentID)
+	if err != nil {
+		return nil, err
+	}
+	from, to := aws.ToString(current.DeploymentId), aws.ToString(good.DeploymentId)
+	log.Printf("Rolling back %s from deployment %s to the revision of %s", target, from, to)
+
+	// The job ID is derived from both deployments, so a retried rollback
+	// resumes the deployment it already created
+	jobID := fmt.Sprintf("rollback-%s-%s", from, to)
+	report := newDeploymentReport(jobID)
+	report.Rollback = &RollbackInfo{FromDeploymentID: from, ToDeploymentID: to, Reason: req.Reason}
+
+	revision, err := rollbackRevision(ctx, clients.S3, current, good)
+	if err != nil {
+		return nil, fmt.Errorf("cannot roll back %s to deployment %s: %v", target, to, err)
+	}
+	deployReq := deployRequest{
+		JobID:       jobID,
+		Bundle:      &bundleInfo{},
+		Revision:    revision,
+		Description: "Rollback to the revision of deployment " + to,
+	}
+	target.SkipUnchangedRevisions = false
+	if err := runDirect(ctx, deployReq, target, report); err != nil {
+		return report, fmt.Errorf("rollback of %s failed: %v", target, err)
+	}
+
+	log.Printf("Rolled back %s to the revision of %s in deployment %s", target, to, report.DeploymentID)
+	return report, nil
+}
+
+// findLastKnownGood returns the deployment being rolled back and the most
+// recent successful deployment created before it with a different revision
+func findLastKnownGood(ctx context.Context, clients *targetClients, target deploymentTarget, currentID string) (current, good *types.DeploymentInfo, err error) {
+	if currentID == "" {
+		group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+			ApplicationName:     aws.String(target.ApplicationName),
+			DeploymentGroupName: aws.String(target.DeploymentGroupName),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get deployment group: %v", err)
+		}
+		last := group.DeploymentGroupInfo.LastSuccessfulDeployment
+		if last == nil || last.DeploymentId == nil {
+			return nil, nil, fmt.Errorf("%s has no successful deployment to roll back from", target)
+		}
+		currentID = *last.DeploymentId
+	}
+
+	result, err := clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(currentID),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get deployment %s: %v", currentID, err)
+	}
+	current = result.DeploymentInfo
+
+	input := &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+		IncludeOnlyStatuses: []types.DeploymentStatus{types.DeploymentStatusSucceeded},
+	}
+	if current.CreateTime != nil {
+		input.CreateTimeRange = &types.TimeRange{End: current.CreateTime}
+	}
+
+	var candidates []types.DeploymentInfo
+	paginator := codedeploy.NewListDeploymentsPaginator(clients.CodeDeploy, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list deployments: %v", err)
+		}
+		for start := 0; start < len(page.Deployments); start += batchGetDeploymentsLimit {
+			end := min(start+batchGetDeploymentsLimit, len(page.Deployments))
+			batch, err := clients.CodeDeploy.BatchGetDeployments(ctx, &codedeploy.BatchGetDeploymentsInput{
+				DeploymentIds: page.Deployments[start:end],
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to get deployments: %v", err)
+			}
+			candidates = append(candidates, batch.DeploymentsInfo...)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return aws.ToTime(candidates[i].CreateTime).After(aws.ToTime(candidates[j].CreateTime))
+	})
+	for i := range candidates {
+		candidate := &candidates[i]
+		if aws.ToString(candidate.DeploymentId) == currentID || candidate.Revision == nil {
+			continue
+		}
+		if current.CreateTime != nil && !aws.ToTime(candidate.CreateTime).Before(*current.CreateTime) {
+			continue
+		}
+		if sameRevision(current, candidate) {
+			continue
+		}
+		return current, candidate, nil
+	}
+	return nil, nil, fmt.Errorf("no successful deployment of %s before %s has a different revision", target, currentID)
+}
+
+// sameRevision compares two deployments by the bundle hash we tag them
+// with, falling back to the revision itself
+func sameRevision(a, b *types.DeploymentInfo) bool {
+	tagA := bundleTagPattern.FindStringSubmatch(aws.ToString(a.Description))
+	tagB := bundleTagPattern.FindStringSubmatch(aws.ToString(b.Description))
+	if tagA != nil && tagB != nil {
+		return tagA[1] == tagB[1]
+	}
+
+	revisionA, _ := json.Marshal(a.Revision)
+	revisionB, _ := json.Marshal(b.Revision)
+	return string(revisionA) == string(revisionB)
+}
+
+var appSpecCurrentVersionPattern = regexp.MustCompile(`("?CurrentVersion"?\s*:\s*"?)([^"\s,}]+)`)
+
+// rollbackRevision is the good deployment's revision. A Lambda AppSpec
+// shifts traffic from its CurrentVersion, which is now the version the
+// current deployment made live, so we point it there. An AppSpec in S3 is
+// read with bundles, in the target's account, and sent inline instead.
+func rollbackRevision(ctx context.Context, bundles BundleAPI, current, good *types.DeploymentInfo) (*types.RevisionLocation, error) {
+	revision := *good.Revision
+	if good.ComputePlatform != types.ComputePlatformLambda {
+		return &revision, nil
+	}
+
+	// We cannot shift traffic safely without knowing what is live
+	liveAppSpec, err := RevisionAppSpec(ctx, bundles, current.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the AppSpec of deployment %s: %v", aws.ToString(current.DeploymentId), err)
+	}
+	live := ParseAppSpecVersions(liveAppSpec).TargetVersion
+	if live == "" {
+		return &revision, nil
+	}
+
+	appSpec, err := RevisionAppSpec(ctx, bundles, good.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the AppSpec of deployment %s: %v", aws.ToString(good.DeploymentId), err)
+	}
+	content := appSpecCurrentVersionPattern.ReplaceAllString(appSpec, "${1}"+live)
+	return &types.RevisionLocation{
+		RevisionType:   types.RevisionLocationTypeAppSpecContent,
+		AppSpecContent: &types.AppSpecContent{Content: aws.String(content)},
+	}, nil
+}
@@ -0,0 +1,186 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// lambdaDeployment is a successful Lambda deployment of the bundle whose hash
+// repeats the hex digit sha
+func lambdaDeployment(id, sha string, created time.Time, current, target string) *types.DeploymentInfo {
+	return &types.DeploymentInfo{
+		DeploymentId:        aws.String(id),
+		ApplicationName:     aws.String("api"),
+		DeploymentGroupName: aws.String("api-live"),
+		ComputePlatform:     types.ComputePlatformLambda,
+		Status:              types.DeploymentStatusSucceeded,
+		CreateTime:          aws.Time(created),
+		Description:         aws.String("Deployment triggered by CodePipeline job " + id + " " + bundleTag(strings.Repeat(sha, 64))),
+		Revision: &types.RevisionLocation{
+			RevisionType: types.RevisionLocationTypeAppSpecContent,
+			AppSpecContent: &types.AppSpecContent{Content: aws.String(`{"version": 0.0, "Resources": [{"api": {"Type": "AWS::Lambda::Function",
+  "Properties": {"Name": "api", "Alias": "live", "CurrentVersion": "` + current + `", "TargetVersion": "` + target + `"}}}]}`)},
+		},
+	}
+}
+
+func rollbackCodeDeploy() *fakeCodeDeploy {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	failed := lambdaDeployment("d-5", "e", start.Add(5*time.Hour), "4", "5")
+	failed.Status = types.DeploymentStatusFailed
+	return &fakeCodeDeploy{
+		groups: map[string]*types.DeploymentGroupInfo{"api/api-live": {
+			LastSuccessfulDeployment: &types.LastDeploymentInfo{DeploymentId: aws.String("d-4")},
+		}},
+		deployments: map[string]*types.DeploymentInfo{
+			"d-1": lambdaDeployment("d-1", "a", start, "1", "2"),
+			"d-2": lambdaDeployment("d-2", "b", start.Add(time.Hour), "2", "3"),
+			// d-3 redeployed the same bundle as the live d-4
+			"d-3": lambdaDeployment("d-3", "c", start.Add(2*time.Hour), "3", "4"),
+			"d-4": lambdaDeployment("d-4", "c", start.Add(3*time.Hour), "4", "4"),
+			"d-5": failed,
+		},
+	}
+}
+
+func TestFindLastKnownGood(t *testing.T) {
+	cd := rollbackCodeDeploy()
+	clients := &targetClients{Region: "us-east-1", CodeDeploy: cd}
+	target := deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-live"}
+
+	current, good, err := findLastKnownGood(context.Background(), clients, target, "")
+	if err != nil {
+		t.Fatalf("findLastKnownGood() returned error: %v", err)
+	}
+	if aws.ToString(current.DeploymentId) != "d-4" || aws.ToString(good.DeploymentId) != "d-2" {
+		t.Errorf("rolls back from %s to %s, want d-4 to d-2", aws.ToString(current.DeploymentId), aws.ToString(good.DeploymentId))
+	}
+
+	// Rolling back from an older deployment only looks further back
+	_, good, err = findLastKnownGood(context.Background(), clients, target, "d-2")
+	if err != nil || aws.ToString(good.DeploymentId) != "d-1" {
+		t.Errorf("findLastKnownGood(d-2) = %v, %v, want d-1", good, err)
+	}
+	if _, _, err := findLastKnownGood(context.Background(), clients, target, "d-1"); err == nil {
+		t.Error("findLastKnownGood(d-1) returned no error with nothing older to roll back to")
+	}
+}
+
+func TestRollbackRevisionShiftsFromLiveVersion(t *testing.T) {
+	cd := rollbackCodeDeploy()
+	revision, err := rollbackRevision(context.Background(), &fakeS3{}, cd.deployments["d-4"], cd.deployments["d-2"])
+	if err != nil {
+		t.Fatalf("rollbackRevision() returned error: %v", err)
+	}
+
+	content := aws.ToString(revision.AppSpecContent.Content)
+	versions := ParseAppSpecVersions(content)
+	if versions.CurrentVersion != "4" || versions.TargetVersion != "3" {
+		t.Errorf("AppSpec shifts %s -> %s, want 4 -> 3:\n%s", versions.CurrentVersion, versions.TargetVersion, content)
+	}
+	if original := aws.ToString(cd.deployments["d-2"].Revision.AppSpecContent.Content); !strings.Contains(original, `"CurrentVersion": "2"`) {
+		t.Errorf("rollbackRevision() modified the good deployment's revision: %s", original)
+	}
+}
+
+// s3Revision points a deployment at an AppSpec bundle in S3 instead
+func s3Revision(d *types.DeploymentInfo, key string, bundleType types.BundleType) *types.DeploymentInfo {
+	moved := *d
+	moved.Revision = &types.RevisionLocation{
+		RevisionType: types.RevisionLocationTypeS3,
+		S3Location:   &types.S3Location{Bucket: aws.String("artifacts"), Key: aws.String(key), BundleType: bundleType},
+	}
+	return &moved
+}
+
+func TestRollbackRevisionFromS3(t *testing.T) {
+	cd := rollbackCodeDeploy()
+	current, good := cd.deployments["d-4"], cd.deployments["d-2"]
+	bundles := &fakeS3{objects: map[string][]byte{
+		"artifacts/d-4.yml": []byte(aws.ToString(current.Revision.AppSpecContent.Content)),
+		"artifacts/d-2.zip": zipBytes(t, map[string]string{"appspec.json": aws.ToString(good.Revision.AppSpecContent.Content)}),
+	}}
+
+	server := s3Revision(good, "d-2.zip", types.BundleTypeZip)
+	server.ComputePlatform = types.ComputePlatformServer
+
+	tests := []struct {
+		name    string
+		current *types.DeploymentInfo
+		good    *types.DeploymentInfo
+		wantErr string
+	}{
+		{name: "good revision in S3", current: current, good: s3Revision(good, "d-2.zip", types.BundleTypeZip)},
+		{name: "live revision in S3", current: s3Revision(current, "d-4.yml", types.BundleTypeYaml), good: good},
+		{name: "both in S3", current: s3Revision(current, "d-4.yml", types.BundleTypeYaml), good: s3Revision(good, "d-2.zip", types.BundleTypeZip)},
+		{name: "good revision missing", current: current, good: s3Revision(good, "gone.zip", types.BundleTypeZip), wantErr: "cannot read the AppSpec of deployment d-2"},
+		{name: "live revision missing", current: s3Revision(current, "gone.yml", types.BundleTypeYaml), good: good, wantErr: "cannot read the AppSpec of deployment d-4"},
+		{name: "live revision a tarball", current: s3Revision(current, "d-4.yml", types.BundleTypeTar), good: good, wantErr: "tar bundle"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revision, err := rollbackRevision(context.Background(), bundles, tt.current, tt.good)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("rollbackRevision() = %+v, %v, want an error containing %q", revision, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rollbackRevision() returned error: %v", err)
+			}
+
+			// The rewritten AppSpec is sent inline
+			if revision.RevisionType != types.RevisionLocationTypeAppSpecContent || revision.AppSpecContent == nil {
+				t.Fatalf("revision = %+v, want the AppSpec inline", revision)
+			}
+			versions := ParseAppSpecVersions(aws.ToString(revision.AppSpecContent.Content))
+			if versions.CurrentVersion != "4" || versions.TargetVersion != "3" {
+				t.Errorf("AppSpec shifts %s -> %s, want 4 -> 3", versions.CurrentVersion, versions.TargetVersion)
+			}
+		})
+	}
+
+	// Server bundles are redeployed as they are, with no AppSpec to rewrite
+	revision, err := rollbackRevision(context.Background(), bundles, current, server)
+	if err != nil || revision.RevisionType != types.RevisionLocationTypeS3 || aws.ToString(revision.S3Location.Key) != "d-2.zip" {
+		t.Errorf("rollbackRevision() of a server bundle = %+v, %v, want it unchanged", revision, err)
+	}
+}
+
+func TestStartDeploymentRollback(t *testing.T) {
+	cfg = &config.Config{Retry: config.RetryConfig{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	cd := rollbackCodeDeploy()
+	revision, err := rollbackRevision(context.Background(), &fakeS3{}, cd.deployments["d-4"], cd.deployments["d-2"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := deployRequest{
+		JobID:       "rollback-d-4-d-2",
+		Bundle:      &bundleInfo{},
+		Revision:    revision,
+		Description: "Rollback to the revision of deployment d-2",
+	}
+	target := deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-live"}
+
+	_, err = startDeployment(context.Background(), &targetClients{Region: "us-east-1", CodeDeploy: cd}, req, target, &TargetResult{})
+	if err != nil {
+		t.Fatalf("startDeployment() returned error: %v", err)
+	}
+
+	created := cd.created[0]
+	if created.Revision != revision {
+		t.Errorf("revision = %+v, want the rollback revision", created.Revision)
+	}
+	description := aws.ToString(created.Description)
+	if !strings.Contains(description, "Rollback to the revision of deployment d-2") || !strings.Contains(description, jobTag(req.JobID)) {
+		t.Errorf("description %q does not name the rollback and its job", description)
+	}
+}
@@ -0,0 +1,154 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// errSecretRejected should be wrapped by callers of secretCache.use when
+// the service they talk to rejects a secret (for example with HTTP 401),
+// so the cache drops the value and fetches it again
+var errSecretRejected = errors.New("secret rejected")
+
+// secretRef identifies a secret value. JSONKey selects a field from a JSON
+// secret, and VersionStage selects a version (AWSCURRENT when empty).
+type secretRef struct {
+	SecretID     string
+	JSONKey      string
+	VersionStage string
+}
+
+func (r secretRef) String() string {
+	s := r.SecretID
+	if r.JSONKey != "" {
+		s += "#" + r.JSONKey
+	}
+	if r.VersionStage != "" {
+		s += "@" + r.VersionStage
+	}
+	return s
+}
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// secretCache keeps secret values across warm invocations, so we only call
+// Secrets Manager once per TTL. Every secret the handler uses goes here.
+type secretCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[secretRef]cachedSecret
+}
+
+func newSecretCache(ttl time.Duration) *secretCache {
+	return &secretCache{
+		ttl:     ttl,
+		entries: map[secretRef]cachedSecret{},
+	}
+}
+
+// Shared cache, created in Init() once the TTL is known
+var secrets *secretCache
+
+// get returns the secret value, fetching it if it is missing or expired
+func (c *secretCache) get(ctx context.Context, ref secretRef) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[ref]
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < c.ttl {
+		return entry.value, nil
+	}
+
+	value, err := fetchSecret(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[ref] = cachedSecret{value: value, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// invalidate drops a cached value, so the next get fetches it again
+func (c *secretCache) invalidate(ref secretRef) {
+	c.mu.Lock()
+	delete(c.entries, ref)
+	c.mu.Unlock()
+}
+
+// use calls fn with the secret value. If fn reports that the secret was
+// rejected, the secret may have been rotated, so we refresh it and try once more.
+func (c *secretCache) use(ctx context.Context, ref secretRef, fn func(value string) error) error {
+	value, err := c.get(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	err = fn(value)
+	if !errors.Is(err, errSecretRejected) {
+		return err
+	}
+
+	log.Printf("Secret %s was rejected, refreshing it", ref)
+	c.invalidate(ref)
+	value, err = c.get(ctx, ref)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
+
+// fetchSecret reads a secret from Secrets Manager. Binary secrets are used
+// as-is, and a JSON key picks one field out of a JSON secret.
+func fetchSecret(ctx context.Context, ref secretRef) (string, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(ref.SecretID),
+	}
+	if ref.VersionStage != "" {
+		input.VersionStage = aws.String(ref.VersionStage)
+	}
+
+	result, err := secretsManagerClient.GetSecretValue(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret value: %v", err)
+	}
+
+	var raw string
+	switch {
+	case result.SecretString != nil:
+		raw = *result.SecretString
+	case result.SecretBinary != nil:
+		raw = string(result.SecretBinary)
+	default:
+		return "", fmt.Errorf("secret %s has no value", ref)
+	}
+
+	if ref.JSONKey == "" {
+		return raw, nil
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %v", ref, err)
+	}
+	value, ok := fields[ref.JSONKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", ref, ref.JSONKey)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s key %q is not a string", ref, ref.JSONKey)
+	}
+	return s, nil
+}
@@ -0,0 +1,131 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/fakeaws"
+)
+
+// secretsTest points the deploy Lambda at a fake Secrets Manager
+func secretsTest(t *testing.T) *fakeaws.Server {
+	t.Helper()
+	fake, _ := localAWS(t)
+	e2eInit(t)
+	return fake
+}
+
+func TestFetchSecret(t *testing.T) {
+	fake := secretsTest(t)
+	fake.PutSecret("plain", "abc")
+	fake.PutSecret("github", `{"token": "abc", "user": "bot", "id": 7}`)
+	fake.PutSecretBinary("signing-key", []byte{0xde, 0xad, 0xbe, 0xef})
+	fake.PutSecret("rotated", `{"token": "new"}`)
+	fake.PutSecretVersion("rotated", "AWSPREVIOUS", `{"token": "old"}`)
+
+	tests := []struct {
+		name    string
+		ref     secretRef
+		want    string
+		wantErr string
+	}{
+		{name: "raw string", ref: secretRef{SecretID: "plain"}, want: "abc"},
+		{name: "JSON key", ref: secretRef{SecretID: "github", JSONKey: "token"}, want: "abc"},
+		{name: "binary", ref: secretRef{SecretID: "signing-key"}, want: "\xde\xad\xbe\xef"},
+		{name: "current stage", ref: secretRef{SecretID: "rotated", JSONKey: "token"}, want: "new"},
+		{name: "previous stage", ref: secretRef{SecretID: "rotated", JSONKey: "token", VersionStage: "AWSPREVIOUS"}, want: "old"},
+		{name: "missing key", ref: secretRef{SecretID: "github", JSONKey: "password"}, wantErr: `has no key "password"`},
+		{name: "key of a non-string", ref: secretRef{SecretID: "github", JSONKey: "id"}, wantErr: "is not a string"},
+		{name: "key of a non-JSON secret", ref: secretRef{SecretID: "plain", JSONKey: "token"}, wantErr: "is not a JSON object"},
+		{name: "missing stage", ref: secretRef{SecretID: "plain", VersionStage: "AWSPENDING"}, wantErr: "failed to get secret value"},
+		{name: "missing secret", ref: secretRef{SecretID: "nope"}, wantErr: "failed to get secret value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchSecret(context.Background(), tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fetchSecret() = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("fetchSecret() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretCacheExpires(t *testing.T) {
+	fake := secretsTest(t)
+	fake.PutSecret("github", `{"token": "abc"}`)
+	cache := newSecretCache(time.Minute)
+	ref := secretRef{SecretID: "github", JSONKey: "token"}
+
+	for range 3 {
+		if got, err := cache.get(context.Background(), ref); err != nil || got != "abc" {
+			t.Fatalf("get() = %q, %v, want abc", got, err)
+		}
+	}
+	if got := fake.Calls("GetSecretValue"); got != 1 {
+		t.Errorf("%d GetSecretValue calls, want one while the value is fresh", got)
+	}
+
+	// Once the TTL has passed, the rotated value is fetched
+	fake.PutSecret("github", `{"token": "def"}`)
+	cache.mu.Lock()
+	cache.entries[ref] = cachedSecret{value: "abc", fetchedAt: time.Now().Add(-2 * time.Minute)}
+	cache.mu.Unlock()
+	if got, err := cache.get(context.Background(), ref); err != nil || got != "def" {
+		t.Errorf("get() = %q, %v, want the rotated value def", got, err)
+	}
+	if got := fake.Calls("GetSecretValue"); got != 2 {
+		t.Errorf("%d GetSecretValue calls, want a second once the value expired", got)
+	}
+}
+
+func TestSecretCacheRefreshesRejectedSecret(t *testing.T) {
+	fake := secretsTest(t)
+	ref := secretRef{SecretID: "github", JSONKey: "token"}
+
+	// The cache holds a token that has since been rotated
+	fake.PutSecret("github", `{"token": "old"}`)
+	if _, err := secrets.get(context.Background(), ref); err != nil {
+		t.Fatalf("get() returned error: %v", err)
+	}
+	fake.PutSecret("github", `{"token": "new"}`)
+
+	accepted := "new"
+	var sent []string
+	send := func(token string) error {
+		sent = append(sent, token)
+		if token != accepted {
+			return fmt.Errorf("service returned 401: %w", errSecretRejected)
+		}
+		return nil
+	}
+	if err := secrets.use(context.Background(), ref, send); err != nil {
+		t.Fatalf("use() returned error: %v", err)
+	}
+	if strings.Join(sent, ",") != "old,new" {
+		t.Errorf("sent %v, want the cached token, then the refreshed one", sent)
+	}
+
+	// A token that is still rejected after the refresh is reported
+	accepted = "newer"
+	if err := secrets.use(context.Background(), ref, send); !errors.Is(err, errSecretRejected) {
+		t.Errorf("use() = %v, want the rejection", err)
+	}
+
+	// Other failures are not a reason to fetch the secret again
+	calls := fake.Calls("GetSecretValue")
+	err := secrets.use(context.Background(), ref, func(string) error { return errors.New("connection refused") })
+	if err == nil || fake.Calls("GetSecretValue") != calls {
+		t.Errorf("use() = %v after %d fetches, want the error and no refresh", err, fake.Calls("GetSecretValue")-calls)
+	}
+}
@@ -0,0 +1,325 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// BatchGetDeploymentTargets accepts at most 25 target IDs per call
+const batchGetDeploymentTargetsLimit = 25
+
+// We report at most this many failed instances, with this much of each
+// lifecycle event log, so the report and failure message stay readable
+const (
+	maxReportedInstanceFailures = 10
+	maxInstanceLogTailLength    = 1000
+)
+
+// Minimum healthy hosts types, named as CodeDeploy names them
+const (
+	minHealthyHostCount    = "HOST_COUNT"
+	minHealthyFleetPercent = "FLEET_PERCENT"
+)
+
+// minHealthyHosts is a floor on the hosts that have not failed, checked
+// on every poll. CodeDeploy's own minimum only throttles how many hosts it
+// deploys at once; this one stops the deployment once failures eat into it.
+type minHealthyHosts struct {
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+func (m *minHealthyHosts) validate() error {
+	switch m.Type {
+	case minHealthyHostCount:
+		if m.Value < 0 {
+			return fmt.Errorf("minHealthyHosts value must not be negative")
+		}
+	case minHealthyFleetPercent:
+		if m.Value < 0 || m.Value > 100 {
+			return fmt.Errorf("minHealthyHosts percentage must be between 0 and 100")
+		}
+	default:
+		return fmt.Errorf("minHealthyHosts type must be %s or %s, got %q", minHealthyHostCount, minHealthyFleetPercent, m.Type)
+	}
+	return nil
+}
+
+// required is the number of hosts that must stay healthy in a fleet
+func (m *minHealthyHosts) required(total int64) int64 {
+	if m.Type == minHealthyFleetPercent {
+		return (total*int64(m.Value) + 99) / 100
+	}
+	return int64(m.Value)
+}
+
+func (m *minHealthyHosts) String() string {
+	if m.Type == minHealthyFleetPercent {
+		return fmt.Sprintf("%d%%", m.Value)
+	}
+	return fmt.Sprintf("%d hosts", m.Value)
+}
+
+// instanceSummary counts the instances of a server deployment by status
+type instanceSummary struct {
+	Pending    int64 `json:"pending"`
+	InProgress int64 `json:"inProgress"`
+	Succeeded  int64 `json:"succeeded"`
+	Failed     int64 `json:"failed"`
+	Skipped    int64 `json:"skipped"`
+	Ready      int64 `json:"ready"`
+}
+
+func newInstanceSummary(overview *types.DeploymentOverview) *instanceSummary {
+	return &instanceSummary{
+		Pending:    overview.Pending,
+		InProgress: overview.InProgress,
+		Succeeded:  overview.Succeeded,
+		Failed:     overview.Failed,
+		Skipped:    overview.Skipped,
+		Ready:      overview.Ready,
+	}
+}
+
+func (s *instanceSummary) total() int64 {
+	return s.Pending + s.InProgress + s.Succeeded + s.Failed + s.Skipped + s.Ready
+}
+
+func (s *instanceSummary) String() string {
+	return fmt.Sprintf("%d pending, %d in progress, %d succeeded, %d failed, %d skipped",
+		s.Pending, s.InProgress, s.Succeeded, s.Failed, s.Skipped)
+}
+
+// instanceFailure is what CodeDeploy tells us about one failed instance
+type instanceFailure struct {
+	InstanceID     string `json:"instanceId"`
+	LifecycleEvent string `json:"lifecycleEvent,omitempty"`
+	ErrorCode      string `json:"errorCode,omitempty"`
+	ScriptName     string `json:"scriptName,omitempty"`
+	Message        string `json:"message,omitempty"`
+	LogTail        string `json:"logTail,omitempty"`
+}
+
+func (f instanceFailure) String() string {
+	s := f.InstanceID
+	if f.LifecycleEvent != "" {
+		s += " failed " + f.LifecycleEvent
+	}
+	if f.ScriptName != "" {
+		s += " in " + f.ScriptName
+	}
+	if f.Message != "" {
+		s += ": " + f.Message
+	}
+	return s
+}
+
+// watchServerDeployment returns the poll callback for monitorDeployment.
+// For server deployments it records instance progress on the result and
+// stops the deployment if the fleet drops below its healthy host floor.
+func watchServerDeployment(ctx context.Context, clients *targetClients, target deploymentTarget, result *TargetResult) func(*types.DeploymentInfo) error {
+	return func(info *types.DeploymentInfo) error {
+		if info.ComputePlatform != types.ComputePlatformServer || info.DeploymentOverview == nil {
+			return nil
+		}
+
+		summary := newInstanceSummary(info.DeploymentOverview)
+		result.Instances = summary
+		log.Printf("Instances for %s: %s", target, summary)
+
+		floor := target.MinHealthyHosts
+		if floor == nil {
+			return nil
+		}
+		total := summary.total()
+		healthy := total - summary.Failed
+		if healthy >= floor.required(total) {
+			return nil
+		}
+
+		deploymentID := aws.ToString(info.DeploymentId)
+		log.Printf("Only %d of %d hosts are healthy, below the minimum of %s, stopping deployment %s", healthy, total, floor, deploymentID)
+		_, err := clients.CodeDeploy.StopDeployment(ctx, &codedeploy.StopDeploymentInput{
+			DeploymentId:        aws.String(deploymentID),
+			AutoRollbackEnabled: aws.Bool(true),
+		})
+		if err != nil {
+			log.Printf("Warning: Failed to stop deployment %s: %v", deploymentID, err)
+		}
+		return fmt.Errorf("only %d of %d hosts are healthy, below the minimum of %s", healthy, total, floor)
+	}
+}
+
+// instanceFailures picks the failed instances out of a deployment's
+// failed targets, with the diagnostics of the lifecycle event each one
+// failed in
+func instanceFailures(targets []targetDiagnostics) []instanceFailure {
+	var failures []instanceFailure
+	for _, t := range targets {
+		if t.TargetType != string(types.DeploymentTargetTypeInstanceTarget) {
+			continue
+		}
+		if len(failures) == maxReportedInstanceFailures {
+			break
+		}
+		failure := instanceFailure{InstanceID: t.TargetID}
+		if event := t.failedEvent(); event != nil {
+			failure.LifecycleEvent = event.Name
+			failure.ErrorCode = event.ErrorCode
+			failure.ScriptName = event.ScriptName
+			failure.Message = event.Message
+			failure.LogTail = tail(event.LogTail, maxInstanceLogTailLength)
+		}
+		failures = append(failures, failure)
+	}
+	return failures
+}
+
+// tail keeps the end of a log, which is where a script's error usually is
+func tail(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return "..." + s[len(s)-max+3:]
+}
+
+// diagnoseServerFailure adds the failed instances among a failed server
+// deployment's failed targets to its result and error
+func diagnoseServerFailure(result *TargetResult, targets []targetDiagnostics, err error) error {
+	failures := instanceFailures(targets)
+	if len(failures) == 0 {
+		return err
+	}
+	result.FailedInstances = failures
+
+	var lines []string
+	for _, failure := range failures {
+		log.Printf("Instance %s", failure)
+		if failure.LogTail != "" {
+			log.Printf("Log tail for %s:\n%s", failure.InstanceID, failure.LogTail)
+		}
+		lines = append(lines, failure.String())
+	}
+	return fmt.Errorf("%v (failed instances: %s)", err, strings.Join(lines, "; "))
+}
+
+// The AppSpec names CodeDeploy looks for at the root of a bundle
+var appSpecNames = []string{"appspec.yml", "appspec.yaml", "appspec.json"}
+
+// validateAppSpec checks that a server deployment group's S3 bundle has an
+// AppSpec at its root. If it does not, the error includes a scaffold
+// generated from the bundle, ready to be filled in and committed. Other
+// compute platforms are not checked: a Lambda revision is often the AppSpec
+// itself, or a bundle CodeDeploy does not read.
+func validateAppSpec(ctx context.Context, clients *targetClients, target deploymentTarget, bundle *bundleInfo) error {
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get deployment group %s: %w", target.DeploymentGroupName, err)
+	}
+	if platform := group.DeploymentGroupInfo.ComputePlatform; platform != types.ComputePlatformServer {
+		log.Printf("Deployment group %s is on %s, skipping AppSpec check", target.DeploymentGroupName, platform)
+		return nil
+	}
+
+	archive, err := bundle.files()
+	if err != nil {
+		return err
+	}
+	if archive == nil {
+		log.Printf("Bundle was not inspected, skipping AppSpec check")
+		return nil
+	}
+
+	var files []string
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		for _, appSpec := range appSpecNames {
+			if strings.EqualFold(name, appSpec) {
+				return nil
+			}
+		}
+		if !file.FileInfo().IsDir() {
+			files = append(files, name)
+		}
+	}
+
+	scaffold := appSpecScaffold(target.ApplicationName, files)
+	return fmt.Errorf("bundle has no appspec.yml at its root. A starting point for this bundle:\n%s", scaffold)
+}
+
+// Hook scripts are matched to lifecycle events by name
+var scaffoldHooks = []struct {
+	event    string
+	keywords []string
+}{
+	{"ApplicationStop", []string{"stop"}},
+	{"BeforeInstall", []string{"before_install", "beforeinstall", "install_dependencies", "dependencies"}},
+	{"AfterInstall", []string{"after_install", "afterinstall", "configure"}},
+	{"ApplicationStart", []string{"start"}},
+	{"ValidateService", []string{"validate", "health"}},
+}
+
+// appSpecScaffold generates an appspec.yml for a server deployment, with
+// scripts in the bundle wired to the hooks their names suggest
+func appSpecScaffold(applicationName string, files []string) string {
+	var b strings.Builder
+	b.WriteString("version: 0.0\n")
+	b.WriteString("os: linux\n")
+	b.WriteString("files:\n")
+	b.WriteString("  - source: /\n")
+	fmt.Fprintf(&b, "    destination: /opt/%s\n", applicationName)
+
+	var scripts []string
+	for _, file := range files {
+		if strings.HasSuffix(file, ".sh") {
+			scripts = append(scripts, file)
+		}
+	}
+	sort.Strings(scripts)
+
+	hooks := map[string]string{}
+	for _, script := range scripts {
+		name := strings.ToLower(path.Base(script))
+		for _, hook := range scaffoldHooks {
+			if _, taken := hooks[hook.event]; taken {
+				continue
+			}
+			if containsAny(name, hook.keywords) {
+				hooks[hook.event] = script
+				break
+			}
+		}
+	}
+
+	b.WriteString("hooks:\n")
+	for _, hook := range scaffoldHooks {
+		script, ok := hooks[hook.event]
+		if !ok {
+			script = fmt.Sprintf("scripts/%s.sh", strings.ToLower(hook.event))
+		}
+		fmt.Fprintf(&b, "  %s:\n", hook.event)
+		fmt.Fprintf(&b, "    - location: %s\n", script)
+		b.WriteString("      timeout: 300\n")
+	}
+	return b.String()
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
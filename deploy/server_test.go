@@ -0,0 +1,213 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+func serverDeployment(overview types.DeploymentOverview) *types.DeploymentInfo {
+	return &types.DeploymentInfo{
+		DeploymentId:       aws.String("d-1"),
+		ComputePlatform:    types.ComputePlatformServer,
+		DeploymentOverview: &overview,
+	}
+}
+
+func TestWatchServerDeploymentRecordsInstances(t *testing.T) {
+	cd := &fakeCodeDeploy{}
+	result := &TargetResult{}
+	watch := watchServerDeployment(context.Background(), &targetClients{CodeDeploy: cd}, deploymentTarget{}, result)
+
+	if err := watch(serverDeployment(types.DeploymentOverview{Pending: 2, InProgress: 1, Succeeded: 3, Failed: 1})); err != nil {
+		t.Fatalf("watch() returned error without a floor: %v", err)
+	}
+	if result.Instances == nil || result.Instances.Succeeded != 3 || result.Instances.total() != 7 {
+		t.Errorf("Instances = %+v, want the deployment overview", result.Instances)
+	}
+	if len(cd.stopped) != 0 {
+		t.Errorf("stopped %v, want nothing stopped", cd.stopped)
+	}
+}
+
+func TestWatchServerDeploymentEnforcesMinHealthyHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		floor    minHealthyHosts
+		overview types.DeploymentOverview
+		stop     bool
+	}{
+		{"count met", minHealthyHosts{minHealthyHostCount, 8}, types.DeploymentOverview{Succeeded: 5, Pending: 3, Failed: 2}, false},
+		{"count breached", minHealthyHosts{minHealthyHostCount, 9}, types.DeploymentOverview{Succeeded: 5, Pending: 3, Failed: 2}, true},
+		{"percent met", minHealthyHosts{minHealthyFleetPercent, 75}, types.DeploymentOverview{Succeeded: 3, Failed: 1}, false},
+		{"percent rounds up", minHealthyHosts{minHealthyFleetPercent, 90}, types.DeploymentOverview{Succeeded: 9, Failed: 1}, false},
+		{"percent breached", minHealthyHosts{minHealthyFleetPercent, 90}, types.DeploymentOverview{Succeeded: 8, Failed: 2}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := &fakeCodeDeploy{}
+			target := deploymentTarget{MinHealthyHosts: &tt.floor}
+			watch := watchServerDeployment(context.Background(), &targetClients{CodeDeploy: cd}, target, &TargetResult{})
+
+			err := watch(serverDeployment(tt.overview))
+			if tt.stop {
+				if err == nil || len(cd.stopped) != 1 || cd.stopped[0] != "d-1" {
+					t.Errorf("watch() = %v with %v stopped, want d-1 stopped", err, cd.stopped)
+				}
+				return
+			}
+			if err != nil || len(cd.stopped) != 0 {
+				t.Errorf("watch() = %v with %v stopped, want the deployment to continue", err, cd.stopped)
+			}
+		})
+	}
+}
+
+func TestDiagnoseServerFailure(t *testing.T) {
+	cd := &fakeCodeDeploy{instances: map[string]*types.InstanceTarget{
+		"i-0abc": {
+			TargetId: aws.String("i-0abc"),
+			Status:   types.TargetStatusFailed,
+			LifecycleEvents: []types.LifecycleEvent{
+				{LifecycleEventName: aws.String("BeforeInstall"), Status: types.LifecycleEventStatusSucceeded},
+				{
+					LifecycleEventName: aws.String("ApplicationStart"),
+					Status:             types.LifecycleEventStatusFailed,
+					Diagnostics: &types.Diagnostics{
+						ErrorCode:  types.LifecycleErrorCodeScriptFailed,
+						ScriptName: aws.String("scripts/start_server.sh"),
+						Message:    aws.String("Script at specified location: scripts/start_server.sh run as user root failed with exit code 1"),
+						LogTail:    aws.String(strings.Repeat("x", 2000) + "port 8080 already in use"),
+					},
+				},
+			},
+		},
+	}}
+	defer func(saved *config.Config) { cfg = saved }(cfg)
+	cfg = &config.Config{}
+
+	for _, status := range []types.DeploymentStatus{types.DeploymentStatusFailed, types.DeploymentStatusInProgress} {
+		t.Run(string(status), func(t *testing.T) {
+			// A deployment stopped below its healthy host floor may still be
+			// in progress, and its failed instances are reported all the same
+			info := serverDeployment(types.DeploymentOverview{Succeeded: 3, Failed: 1})
+			info.Status = status
+			cd.deployments = map[string]*types.DeploymentInfo{"d-1": info}
+			listed := &countingCodeDeploy{fakeCodeDeploy: cd}
+			result := &TargetResult{Instances: &instanceSummary{Succeeded: 3, Failed: 1}}
+
+			err := diagnoseFailure(context.Background(), &targetClients{CodeDeploy: listed}, "job-1", deploymentTarget{}, "d-1", result, errors.New("deployment d-1 failed"))
+
+			if listed.listCalls != 1 {
+				t.Errorf("failed targets listed %d times, want once", listed.listCalls)
+			}
+			if len(result.FailedInstances) != 1 {
+				t.Fatalf("FailedInstances = %+v, want one", result.FailedInstances)
+			}
+			failure := result.FailedInstances[0]
+			if failure.InstanceID != "i-0abc" || failure.LifecycleEvent != "ApplicationStart" || failure.ScriptName != "scripts/start_server.sh" {
+				t.Errorf("failure = %+v, want i-0abc failing ApplicationStart", failure)
+			}
+			if len(failure.LogTail) != maxInstanceLogTailLength || !strings.HasSuffix(failure.LogTail, "port 8080 already in use") {
+				t.Errorf("log tail is %d bytes, want the last %d", len(failure.LogTail), maxInstanceLogTailLength)
+			}
+			if got := strings.Count(err.Error(), "i-0abc failed ApplicationStart in scripts/start_server.sh"); got != 1 {
+				t.Errorf("error %q names the failed instance %d times, want once", err, got)
+			}
+		})
+	}
+}
+
+// countingCodeDeploy counts the calls that list a deployment's targets
+type countingCodeDeploy struct {
+	*fakeCodeDeploy
+	listCalls int
+}
+
+func (c *countingCodeDeploy) ListDeploymentTargets(ctx context.Context, params *codedeploy.ListDeploymentTargetsInput, optFns ...func(*codedeploy.Options)) (*codedeploy.ListDeploymentTargetsOutput, error) {
+	c.listCalls++
+	return c.fakeCodeDeploy.ListDeploymentTargets(ctx, params, optFns...)
+}
+
+func TestValidateAppSpec(t *testing.T) {
+	cd := &fakeCodeDeploy{groups: map[string]*types.DeploymentGroupInfo{
+		"web/web-fleet": {ComputePlatform: types.ComputePlatformServer},
+	}}
+	clients := &targetClients{CodeDeploy: cd}
+	target := deploymentTarget{ApplicationName: "web", DeploymentGroupName: "web-fleet"}
+
+	withAppSpec := zipBundle(t, map[string]string{"appspec.yml": "version: 0.0", "app.jar": ""})
+	if err := validateAppSpec(context.Background(), clients, target, withAppSpec); err != nil {
+		t.Errorf("validateAppSpec() returned error for a bundle with an AppSpec: %v", err)
+	}
+
+	withoutAppSpec := zipBundle(t, map[string]string{
+		"app.jar":                 "",
+		"scripts/stop_server.sh":  "",
+		"scripts/start_server.sh": "",
+		"scripts/health_check.sh": "",
+	})
+	err := validateAppSpec(context.Background(), clients, target, withoutAppSpec)
+	if err == nil {
+		t.Fatal("validateAppSpec() returned no error for a bundle without an AppSpec")
+	}
+	for _, want := range []string{
+		"destination: /opt/web",
+		"ApplicationStop:\n    - location: scripts/stop_server.sh",
+		"ApplicationStart:\n    - location: scripts/start_server.sh",
+		"ValidateService:\n    - location: scripts/health_check.sh",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("scaffold does not contain %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateAppSpecChecksOnlyServerGroups(t *testing.T) {
+	cd := &fakeCodeDeploy{groups: map[string]*types.DeploymentGroupInfo{
+		"api/api-live": {ComputePlatform: types.ComputePlatformLambda},
+	}}
+	clients := &targetClients{CodeDeploy: cd}
+
+	// Lambda artifacts often have no root AppSpec, or are not zips at all
+	for name, bundle := range map[string]*bundleInfo{
+		"bundle without an AppSpec":  zipBundle(t, map[string]string{"bootstrap": ""}),
+		"artifact that is not a zip": {archiveErr: errors.New("artifact is not a zip")},
+	} {
+		if err := validateAppSpec(context.Background(), clients, deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-live"}, bundle); err != nil {
+			t.Errorf("validateAppSpec() of a Lambda group's %s returned error: %v", name, err)
+		}
+	}
+
+	// A group we cannot look up is not reported as a bundle without an AppSpec
+	err := validateAppSpec(context.Background(), clients, deploymentTarget{ApplicationName: "api", DeploymentGroupName: "api-gone"}, zipBundle(t, map[string]string{"bootstrap": ""}))
+	if err == nil || !strings.Contains(err.Error(), "DeploymentGroupDoesNotExistException") || strings.Contains(err.Error(), "appspec.yml") {
+		t.Errorf("validateAppSpec() = %v, want the lookup failure", err)
+	}
+}
+
+func TestLambdaBundleWithoutAppSpecDeploys(t *testing.T) {
+	fake, _ := localAWS(t)
+	fake.AddDeploymentGroup("api", "api-live", "Lambda")
+	fake.PutObject("artifacts", "build/lambda.zip", zipBytes(t, map[string]string{"bootstrap": "", "lambda_function.zip": ""}))
+	e2eInit(t)
+
+	var event CodePipelineEvent
+	event.CodePipelineJob.ID = "job-1"
+	event.CodePipelineJob.Data.InputArtifacts = []Artifact{{
+		Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "build/lambda.zip"}},
+	}}
+	if _, err := RunJob(context.Background(), event); err != nil {
+		t.Fatalf("RunJob() returned error: %v", err)
+	}
+	if job, _ := fake.Job("job-1"); job.Status != "Succeeded" {
+		t.Errorf("job = %+v, want a success", job)
+	}
+}
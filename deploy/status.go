@@ -0,0 +1,133 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// jobTagPattern finds the job ID that jobTag puts in a deployment's description
+var jobTagPattern = regexp.MustCompile(`\[codepipeline-job:([^\]]+)\]`)
+
+// StatusRequest asks for the state of a deployment group's latest
+// deployment, or of the given one. It is the request of a direct
+// invocation's "status" action.
+type StatusRequest struct {
+	TargetRef
+
+	DeploymentID string `json:"deploymentId,omitempty"`
+}
+
+// DeploymentStatus is a deployment as CodeDeploy reports it, with the job
+// that created it when it was one of ours
+type DeploymentStatus struct {
+	ApplicationName     string           `json:"applicationName"`
+	DeploymentGroupName string           `json:"deploymentGroupName"`
+	Region              string           `json:"region,omitempty"`
+	DeploymentID        string           `json:"deploymentId,omitempty"`
+	Status              string           `json:"status,omitempty"`
+	Creator             string           `json:"creator,omitempty"`
+	Description         string           `json:"description,omitempty"`
+	JobID               string           `json:"jobId,omitempty"`
+	CreateTime          *time.Time       `json:"createTime,omitempty"`
+	CompleteTime        *time.Time       `json:"completeTime,omitempty"`
+	ErrorCode           string           `json:"errorCode,omitempty"`
+	ErrorMessage        string           `json:"errorMessage,omitempty"`
+	Instances           *instanceSummary `json:"instances,omitempty"`
+
+	// LastSuccessfulDeploymentID is what is live in the group
+	LastSuccessfulDeploymentID string `json:"lastSuccessfulDeploymentId,omitempty"`
+}
+
+// Status returns the state of the group's latest deployment, or of the
+// requested one. A group that was never deployed has no deployment ID.
+func Status(ctx context.Context, req StatusRequest) (*DeploymentStatus, error) {
+	if awsCfgErr != nil {
+		return nil, awsCfgErr
+	}
+	if cfgErr != nil {
+		return nil, cfgErr
+	}
+	if req.ApplicationName == "" || req.DeploymentGroupName == "" {
+		return nil, fmt.Errorf("status needs an applicationName and a deploymentGroupName")
+	}
+
+	target := findTarget(ctx, req.TargetRef)
+	clients, err := targetClientCache.forTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment group: %v", err)
+	}
+
+	status := &DeploymentStatus{
+		ApplicationName:     target.ApplicationName,
+		DeploymentGroupName: target.DeploymentGroupName,
+		Region:              clients.Region,
+	}
+	if last := group.DeploymentGroupInfo.LastSuccessfulDeployment; last != nil {
+		status.LastSuccessfulDeploymentID = aws.ToString(last.DeploymentId)
+	}
+
+	deploymentID := req.DeploymentID
+	if deploymentID == "" {
+		last := group.DeploymentGroupInfo.LastAttemptedDeployment
+		if last == nil || last.DeploymentId == nil {
+			log.Printf("%s has no deployments", target)
+			return status, nil
+		}
+		deploymentID = *last.DeploymentId
+	}
+
+	output, err := clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+		DeploymentId: aws.String(deploymentID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment %s: %v", deploymentID, err)
+	}
+	info := output.DeploymentInfo
+	if aws.ToString(info.ApplicationName) != target.ApplicationName || aws.ToString(info.DeploymentGroupName) != target.DeploymentGroupName {
+		return nil, fmt.Errorf("deployment %s is not a deployment of %s", deploymentID, target)
+	}
+	status.setDeployment(info)
+	return status, nil
+}
+
+// setDeployment fills in the status from the deployment's info
+func (s *DeploymentStatus) setDeployment(info *types.DeploymentInfo) {
+	s.DeploymentID = aws.ToString(info.DeploymentId)
+	s.Status = string(info.Status)
+	s.Creator = string(info.Creator)
+	s.Description = aws.ToString(info.Description)
+	s.JobID = deploymentJobID(info)
+	s.CreateTime = info.CreateTime
+	s.CompleteTime = info.CompleteTime
+	if e := info.ErrorInformation; e != nil {
+		s.ErrorCode = string(e.Code)
+		s.ErrorMessage = aws.ToString(e.Message)
+	}
+	if info.DeploymentOverview != nil {
+		s.Instances = newInstanceSummary(info.DeploymentOverview)
+	}
+}
+
+// deploymentJobID returns the ID of the job that created the deployment,
+// or "" if it was created some other way
+func deploymentJobID(info *types.DeploymentInfo) string {
+	if m := jobTagPattern.FindStringSubmatch(aws.ToString(info.Description)); m != nil {
+		return m[1]
+	}
+	return ""
+}
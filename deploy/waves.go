@@ -0,0 +1,583 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+)
+
+// Target statuses recorded in the report
+const (
+	targetSucceeded  = "Succeeded"
+	targetUnchanged  = "Unchanged"
+	targetFailed     = "Failed"
+	targetRolledBack = "RolledBack"
+)
+
+// wavePlan is an ordered list of waves. The targets in a wave deploy in
+// parallel, and the next wave only starts once the current one has
+// succeeded, baked and passed its health checks.
+type wavePlan struct {
+	Waves []wave `json:"waves"`
+
+	// RollbackOnFailure redeploys the previous revision to every target
+	// that had already been deployed when the plan halts
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+}
+
+type wave struct {
+	Name    string             `json:"name,omitempty"`
+	Targets []deploymentTarget `json:"targets"`
+
+	// BakeTime is how long to wait after the wave deploys before checking
+	// its health again and moving on, e.g. "10m"
+	BakeTime duration `json:"bakeTime,omitempty"`
+
+	// HealthCheckURL is checked after the bake, on top of each target's
+	// own application health check
+	HealthCheckURL string             `json:"healthCheckUrl,omitempty"`
+	HealthCheck    *lambdaHealthCheck `json:"healthCheck,omitempty"`
+}
+
+// duration reads Go duration strings such as "90s" from JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// singleTargetPlan is the plan for a pipeline that deploys one group
+func singleTargetPlan(target deploymentTarget) wavePlan {
+	return wavePlan{Waves: []wave{{Targets: []deploymentTarget{target}}}}
+}
+
+// parseWavePlan reads and validates a plan from JSON
+func parseWavePlan(raw string) (wavePlan, error) {
+	var plan wavePlan
+	if err := json.Unmarshal([]byte(raw), &plan); err != nil {
+		return plan, fmt.Errorf("invalid wave plan: %v", err)
+	}
+	return plan, plan.validate()
+}
+
+func (p wavePlan) validate() error {
+	if len(p.Waves) == 0 {
+		return fmt.Errorf("wave plan has no waves")
+	}
+	seen := map[string]bool{}
+	for i, w := range p.Waves {
+		if len(w.Targets) == 0 {
+			return fmt.Errorf("wave %s has no targets", w.label(i))
+		}
+		if w.HealthCheck != nil {
+			if err := w.HealthCheck.validate(); err != nil {
+				return fmt.Errorf("wave %s: %v", w.label(i), err)
+			}
+		}
+		for _, t := range w.Targets {
+			if t.ApplicationName == "" || t.DeploymentGroupName == "" {
+				return fmt.Errorf("wave %s has a target without applicationName and deploymentGroupName", w.label(i))
+			}
+			if t.RoleARN != "" && !strings.HasPrefix(t.RoleARN, "arn:") {
+				return fmt.Errorf("target %s has an invalid roleArn %q", t, t.RoleARN)
+			}
+			if t.ExternalID != "" && t.RoleARN == "" {
+				return fmt.Errorf("target %s has an externalId but no roleArn", t)
+			}
+			if t.RoleARN != "" && t.ArtifactBucket == "" && t.Platform != platformECS {
+				return fmt.Errorf("target %s has a roleArn but no artifactBucket its account can read", t)
+			}
+			for _, check := range []*lambdaHealthCheck{t.HealthCheck, t.AppHealthCheck} {
+				if check == nil {
+					continue
+				}
+				if err := check.validate(); err != nil {
+					return fmt.Errorf("target %s: %v", t, err)
+				}
+			}
+			if t.MinHealthyHosts != nil {
+				if err := t.MinHealthyHosts.validate(); err != nil {
+					return fmt.Errorf("target %s: %v", t, err)
+				}
+			}
+			switch t.Platform {
+			case "":
+			case platformECS:
+				if err := t.ECS.validate(); err != nil {
+					return fmt.Errorf("target %s: %v", t, err)
+				}
+			default:
+				return fmt.Errorf("target %s has unknown platform %q", t, t.Platform)
+			}
+			key := t.String() + " " + t.RoleARN
+			if seen[key] {
+				return fmt.Errorf("deployment group %s appears more than once in the wave plan", t)
+			}
+			seen[key] = true
+		}
+	}
+
+	// The continuation token carries every target from one invocation to
+	// the next, and CodePipeline caps its length
+	if n := p.maxContinuationLength(); n > maxContinuationTokenLength {
+		return fmt.Errorf("wave plan has too many targets: tracking them across invocations needs %d characters, CodePipeline allows %d", n, maxContinuationTokenLength)
+	}
+	return nil
+}
+
+// targets lists every target of the plan
+func (p wavePlan) targets() []deploymentTarget {
+	var targets []deploymentTarget
+	for _, w := range p.Waves {
+		targets = append(targets, w.Targets...)
+	}
+	return targets
+}
+
+// label names a wave in logs and reports
+func (w wave) label(index int) string {
+	if w.Name != "" {
+		return w.Name
+	}
+	return fmt.Sprintf("%d", index+1)
+}
+
+// deployRequest is what every target deployment needs from the job
+type deployRequest struct {
+	JobID        string
+	S3BucketName string
+	S3ObjectKey  string
+	Bundle       *bundleInfo
+
+	// Revision, when set, is deployed as it is instead of the artifact.
+	// Rollbacks use it to redeploy an earlier deployment's revision.
+	Revision *types.RevisionLocation
+
+	// Description replaces the CodePipeline job in the deployment's
+	// description for deployments made outside a pipeline
+	Description string
+
+	// DryRun plans the deployment without registering or creating anything
+	DryRun bool
+
+	// SourceBranch is the branch the revision was built from, if known
+	SourceBranch string
+}
+
+// TargetResult records how the deployment to one group went
+type TargetResult struct {
+	Wave                 string             `json:"wave"`
+	ApplicationName      string             `json:"applicationName"`
+	DeploymentGroupName  string             `json:"deploymentGroupName"`
+	Region               string             `json:"region,omitempty"`
+	DeploymentID         string             `json:"deploymentId,omitempty"`
+	TaskDefinitionArn    string             `json:"taskDefinitionArn,omitempty"`
+	Status               string             `json:"status"`
+	Message              string             `json:"message,omitempty"`
+	Duration             string             `json:"duration"`
+	Validations          []ValidationResult `json:"validations"`
+	RollbackDeploymentID string             `json:"rollbackDeploymentId,omitempty"`
+
+	// Server deployments report their instances, and which ones failed
+	Instances       *instanceSummary  `json:"instances,omitempty"`
+	FailedInstances []instanceFailure `json:"failedInstances,omitempty"`
+
+	// Diagnostics is where the diagnostic bundle of a failed deployment
+	// was written
+	Diagnostics string `json:"diagnostics,omitempty"`
+
+	// previousDeploymentID is what the group ran before, kept for
+	// rollback through the same clients the deployment used
+	previousDeploymentID string
+	clients              *targetClients
+
+	// waveIndex and targetIndex place the target in the plan
+	waveIndex, targetIndex int
+}
+
+// label names the target in logs and failure messages
+func (r *TargetResult) label() string {
+	s := r.ApplicationName + "/" + r.DeploymentGroupName
+	if r.Region != "" {
+		s += "@" + r.Region
+	}
+	return s
+}
+
+// runPlan carries the plan forward by one step and records every target's
+// result in the report. Each invocation deploys one wave, or checks on the
+// bake of the wave it deployed, and returns errWaveInProgress to have
+// CodePipeline invoke us again for the rest, so no invocation outlives the
+// Lambda timeout. It halts at the first wave that fails and, if the plan
+// asks for it, rolls back the targets that were already deployed.
+func runPlan(ctx context.Context, req deployRequest, plan wavePlan, continuation jobContinuation, report *DeploymentReport) error {
+	done, err := continuation.restoreTargets(plan)
+	if err != nil {
+		return err
+	}
+	report.Targets = append(report.Targets, done...)
+
+	i := continuation.Wave
+	w := plan.Waves[i]
+	name := w.label(i)
+
+	if continuation.BakeUntil == nil {
+		results := deployWave(ctx, req, plan, i, report)
+		var failed []string
+		for _, result := range results {
+			report.Targets = append(report.Targets, result)
+			done = append(done, result)
+			if result.Status == targetFailed {
+				failed = append(failed, fmt.Sprintf("%s: %s", result.label(), result.Message))
+			}
+		}
+		if len(failed) > 0 {
+			return haltPlan(ctx, req.JobID, plan, done, fmt.Errorf("wave %s failed: %s", name, strings.Join(failed, "; ")))
+		}
+
+		if w.BakeTime > 0 {
+			until := time.Now().Add(time.Duration(w.BakeTime))
+			continuation.BakeUntil = &until
+			log.Printf("Baking wave %s until %s", name, until.Format(time.RFC3339))
+			return continuation.continueWith(done, fmt.Sprintf("Wave %s deployed, baking until %s", name, until.Format(time.RFC3339)))
+		}
+	} else if wait := time.Until(*continuation.BakeUntil); wait > 0 {
+		// We sleep through the end of a bake here, and hand longer ones
+		// back to CodePipeline as we do with change freezes
+		if wait > bakePollInterval {
+			log.Printf("Wave %s is baking for another %v, checking again in %v", name, wait.Round(time.Second), bakePollInterval)
+			if err := sleep(ctx, bakePollInterval); err != nil {
+				return fmt.Errorf("wave %s bake interrupted: %v", name, err)
+			}
+			return continuation.continueWith(done, fmt.Sprintf("Wave %s is baking until %s", name, continuation.BakeUntil.Format(time.RFC3339)))
+		}
+		log.Printf("Wave %s is baking for another %v", name, wait.Round(time.Second))
+		if err := sleep(ctx, wait); err != nil {
+			return fmt.Errorf("wave %s bake interrupted: %v", name, err)
+		}
+	}
+
+	if err := checkWaveHealth(ctx, w, name, report); err != nil {
+		return haltPlan(ctx, req.JobID, plan, done, err)
+	}
+	if i+1 == len(plan.Waves) {
+		return nil
+	}
+
+	next := jobContinuation{Wave: i + 1}
+	return next.continueWith(done, fmt.Sprintf("Wave %s done, wave %s is next", name, plan.Waves[i+1].label(i+1)))
+}
+
+// deployWave deploys to the targets of the plan's ith wave in parallel
+func deployWave(ctx context.Context, req deployRequest, plan wavePlan, i int, report *DeploymentReport) []*TargetResult {
+	w := plan.Waves[i]
+	name := w.label(i)
+	log.Printf("Starting wave %s with %d targets", name, len(w.Targets))
+	waveStart := time.Now()
+
+	results := make([]*TargetResult, len(w.Targets))
+	var wg sync.WaitGroup
+	for j, target := range w.Targets {
+		wg.Add(1)
+		go func(j int, target deploymentTarget) {
+			defer wg.Done()
+			results[j] = deployToTarget(ctx, req, target, name, plan.RollbackOnFailure)
+			results[j].waveIndex = i
+			results[j].targetIndex = j
+		}(j, target)
+	}
+	wg.Wait()
+
+	report.addPhase("wave "+name, time.Since(waveStart))
+	return results
+}
+
+// haltPlan stops the plan at err and, if the plan asks for it, rolls back
+// the targets it deployed, in this invocation or earlier ones
+func haltPlan(ctx context.Context, jobID string, plan wavePlan, results []*TargetResult, err error) error {
+	log.Printf("Halting wave plan: %v", err)
+	if !plan.RollbackOnFailure {
+		return err
+	}
+
+	var deployed []*TargetResult
+	for _, result := range results {
+		if result.Status != targetSucceeded {
+			continue
+		}
+		if result.clients == nil {
+			clients, err := targetClientCache.forTarget(ctx, plan.Waves[result.waveIndex].Targets[result.targetIndex])
+			if err != nil {
+				log.Printf("Rollback of %s failed: %v", result.label(), err)
+				result.Message = fmt.Sprintf("rollback failed: %v", err)
+				continue
+			}
+			result.clients = clients
+		}
+		deployed = append(deployed, result)
+	}
+	rollbackTargets(ctx, jobID, deployed)
+	return err
+}
+
+// checkWaveHealth checks the wave's health again once its bake is over
+func checkWaveHealth(ctx context.Context, w wave, name string, report *DeploymentReport) error {
+	// Without a bake there is nothing new to check, since every target
+	// has just passed its post-deployment validation
+	if w.BakeTime == 0 && w.HealthCheckURL == "" && w.HealthCheck == nil {
+		return nil
+	}
+
+	checkStart := time.Now()
+	var failures []string
+	for _, target := range w.Targets {
+		if err := ValidateApplicationHealth(ctx, target.AppHealthCheckURL); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", target, err))
+		}
+		if target.AppHealthCheck == nil {
+			continue
+		}
+		clients, err := targetClientCache.forTarget(ctx, target)
+		if err == nil {
+			err = target.AppHealthCheck.run(ctx, clients.Lambda)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", target, err))
+		}
+	}
+	if err := ValidateApplicationHealth(ctx, w.HealthCheckURL); err != nil {
+		failures = append(failures, fmt.Sprintf("wave health check: %v", err))
+	}
+	if err := w.HealthCheck.run(ctx, targetClientCache.local.Lambda); err != nil {
+		failures = append(failures, fmt.Sprintf("wave health check: %v", err))
+	}
+
+	var err error
+	if len(failures) > 0 {
+		err = fmt.Errorf("wave %s failed health checks after bake: %s", name, strings.Join(failures, "; "))
+	}
+	report.addValidation("wave "+name+" health", err, time.Since(checkStart))
+	return err
+}
+
+// deployToTarget runs the full deployment flow against one group. Errors
+// are recorded on the result rather than reported, since the plan decides
+// what the job's outcome is.
+func deployToTarget(ctx context.Context, req deployRequest, target deploymentTarget, waveName string, captureRevision bool) *TargetResult {
+	start := time.Now()
+	result := &TargetResult{
+		Wave:                waveName,
+		ApplicationName:     target.ApplicationName,
+		DeploymentGroupName: target.DeploymentGroupName,
+		Region:              target.Region,
+		Validations:         []ValidationResult{},
+	}
+	finish := func(status string, err error) *TargetResult {
+		result.Status = status
+		if err != nil {
+			result.Message = err.Error()
+		}
+		result.Duration = time.Since(start).Round(time.Millisecond).String()
+		return result
+	}
+
+	// Targets in other regions and accounts get their own clients
+	clients, err := targetClientCache.forTarget(ctx, target)
+	if err != nil {
+		return finish(targetFailed, err)
+	}
+	result.clients = clients
+
+	if captureRevision {
+		previous, err := liveDeploymentID(ctx, clients, target)
+		if err != nil {
+			log.Printf("Warning: Could not record the live revision of %s for rollback: %v", target, err)
+		}
+		result.previousDeploymentID = previous
+	}
+
+	// If an earlier delivery of this job already created a deployment,
+	// we resume monitoring it instead of creating a duplicate
+	deploymentID, err := findDeploymentForJob(ctx, clients, target.ApplicationName, target.DeploymentGroupName, req.JobID)
+	if err != nil {
+		log.Printf("Warning: Could not check for an existing deployment for job %s: %v", req.JobID, err)
+	} else if deploymentID != "" {
+		log.Printf("Found existing deployment %s for job %s, resuming monitoring", deploymentID, req.JobID)
+	}
+
+	// A re-run with the same artifact does not need another canary
+	if deploymentID == "" && target.SkipUnchangedRevisions {
+		liveDeploymentID, err := findLiveRevision(ctx, clients, target.ApplicationName, target.DeploymentGroupName, req.Bundle)
+		if err != nil {
+			log.Printf("Warning: Could not compare with the live revision: %v", err)
+		} else if liveDeploymentID != "" {
+			log.Printf("Revision is already live from deployment %s, skipping deployment", liveDeploymentID)
+			result.DeploymentID = liveDeploymentID
+			return finish(targetUnchanged, nil)
+		}
+	}
+
+	// Pipelines sharing the group take turns, and we hold the group's
+	// lease until the deployment and its validation are done
+	lease, err := acquireDeploymentLease(ctx, target, req.JobID)
+	if err != nil {
+		return finish(targetFailed, err)
+	}
+	if lease != nil {
+		// Losing the lease cancels the deployment's monitoring and
+		// validation, and fails the target
+		var lost context.CancelCauseFunc
+		ctx, lost = context.WithCancelCause(ctx)
+		stop := lease.keepAlive(ctx, lost)
+		defer func() {
+			stop()
+			lost(nil)
+			lease.release(context.WithoutCancel(ctx))
+		}()
+	}
+
+	if deploymentID == "" {
+		staged, err := stageArtifact(ctx, req, target, clients)
+		if err != nil {
+			return finish(targetFailed, err)
+		}
+		deploymentID, err = startDeployment(ctx, clients, staged, target, result)
+		if err != nil {
+			return finish(targetFailed, err)
+		}
+	}
+	result.DeploymentID = deploymentID
+
+	// Monitor the deployment until completion or timeout, following the
+	// instances of server deployments as they go
+	err = monitorDeployment(ctx, clients, deploymentID, watchServerDeployment(ctx, clients, target, result))
+	if lost := leaseLost(ctx); lost != nil {
+		return finish(targetFailed, fmt.Errorf("stopped following deployment %s: %v", deploymentID, lost))
+	}
+	if err != nil {
+		log.Printf("Deployment monitoring failed: %v", err)
+		err = diagnoseFailure(ctx, clients, req.JobID, target, deploymentID, result, err)
+		return finish(targetFailed, fmt.Errorf("deployment monitoring failed: %v", err))
+	}
+
+	// Run post-deployment validation
+	phaseStart := time.Now()
+	err = runPostDeploymentValidation(ctx, clients, target, deploymentID)
+	result.Validations = append(result.Validations, newValidationResult("post-deployment", err, time.Since(phaseStart)))
+	if lost := leaseLost(ctx); lost != nil {
+		return finish(targetFailed, fmt.Errorf("stopped validating deployment %s: %v", deploymentID, lost))
+	}
+	if err != nil {
+		log.Printf("Post-deployment validation failed: %v", err)
+		return finish(targetFailed, fmt.Errorf("post-deployment validation failed: %v", err))
+	}
+
+	return finish(targetSucceeded, nil)
+}
+
+// liveDeploymentID returns the group's last successful deployment, or ""
+// if it has never deployed successfully
+func liveDeploymentID(ctx context.Context, clients *targetClients, target deploymentTarget) (string, error) {
+	group, err := clients.CodeDeploy.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String(target.ApplicationName),
+		DeploymentGroupName: aws.String(target.DeploymentGroupName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment group: %v", err)
+	}
+
+	last := group.DeploymentGroupInfo.LastSuccessfulDeployment
+	if last == nil || last.DeploymentId == nil {
+		return "", nil
+	}
+	return *last.DeploymentId, nil
+}
+
+// rollbackTargets redeploys the previous revision to each target in
+// parallel, pointed at the version our deployment made live as Rollback
+// does. Failures are logged and recorded, since the job has already failed.
+func rollbackTargets(ctx context.Context, jobID string, targets []*TargetResult) {
+	var wg sync.WaitGroup
+	for _, result := range targets {
+		if result.previousDeploymentID == "" {
+			log.Printf("No previous revision for %s, cannot roll back", result.label())
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *TargetResult) {
+			defer wg.Done()
+			log.Printf("Rolling back %s", result.label())
+
+			revision, err := targetRollbackRevision(ctx, result)
+			if err != nil {
+				log.Printf("Rollback of %s failed: %v", result.label(), err)
+				result.Message = fmt.Sprintf("rollback failed: %v", err)
+				return
+			}
+
+			var deploymentID string
+			err = newRetryPolicy(cfg.Retry).do(ctx, "CreateDeployment", func(ctx context.Context) error {
+				resp, err := result.clients.CodeDeploy.CreateDeployment(ctx, &codedeploy.CreateDeploymentInput{
+					ApplicationName:     aws.String(result.ApplicationName),
+					DeploymentGroupName: aws.String(result.DeploymentGroupName),
+					Revision:            revision,
+					Description:         aws.String(fmt.Sprintf("Rollback after CodePipeline job %s failed", jobID)),
+				})
+				if err != nil {
+					return err
+				}
+				deploymentID = *resp.DeploymentId
+				return nil
+			})
+			if err == nil {
+				result.RollbackDeploymentID = deploymentID
+				err = monitorDeployment(ctx, result.clients, deploymentID, nil)
+			}
+			if err != nil {
+				log.Printf("Rollback of %s failed: %v", result.label(), err)
+				result.Message = fmt.Sprintf("rollback failed: %v", err)
+				return
+			}
+			result.Status = targetRolledBack
+		}(result)
+	}
+	wg.Wait()
+}
+
+// targetRollbackRevision is the revision that rolls the target back from
+// the deployment we made to the one it replaced
+func targetRollbackRevision(ctx context.Context, result *TargetResult) (*types.RevisionLocation, error) {
+	var infos [2]*types.DeploymentInfo
+	for i, id := range []string{result.DeploymentID, result.previousDeploymentID} {
+		output, err := result.clients.CodeDeploy.GetDeployment(ctx, &codedeploy.GetDeploymentInput{
+			DeploymentId: aws.String(id),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment %s: %v", id, err)
+		}
+		infos[i] = output.DeploymentInfo
+	}
+	return rollbackRevision(ctx, result.clients.S3, infos[0], infos[1])
+}
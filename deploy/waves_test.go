@@ -0,0 +1,177 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/30Piraten/pipeline/config"
+	"github.com/30Piraten/pipeline/fakeaws"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// waveJob runs job-1 once, with the continuation token CodePipeline would
+// have handed back
+func waveJob(t *testing.T, fake *fakeaws.Server, token string) (*DeploymentReport, fakeaws.Job, error) {
+	t.Helper()
+	var event CodePipelineEvent
+	event.CodePipelineJob.ID = "job-1"
+	event.CodePipelineJob.Data.ContinuationToken = token
+	event.CodePipelineJob.Data.InputArtifacts = []Artifact{{
+		Location: Location{Type: "S3", S3Location: S3Location{BucketName: "artifacts", ObjectKey: "build/bundle.zip"}},
+	}}
+	report, err := RunJob(context.Background(), event)
+	job, _ := fake.Job("job-1")
+	return report, job, err
+}
+
+func waveTest(t *testing.T, plan string) *fakeaws.Server {
+	t.Helper()
+	fake, _ := localAWS(t)
+	fake.PutObject("artifacts", "build/bundle.zip", zipBytes(t, map[string]string{"appspec.yml": "version: 0.0\nos: linux\n"}))
+	for _, group := range []string{"api-canary", "api-live", "api-eu"} {
+		fake.SetScenario("api", group, fakeaws.Scenario{Instances: []string{"i-1"}})
+	}
+	t.Setenv("WAVE_PLAN", plan)
+	e2eInit(t)
+	return fake
+}
+
+func TestWavePlanContinuesAcrossInvocations(t *testing.T) {
+	fake := waveTest(t, `{"waves": [
+		{"name": "canary", "bakeTime": "1ms", "targets": [{"applicationName": "api", "deploymentGroupName": "api-canary"}]},
+		{"name": "rest", "targets": [{"applicationName": "api", "deploymentGroupName": "api-live"}, {"applicationName": "api", "deploymentGroupName": "api-eu"}]}]}`)
+
+	// The canary deploys and starts baking, then the bake ends and the job
+	// moves on to the next wave, which finishes the job
+	_, job, err := waveJob(t, fake, "")
+	if err != nil || job.Status != "InProgress" || !strings.HasPrefix(job.Summary, "Wave canary deployed, baking until") {
+		t.Fatalf("job = %+v, err = %v, want it handed back to bake", job, err)
+	}
+	_, job, err = waveJob(t, fake, job.ContinuationToken)
+	if err != nil || job.Status != "InProgress" || job.Summary != "Wave canary done, wave rest is next" {
+		t.Fatalf("job = %+v, err = %v, want it handed back for the next wave", job, err)
+	}
+	if got := fake.Calls("CreateDeployment"); got != 1 {
+		t.Errorf("%d deployments created before the second wave, want the canary's", got)
+	}
+
+	report, job, err := waveJob(t, fake, job.ContinuationToken)
+	if err != nil || job.Status != "Succeeded" {
+		t.Fatalf("job = %+v, err = %v, want a success", job, err)
+	}
+	if len(report.Targets) != 3 || report.Targets[0].DeploymentGroupName != "api-canary" || report.Targets[0].DeploymentID == "" {
+		t.Errorf("report targets = %+v, want the canary's carried over and both of the second wave", report.Targets)
+	}
+	if got := fake.Calls("CreateDeployment"); got != 3 {
+		t.Errorf("%d deployments created, want one per target", got)
+	}
+}
+
+func TestWaveBakeIsHandedBack(t *testing.T) {
+	defer func(interval time.Duration) { bakePollInterval = interval }(bakePollInterval)
+	bakePollInterval = time.Millisecond
+
+	fake := waveTest(t, `{"waves": [
+		{"bakeTime": "1h", "targets": [{"applicationName": "api", "deploymentGroupName": "api-canary"}]},
+		{"targets": [{"applicationName": "api", "deploymentGroupName": "api-live"}]}]}`)
+
+	_, job, err := waveJob(t, fake, "")
+	if err != nil || job.Status != "InProgress" {
+		t.Fatalf("job = %+v, err = %v, want it handed back", job, err)
+	}
+	baking := parseContinuation(job.ContinuationToken)
+	if baking.BakeUntil == nil || time.Until(*baking.BakeUntil) < 59*time.Minute || len(baking.Targets) != 1 {
+		t.Fatalf("continuation = %s, want the canary baking for an hour", job.ContinuationToken)
+	}
+
+	// A bake with time left hands the job back again without moving on
+	_, job, err = waveJob(t, fake, job.ContinuationToken)
+	if err != nil || job.Status != "InProgress" {
+		t.Fatalf("job = %+v, err = %v, want it handed back", job, err)
+	}
+	if again := parseContinuation(job.ContinuationToken); again.Wave != 0 || again.BakeUntil == nil || !again.BakeUntil.Equal(*baking.BakeUntil) {
+		t.Errorf("continuation = %s, want the same bake", job.ContinuationToken)
+	}
+	if got := fake.Calls("CreateDeployment"); got != 1 {
+		t.Errorf("%d deployments created, want only the canary's", got)
+	}
+}
+
+func TestWavePlanRejectsPlansTooLargeToContinue(t *testing.T) {
+	plan := wavePlan{Waves: []wave{{}}}
+	for i := range 40 {
+		plan.Waves[0].Targets = append(plan.Waves[0].Targets, deploymentTarget{ApplicationName: "api", DeploymentGroupName: fmt.Sprintf("group-%d", i)})
+	}
+	if err := plan.validate(); err == nil || !strings.Contains(err.Error(), "too many targets") {
+		t.Errorf("validate() = %v, want a plan too large for a continuation token rejected", err)
+	}
+}
+
+func TestWavePlanHaltsAtFailedWave(t *testing.T) {
+	fake := waveTest(t, `{"rollbackOnFailure": true, "waves": [
+		{"name": "first", "targets": [{"applicationName": "api", "deploymentGroupName": "api-canary"}, {"applicationName": "api", "deploymentGroupName": "api-live"}]},
+		{"name": "second", "targets": [{"applicationName": "api", "deploymentGroupName": "api-eu"}]}]}`)
+	fake.SetScenario("api", "api-live", fakeaws.Scenario{Outcome: fakeaws.StatusFailed, Instances: []string{"i-1"}, FailedInstance: "i-1"})
+
+	report, job, err := waveJob(t, fake, "")
+	if err == nil || job.Status != "Failed" || !strings.Contains(job.FailureMessage, "wave first failed") {
+		t.Fatalf("job = %+v, err = %v, want the first wave to fail it", job, err)
+	}
+	if job.ContinuationToken != "" {
+		t.Errorf("continuation token = %s, want none once the plan halts", job.ContinuationToken)
+	}
+	// Neither group had a revision to go back to, so nothing is rolled back
+	if got := fake.Calls("CreateDeployment"); got != 2 {
+		t.Errorf("%d deployments created, want the first wave's only", got)
+	}
+	if len(report.Targets) != 2 {
+		t.Errorf("report targets = %+v, want the first wave's", report.Targets)
+	}
+}
+
+func TestHaltPlanRollsBackEarlierWaves(t *testing.T) {
+	defer func(saved *config.Config) { cfg = saved }(cfg)
+	cfg = &config.Config{
+		MaxDeploymentWaitTime: time.Minute,
+		Retry:                 config.RetryConfig{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	cd := rollbackCodeDeploy()
+	clients := &targetClients{Region: "us-east-1", CodeDeploy: cd}
+	plan := wavePlan{RollbackOnFailure: true, Waves: []wave{
+		{Targets: []deploymentTarget{{ApplicationName: "api", DeploymentGroupName: "api-live"}}},
+		{Targets: []deploymentTarget{{ApplicationName: "api", DeploymentGroupName: "api-eu"}}},
+	}}
+
+	// The first wave made d-4 live over d-2 in an earlier invocation, and
+	// the second wave has just failed
+	deployed := &TargetResult{ApplicationName: "api", DeploymentGroupName: "api-live", Status: targetSucceeded,
+		DeploymentID: "d-4", previousDeploymentID: "d-2", clients: clients}
+	failed := &TargetResult{ApplicationName: "api", DeploymentGroupName: "api-eu", Status: targetFailed,
+		waveIndex: 1, clients: clients}
+	waveErr := fmt.Errorf("wave 2 failed")
+
+	if err := haltPlan(context.Background(), "job-1", plan, []*TargetResult{deployed, failed}, waveErr); err != waveErr {
+		t.Fatalf("haltPlan() = %v, want the wave's error", err)
+	}
+	if len(cd.created) != 1 || aws.ToString(cd.created[0].DeploymentGroupName) != "api-live" {
+		t.Fatalf("created %d deployments, want one rollback of api-live", len(cd.created))
+	}
+
+	// d-2 deployed version 3 over 2, and the rollback shifts back to it
+	// from version 4, which d-4 made live
+	versions := ParseAppSpecVersions(aws.ToString(cd.created[0].Revision.AppSpecContent.Content))
+	if versions.CurrentVersion != "4" || versions.TargetVersion != "3" {
+		t.Errorf("rollback versions = %+v, want CurrentVersion 4 and TargetVersion 3", versions)
+	}
+	// The fake numbers created deployments from d-1, which it serves as a
+	// success
+	if deployed.Status != targetRolledBack || deployed.RollbackDeploymentID != "d-1" {
+		t.Errorf("deployed target = %+v, want it rolled back in d-1", deployed)
+	}
+	if failed.Status != targetFailed || failed.RollbackDeploymentID != "" {
+		t.Errorf("failed target = %+v, want it left alone", failed)
+	}
+}
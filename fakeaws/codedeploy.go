@@ -0,0 +1,397 @@
+package fakeaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Deployment statuses, as CodeDeploy names them
+const (
+	StatusCreated    = "Created"
+	StatusInProgress = "InProgress"
+	StatusSucceeded  = "Succeeded"
+	StatusFailed     = "Failed"
+	StatusStopped    = "Stopped"
+)
+
+type deploymentGroup struct {
+	application     string
+	name            string
+	computePlatform string
+	scenario        Scenario
+	lastSuccessful  *deployment
+	lastAttempted   *deployment
+}
+
+type deployment struct {
+	id              string
+	application     string
+	group           string
+	computePlatform string
+	description     string
+	revision        json.RawMessage
+	status          string
+	errorCode       string
+	errorMessage    string
+	created         time.Time
+	completed       time.Time
+	scenario        Scenario
+	instances       []*instance
+	polls           int
+
+	// An automatic rollback and the deployment it rolled back
+	rollbackID      string
+	rollbackMessage string
+	rollbackOf      string
+}
+
+// AddDeploymentGroup creates a deployment group for the compute platform:
+// Server, Lambda or ECS
+func (s *Server) AddDeploymentGroup(application, group, computePlatform string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupKey(application, group)]
+	if !ok {
+		g = &deploymentGroup{application: application, name: group}
+		s.groups[groupKey(application, group)] = g
+	}
+	g.computePlatform = computePlatform
+}
+
+// defaultDeploymentConfigs are the deployment configs CodeDeploy gives a
+// group that does not name one
+var defaultDeploymentConfigs = map[string]string{
+	"Server": "CodeDeployDefault.OneAtATime",
+	"Lambda": "CodeDeployDefault.LambdaAllAtOnce",
+	"ECS":    "CodeDeployDefault.ECSAllAtOnce",
+}
+
+func groupKey(application, group string) string {
+	return application + "/" + group
+}
+
+// group returns the deployment group, creating it if AutoCreateGroups is set
+func (s *Server) group(application, name string) (*deploymentGroup, error) {
+	if g, ok := s.groups[groupKey(application, name)]; ok {
+		return g, nil
+	}
+	if !s.AutoCreateGroups {
+		return nil, badRequest("DeploymentGroupDoesNotExistException", "No Deployment Group found for name: %s", name)
+	}
+	g := &deploymentGroup{application: application, name: name, computePlatform: "Server"}
+	s.groups[groupKey(application, name)] = g
+	return g, nil
+}
+
+func (s *Server) deployment(id string) (*deployment, error) {
+	d, ok := s.deployments[id]
+	if !ok {
+		return nil, badRequest("DeploymentDoesNotExistException", "The deployment %s could not be found", id)
+	}
+	return d, nil
+}
+
+func (s *Server) finish(d *deployment, status, message string) {
+	d.status = status
+	d.errorMessage = message
+	d.completed = time.Now()
+	if status == StatusSucceeded {
+		if g, ok := s.groups[groupKey(d.application, d.group)]; ok {
+			g.lastSuccessful = d
+		}
+	}
+}
+
+var codeDeployOperations = map[string]jsonOperation{
+	"GetDeploymentGroup": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			ApplicationName     string `json:"applicationName"`
+			DeploymentGroupName string `json:"deploymentGroupName"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		g, err := s.group(in.ApplicationName, in.DeploymentGroupName)
+		if err != nil {
+			return nil, err
+		}
+		info := map[string]any{
+			"applicationName":      g.application,
+			"deploymentGroupName":  g.name,
+			"computePlatform":      g.computePlatform,
+			"deploymentConfigName": defaultDeploymentConfigs[g.computePlatform],
+		}
+		if g.lastSuccessful != nil {
+			info["lastSuccessfulDeployment"] = lastDeploymentInfo(g.lastSuccessful)
+		}
+		if g.lastAttempted != nil {
+			info["lastAttemptedDeployment"] = lastDeploymentInfo(g.lastAttempted)
+		}
+		if len(g.scenario.Alarms) > 0 {
+			alarms := []map[string]string{}
+			for _, name := range g.scenario.Alarms {
+				alarms = append(alarms, map[string]string{"name": name})
+			}
+			info["alarmConfiguration"] = map[string]any{"enabled": true, "alarms": alarms}
+		}
+		return map[string]any{"deploymentGroupInfo": info}, nil
+	},
+
+	"CreateDeployment": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			ApplicationName     string          `json:"applicationName"`
+			DeploymentGroupName string          `json:"deploymentGroupName"`
+			Description         string          `json:"description"`
+			Revision            json.RawMessage `json:"revision"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		g, err := s.group(in.ApplicationName, in.DeploymentGroupName)
+		if err != nil {
+			return nil, err
+		}
+		s.nextID++
+		d := &deployment{
+			id:              fmt.Sprintf("d-FAKE%05d", s.nextID),
+			application:     g.application,
+			group:           g.name,
+			computePlatform: g.computePlatform,
+			description:     in.Description,
+			revision:        in.Revision,
+			status:          StatusCreated,
+			created:         time.Now(),
+			scenario:        g.scenario,
+			instances:       newInstances(g.scenario),
+		}
+		s.deployments[d.id] = d
+		g.lastAttempted = d
+		return map[string]any{"deploymentId": d.id}, nil
+	},
+
+	"GetDeployment": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentID string `json:"deploymentId"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		d, err := s.deployment(in.DeploymentID)
+		if err != nil {
+			return nil, err
+		}
+		s.advance(d)
+		return map[string]any{"deploymentInfo": deploymentInfo(d)}, nil
+	},
+
+	"BatchGetDeployments": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentIDs []string `json:"deploymentIds"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		infos := []map[string]any{}
+		for _, id := range in.DeploymentIDs {
+			if d, ok := s.deployments[id]; ok {
+				infos = append(infos, deploymentInfo(d))
+			}
+		}
+		return map[string]any{"deploymentsInfo": infos}, nil
+	},
+
+	"ListDeployments": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			ApplicationName     string   `json:"applicationName"`
+			DeploymentGroupName string   `json:"deploymentGroupName"`
+			IncludeOnlyStatuses []string `json:"includeOnlyStatuses"`
+			CreateTimeRange     *struct {
+				Start *float64 `json:"start"`
+				End   *float64 `json:"end"`
+			} `json:"createTimeRange"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		var matched []*deployment
+		for _, d := range s.deployments {
+			switch {
+			case in.ApplicationName != "" && d.application != in.ApplicationName,
+				in.DeploymentGroupName != "" && d.group != in.DeploymentGroupName,
+				len(in.IncludeOnlyStatuses) > 0 && !slices.Contains(in.IncludeOnlyStatuses, d.status):
+				continue
+			}
+			if r := in.CreateTimeRange; r != nil {
+				if r.Start != nil && d.created.Before(fromEpoch(*r.Start)) || r.End != nil && d.created.After(fromEpoch(*r.End)) {
+					continue
+				}
+			}
+			matched = append(matched, d)
+		}
+		// Newest first, as CodeDeploy lists them
+		sort.Slice(matched, func(i, j int) bool { return matched[i].id > matched[j].id })
+		ids := []string{}
+		for _, d := range matched {
+			ids = append(ids, d.id)
+		}
+		return map[string]any{"deployments": ids}, nil
+	},
+
+	"StopDeployment": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentID string `json:"deploymentId"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		d, err := s.deployment(in.DeploymentID)
+		if err != nil {
+			return nil, err
+		}
+		if d.status == StatusSucceeded || d.status == StatusFailed || d.status == StatusStopped {
+			return nil, badRequest("DeploymentAlreadyCompletedException", "The deployment %s has already completed", d.id)
+		}
+		s.stop(d)
+		return map[string]any{"status": "Succeeded"}, nil
+	},
+
+	// Targets are the instances of the group's scenario
+	"ListDeploymentTargets": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentID  string              `json:"deploymentId"`
+			TargetFilters map[string][]string `json:"targetFilters"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		d, err := s.deployment(in.DeploymentID)
+		if err != nil {
+			return nil, err
+		}
+		statuses := in.TargetFilters["TargetStatus"]
+		ids := []string{}
+		for _, i := range d.instances {
+			if len(statuses) == 0 || slices.Contains(statuses, i.status) {
+				ids = append(ids, i.id)
+			}
+		}
+		return map[string]any{"targetIds": ids}, nil
+	},
+
+	"BatchGetDeploymentTargets": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentID string   `json:"deploymentId"`
+			TargetIDs    []string `json:"targetIds"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		d, err := s.deployment(in.DeploymentID)
+		if err != nil {
+			return nil, err
+		}
+		targets := []map[string]any{}
+		for _, id := range in.TargetIDs {
+			i, err := d.instance(id)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, d.instanceTarget(i))
+		}
+		return map[string]any{"deploymentTargets": targets}, nil
+	},
+
+	"GetDeploymentTarget": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			DeploymentID string `json:"deploymentId"`
+			TargetID     string `json:"targetId"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		d, err := s.deployment(in.DeploymentID)
+		if err != nil {
+			return nil, err
+		}
+		i, err := d.instance(in.TargetID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"deploymentTarget": d.instanceTarget(i)}, nil
+	},
+}
+
+func (d *deployment) instance(id string) (*instance, error) {
+	for _, i := range d.instances {
+		if i.id == id {
+			return i, nil
+		}
+	}
+	return nil, badRequest("DeploymentTargetDoesNotExistException", "The target %s could not be found", id)
+}
+
+func deploymentInfo(d *deployment) map[string]any {
+	info := map[string]any{
+		"deploymentId":        d.id,
+		"applicationName":     d.application,
+		"deploymentGroupName": d.group,
+		"computePlatform":     d.computePlatform,
+		"description":         d.description,
+		"status":              d.status,
+		"createTime":          epoch(d.created),
+	}
+	if d.revision != nil {
+		info["revision"] = d.revision
+	}
+	if !d.completed.IsZero() {
+		info["completeTime"] = epoch(d.completed)
+	}
+	if d.errorMessage != "" {
+		errorInformation := map[string]string{"message": d.errorMessage}
+		if d.errorCode != "" {
+			errorInformation["code"] = d.errorCode
+		}
+		info["errorInformation"] = errorInformation
+	}
+	if d.rollbackID != "" || d.rollbackMessage != "" || d.rollbackOf != "" {
+		rollbackInfo := map[string]string{}
+		if d.rollbackID != "" {
+			rollbackInfo["rollbackDeploymentId"] = d.rollbackID
+		}
+		if d.rollbackMessage != "" {
+			rollbackInfo["rollbackMessage"] = d.rollbackMessage
+		}
+		if d.rollbackOf != "" {
+			rollbackInfo["rollbackTriggeringDeploymentId"] = d.rollbackOf
+		}
+		info["rollbackInfo"] = rollbackInfo
+	}
+	if len(d.instances) > 0 {
+		info["deploymentOverview"] = d.overview()
+	}
+	return info
+}
+
+func lastDeploymentInfo(d *deployment) map[string]any {
+	info := map[string]any{
+		"deploymentId": d.id,
+		"status":       d.status,
+		"createTime":   epoch(d.created),
+	}
+	if !d.completed.IsZero() {
+		info["endTime"] = epoch(d.completed)
+	}
+	return info
+}
+
+// The JSON protocols send timestamps as fractional epoch seconds
+func epoch(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+func fromEpoch(seconds float64) time.Time {
+	return time.UnixMilli(int64(seconds * 1000))
+}
@@ -0,0 +1,129 @@
+package fakeaws
+
+// Job is what the handler has told CodePipeline about a job
+type Job struct {
+	ID     string
+	Status string
+	// Acknowledged is set once the job was acknowledged with its nonce
+	Acknowledged bool
+	// ContinuationToken is the token of the last continuation, if the job
+	// was handed back to CodePipeline to be invoked again
+	ContinuationToken string
+	Summary           string
+	OutputVariables   map[string]string
+	FailureType       string
+	FailureMessage    string
+}
+
+// Job returns a copy of the job, and false if the handler never mentioned it
+func (s *Server) Job(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// job returns the job, which exists as soon as anything asks about it
+func (s *Server) job(id string) *Job {
+	job, ok := s.jobs[id]
+	if !ok {
+		job = &Job{ID: id, Status: "InProgress"}
+		s.jobs[id] = job
+	}
+	return job
+}
+
+var codePipelineOperations = map[string]jsonOperation{
+	"AcknowledgeJob": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			JobID string `json:"jobId"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		job := s.job(in.JobID)
+		job.Acknowledged = true
+		return map[string]any{"status": job.Status}, nil
+	},
+
+	"PutJobSuccessResult": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			JobID             string            `json:"jobId"`
+			ContinuationToken string            `json:"continuationToken"`
+			OutputVariables   map[string]string `json:"outputVariables"`
+			ExecutionDetails  *struct {
+				Summary string `json:"summary"`
+			} `json:"executionDetails"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		job := s.job(in.JobID)
+		if err := checkJobActive(job); err != nil {
+			return nil, err
+		}
+		job.Status = "Succeeded"
+		if in.ContinuationToken != "" {
+			job.Status = "InProgress"
+		}
+		job.ContinuationToken = in.ContinuationToken
+		job.OutputVariables = in.OutputVariables
+		if in.ExecutionDetails != nil {
+			job.Summary = in.ExecutionDetails.Summary
+		}
+		return map[string]any{}, nil
+	},
+
+	"PutJobFailureResult": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			JobID          string `json:"jobId"`
+			FailureDetails struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"failureDetails"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		job := s.job(in.JobID)
+		if err := checkJobActive(job); err != nil {
+			return nil, err
+		}
+		job.Status = "Failed"
+		job.FailureType = in.FailureDetails.Type
+		job.FailureMessage = in.FailureDetails.Message
+		return map[string]any{}, nil
+	},
+
+	"GetJobDetails": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			JobID string `json:"jobId"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		s.job(in.JobID)
+		return map[string]any{"jobDetails": map[string]any{
+			"id": in.JobID,
+			"data": map[string]any{
+				"pipelineContext": map[string]any{
+					"pipelineName":        "local",
+					"pipelineExecutionId": "local-" + in.JobID,
+					"stage":               map[string]string{"name": "Deploy"},
+					"action":              map[string]string{"name": "Deploy"},
+				},
+			},
+		}}, nil
+	},
+}
+
+// CodePipeline rejects results for jobs that already have one
+func checkJobActive(job *Job) error {
+	if job.Status != "InProgress" {
+		return badRequest("InvalidJobStateException", "Job %s is in state %s", job.ID, job.Status)
+	}
+	return nil
+}
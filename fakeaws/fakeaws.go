@@ -0,0 +1,151 @@
+// Package fakeaws is an in-memory stand-in for the AWS APIs the deploy
+// Lambda calls: CodeDeploy, CodePipeline, S3, Secrets Manager and SSM. It
+// speaks their wire protocols, so the real SDK clients talk to it, either
+// in process through HTTPClient or over the network as an http.Handler.
+package fakeaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server holds the fake state of every service. It is safe for concurrent
+// use, as the handler deploys waves in parallel. Scenarios script how
+// deployments play out, and faults fail calls before they are served.
+type Server struct {
+	// AutoCreateGroups makes every deployment group exist, as an EC2/on-
+	// premises group, so a job can run without seeding its groups
+	AutoCreateGroups bool
+
+	mu          sync.Mutex
+	groups      map[string]*deploymentGroup
+	deployments map[string]*deployment
+	jobs        map[string]*Job
+	objects     map[string]*object
+	secrets     map[string]map[string]secret
+	parameters  map[string]string
+	faults      []*Fault
+	calls       map[string]int
+	nextID      int
+}
+
+// New returns a server with no groups, jobs, objects, secrets or parameters
+func New() *Server {
+	return &Server{
+		groups:      map[string]*deploymentGroup{},
+		deployments: map[string]*deployment{},
+		jobs:        map[string]*Job{},
+		objects:     map[string]*object{},
+		secrets:     map[string]map[string]secret{},
+		parameters:  map[string]string{},
+		calls:       map[string]int{},
+	}
+}
+
+// HTTPClient serves the SDK's requests in process, whatever endpoint they
+// are sent to
+func (s *Server) HTTPClient() *http.Client {
+	return &http.Client{Transport: roundTripper{s}}
+}
+
+type roundTripper struct {
+	handler http.Handler
+}
+
+func (t roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, r)
+	resp := recorder.Result()
+	resp.Request = r
+	return resp, nil
+}
+
+// jsonOperation serves one operation of a JSON protocol service. It runs
+// with the server locked.
+type jsonOperation func(s *Server, body []byte) (any, error)
+
+// JSON protocol services, by their X-Amz-Target prefix
+var jsonServices = map[string]map[string]jsonOperation{
+	"CodeDeploy_20141006":   codeDeployOperations,
+	"CodePipeline_20150709": codePipelineOperations,
+	"secretsmanager":        secretsManagerOperations,
+	"AmazonSSM":             ssmOperations,
+}
+
+// ServeHTTP routes JSON protocol calls by their X-Amz-Target header, and
+// everything else to S3
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if target == "" {
+		s.serveS3(w, r)
+		return
+	}
+
+	service, operation, _ := strings.Cut(target, ".")
+	handle, ok := jsonServices[service][operation]
+	if !ok {
+		writeJSONError(w, &apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("fakeaws does not implement %s", target)})
+		return
+	}
+	if err := s.fault(operation); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, &apiError{http.StatusBadRequest, "SerializationException", err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	out, err := handle(s, body)
+	s.mu.Unlock()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(out)
+}
+
+// apiError is an error response with the service's error code
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func badRequest(code, format string, args ...any) *apiError {
+	return &apiError{http.StatusBadRequest, code, fmt.Sprintf(format, args...)}
+}
+
+func writeJSONError(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = badRequest("SerializationException", "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-ErrorType", e.code)
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": e.code, "message": e.message})
+}
+
+// decode reads a JSON request body into in
+func decode(body []byte, in any) error {
+	if len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, in); err != nil {
+		return badRequest("SerializationException", "invalid request: %v", err)
+	}
+	return nil
+}
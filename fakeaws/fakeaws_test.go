@@ -0,0 +1,267 @@
+package fakeaws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy"
+	"github.com/aws/aws-sdk-go-v2/service/codedeploy/types"
+	"github.com/aws/aws-sdk-go-v2/service/codepipeline"
+	pipelinetypes "github.com/aws/aws-sdk-go-v2/service/codepipeline/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/smithy-go"
+)
+
+func testConfig(s *Server) aws.Config {
+	return aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		HTTPClient:  s.HTTPClient(),
+	}
+}
+
+func TestCodeDeployDeploymentLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	s.AddDeploymentGroup("api", "api-live", "Lambda")
+	client := codedeploy.NewFromConfig(testConfig(s))
+
+	created, err := client.CreateDeployment(ctx, &codedeploy.CreateDeploymentInput{
+		ApplicationName:     aws.String("api"),
+		DeploymentGroupName: aws.String("api-live"),
+		Description:         aws.String("first"),
+		Revision: &types.RevisionLocation{
+			RevisionType: types.RevisionLocationTypeS3,
+			S3Location:   &types.S3Location{Bucket: aws.String("artifacts"), Key: aws.String("bundle.zip"), BundleType: types.BundleTypeZip},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateDeployment() returned error: %v", err)
+	}
+
+	pending, err := client.ListDeployments(ctx, &codedeploy.ListDeploymentsInput{
+		ApplicationName:     aws.String("api"),
+		DeploymentGroupName: aws.String("api-live"),
+		IncludeOnlyStatuses: []types.DeploymentStatus{types.DeploymentStatusCreated},
+	})
+	if err != nil || len(pending.Deployments) != 1 {
+		t.Fatalf("ListDeployments() = %v, %v, want the new deployment", pending, err)
+	}
+
+	// The first poll completes the deployment
+	got, err := client.GetDeployment(ctx, &codedeploy.GetDeploymentInput{DeploymentId: created.DeploymentId})
+	if err != nil {
+		t.Fatalf("GetDeployment() returned error: %v", err)
+	}
+	info := got.DeploymentInfo
+	if info.Status != types.DeploymentStatusSucceeded || aws.ToString(info.Description) != "first" || info.CreateTime == nil {
+		t.Errorf("deployment = %+v, want a succeeded deployment with its description", info)
+	}
+	if info.Revision == nil || aws.ToString(info.Revision.S3Location.Key) != "bundle.zip" {
+		t.Errorf("revision = %+v, want the revision it was created with", info.Revision)
+	}
+
+	group, err := client.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String("api"),
+		DeploymentGroupName: aws.String("api-live"),
+	})
+	if err != nil {
+		t.Fatalf("GetDeploymentGroup() returned error: %v", err)
+	}
+	if last := group.DeploymentGroupInfo.LastSuccessfulDeployment; last == nil || aws.ToString(last.DeploymentId) != aws.ToString(created.DeploymentId) {
+		t.Errorf("last successful deployment = %+v, want %s", last, aws.ToString(created.DeploymentId))
+	}
+	if group.DeploymentGroupInfo.ComputePlatform != types.ComputePlatformLambda {
+		t.Errorf("compute platform = %s, want Lambda", group.DeploymentGroupInfo.ComputePlatform)
+	}
+
+	_, err = client.GetDeploymentGroup(ctx, &codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     aws.String("api"),
+		DeploymentGroupName: aws.String("missing"),
+	})
+	var missing *types.DeploymentGroupDoesNotExistException
+	if !errors.As(err, &missing) {
+		t.Errorf("GetDeploymentGroup(missing) returned %v, want DeploymentGroupDoesNotExistException", err)
+	}
+}
+
+func TestCodePipelineJobResults(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	client := codepipeline.NewFromConfig(testConfig(s))
+
+	ack, err := client.AcknowledgeJob(ctx, &codepipeline.AcknowledgeJobInput{JobId: aws.String("job-1"), Nonce: aws.String("1")})
+	if err != nil || ack.Status != pipelinetypes.JobStatusInProgress {
+		t.Fatalf("AcknowledgeJob() = %v, %v, want InProgress", ack, err)
+	}
+
+	// A continuation keeps the job running
+	_, err = client.PutJobSuccessResult(ctx, &codepipeline.PutJobSuccessResultInput{JobId: aws.String("job-1"), ContinuationToken: aws.String("wait")})
+	if err != nil {
+		t.Fatalf("PutJobSuccessResult(continuation) returned error: %v", err)
+	}
+	_, err = client.PutJobSuccessResult(ctx, &codepipeline.PutJobSuccessResultInput{
+		JobId:           aws.String("job-1"),
+		OutputVariables: map[string]string{"DeploymentId": "d-1"},
+	})
+	if err != nil {
+		t.Fatalf("PutJobSuccessResult() returned error: %v", err)
+	}
+
+	job, ok := s.Job("job-1")
+	if !ok || job.Status != "Succeeded" || !job.Acknowledged || job.OutputVariables["DeploymentId"] != "d-1" {
+		t.Errorf("job = %+v, want an acknowledged success with its output variables", job)
+	}
+
+	_, err = client.PutJobFailureResult(ctx, &codepipeline.PutJobFailureResultInput{
+		JobId:          aws.String("job-1"),
+		FailureDetails: &pipelinetypes.FailureDetails{Type: pipelinetypes.FailureTypeJobFailed, Message: aws.String("late")},
+	})
+	var invalid *pipelinetypes.InvalidJobStateException
+	if !errors.As(err, &invalid) {
+		t.Errorf("PutJobFailureResult() after success returned %v, want InvalidJobStateException", err)
+	}
+}
+
+func TestS3Objects(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	cfg := testConfig(s)
+	for name, client := range map[string]*s3.Client{
+		"virtual-hosted": s3.NewFromConfig(cfg),
+		"path-style":     s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = true }),
+	} {
+		t.Run(name, func(t *testing.T) {
+			put := func(key string) error {
+				_, err := client.PutObject(ctx, &s3.PutObjectInput{
+					Bucket:      aws.String("audit-" + name),
+					Key:         aws.String(key),
+					Body:        bytes.NewReader([]byte(`{"jobId":"` + key + `"}`)),
+					IfNoneMatch: aws.String("*"),
+				})
+				return err
+			}
+			for _, key := range []string{"date=2026-10-01/a.json", "date=2026-10-01/b.json", "date=2026-10-02/c.json"} {
+				if err := put(key); err != nil {
+					t.Fatalf("PutObject(%s) returned error: %v", key, err)
+				}
+			}
+
+			var apiErr smithy.APIError
+			if err := put("date=2026-10-01/a.json"); !errors.As(err, &apiErr) || apiErr.ErrorCode() != "PreconditionFailed" {
+				t.Errorf("PutObject() over an existing key returned %v, want PreconditionFailed", err)
+			}
+
+			got, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("audit-" + name), Key: aws.String("date=2026-10-01/a.json")})
+			if err != nil {
+				t.Fatalf("GetObject() returned error: %v", err)
+			}
+			body, _ := io.ReadAll(got.Body)
+			if string(body) != `{"jobId":"date=2026-10-01/a.json"}` || aws.ToString(got.ETag) == "" {
+				t.Errorf("GetObject() = %q with ETag %q, want the uploaded body", body, aws.ToString(got.ETag))
+			}
+
+			// Bundles are read by range, pinned to the ETag that was hashed
+			for _, tt := range []struct {
+				rng, etag, want, wantErr string
+			}{
+				{rng: "bytes=2-6", want: `jobId`},
+				{rng: "bytes=27-99", etag: aws.ToString(got.ETag), want: `.json"}`},
+				{rng: "bytes=99-", wantErr: "InvalidRange"},
+				{rng: "bytes=0-1", etag: `"stale"`, wantErr: "PreconditionFailed"},
+			} {
+				input := &s3.GetObjectInput{Bucket: aws.String("audit-" + name), Key: aws.String("date=2026-10-01/a.json"), Range: aws.String(tt.rng)}
+				if tt.etag != "" {
+					input.IfMatch = aws.String(tt.etag)
+				}
+				part, err := client.GetObject(ctx, input)
+				if tt.wantErr != "" {
+					if !errors.As(err, &apiErr) || apiErr.ErrorCode() != tt.wantErr {
+						t.Errorf("GetObject(%s) returned %v, want %s", tt.rng, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("GetObject(%s) returned error: %v", tt.rng, err)
+				}
+				body, _ := io.ReadAll(part.Body)
+				if string(body) != tt.want {
+					t.Errorf("GetObject(%s) = %q, want %q", tt.rng, body, tt.want)
+				}
+			}
+
+			listed, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("audit-" + name), Prefix: aws.String("date=2026-10-01/")})
+			if err != nil {
+				t.Fatalf("ListObjectsV2() returned error: %v", err)
+			}
+			if len(listed.Contents) != 2 || aws.ToString(listed.Contents[1].Key) != "date=2026-10-01/b.json" {
+				t.Errorf("ListObjectsV2() listed %d objects, want a.json and b.json", len(listed.Contents))
+			}
+
+			_, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("audit-" + name), Key: aws.String("missing")})
+			if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "NotFound" {
+				t.Errorf("HeadObject(missing) returned %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestGetSecretValue(t *testing.T) {
+	s := New()
+	s.PutSecret("github-token", `{"token":"abc"}`)
+	client := secretsmanager.NewFromConfig(testConfig(s))
+
+	got, err := client.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{SecretId: aws.String("github-token")})
+	if err != nil || aws.ToString(got.SecretString) != `{"token":"abc"}` {
+		t.Errorf("GetSecretValue() = %v, %v, want the stored secret", got, err)
+	}
+}
+
+func TestScenarioAndFaults(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	s.SetScenario("api", "api-live", Scenario{InProgressPolls: 1, Instances: []string{"i-1", "i-2"}})
+	s.AddFault(Fault{Operation: "CreateDeployment", Count: 1})
+	client := codedeploy.NewFromConfig(testConfig(s), func(o *codedeploy.Options) {
+		o.RetryMaxAttempts = 1
+	})
+	input := &codedeploy.CreateDeploymentInput{ApplicationName: aws.String("api"), DeploymentGroupName: aws.String("api-live")}
+
+	var apiErr smithy.APIError
+	if _, err := client.CreateDeployment(ctx, input); !errors.As(err, &apiErr) || apiErr.ErrorCode() != "ThrottlingException" {
+		t.Fatalf("CreateDeployment() returned error %v, want the injected ThrottlingException", err)
+	}
+	created, err := client.CreateDeployment(ctx, input)
+	if err != nil {
+		t.Fatalf("CreateDeployment() returned error: %v", err)
+	}
+	if calls := s.Calls("CreateDeployment"); calls != 2 {
+		t.Errorf("Calls(CreateDeployment) = %d, want 2", calls)
+	}
+
+	got, err := client.GetDeployment(ctx, &codedeploy.GetDeploymentInput{DeploymentId: created.DeploymentId})
+	if err != nil {
+		t.Fatalf("GetDeployment() returned error: %v", err)
+	}
+	if info := got.DeploymentInfo; info.Status != types.DeploymentStatusInProgress || info.DeploymentOverview.InProgress != 2 {
+		t.Errorf("deployment = %+v, want both instances in progress", info)
+	}
+
+	// Stopping skips the instances that had not finished
+	if _, err := client.StopDeployment(ctx, &codedeploy.StopDeploymentInput{DeploymentId: created.DeploymentId}); err != nil {
+		t.Fatalf("StopDeployment() returned error: %v", err)
+	}
+	got, err = client.GetDeployment(ctx, &codedeploy.GetDeploymentInput{DeploymentId: created.DeploymentId})
+	if err != nil {
+		t.Fatalf("GetDeployment() returned error: %v", err)
+	}
+	if info := got.DeploymentInfo; info.Status != types.DeploymentStatusStopped || info.DeploymentOverview.Skipped != 2 {
+		t.Errorf("deployment = %+v, want it stopped with both instances skipped", info)
+	}
+}
@@ -0,0 +1,290 @@
+package fakeaws
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type object struct {
+	data        []byte
+	etag        string
+	contentType string
+	modified    time.Time
+}
+
+// PutObject stores an object, as if it had been uploaded
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putObject(bucket, key, data, "")
+}
+
+// Object returns the object's contents, and false if there is none
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+func (s *Server) putObject(bucket, key string, data []byte, contentType string) *object {
+	sum := md5.Sum(data)
+	o := &object{
+		data:        data,
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		contentType: contentType,
+		modified:    time.Now().UTC().Truncate(time.Second),
+	}
+	s.objects[bucket+"/"+key] = o
+	return o
+}
+
+// bucketAndKey reads the bucket from a virtual-hosted style host, such as
+// bucket.s3.us-east-1.amazonaws.com, or else from the path
+func bucketAndKey(r *http.Request) (string, string) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, _, ok := strings.Cut(host, ".s3."); ok && bucket != "" {
+		return bucket, path
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	return bucket, key
+}
+
+func (s *Server) serveS3(w http.ResponseWriter, r *http.Request) {
+	bucket, key := bucketAndKey(r)
+	if bucket == "" {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidBucketName", "The request names no bucket")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		s.listObjects(w, r, bucket)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && key != "":
+		o, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if etag := r.Header.Get("If-Match"); etag != "" && etag != o.etag && etag != "*" {
+			writeS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		data, status := o.data, http.StatusOK
+		if header := r.Header.Get("Range"); header != "" && r.Method == http.MethodGet {
+			start, end, ok := byteRange(header, len(o.data))
+			if !ok {
+				writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+				return
+			}
+			data, status = o.data[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if o.contentType != "" {
+			w.Header().Set("Content-Type", o.contentType)
+		}
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodPut && key != "":
+		data, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if !s.checkConditions(w, r, bucket, key) {
+			return
+		}
+		o := s.putObject(bucket, key, data, r.Header.Get("Content-Type"))
+		w.Header().Set("ETag", o.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && key != "":
+		if !s.checkConditions(w, r, bucket, key) {
+			return
+		}
+		delete(s.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		// Every bucket exists, so creating one only succeeds
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("fakeaws does not implement %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// byteRange reads a single "bytes=start-end" or "bytes=start-" range, with
+// the end clamped to the object, as S3 does
+func byteRange(header string, size int) (int, int, bool) {
+	first, last, ok := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+	start, err := strconv.Atoi(first)
+	if !ok || err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// checkConditions answers a conditional write whose If-None-Match or
+// If-Match condition does not hold, as S3 does, and reports whether the
+// write may go ahead
+func (s *Server) checkConditions(w http.ResponseWriter, r *http.Request, bucket, key string) bool {
+	o, exists := s.objects[bucket+"/"+key]
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		writeS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return false
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		if !exists {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return false
+		}
+		if etag != o.etag && etag != "*" {
+			writeS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return false
+		}
+	}
+	return true
+}
+
+// readS3Body reads an upload, which the SDK sends aws-chunked when it adds
+// a trailing checksum
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %v", err)
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk size %q", sizeField)
+		}
+		if size == 0 {
+			// The trailers, such as the checksum, follow the last chunk
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %v", err)
+		}
+		if _, err := reader.Discard(2); err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %v", err)
+		}
+	}
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name        `xml:"ListBucketResult"`
+	Name                  string          `xml:"Name"`
+	Prefix                string          `xml:"Prefix"`
+	KeyCount              int             `xml:"KeyCount"`
+	MaxKeys               int             `xml:"MaxKeys"`
+	IsTruncated           bool            `xml:"IsTruncated"`
+	ContinuationToken     string          `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string          `xml:"NextContinuationToken,omitempty"`
+	Contents              []objectSummary `xml:"Contents"`
+}
+
+type objectSummary struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+// listObjects lists keys in order. The continuation token is the last key
+// of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	token := query.Get("continuation-token")
+	maxKeys := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	var keys []string
+	for name := range s.objects {
+		b, key, _ := strings.Cut(name, "/")
+		if b == bucket && strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, ContinuationToken: token}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		o := s.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, objectSummary{
+			Key:          key,
+			LastModified: o.modified.Format(time.RFC3339),
+			ETag:         o.etag,
+			Size:         len(o.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, http.StatusOK, result)
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// writeS3Error answers with an S3 error document. HEAD responses have no
+// body, so the SDK only sees the status.
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, s3Error{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
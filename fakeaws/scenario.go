@@ -0,0 +1,265 @@
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Scenario scripts how the deployments of a deployment group play out.
+// The zero value succeeds on the first status check.
+type Scenario struct {
+	// InProgressPolls is how many status checks a deployment stays
+	// InProgress for before it finishes. A negative count never finishes,
+	// to test timeouts.
+	InProgressPolls int `json:"inProgressPolls,omitempty"`
+
+	// Outcome is how the deployment finishes: Succeeded, Failed, or
+	// Stopped as if an operator had stopped it
+	Outcome string `json:"outcome,omitempty"`
+
+	// ErrorMessage is the deployment's error information when it fails
+	ErrorMessage string `json:"errorMessage,omitempty"`
+
+	// Instances are the EC2/on-premises instances deployed to. Without
+	// any, a deployment has no targets.
+	Instances []string `json:"instances,omitempty"`
+
+	// FailedInstance fails in FailedLifecycleEvent (AfterInstall by
+	// default) with the script diagnostics below when the outcome is Failed
+	FailedInstance       string `json:"failedInstance,omitempty"`
+	FailedLifecycleEvent string `json:"failedLifecycleEvent,omitempty"`
+	ScriptName           string `json:"scriptName,omitempty"`
+	LogTail              string `json:"logTail,omitempty"`
+
+	// Alarms are the group's CloudWatch alarms. When the outcome is
+	// Stopped, TriggeredAlarm stops the deployment as an alarm does.
+	Alarms         []string `json:"alarms,omitempty"`
+	TriggeredAlarm string   `json:"triggeredAlarm,omitempty"`
+
+	// AutoRollback rolls a failed or stopped deployment back with a new
+	// deployment, as a group with automatic rollbacks does
+	AutoRollback bool `json:"autoRollback,omitempty"`
+}
+
+// Fault fails the next Count calls of an operation, such as
+// CreateDeployment or GetDeployment, the way throttling or a burst of
+// server errors does
+type Fault struct {
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+
+	// Status and Code are the error response, by default a 400
+	// ThrottlingException. A 5xx status is a server error.
+	Status int    `json:"status,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+func (f *Fault) error() *apiError {
+	status, code := f.Status, f.Code
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	if code == "" {
+		code = "ThrottlingException"
+		if status >= 500 {
+			code = "InternalFailure"
+		}
+	}
+	return &apiError{status, code, "fakeaws injected fault"}
+}
+
+// SetScenario scripts the group's future deployments, creating the group
+// as an EC2/on-premises group if it does not exist
+func (s *Server) SetScenario(application, group string, scenario Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupKey(application, group)]
+	if !ok {
+		g = &deploymentGroup{application: application, name: group, computePlatform: "Server"}
+		s.groups[groupKey(application, group)] = g
+	}
+	g.scenario = scenario
+}
+
+// AddFault queues a fault. Faults for the same operation run in turn.
+func (s *Server) AddFault(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// Calls returns how many calls of the operation the server received,
+// including the ones that failed with a fault
+func (s *Server) Calls(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[operation]
+}
+
+// fault counts the call and returns the fault it runs into, if any
+func (s *Server) fault(operation string) *apiError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[operation]++
+	for _, f := range s.faults {
+		if f.Operation == operation && f.Count > 0 {
+			f.Count--
+			return f.error()
+		}
+	}
+	return nil
+}
+
+// instance is one instance of a deployment
+type instance struct {
+	id      string
+	status  string
+	updated time.Time
+	failed  bool
+}
+
+func newInstances(scenario Scenario) []*instance {
+	instances := make([]*instance, len(scenario.Instances))
+	for i, id := range scenario.Instances {
+		instances[i] = &instance{id: id, status: "Pending", updated: time.Now()}
+	}
+	return instances
+}
+
+// advance moves a deployment on by one status check, as its scenario says
+func (s *Server) advance(d *deployment) {
+	if d.status != StatusCreated && d.status != StatusInProgress {
+		return
+	}
+	d.polls++
+	if d.scenario.InProgressPolls < 0 || d.polls <= d.scenario.InProgressPolls {
+		d.status = StatusInProgress
+		d.setInstances(func(*instance) string { return "InProgress" })
+		return
+	}
+
+	switch d.scenario.Outcome {
+	case StatusFailed:
+		message := d.scenario.ErrorMessage
+		if message == "" {
+			message = "The overall deployment failed because too many individual instances failed deployment"
+		}
+		d.setInstances(func(i *instance) string {
+			if i.id == d.scenario.FailedInstance {
+				i.failed = true
+				return "Failed"
+			}
+			return "Succeeded"
+		})
+		s.finish(d, StatusFailed, message)
+		s.autoRollback(d)
+	case StatusStopped:
+		s.stop(d)
+		if alarm := d.scenario.TriggeredAlarm; alarm != "" {
+			d.errorCode = "ALARM_ACTIVE"
+			d.errorMessage = "One or more alarms have been activated according to the Amazon CloudWatch metrics you selected, and the affected deployments have been stopped. Activated alarms: " + alarm
+		}
+		s.autoRollback(d)
+	default:
+		d.setInstances(func(*instance) string { return "Succeeded" })
+		s.finish(d, StatusSucceeded, "")
+	}
+}
+
+// stop stops the deployment, skipping the instances it had not finished
+func (s *Server) stop(d *deployment) {
+	d.setInstances(func(i *instance) string {
+		if i.status == "InProgress" || i.status == "Pending" {
+			return "Skipped"
+		}
+		return i.status
+	})
+	s.finish(d, StatusStopped, "The deployment was stopped")
+}
+
+// autoRollback redeploys the group's last successful revision after a
+// deployment failed or was stopped, if the scenario asks for it
+func (s *Server) autoRollback(d *deployment) {
+	if !d.scenario.AutoRollback {
+		return
+	}
+	g, ok := s.groups[groupKey(d.application, d.group)]
+	if !ok || g.lastSuccessful == nil {
+		d.rollbackMessage = "Automatic rollback was skipped because there is no last successful deployment"
+		return
+	}
+
+	s.nextID++
+	r := &deployment{
+		id:              fmt.Sprintf("d-FAKE%05d", s.nextID),
+		application:     d.application,
+		group:           d.group,
+		computePlatform: d.computePlatform,
+		description:     "Rollback of " + d.id,
+		revision:        g.lastSuccessful.revision,
+		created:         time.Now(),
+		rollbackOf:      d.id,
+	}
+	s.deployments[r.id] = r
+	s.finish(r, StatusSucceeded, "")
+	d.rollbackID = r.id
+	d.rollbackMessage = "Automatic rollback deployment " + r.id + " succeeded"
+}
+
+func (d *deployment) setInstances(status func(*instance) string) {
+	for _, i := range d.instances {
+		i.status = status(i)
+		i.updated = time.Now()
+	}
+}
+
+// overview counts the deployment's instances by status
+func (d *deployment) overview() map[string]int {
+	counts := map[string]int{"Pending": 0, "InProgress": 0, "Succeeded": 0, "Failed": 0, "Skipped": 0, "Ready": 0}
+	for _, i := range d.instances {
+		counts[i.status]++
+	}
+	return counts
+}
+
+// instanceTarget describes an instance as an InstanceTarget
+func (d *deployment) instanceTarget(i *instance) map[string]any {
+	failedEvent := d.scenario.FailedLifecycleEvent
+	if failedEvent == "" {
+		failedEvent = "AfterInstall"
+	}
+
+	// A failed instance skips the events after the one that failed
+	status := "Succeeded"
+	if i.status != "Succeeded" && !i.failed {
+		status = "Pending"
+	}
+	events := []map[string]any{}
+	for _, name := range []string{"BeforeInstall", "AfterInstall", "ApplicationStart", "ValidateService"} {
+		event := map[string]any{"lifecycleEventName": name, "status": status}
+		if i.failed && name == failedEvent {
+			event["status"] = "Failed"
+			event["diagnostics"] = map[string]string{
+				"errorCode":  "ScriptFailed",
+				"scriptName": d.scenario.ScriptName,
+				"message":    "Script at specified location: " + d.scenario.ScriptName + " run as user root failed with exit code 1",
+				"logTail":    d.scenario.LogTail,
+			}
+			status = "Skipped"
+		}
+		events = append(events, event)
+	}
+
+	return map[string]any{
+		"deploymentTargetType": "InstanceTarget",
+		"instanceTarget": map[string]any{
+			"deploymentId":    d.id,
+			"targetId":        i.id,
+			"targetArn":       "arn:aws:ec2:us-east-1:000000000000:instance/" + i.id,
+			"status":          i.status,
+			"lastUpdatedAt":   epoch(i.updated),
+			"lifecycleEvents": events,
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package fakeaws
+
+// secret is one version of a Secrets Manager secret, holding either a
+// string or binary value
+type secret struct {
+	text   *string
+	binary []byte
+}
+
+// PutSecret stores a Secrets Manager secret string under its name or ARN,
+// as its AWSCURRENT version
+func (s *Server) PutSecret(id, value string) {
+	s.PutSecretVersion(id, "AWSCURRENT", value)
+}
+
+// PutSecretVersion stores a secret string under a version stage, such as
+// AWSPREVIOUS
+func (s *Server) PutSecretVersion(id, stage, value string) {
+	s.putSecret(id, stage, secret{text: &value})
+}
+
+// PutSecretBinary stores a binary secret as its AWSCURRENT version
+func (s *Server) PutSecretBinary(id string, value []byte) {
+	s.putSecret(id, "AWSCURRENT", secret{binary: value})
+}
+
+func (s *Server) putSecret(id, stage string, value secret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets[id] == nil {
+		s.secrets[id] = map[string]secret{}
+	}
+	s.secrets[id][stage] = value
+}
+
+// PutParameter stores an SSM parameter
+func (s *Server) PutParameter(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parameters[name] = value
+}
+
+// Secrets Manager names its JSON members in PascalCase
+var secretsManagerOperations = map[string]jsonOperation{
+	"GetSecretValue": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			SecretID     string `json:"SecretId"`
+			VersionStage string `json:"VersionStage"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		if in.VersionStage == "" {
+			in.VersionStage = "AWSCURRENT"
+		}
+		versions, ok := s.secrets[in.SecretID]
+		if !ok {
+			return nil, badRequest("ResourceNotFoundException", "Secrets Manager can't find the specified secret.")
+		}
+		value, ok := versions[in.VersionStage]
+		if !ok {
+			return nil, badRequest("ResourceNotFoundException", "Secrets Manager can't find the specified secret value for staging label: %s", in.VersionStage)
+		}
+		out := map[string]any{
+			"ARN":           in.SecretID,
+			"Name":          in.SecretID,
+			"VersionStages": []string{in.VersionStage},
+		}
+		// Binary values are base64 in JSON, as Secrets Manager sends them
+		if value.text != nil {
+			out["SecretString"] = *value.text
+		} else {
+			out["SecretBinary"] = value.binary
+		}
+		return out, nil
+	},
+}
+
+var ssmOperations = map[string]jsonOperation{
+	"GetParameter": func(s *Server, body []byte) (any, error) {
+		var in struct {
+			Name string `json:"Name"`
+		}
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		value, ok := s.parameters[in.Name]
+		if !ok {
+			return nil, badRequest("ParameterNotFound", "Parameter %s not found.", in.Name)
+		}
+		return map[string]any{"Parameter": map[string]any{
+			"Name":    in.Name,
+			"Type":    "String",
+			"Value":   value,
+			"Version": 1,
+		}}, nil
+	},
+}